@@ -0,0 +1,162 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/rest/admin"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
+)
+
+func createAdmin(c echo.Context) error {
+	r := model.CreateAdminDto{}
+
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	if err := adminStore.CreateAdmin(r.Username, r.Password); err != nil {
+		if errors.Is(err, admin.ErrAdminExists) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+func listAdmins(c echo.Context) error {
+	list, err := adminStore.ListAdmins()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+func updateAdminPassword(c echo.Context) error {
+	r := model.Password{}
+
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	if err := adminStore.SetAdminPassword(c.Param("name"), r.Password); err != nil {
+		if errors.Is(err, admin.ErrUnknownAdmin) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func deleteAdmin(c echo.Context) error {
+	if err := adminStore.DeleteAdmin(c.Param("name")); err != nil {
+		if errors.Is(err, admin.ErrUnknownAdmin) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func createToken(c echo.Context) error {
+	r := model.CreateTokenDto{}
+
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	for _, scope := range r.Scopes {
+		if err := admin.ValidateScope(scope); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	p := api_auth.Principal(c)
+	if !p.CanDelegate(r.Scopes, r.Domains) {
+		return echo.NewHTTPError(http.StatusForbidden, "token cannot have more privileges than its creator")
+	}
+
+	var expiresAt time.Time
+	if r.ExpiresAt != nil {
+		expiresAt = *r.ExpiresAt
+	}
+	expiresAt, ok := p.DelegatedExpiry(expiresAt)
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "token created using an expiring token should expire too")
+	}
+
+	raw, tok, err := adminStore.CreateToken(p.Admin, r.Name, r.Scopes, r.Domains, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	resp := tokenToModel(*tok)
+	resp.Token = raw
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func listTokens(c echo.Context) error {
+	// Only principals with unrestricted access see tokens of other admins.
+	owner := ""
+	if p := api_auth.Principal(c); !p.HasScope(admin.ScopeAll) {
+		owner = p.Admin
+	}
+
+	tokens, err := adminStore.ListTokens(owner)
+	if err != nil {
+		return err
+	}
+
+	results := make([]model.Token, 0, len(tokens))
+	for _, tok := range tokens {
+		results = append(results, tokenToModel(tok))
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+func revokeToken(c echo.Context) error {
+	tok, err := adminStore.GetToken(c.Param("tokenId"))
+	if err != nil {
+		if errors.Is(err, admin.ErrUnknownToken) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	if p := api_auth.Principal(c); !p.HasScope(admin.ScopeAll) && tok.Owner != p.Admin {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	if err := adminStore.RevokeToken(tok.ID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func tokenToModel(tok admin.Token) model.Token {
+	m := model.Token{
+		ID:        tok.ID,
+		Owner:     tok.Owner,
+		Name:      tok.Name,
+		Scopes:    tok.Scopes,
+		Domains:   tok.Domains,
+		CreatedAt: tok.CreatedAt,
+	}
+	if !tok.ExpiresAt.IsZero() {
+		m.ExpiresAt = &tok.ExpiresAt
+	}
+	if !tok.LastUsedAt.IsZero() {
+		m.LastUsedAt = &tok.LastUsedAt
+	}
+	return m
+}
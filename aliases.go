@@ -0,0 +1,358 @@
+package maddy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
+)
+
+var (
+	errAliasNotFound  = errors.New("alias not found")
+	errAliasExists    = errors.New("alias already exists")
+	errAliasesMissing = echo.NewHTTPError(http.StatusNotFound, "alias management is not configured")
+)
+
+// createAlias handles POST /v1/aliases
+func createAlias(c echo.Context) error {
+	if aliasTable == nil {
+		return errAliasesMissing
+	}
+
+	r := model.CreateAliasDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	alias, err := normalizeAlias(r.Alias)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := api_auth.CheckDomain(c, alias); err != nil {
+		return err
+	}
+
+	exists, err := domainExists(extractDomain(alias))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("domain %s is not registered", extractDomain(alias)))
+	}
+
+	if err := aliasCreate(alias, r.Destinations); err != nil {
+		if errors.Is(err, errAliasExists) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// listAliases handles GET /v1/aliases
+func listAliases(c echo.Context) error {
+	if aliasTable == nil {
+		return errAliasesMissing
+	}
+
+	domain := c.QueryParam("domain")
+	if domain != "" {
+		if err := api_auth.CheckDomain(c, domain); err != nil {
+			return err
+		}
+	}
+
+	list, err := aliasList()
+	if err != nil {
+		return err
+	}
+
+	p := api_auth.Principal(c)
+	results := []model.Alias{}
+	for _, a := range list {
+		aliasDomain := extractDomain(a.Alias)
+		if domain != "" && !strings.EqualFold(aliasDomain, domain) {
+			continue
+		}
+		if !p.HasDomain(aliasDomain) {
+			continue
+		}
+		results = append(results, a)
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// getAlias handles GET /v1/aliases/:alias
+func getAlias(c echo.Context) error {
+	if aliasTable == nil {
+		return errAliasesMissing
+	}
+
+	a, err := aliasGet(c.Param("alias"))
+	if err != nil {
+		if errors.Is(err, errAliasNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, a)
+}
+
+// updateAlias handles PUT /v1/aliases/:alias
+func updateAlias(c echo.Context) error {
+	if aliasTable == nil {
+		return errAliasesMissing
+	}
+
+	r := model.UpdateAliasDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	if err := aliasUpdate(c.Param("alias"), r.Destinations); err != nil {
+		if errors.Is(err, errAliasNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteAlias handles DELETE /v1/aliases/:alias
+func deleteAlias(c echo.Context) error {
+	if aliasTable == nil {
+		return errAliasesMissing
+	}
+
+	if err := aliasDelete(c.Param("alias")); err != nil {
+		if errors.Is(err, errAliasNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// normalizeAlias converts the alias into the form used for table lookups by
+// replace_rcpt. "*@domain" denotes a catch-all for the domain.
+func normalizeAlias(alias string) (string, error) {
+	if domain, ok := strings.CutPrefix(alias, "*@"); ok {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil || normDomain == "" || strings.Contains(normDomain, "@") {
+			return "", fmt.Errorf("malformed catch-all alias: %s", alias)
+		}
+		return "*@" + normDomain, nil
+	}
+
+	if strings.Contains(alias, "*") {
+		return "", fmt.Errorf("wildcards are only allowed as *@domain: %s", alias)
+	}
+	if !address.Valid(alias) {
+		return "", fmt.Errorf("malformed alias: %s", alias)
+	}
+	normAlias, err := address.ForLookup(alias)
+	if err != nil {
+		return "", fmt.Errorf("malformed alias: %s", alias)
+	}
+	if _, domain, err := address.Split(normAlias); err != nil || domain == "" {
+		return "", fmt.Errorf("alias should include the domain: %s", alias)
+	}
+	return normAlias, nil
+}
+
+func aliasExists(alias string) (bool, error) {
+	// Lookup cannot be used since it resolves catch-alls.
+	keys, err := aliasTable.Keys()
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if key == alias {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func aliasDestinations(alias string) ([]string, error) {
+	if multi, ok := aliasTable.(module.MultiTable); ok {
+		return multi.LookupMulti(context.Background(), alias)
+	}
+
+	dest, ok, err := aliasTable.Lookup(context.Background(), alias)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{dest}, nil
+}
+
+// aliasWrite stores destinations of the alias replacing the existing ones.
+// Lookups never see a partially written list: tables with multiple values
+// per key replace them using SetKeyMulti, other tables hold a single
+// destination that is overwritten by SetKey.
+func aliasWrite(alias string, destinations []string) error {
+	normDests := make([]string, 0, len(destinations))
+	seen := make(map[string]struct{}, len(destinations))
+	for _, dest := range destinations {
+		normDest, err := address.ForLookup(dest)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("malformed destination: %s", dest))
+		}
+		if _, ok := seen[normDest]; ok {
+			continue
+		}
+		seen[normDest] = struct{}{}
+		normDests = append(normDests, normDest)
+	}
+
+	if multi, ok := aliasTable.(module.MutableMultiTable); ok {
+		return multi.SetKeyMulti(alias, normDests)
+	}
+	switch len(normDests) {
+	case 0:
+		return aliasTable.RemoveKey(alias)
+	case 1:
+		return aliasTable.SetKey(alias, normDests[0])
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "alias table does not support multiple destinations")
+	}
+}
+
+func aliasCreate(alias string, destinations []string) error {
+	exists, err := aliasExists(alias)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errAliasExists
+	}
+
+	return aliasWrite(alias, destinations)
+}
+
+func aliasUpdate(alias string, destinations []string) error {
+	alias, err := normalizeAlias(alias)
+	if err != nil {
+		return errAliasNotFound
+	}
+
+	exists, err := aliasExists(alias)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errAliasNotFound
+	}
+
+	return aliasWrite(alias, destinations)
+}
+
+func aliasGet(alias string) (model.Alias, error) {
+	alias, err := normalizeAlias(alias)
+	if err != nil {
+		return model.Alias{}, errAliasNotFound
+	}
+
+	exists, err := aliasExists(alias)
+	if err != nil {
+		return model.Alias{}, err
+	}
+	if !exists {
+		return model.Alias{}, errAliasNotFound
+	}
+
+	destinations, err := aliasDestinations(alias)
+	if err != nil {
+		return model.Alias{}, err
+	}
+
+	return model.Alias{
+		Alias:        alias,
+		Destinations: destinations,
+		CatchAll:     strings.HasPrefix(alias, "*@"),
+	}, nil
+}
+
+func aliasList() ([]model.Alias, error) {
+	keys, err := aliasTable.Keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	aliases := []model.Alias{}
+	for i, key := range keys {
+		// The list query may return the alias once per destination.
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+
+		destinations, err := aliasDestinations(key)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, model.Alias{
+			Alias:        key,
+			Destinations: destinations,
+			CatchAll:     strings.HasPrefix(key, "*@"),
+		})
+	}
+	return aliases, nil
+}
+
+func aliasDelete(alias string) error {
+	alias, err := normalizeAlias(alias)
+	if err != nil {
+		return errAliasNotFound
+	}
+
+	exists, err := aliasExists(alias)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errAliasNotFound
+	}
+
+	return aliasTable.RemoveKey(alias)
+}
+
+// domainAliases returns aliases within the domain, including the catch-all.
+func domainAliases(domain string) ([]string, error) {
+	if aliasTable == nil {
+		return nil, nil
+	}
+
+	keys, err := aliasTable.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	seen := map[string]struct{}{}
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if strings.EqualFold(extractDomain(key), domain) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
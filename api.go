@@ -1,27 +1,39 @@
 package maddy
 
 import (
+	"errors"
 	"net/http"
 	"os"
 	"sync"
 
 	echo "github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/foxcpp/maddy/internal/rest/admin"
 	"github.com/foxcpp/maddy/internal/rest/util/server"
+	"github.com/foxcpp/maddy/internal/sieve"
 	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/target/autoreply"
+	"github.com/foxcpp/maddy/internal/target/queue"
 
-	"github.com/foxcpp/maddy/internal/rest/util/middleware/basic_auth"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
 )
 
 var (
-	userDb     module.PlainUserDB
-	imapDb     module.ManageableStorage
-	mailboxes  Mailboxes
-	dkimModule *dkim.Modifier
+	userDb        module.PlainUserDB
+	imapDb        module.ManageableStorage
+	mailboxes     Mailboxes
+	dkimModule    *dkim.Modifier
+	aliasTable    module.MutableTable
+	forwardTable  module.MutableTable
+	vacationStore *autoreply.Store
+	sieveStore    *sieve.Store
+	adminStore    *admin.Store
+	// outboundQueues are target.queue instances defined as top-level
+	// configuration blocks.
+	outboundQueues []*queue.Queue
 )
 
 func startApi(mods []ModInfo, wg *sync.WaitGroup) (err error) {
@@ -42,14 +54,30 @@ func startApi(mods []ModInfo, wg *sync.WaitGroup) (err error) {
 		log.Printf("DKIM module not found, DKIM signing will be disabled: %v\n", dkimErr)
 	}
 
-	// Initialize domain_quotas table
-	if err := initDomainQuotasTable(); err != nil {
-		log.Printf("Warning: failed to initialize domain_quotas table: %v", err)
+	if aliasTable, err = openMutableTable("local_aliases"); err != nil {
+		log.Printf("Alias table not found, alias management will be disabled: %v\n", err)
 	}
 
-	if os.Getenv("ADMIN_EMAIL") == "" || os.Getenv("ADMIN_PASSWORD") == "" {
-		log.Println("ADMIN_EMAIL and ADMIN_PASSWORD environment variables must be set")
-		os.Exit(1)
+	if forwardTable, err = openMutableTable("local_forwards"); err != nil {
+		log.Printf("Forwarding table not found, forwarding management will be disabled: %v\n", err)
+	}
+
+	if err := initDomainsTable(); err != nil {
+		log.Printf("Warning: failed to initialize domains table: %v", err)
+	}
+
+	outboundQueues = openQueues(mods)
+
+	if err := initVacationStore(); err != nil {
+		log.Printf("Vacation store not available, vacation management will be disabled: %v\n", err)
+	}
+
+	if err := initSieveStore(); err != nil {
+		log.Printf("Sieve store not available, scripts of deleted users will be kept: %v\n", err)
+	}
+
+	if err := initAdminStore(); err != nil {
+		return err
 	}
 
 	port := os.Getenv("MADDY_PORT")
@@ -76,29 +104,131 @@ func NewV1(e *echo.Echo) {
 	e.GET("/version", version)
 
 	v1 := e.Group("/v1")
-	v1.Use(middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{Validator: basic_auth.AdminBasicAuthValidator}))
+	v1.Use(api_auth.Authenticate(adminStore))
+
+	scope := api_auth.RequireScope
+	userDomain := api_auth.RequireParamDomain("id")
+	domainParam := api_auth.RequireParamDomain("domain")
+	aliasDomain := api_auth.RequireParamDomain("alias")
+	requireUnrestricted := api_auth.RequireUnrestricted
 
 	users := v1.Group("/users")
 	{
-		users.POST("", createUser)
-		users.GET("", listUsers)
-		users.GET("/:id", getUser)
-		users.POST("/:id/password", updateUserPassword)
-		users.DELETE("/:id", deleteUser)
-		users.GET("/:id/quota", getUserQuota)
-		users.PUT("/:id/quota", setUserQuota)
+		users.POST("", createUser, scope("users:write"))
+		users.GET("", listUsers, scope("users:read"))
+		users.GET("/:id", getUser, scope("users:read"), userDomain)
+		users.POST("/:id/password", updateUserPassword, scope("users:write"), userDomain)
+		users.GET("/:id/app-passwords", listAppPasswords, scope("users:read"), userDomain)
+		users.POST("/:id/app-passwords", createAppPassword, scope("users:write"), userDomain)
+		users.DELETE("/:id/app-passwords/:name", deleteAppPassword, scope("users:write"), userDomain)
+		users.GET("/:id/totp", getUserTOTP, scope("users:read"), userDomain)
+		users.POST("/:id/totp", enrollUserTOTP, scope("users:write"), userDomain)
+		users.POST("/:id/totp/confirm", confirmUserTOTP, scope("users:write"), userDomain)
+		users.DELETE("/:id/totp", disableUserTOTP, scope("users:write"), userDomain)
+		users.POST("/:id/totp/session", createUserSession, scope("users:write"), userDomain)
+		users.DELETE("/:id", deleteUser, scope("users:write"), userDomain)
+		users.GET("/:id/quota", getUserQuota, scope("quota:read"), userDomain)
+		users.PUT("/:id/quota", setUserQuota, scope("quota:write"), userDomain)
+		users.GET("/:id/retention", getUserRetention, scope("retention:read"), userDomain)
+		users.PUT("/:id/retention", setUserRetention, scope("retention:write"), userDomain)
+		users.GET("/:id/forwarding", getForwarding, scope("forwarding:read"), userDomain)
+		users.PUT("/:id/forwarding", setForwarding, scope("forwarding:write"), userDomain)
+		users.DELETE("/:id/forwarding", deleteForwarding, scope("forwarding:write"), userDomain)
+		users.GET("/:id/vacation", getVacation, scope("vacation:read"), userDomain)
+		users.PUT("/:id/vacation", setVacation, scope("vacation:write"), userDomain)
+		users.DELETE("/:id/vacation", deleteVacation, scope("vacation:write"), userDomain)
+		users.POST("/:id/export", startExport, scope("messages:read"), userDomain)
+		users.GET("/:id/export/:job", getExport, scope("messages:read"), userDomain)
+		users.GET("/:id/export/:job/download", downloadExport, scope("messages:read"), userDomain)
+		users.DELETE("/:id/export/:job", deleteExport, scope("messages:write"), userDomain)
+		users.POST("/:id/import", startImport, scope("messages:write"), userDomain)
+		users.GET("/:id/import/:job", getImport, scope("messages:read"), userDomain)
+		users.POST("/:id/migrations", startMigration, scope("messages:write"), userDomain)
+		users.GET("/:id/migrations/:job", getMigration, scope("messages:read"), userDomain)
 	}
 
-	mailboxes := v1.Group("/users/:id/mailboxes")
+	mailboxes := v1.Group("/users/:id/mailboxes", userDomain)
 	{
-		mailboxes.POST("", createImapAccount)
-		mailboxes.DELETE("", deleteImapAccount)
+		mailboxes.POST("", createImapAccount, scope("mailboxes:write"))
+		mailboxes.DELETE("", deleteImapAccount, scope("mailboxes:write"))
+		mailboxes.GET("", listMailboxes, scope("mailboxes:read"))
+		mailboxes.POST("/:mailbox", createMailbox, scope("mailboxes:write"))
+		mailboxes.PATCH("/:mailbox", updateMailbox, scope("mailboxes:write"))
+		mailboxes.DELETE("/:mailbox", deleteMailbox, scope("mailboxes:write"))
+		mailboxes.GET("/:mailbox/messages", listMessages, scope("messages:read"))
+		mailboxes.GET("/:mailbox/messages/:uid", getMessage, scope("messages:read"))
+		mailboxes.GET("/:mailbox/messages/:uid/raw", getMessageRaw, scope("messages:read"))
+		mailboxes.POST("/:mailbox/messages/flags", updateMessageFlags, scope("messages:write"))
+		mailboxes.POST("/:mailbox/messages/copy", copyMessages, scope("messages:write"))
+		mailboxes.POST("/:mailbox/messages/move", moveMessages, scope("messages:write"))
 	}
 
 	domains := v1.Group("/domains")
 	{
-		domains.GET("/:domain/quota", getDomainQuota)
-		domains.PUT("/:domain/quota", setDomainQuota)
+		domains.POST("", createDomain, scope("domains:write"))
+		domains.GET("", listDomains, scope("domains:read"))
+		domains.GET("/:domain", getDomain, scope("domains:read"), domainParam)
+		domains.DELETE("/:domain", deleteDomain, scope("domains:write"), domainParam)
+		domains.GET("/:domain/quota", getDomainQuota, scope("quota:read"), domainParam)
+		domains.PUT("/:domain/quota", setDomainQuota, scope("quota:write"), domainParam)
+		domains.GET("/:domain/retention", getDomainRetention, scope("retention:read"), domainParam)
+		domains.PUT("/:domain/retention", setDomainRetention, scope("retention:write"), domainParam)
+		domains.GET("/:domain/dkim", getDKIM, scope("dkim:read"), domainParam)
+		domains.POST("/:domain/dkim/rotate", rotateDKIM, scope("dkim:write"), domainParam)
+		domains.DELETE("/:domain/dkim/:selector", revokeDKIM, scope("dkim:write"), domainParam)
+	}
+
+	v1.GET("/retention", getGlobalRetention, scope("retention:read"), requireUnrestricted)
+	v1.PUT("/retention", setGlobalRetention, scope("retention:write"), requireUnrestricted)
+
+	aliases := v1.Group("/aliases")
+	{
+		aliases.POST("", createAlias, scope("aliases:write"))
+		aliases.GET("", listAliases, scope("aliases:read"))
+		aliases.GET("/:alias", getAlias, scope("aliases:read"), aliasDomain)
+		aliases.PUT("/:alias", updateAlias, scope("aliases:write"), aliasDomain)
+		aliases.DELETE("/:alias", deleteAlias, scope("aliases:write"), aliasDomain)
+	}
+
+	admins := v1.Group("/admins", requireUnrestricted)
+	{
+		admins.POST("", createAdmin, scope("admins:write"))
+		admins.GET("", listAdmins, scope("admins:read"))
+		admins.POST("/:name/password", updateAdminPassword, scope("admins:write"))
+		admins.DELETE("/:name", deleteAdmin, scope("admins:write"))
+		admins.GET("/:name/totp", getAdminTOTP, scope("admins:read"))
+		admins.POST("/:name/totp", enrollAdminTOTP)
+		admins.POST("/:name/totp/confirm", confirmAdminTOTP)
+		admins.POST("/:name/totp/recovery-codes", regenerateRecoveryCodes)
+		admins.DELETE("/:name/totp", disableAdminTOTP, scope("admins:write"))
+	}
+
+	lockouts := v1.Group("/auth", requireUnrestricted)
+	{
+		lockouts.GET("/lockouts", listLockouts, scope("auth:read"))
+		lockouts.POST("/unlock", unlockAuth, scope("auth:write"))
+	}
+
+	outbound := v1.Group("/queue", requireUnrestricted)
+	{
+		outbound.GET("", listQueue, scope("queue:read"))
+		outbound.POST("/purge", purgeQueue, scope("queue:write"))
+		outbound.GET("/domains", listQueueDomains, scope("queue:read"))
+		outbound.POST("/domains/:domain/suspend", suspendQueueDomain, scope("queue:write"))
+		outbound.POST("/domains/:domain/resume", resumeQueueDomain, scope("queue:write"))
+		outbound.GET("/:id", getQueuedMessage, scope("queue:read"))
+		outbound.DELETE("/:id", dropQueuedMessage, scope("queue:write"))
+		outbound.POST("/:id/retry", retryQueuedMessage, scope("queue:write"))
+		outbound.POST("/:id/hold", holdQueuedMessage, scope("queue:write"))
+		outbound.POST("/:id/release", releaseQueuedMessage, scope("queue:write"))
+		outbound.POST("/:id/bounce", bounceQueuedMessage, scope("queue:write"))
+	}
+
+	tokens := v1.Group("/tokens")
+	{
+		tokens.POST("", createToken, scope("tokens:write"))
+		tokens.GET("", listTokens, scope("tokens:read"))
+		tokens.DELETE("/:tokenId", revokeToken, scope("tokens:write"))
 	}
 }
 
@@ -110,37 +240,32 @@ func version(c echo.Context) error {
 	return c.JSON(http.StatusOK, Version)
 }
 
-// initQuotaTables creates the quota tables if they don't exist
-func initDomainQuotasTable() error {
+// initAdminStore opens the API admin store in the storage database and
+// creates the bootstrap admin account from ADMIN_EMAIL/ADMIN_PASSWORD if set.
+func initAdminStore() error {
 	storage, ok := imapDb.(*imapsql.Storage)
 	if !ok {
-		return nil // Not using imapsql backend, skip
-	}
-	db := storage.Back.DB
-
-	// Create domain_quotas table
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS domain_quotas (
-			id BIGSERIAL PRIMARY KEY,
-			domain VARCHAR(255) NOT NULL UNIQUE,
-			quota_bytes BIGINT NOT NULL DEFAULT 0,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+		return errors.New("REST API requires storage.imapsql as local_mailboxes")
+	}
+
+	adminStore = &admin.Store{DB: storage.Back.DB, Driver: storage.Driver()}
+	if err := adminStore.Init(); err != nil {
+		return err
+	}
+
+	if email, pass := os.Getenv("ADMIN_EMAIL"), os.Getenv("ADMIN_PASSWORD"); email != "" && pass != "" {
+		if err := adminStore.EnsureAdmin(email, pass); err != nil {
+			return err
+		}
+	}
+
+	admins, err := adminStore.ListAdmins()
 	if err != nil {
 		return err
 	}
+	if len(admins) == 0 {
+		log.Println("No REST API admins configured, create one using 'maddy api-admin create'")
+	}
 
-	// Create user_quotas table for user-specific overrides
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS user_quotas (
-			id BIGSERIAL PRIMARY KEY,
-			username VARCHAR(255) NOT NULL UNIQUE,
-			quota_bytes BIGINT NOT NULL DEFAULT 0,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	return err
+	return nil
 }
@@ -0,0 +1,108 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+var errAppPasswordsMissing = echo.NewHTTPError(http.StatusNotFound, "app passwords are not configured")
+
+// appPasswordDB returns the credentials store if it supports app passwords.
+func appPasswordDB() (*pass_table.Auth, error) {
+	db, ok := userDb.(*pass_table.Auth)
+	if !ok || !db.AppPasswordsEnabled() {
+		return nil, errAppPasswordsMissing
+	}
+	return db, nil
+}
+
+// listAppPasswords handles GET /v1/users/:id/app-passwords
+func listAppPasswords(c echo.Context) error {
+	db, err := appPasswordDB()
+	if err != nil {
+		return err
+	}
+
+	list, err := db.ListAppPasswords(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	results := make([]model.AppPassword, 0, len(list))
+	for _, ap := range list {
+		results = append(results, appPasswordToModel(ap))
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// createAppPassword handles POST /v1/users/:id/app-passwords
+//
+// The generated password is returned only in this response.
+func createAppPassword(c echo.Context) error {
+	db, err := appPasswordDB()
+	if err != nil {
+		return err
+	}
+
+	r := model.CreateAppPasswordDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	ap, pass, err := db.CreateAppPassword(c.Param("id"), r.Name, r.Protocols)
+	if err != nil {
+		return appPasswordError(err)
+	}
+
+	m := appPasswordToModel(ap)
+	m.Password = pass
+	return c.JSON(http.StatusCreated, m)
+}
+
+// deleteAppPassword handles DELETE /v1/users/:id/app-passwords/:name
+func deleteAppPassword(c echo.Context) error {
+	db, err := appPasswordDB()
+	if err != nil {
+		return err
+	}
+
+	if err := db.DeleteAppPassword(c.Param("id"), c.Param("name")); err != nil {
+		return appPasswordError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func appPasswordError(err error) error {
+	switch {
+	case errors.Is(err, pass_table.ErrUnknownUser), errors.Is(err, pass_table.ErrUnknownAppPassword):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, pass_table.ErrAppPasswordExists):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return err
+}
+
+func appPasswordToModel(ap pass_table.AppPassword) model.AppPassword {
+	m := model.AppPassword{
+		Name:      ap.Name,
+		Protocols: ap.Protocols,
+		CreatedAt: ap.CreatedAt,
+	}
+	if m.Protocols == nil {
+		m.Protocols = []string{}
+	}
+	if !ap.LastUsedAt.IsZero() {
+		m.LastUsedAt = &ap.LastUsedAt
+	}
+	if !ap.ExpiresAt.IsZero() {
+		m.ExpiresAt = &ap.ExpiresAt
+	}
+	return m
+}
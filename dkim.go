@@ -0,0 +1,101 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+// defaultDKIMOverlap is how long the replaced key stays published after
+// rotation unless the request says otherwise.
+const defaultDKIMOverlap = 7 * 24 * time.Hour
+
+// getDKIM handles GET /v1/domains/:domain/dkim
+func getDKIM(c echo.Context) error {
+	if dkimModule == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "DKIM signing is not configured")
+	}
+
+	info, err := dkimModule.KeyInfo(c.Param("domain"))
+	if err != nil {
+		return dkimError(err)
+	}
+
+	return c.JSON(http.StatusOK, dkimToModel(info))
+}
+
+// rotateDKIM handles POST /v1/domains/:domain/dkim/rotate
+func rotateDKIM(c echo.Context) error {
+	if dkimModule == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "DKIM signing is not configured")
+	}
+
+	r := model.RotateDKIMDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	overlap := defaultDKIMOverlap
+	if r.OverlapHours != nil {
+		overlap = time.Duration(*r.OverlapHours) * time.Hour
+	}
+
+	info, err := dkimModule.RotateKey(c.Param("domain"), r.Selector, overlap)
+	if err != nil {
+		return dkimError(err)
+	}
+
+	return c.JSON(http.StatusOK, dkimToModel(info))
+}
+
+// revokeDKIM handles DELETE /v1/domains/:domain/dkim/:selector
+func revokeDKIM(c echo.Context) error {
+	if dkimModule == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "DKIM signing is not configured")
+	}
+
+	if err := dkimModule.RevokeKey(c.Param("domain"), c.Param("selector")); err != nil {
+		return dkimError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func dkimError(err error) error {
+	switch {
+	case errors.Is(err, dkim.ErrNoKey), errors.Is(err, dkim.ErrUnknownSelector):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, dkim.ErrInvalidSelector):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, dkim.ErrSelectorInUse), errors.Is(err, dkim.ErrActiveSelector):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return err
+}
+
+func dkimToModel(info dkim.KeyInfo) model.DKIMResponse {
+	resp := model.DKIMResponse{
+		Domain: info.Domain,
+		Active: model.DKIMRecord{
+			Selector: info.Active.Selector,
+			DNSName:  info.Active.DNSName,
+			DNSValue: info.Active.DNSValue,
+		},
+		Previous: make([]model.DKIMRecord, 0, len(info.Previous)),
+	}
+	for _, rec := range info.Previous {
+		publishUntil := rec.PublishUntil
+		resp.Previous = append(resp.Previous, model.DKIMRecord{
+			Selector:     rec.Selector,
+			DNSName:      rec.DNSName,
+			DNSValue:     rec.DNSValue,
+			PublishUntil: &publishUntil,
+		})
+	}
+	return resp
+}
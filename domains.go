@@ -0,0 +1,366 @@
+package maddy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+)
+
+var (
+	errDomainNotFound = errors.New("domain not found")
+	errDomainExists   = errors.New("domain already exists")
+	errDomainInUse    = errors.New("domain still has users or aliases, delete them first or use cascade=true")
+)
+
+// createDomain handles POST /v1/domains
+func createDomain(c echo.Context) error {
+	r := model.CreateDomainDto{}
+
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	if err := api_auth.CheckDomain(c, r.Domain); err != nil {
+		return err
+	}
+
+	if err := domainAdd(r.Domain, r.QuotaBytes); err != nil {
+		if errors.Is(err, errDomainExists) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// listDomains handles GET /v1/domains
+func listDomains(c echo.Context) error {
+	list, err := domainList()
+	if err != nil {
+		return err
+	}
+
+	p := api_auth.Principal(c)
+	results := []model.Domain{}
+	for _, d := range list {
+		if p.HasDomain(d.Domain) {
+			results = append(results, d)
+		}
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// getDomain handles GET /v1/domains/:domain
+func getDomain(c echo.Context) error {
+	d, err := domainGet(c.Param("domain"))
+	if err != nil {
+		if errors.Is(err, errDomainNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, d)
+}
+
+// deleteDomain handles DELETE /v1/domains/:domain
+func deleteDomain(c echo.Context) error {
+	cascade := c.QueryParam("cascade") == "true"
+	if err := domainDelete(c.Param("domain"), cascade, api_auth.Principal(c).Admin); err != nil {
+		switch {
+		case errors.Is(err, errDomainNotFound):
+			return c.NoContent(http.StatusNotFound)
+		case errors.Is(err, errDomainInUse):
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// initDomainsTable creates the domain registry table. If the registry is
+// empty, it is populated from domains of existing users.
+func initDomainsTable() error {
+	db, err := storageDB()
+	if err != nil {
+		return nil // Not using imapsql backend, skip
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS domains (
+			domain VARCHAR(255) NOT NULL PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM domains").Scan(&count); err != nil {
+		return err
+	}
+	if count != 0 {
+		return nil
+	}
+
+	users, err := userDb.ListUsers()
+	if err != nil {
+		return err
+	}
+	seen := map[string]struct{}{}
+	for _, user := range users {
+		domain := strings.ToLower(extractDomain(user))
+		if domain == "" {
+			continue
+		}
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+
+		if _, err := db.Exec(storageSQL("INSERT INTO domains (domain) VALUES ($1)"), domain); err != nil {
+			return err
+		}
+	}
+	if len(seen) != 0 {
+		log.Printf("domain registry populated with %d domains of existing users", len(seen))
+	}
+
+	return nil
+}
+
+func domainExists(domain string) (bool, error) {
+	db, err := storageDB()
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = db.QueryRow(storageSQL("SELECT EXISTS(SELECT 1 FROM domains WHERE domain = $1)"), strings.ToLower(domain)).Scan(&exists)
+	return exists, err
+}
+
+// domainAdd registers the domain, generates its DKIM key and sets the
+// domain quota if quotaBytes is not zero. The registry entry and the quota
+// are added in one transaction and removed again if the DKIM key cannot be
+// generated, so a failed request can be retried.
+func domainAdd(domain string, quotaBytes int64) error {
+	domain = strings.ToLower(domain)
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	exists, err := domainExists(domain)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errDomainExists
+	}
+
+	var quota *imapsql.QuotaSettings
+	if quotaBytes != 0 {
+		quota = &imapsql.QuotaSettings{Bytes: quotaBytes}
+	}
+	err = storage.AddDomainSettings(domain, quota, func(tx *sql.Tx) error {
+		_, err := tx.Exec(storageSQL("INSERT INTO domains (domain) VALUES ($1)"), domain)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if dkimModule != nil {
+		if err := dkimModule.AddKey(domain); err != nil {
+			rollbackErr := storage.DeleteDomainSettings(domain, nil, func(tx *sql.Tx) error {
+				_, err := tx.Exec(storageSQL("DELETE FROM domains WHERE domain = $1"), domain)
+				return err
+			})
+			if rollbackErr != nil {
+				log.Printf("failed to remove domain %s after DKIM key generation failure: %v", domain, rollbackErr)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// domainEnsure registers the domain unless it is already registered.
+func domainEnsure(domain string) error {
+	err := domainAdd(domain, 0)
+	if errors.Is(err, errDomainExists) {
+		return nil
+	}
+	return err
+}
+
+func domainGet(domain string) (model.Domain, error) {
+	list, err := domainList()
+	if err != nil {
+		return model.Domain{}, err
+	}
+	for _, d := range list {
+		if strings.EqualFold(d.Domain, domain) {
+			return d, nil
+		}
+	}
+	return model.Domain{}, errDomainNotFound
+}
+
+func domainList() ([]model.Domain, error) {
+	db, err := storageDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT d.domain, d.created_at, COALESCE(dq.quota_bytes, 0)
+		FROM domains d
+		LEFT JOIN domain_quotas dq ON dq.domain = d.domain
+		ORDER BY d.domain
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []model.Domain{}
+	index := map[string]int{}
+	for rows.Next() {
+		var (
+			d         model.Domain
+			createdAt sql.NullTime
+		)
+		if err := rows.Scan(&d.Domain, &createdAt, &d.QuotaBytes); err != nil {
+			return nil, err
+		}
+		if createdAt.Valid {
+			d.CreatedAt = createdAt.Time
+		}
+		index[d.Domain] = len(domains)
+		domains = append(domains, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	users, err := userDb.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if i, ok := index[strings.ToLower(extractDomain(user))]; ok {
+			domains[i].UserCount++
+		}
+	}
+
+	return domains, nil
+}
+
+func domainUsers(domain string) ([]string, error) {
+	users, err := userDb.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, user := range users {
+		if strings.EqualFold(extractDomain(user), domain) {
+			result = append(result, user)
+		}
+	}
+	return result, nil
+}
+
+// domainDelete removes the domain from the registry. If the domain still
+// has users or aliases, errDomainInUse is returned unless cascade is set, in
+// which case users, their mailboxes and aliases are deleted too. admin is
+// reported in user.deleted events.
+//
+// Aliases, credentials and mailboxes are managed by other modules and are
+// removed first. The registry entry is then removed along with quotas,
+// retention rules and migration state in a single transaction, so if any
+// step fails the domain stays registered and the deletion can be retried.
+func domainDelete(domain string, cascade bool, admin string) error {
+	domain = strings.ToLower(domain)
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	exists, err := domainExists(domain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errDomainNotFound
+	}
+
+	users, err := domainUsers(domain)
+	if err != nil {
+		return err
+	}
+	aliases, err := domainAliases(domain)
+	if err != nil {
+		return err
+	}
+	if (len(users) != 0 || len(aliases) != 0) && !cascade {
+		return errDomainInUse
+	}
+
+	for _, alias := range aliases {
+		if err := aliasTable.RemoveKey(alias); err != nil {
+			return fmt.Errorf("delete alias %s: %w", alias, err)
+		}
+	}
+
+	accounts, err := imapDb.ListIMAPAccts()
+	if err != nil {
+		return err
+	}
+	hasAccount := make(map[string]bool, len(accounts))
+	for _, acct := range accounts {
+		hasAccount[acct] = true
+	}
+
+	for _, user := range users {
+		if err := userDelete(user, hasAccount[user]); err != nil {
+			return fmt.Errorf("delete user %s: %w", user, err)
+		}
+		publishUserEvent(events.UserDeleted, user, admin)
+	}
+
+	err = storage.DeleteDomainSettings(domain, users, func(tx *sql.Tx) error {
+		_, err := tx.Exec(storageSQL("DELETE FROM domains WHERE domain = $1"), domain)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if dkimModule != nil {
+		if err := dkimModule.RemoveKey(domain); err != nil {
+			log.Printf("failed to remove DKIM key for %s: %v", domain, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package maddy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/mailexport"
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+const (
+	jobExport    = "export"
+	jobImport    = "import"
+	jobMigration = "migration"
+
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	// accountJobTTL is how long finished jobs and their archives are kept.
+	accountJobTTL = 24 * time.Hour
+)
+
+// accountJob is an export, import or migration running in the background.
+// Archives are kept in the exports directory under the state directory.
+type accountJob struct {
+	mu   sync.Mutex
+	info model.AccountJob
+	file string
+}
+
+var accountJobs = struct {
+	sync.Mutex
+	m map[string]*accountJob
+}{m: map[string]*accountJob{}}
+
+// startExport handles POST /v1/users/:id/export
+func startExport(c echo.Context) error {
+	r := model.ExportRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	format, err := mailexport.ParseFormat(r.Format)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	u, err := imapAccount(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	job, err := newAccountJob(jobExport, c.Param("id"), string(format))
+	if err != nil {
+		u.Logout()
+		return err
+	}
+
+	go job.run(u, func() error {
+		f, err := os.Create(job.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := mailexport.Export(u, f, format, job.exportProgress); err != nil {
+			return err
+		}
+		return f.Close()
+	})
+
+	return c.JSON(http.StatusAccepted, job.snapshot())
+}
+
+// getExport handles GET /v1/users/:id/export/:job
+func getExport(c echo.Context) error {
+	job, err := findAccountJob(c, jobExport)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, job.snapshot())
+}
+
+// downloadExport handles GET /v1/users/:id/export/:job/download
+func downloadExport(c echo.Context) error {
+	job, err := findAccountJob(c, jobExport)
+	if err != nil {
+		return err
+	}
+	if job.snapshot().Status != jobDone {
+		return echo.NewHTTPError(http.StatusConflict, "export is not finished")
+	}
+	return c.Attachment(job.file, job.snapshot().Username+".tar")
+}
+
+// deleteExport handles DELETE /v1/users/:id/export/:job
+func deleteExport(c echo.Context) error {
+	job, err := findAccountJob(c, jobExport)
+	if err != nil {
+		return err
+	}
+	if job.snapshot().Status == jobRunning {
+		return echo.NewHTTPError(http.StatusConflict, "export is still running")
+	}
+
+	accountJobs.Lock()
+	delete(accountJobs.m, job.snapshot().ID)
+	accountJobs.Unlock()
+	job.removeFile()
+
+	return c.NoContent(http.StatusOK)
+}
+
+// startImport handles POST /v1/users/:id/import
+//
+// The request body is the archive created by the export. It is stored
+// before the response is sent, the import itself runs in the background.
+func startImport(c echo.Context) error {
+	u, err := imapAccount(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	job, err := newAccountJob(jobImport, c.Param("id"), "")
+	if err != nil {
+		u.Logout()
+		return err
+	}
+
+	if err := saveUpload(job.file, c.Request().Body); err != nil {
+		u.Logout()
+		accountJobs.Lock()
+		delete(accountJobs.m, job.info.ID)
+		accountJobs.Unlock()
+		job.removeFile()
+		return err
+	}
+
+	go job.run(u, func() error {
+		defer job.removeFile()
+		f, err := os.Open(job.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return mailexport.Import(u, f, job.exportProgress)
+	})
+
+	return c.JSON(http.StatusAccepted, job.snapshot())
+}
+
+// getImport handles GET /v1/users/:id/import/:job
+func getImport(c echo.Context) error {
+	job, err := findAccountJob(c, jobImport)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, job.snapshot())
+}
+
+func saveUpload(path string, body io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func accountJobsDir() (string, error) {
+	dir := filepath.Join(config.StateDirectory, "exports")
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// newAccountJob registers the job. Finished jobs older than accountJobTTL
+// are removed.
+func newAccountJob(kind, username, format string) (*accountJob, error) {
+	dir, err := accountJobsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	job := &accountJob{
+		info: model.AccountJob{
+			ID:        id,
+			Type:      kind,
+			Username:  username,
+			Format:    format,
+			Status:    jobRunning,
+			CreatedAt: time.Now(),
+		},
+		file: filepath.Join(dir, id+".tar"),
+	}
+
+	accountJobs.Lock()
+	defer accountJobs.Unlock()
+	for id, j := range accountJobs.m {
+		info := j.snapshot()
+		if info.FinishedAt != nil && time.Since(*info.FinishedAt) > accountJobTTL {
+			delete(accountJobs.m, id)
+			j.removeFile()
+		}
+	}
+	accountJobs.m[id] = job
+
+	return job, nil
+}
+
+// findAccountJob returns the job from the path, jobs of other users are
+// reported as not found.
+func findAccountJob(c echo.Context, kind string) (*accountJob, error) {
+	accountJobs.Lock()
+	job, ok := accountJobs.m[c.Param("job")]
+	accountJobs.Unlock()
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "job not found")
+	}
+	info := job.snapshot()
+	if info.Type != kind || info.Username != c.Param("id") {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "job not found")
+	}
+	return job, nil
+}
+
+func (j *accountJob) run(u backend.User, fn func() error) {
+	err := fn()
+	u.Logout()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.info.FinishedAt = &now
+	if err != nil {
+		j.info.Status = jobFailed
+		j.info.Error = err.Error()
+		log.Printf("account %s of %s failed: %v", j.info.Type, j.info.Username, err)
+		if j.info.Type == jobExport {
+			os.Remove(j.file)
+		}
+		return
+	}
+	j.info.Status = jobDone
+}
+
+func (j *accountJob) setProgress(mailbox string, done, total int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.Mailbox = mailbox
+	j.info.MessagesDone = done
+	j.info.MessagesTotal = total
+}
+
+func (j *accountJob) exportProgress(p mailexport.Progress) {
+	j.setProgress(p.Mailbox, p.MessagesDone, p.MessagesTotal)
+}
+
+func (j *accountJob) snapshot() model.AccountJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info := j.info
+	return info
+}
+
+func (j *accountJob) removeFile() {
+	if err := os.Remove(j.file); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove %s: %v", j.file, err)
+	}
+}
@@ -0,0 +1,184 @@
+package maddy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+var (
+	errForwardingNotFound = errors.New("forwarding rule not found")
+	errForwardingMissing  = echo.NewHTTPError(http.StatusNotFound, "forwarding management is not configured")
+)
+
+// getForwarding handles GET /v1/users/:id/forwarding
+func getForwarding(c echo.Context) error {
+	if forwardTable == nil {
+		return errForwardingMissing
+	}
+
+	rule, err := forwardingGet(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, errForwardingNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, rule)
+}
+
+// setForwarding handles PUT /v1/users/:id/forwarding
+func setForwarding(c echo.Context) error {
+	if forwardTable == nil {
+		return errForwardingMissing
+	}
+
+	r := model.Forwarding{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	exists, err := userExists(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	if err := forwardingSet(c.Param("id"), r); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteForwarding handles DELETE /v1/users/:id/forwarding
+func deleteForwarding(c echo.Context) error {
+	if forwardTable == nil {
+		return errForwardingMissing
+	}
+
+	if err := forwardingDelete(c.Param("id")); err != nil {
+		if errors.Is(err, errForwardingNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func userExists(username string) (bool, error) {
+	list, err := userList()
+	if err != nil {
+		return false, err
+	}
+	for _, user := range list {
+		if user == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// forwardingGet returns the forwarding rule of the user. Keep-copy is stored
+// as the user address listed among destinations, which is also how
+// target.forward interprets it.
+func forwardingGet(username string) (model.Forwarding, error) {
+	key, err := address.ForLookup(username)
+	if err != nil {
+		return model.Forwarding{}, errForwardingNotFound
+	}
+
+	var dests []string
+	if multi, ok := forwardTable.(module.MultiTable); ok {
+		dests, err = multi.LookupMulti(context.Background(), key)
+	} else {
+		var (
+			dest  string
+			found bool
+		)
+		dest, found, err = forwardTable.Lookup(context.Background(), key)
+		if found {
+			dests = []string{dest}
+		}
+	}
+	if err != nil {
+		return model.Forwarding{}, err
+	}
+	if len(dests) == 0 {
+		return model.Forwarding{}, errForwardingNotFound
+	}
+
+	rule := model.Forwarding{Destinations: []string{}}
+	for _, dest := range dests {
+		if dest == key {
+			rule.KeepCopy = true
+			continue
+		}
+		rule.Destinations = append(rule.Destinations, dest)
+	}
+	return rule, nil
+}
+
+func forwardingSet(username string, rule model.Forwarding) error {
+	key, err := address.ForLookup(username)
+	if err != nil {
+		return err
+	}
+
+	var dests []string
+	seen := map[string]struct{}{}
+	for _, dest := range rule.Destinations {
+		normDest, err := address.ForLookup(dest)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("malformed destination: %s", dest))
+		}
+		if normDest == key {
+			return echo.NewHTTPError(http.StatusBadRequest, "use keepCopy to deliver to the local mailbox")
+		}
+		if _, ok := seen[normDest]; ok {
+			continue
+		}
+		seen[normDest] = struct{}{}
+		dests = append(dests, normDest)
+	}
+	if rule.KeepCopy {
+		dests = append(dests, key)
+	}
+
+	// Replaced at once so mail delivered meanwhile never sees a partial
+	// rule, same as aliasWrite.
+	if multi, ok := forwardTable.(module.MutableMultiTable); ok {
+		return multi.SetKeyMulti(key, dests)
+	}
+	switch len(dests) {
+	case 0:
+		return forwardTable.RemoveKey(key)
+	case 1:
+		return forwardTable.SetKey(key, dests[0])
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "forwarding table does not support multiple destinations")
+	}
+}
+
+func forwardingDelete(username string) error {
+	if _, err := forwardingGet(username); err != nil {
+		return err
+	}
+
+	key, err := address.ForLookup(username)
+	if err != nil {
+		return err
+	}
+	return forwardTable.RemoveKey(key)
+}
@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package events implements the in-process bus for mail and admin events.
+//
+// Modules call Publish when something interesting happens, sinks (see the
+// 'events' endpoint) subscribe to the bus and forward events to external
+// consumers. Publish is cheap if there are no sinks.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	MessageAccepted  = "message.accepted"
+	MessageRejected  = "message.rejected"
+	MessageDelivered = "message.delivered"
+	MessageDeferred  = "message.deferred"
+	MessageBounced   = "message.bounced"
+
+	UserCreated         = "user.created"
+	UserDeleted         = "user.deleted"
+	UserPasswordChanged = "user.password_changed"
+
+	QuotaExceeded = "quota.exceeded"
+	QuotaWarning  = "quota.warning"
+
+	AuthFailed = "auth.failed"
+	AuthLocked = "auth.locked"
+)
+
+// Event is a single notification published on the bus.
+type Event struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"event"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Sink receives all published events.
+//
+// Handle is called synchronously by the publisher, so it should not block.
+// Sinks that do I/O are expected to queue events.
+type Sink interface {
+	Handle(ev Event)
+}
+
+var (
+	sinks    []Sink
+	sinksLck sync.RWMutex
+)
+
+// Subscribe adds the sink to the bus. The returned function removes it.
+func Subscribe(s Sink) func() {
+	sinksLck.Lock()
+	defer sinksLck.Unlock()
+	sinks = append(sinks, s)
+
+	return func() {
+		sinksLck.Lock()
+		defer sinksLck.Unlock()
+		for i, other := range sinks {
+			if other == s {
+				sinks = append(sinks[:i:i], sinks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Enabled reports whether there are any sinks. It can be used to skip
+// building event data that would be thrown away.
+func Enabled() bool {
+	sinksLck.RLock()
+	defer sinksLck.RUnlock()
+	return len(sinks) != 0
+}
+
+// Publish sends the event to all sinks.
+//
+// data should contain only values that can be serialized to JSON.
+func Publish(typ string, data map[string]interface{}) {
+	sinksLck.RLock()
+	defer sinksLck.RUnlock()
+	if len(sinks) == 0 {
+		return
+	}
+
+	ev := Event{
+		ID:   newID(),
+		Type: typ,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+	for _, s := range sinks {
+		s.Handle(ev)
+	}
+}
+
+// Match reports whether the event type matches any of patterns.
+//
+// Patterns use shell glob syntax, e.g. "message.*". Empty list matches all
+// events.
+func Match(patterns []string, typ string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Should not happen, fallback to the timestamp to keep IDs unique
+		// enough.
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,75 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import "testing"
+
+type sliceSink []Event
+
+func (s *sliceSink) Handle(ev Event) {
+	*s = append(*s, ev)
+}
+
+func TestPublish(t *testing.T) {
+	if Enabled() {
+		t.Fatal("no sinks expected")
+	}
+	Publish(UserCreated, nil)
+
+	var a, b sliceSink
+	unsubA := Subscribe(&a)
+	unsubB := Subscribe(&b)
+	defer unsubB()
+
+	Publish(UserCreated, map[string]interface{}{"username": "foo@example.org"})
+	unsubA()
+	Publish(UserDeleted, nil)
+
+	if len(a) != 1 || len(b) != 2 {
+		t.Fatalf("wrong events received: %v, %v", a, b)
+	}
+	if a[0].Type != UserCreated || a[0].Data["username"] != "foo@example.org" || a[0].ID == "" {
+		t.Errorf("wrong event: %+v", a[0])
+	}
+	if a[0].ID != b[0].ID {
+		t.Error("sinks should receive the same event")
+	}
+	if b[1].ID == b[0].ID {
+		t.Error("event IDs should be unique")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		patterns []string
+		typ      string
+		expected bool
+	}{
+		{nil, MessageAccepted, true},
+		{[]string{"*"}, AuthFailed, true},
+		{[]string{"message.*"}, MessageBounced, true},
+		{[]string{"message.*"}, UserCreated, false},
+		{[]string{"user.created", "quota.*"}, QuotaExceeded, true},
+		{[]string{"user.created"}, UserDeleted, false},
+	} {
+		if got := Match(c.patterns, c.typ); got != c.expected {
+			t.Errorf("Match(%v, %s) = %v, expected %v", c.patterns, c.typ, got, c.expected)
+		}
+	}
+}
@@ -33,6 +33,47 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// ProtocolPlainAuth is implemented by PlainAuth modules that can restrict
+// credentials to certain protocols (e.g. application-specific passwords).
+//
+// protocol is the name of the endpoint module that authenticates the user,
+// e.g. "imap" or "submission".
+type ProtocolPlainAuth interface {
+	PlainAuth
+	AuthPlainProtocol(username, password, protocol string) error
+}
+
+// TokenAuth is the interface implemented by modules providing authentication
+// using bearer tokens (e.g. OAuth 2.0 access tokens).
+//
+// AuthToken verifies the token and returns the username it was issued for.
+//
+// Modules implementing this interface should be registered with "auth." prefix in name.
+type TokenAuth interface {
+	AuthToken(token string) (username string, err error)
+}
+
+// SCRAMCredentials is the SCRAM verifier derived from the user password
+// (RFC 5802). The password itself cannot be recovered from it.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMAuth is the interface implemented by modules that store SCRAM-SHA-256
+// verifiers.
+//
+// SCRAMEnabled reports whether verifiers are stored at all, it is checked
+// once to decide whether SCRAM mechanisms should be offered.
+// SCRAMSHA256Credentials returns ErrUnknownCredentials if there is no verifier
+// for the user.
+type SCRAMAuth interface {
+	SCRAMEnabled() bool
+	SCRAMSHA256Credentials(username string) (SCRAMCredentials, error)
+}
+
 // PlainUserDB is a local credentials store that can be managed using maddy command
 // utility.
 type PlainUserDB interface {
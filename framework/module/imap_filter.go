@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"errors"
+
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 )
@@ -37,7 +39,30 @@ type IMAPFilter interface {
 	// Additionally it can add additional IMAP flags to the message by returning
 	// them.
 	//
-	// Errors returned by IMAPFilter will be just logged and will not cause delivery
-	// to fail.
+	// If ErrDiscard is returned, the message is not stored for that recipient.
+	// Other errors returned by IMAPFilter will be just logged and will not cause
+	// delivery to fail.
 	IMAPFilter(accountName string, rcptTo string, meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error)
 }
+
+// DeferredIMAPFilter is implemented by filters that have side effects
+// besides selecting the folder, such as sending new messages.
+//
+// Storage modules that support it should use IMAPFilterDeferred instead of
+// IMAPFilter and call the returned commit function (if it is not nil) only
+// after the message is stored successfully. If the delivery is aborted,
+// commit should not be called. This way side effects are not repeated if
+// the delivery is retried.
+type DeferredIMAPFilter interface {
+	IMAPFilter
+
+	// IMAPFilterDeferred is similar to IMAPFilter but it does not run the side
+	// effects and returns them as commit instead. commit can be non-nil
+	// even if ErrDiscard is returned.
+	IMAPFilterDeferred(accountName string, rcptTo string, meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, commit func(), err error)
+}
+
+// ErrDiscard can be returned by IMAPFilter to drop the message silently for
+// the recipient, e.g. if it was rejected or redirected by the user-defined
+// rules.
+var ErrDiscard = errors.New("imap_filter: message discarded")
@@ -48,3 +48,49 @@ type ManageableStorage interface {
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
 }
+
+// Quota describes resource usage and limits of a storage account.
+// Zero limit means that the resource is not limited.
+type Quota struct {
+	// StorageUsed and StorageLimit are in bytes.
+	StorageUsed  int64
+	StorageLimit int64
+
+	MessagesUsed  int64
+	MessagesLimit int64
+}
+
+// QuotaStorage is an extended Storage interface implemented by backends
+// that enforce per-account quotas.
+//
+// IMAP endpoint uses it to implement the QUOTA extension (RFC 9208) if
+// backend includes "QUOTA" in IMAPExtensions.
+type QuotaStorage interface {
+	Storage
+
+	// GetQuota returns the current usage and limits for the account
+	// specified by the name as returned by imapbackend.User.Username.
+	GetQuota(username string) (Quota, error)
+}
+
+// MailboxQuotaStorage is an extended QuotaStorage interface implemented by
+// backends that also support limits on individual mailboxes.
+type MailboxQuotaStorage interface {
+	QuotaStorage
+
+	// GetMailboxQuota returns the current usage and limits of the mailbox.
+	// Zero limits mean the mailbox is limited only by the account quota.
+	GetMailboxQuota(username, mailbox string) (Quota, error)
+}
+
+// QuotaWarningStorage is an extended QuotaStorage interface implemented by
+// backends that warn accounts about their usage approaching the quota.
+type QuotaWarningStorage interface {
+	QuotaStorage
+
+	// CheckQuotaWarnings sends warnings for thresholds crossed by the
+	// account. Backends call it themselves after SMTP deliveries, frontends
+	// call it after adding messages to the account by other means (e.g.
+	// IMAP APPEND or COPY). Errors are handled by the backend.
+	CheckQuotaWarnings(username string)
+}
@@ -41,3 +41,24 @@ type MutableTable interface {
 	RemoveKey(k string) error
 	SetKey(k, v string) error
 }
+
+// MutableMultiTable is the interface that mutable tables storing multiple
+// values per key can implement to replace all values of the key at once.
+type MutableMultiTable interface {
+	MutableTable
+	MultiTable
+
+	// SetKeyMulti replaces all values of the key. Concurrent lookups should
+	// see either old or new values, never a partial list.
+	SetKeyMulti(k string, values []string) error
+}
+
+// CompareAndSetTable is the interface that mutable tables can implement to
+// update the key only if it was not changed concurrently.
+type CompareAndSetTable interface {
+	MutableTable
+
+	// CompareAndSetKey replaces the value of the key with v only if the
+	// current value is old. It reports whether the value was replaced.
+	CompareAndSetKey(k, old, v string) (bool, error)
+}
@@ -0,0 +1,304 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	// maxJWKSSize limits the size of the key set document.
+	maxJWKSSize = 1 << 20
+	// minReload is the minimal interval between key set reloads triggered
+	// by tokens signed using unknown keys.
+	minReload = time.Minute
+)
+
+var ErrUnknownKey = errors.New("oauth2: no matching key in the key set")
+
+// jwk is the JSON Web Key (RFC 7517) in the form relevant for signature
+// verification.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type publicKey struct {
+	id  string
+	alg string
+	// *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+	key interface{}
+}
+
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := decodeB64(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("malformed modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("malformed exponent: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("malformed x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("malformed y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeB64(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("malformed x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+// parseJWKS parses the JWK set document. Keys not usable for signature
+// verification are skipped.
+func parseJWKS(blob []byte, log log.Logger) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(blob, &set); err != nil {
+		return nil, fmt.Errorf("malformed key set: %w", err)
+	}
+
+	keys := make([]publicKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Msg("skipping key", "kid", k.Kid, "reason", err.Error())
+			continue
+		}
+		keys = append(keys, publicKey{id: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// algMatches reports whether the key can be used to verify signatures made
+// using the JWS algorithm alg.
+func (k publicKey) algMatches(alg string) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	switch k.key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(alg, "ES")
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// keySet is the set of issuer keys loaded from a file or a URL. It is
+// reloaded every refresh interval and when a token is signed using an
+// unknown key (e.g. after the key rotation).
+type keySet struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+	log     log.Logger
+	now     func() time.Time
+
+	lock       sync.Mutex
+	keys       []publicKey
+	loadedAt   time.Time
+	lastReload time.Time
+}
+
+func (ks *keySet) isURL() bool {
+	return strings.HasPrefix(ks.source, "https://") || strings.HasPrefix(ks.source, "http://")
+}
+
+func (ks *keySet) fetch() ([]byte, error) {
+	if !ks.isURL() {
+		return os.ReadFile(ks.source)
+	}
+
+	resp, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// reload replaces the keys with the current contents of the source. The old
+// keys are kept if it fails. lock should be held.
+func (ks *keySet) reload() error {
+	ks.lastReload = ks.now()
+
+	blob, err := ks.fetch()
+	if err != nil {
+		return fmt.Errorf("oauth2: load %s: %w", ks.source, err)
+	}
+	keys, err := parseJWKS(blob, ks.log)
+	if err != nil {
+		return fmt.Errorf("oauth2: load %s: %w", ks.source, err)
+	}
+
+	ks.keys = keys
+	ks.loadedAt = ks.lastReload
+	ks.log.DebugMsg("key set loaded", "source", ks.source, "keys", len(keys))
+	return nil
+}
+
+// Load loads the key set unconditionally.
+func (ks *keySet) Load() error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.reload()
+}
+
+func (ks *keySet) find(kid, alg string) interface{} {
+	var match interface{}
+	for _, k := range ks.keys {
+		if !k.algMatches(alg) {
+			continue
+		}
+		if kid != "" {
+			if k.id == kid {
+				return k.key
+			}
+			continue
+		}
+		// Tokens without kid are accepted only if the choice is
+		// unambiguous.
+		if match != nil {
+			return nil
+		}
+		match = k.key
+	}
+	return match
+}
+
+// Key returns the key with the specified ID usable with the algorithm.
+func (ks *keySet) Key(kid, alg string) (interface{}, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	now := ks.now()
+	canReload := now.Sub(ks.lastReload) >= minReload
+	if canReload && (ks.keys == nil || now.Sub(ks.loadedAt) >= ks.refresh) {
+		if err := ks.reload(); err != nil {
+			ks.log.Error("key set reload failed", err)
+		}
+		canReload = false
+	}
+	if ks.keys == nil {
+		return nil, errKeysUnavailable
+	}
+
+	if key := ks.find(kid, alg); key != nil {
+		return key, nil
+	}
+	if canReload {
+		if err := ks.reload(); err != nil {
+			ks.log.Error("key set reload failed", err)
+		} else if key := ks.find(kid, alg); key != nil {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,243 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package oauth2 implements the auth.oauth2 module that verifies OAuth 2.0
+// bearer tokens issued as signed JWTs (e.g. by an OpenID Connect provider).
+//
+// Tokens are verified offline using the issuer keys (JWKS), no token
+// introspection requests are made.
+package oauth2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/golang-jwt/jwt"
+)
+
+const modName = "auth.oauth2"
+
+var errKeysUnavailable = exterrors.WithTemporary(errors.New("oauth2: issuer keys are not available"), true)
+
+// signingMethods lists accepted JWS algorithms. Symmetric algorithms are not
+// accepted since JWKS publishes only public keys.
+var signingMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+type Auth struct {
+	instName string
+	log      log.Logger
+
+	keys          *keySet
+	issuer        string
+	audience      []string
+	usernameClaim string
+	clockSkew     time.Duration
+
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) > 1 {
+		return nil, fmt.Errorf("%s: at most one inline argument is allowed", modName)
+	}
+	a := &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		now:      time.Now,
+	}
+	a.keys = &keySet{
+		log: a.log,
+		now: func() time.Time { return a.now() },
+	}
+	if len(inlineArgs) == 1 {
+		a.keys.source = inlineArgs[0]
+	}
+	return a, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var fetchTimeout time.Duration
+
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.String("jwks", false, a.keys.source == "", a.keys.source, &a.keys.source)
+	cfg.Duration("jwks_refresh", false, false, time.Hour, &a.keys.refresh)
+	cfg.Duration("jwks_timeout", false, false, 10*time.Second, &fetchTimeout)
+	cfg.String("issuer", false, true, "", &a.issuer)
+	cfg.StringList("audience", false, true, nil, &a.audience)
+	cfg.String("username_claim", false, false, "email", &a.usernameClaim)
+	cfg.Duration("clock_skew", false, false, time.Minute, &a.clockSkew)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if len(a.audience) == 0 {
+		return fmt.Errorf("%s: at least one audience is required", modName)
+	}
+	if a.keys.refresh < minReload {
+		return fmt.Errorf("%s: jwks_refresh should be at least %v", modName, minReload)
+	}
+
+	a.keys.log = a.log
+	a.keys.client = &http.Client{Timeout: fetchTimeout}
+
+	if module.NoRun {
+		return nil
+	}
+
+	if err := a.keys.Load(); err != nil {
+		// The issuer may be temporarily down, keys will be fetched on
+		// the first login then.
+		if a.keys.isURL() {
+			a.log.Error("failed to load keys, will retry later", err)
+			return nil
+		}
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+// AuthToken verifies the signature and claims of the JWT and returns the
+// value of the username claim.
+func (a *Auth) AuthToken(token string) (string, error) {
+	var keyErr error
+	parser := jwt.Parser{
+		ValidMethods: signingMethods,
+		// Checked by checkClaims to allow clock skew.
+		SkipClaimsValidation: true,
+	}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := a.keys.Key(kid, t.Method.Alg())
+		keyErr = err
+		return key, err
+	})
+	if keyErr != nil {
+		return "", fmt.Errorf("%s: %w", modName, keyErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid token: %v: %w", modName, err, module.ErrUnknownCredentials)
+	}
+
+	username, err := a.checkClaims(claims)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %w", modName, err, module.ErrUnknownCredentials)
+	}
+	return username, nil
+}
+
+func numericDate(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	val, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	secs, ok := val.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("malformed %s claim", name)
+	}
+	return time.Unix(int64(secs), 0), true, nil
+}
+
+// audiences returns the aud claim that can be either a string or a list.
+func audiences(claims jwt.MapClaims) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		res := make([]string, 0, len(aud))
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func (a *Auth) checkClaims(claims jwt.MapClaims) (string, error) {
+	now := a.now()
+
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("token has no expiration time")
+	}
+	if now.After(exp.Add(a.clockSkew)) {
+		return "", errors.New("token is expired")
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return "", err
+	}
+	if ok && now.Before(nbf.Add(-a.clockSkew)) {
+		return "", errors.New("token is not valid yet")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return "", fmt.Errorf("unexpected issuer: %s", iss)
+	}
+
+	audOk := false
+	for _, aud := range audiences(claims) {
+		for _, expected := range a.audience {
+			if aud == expected {
+				audOk = true
+			}
+		}
+	}
+	if !audOk {
+		return "", fmt.Errorf("token is not intended for %v", a.audience)
+	}
+
+	username, _ := claims[a.usernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("token has no %s claim", a.usernameClaim)
+	}
+	// Do not trust e-mail addresses the issuer did not verify.
+	if a.usernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "", errors.New("e-mail address is not verified")
+		}
+	}
+	return username, nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,359 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	testIssuer   = "https://sso.example.org"
+	testAudience = "maddy"
+)
+
+var testNow = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   b64(key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64(key.X.FillBytes(make([]byte, 32))),
+		"y":   b64(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func jwks(t *testing.T, keys ...map[string]string) []byte {
+	t.Helper()
+	blob, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            testIssuer,
+		"aud":            []string{"other", testAudience},
+		"exp":            testNow.Add(time.Hour).Unix(),
+		"nbf":            testNow.Add(-time.Minute).Unix(),
+		"sub":            "0d5c7a4e",
+		"email":          "user@example.org",
+		"email_verified": true,
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testAuth(t *testing.T, source string, children ...config.Node) *Auth {
+	t.Helper()
+	mod, err := New(modName, "test", nil, []string{source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	a.now = func() time.Time { return testNow }
+
+	children = append([]config.Node{
+		{Name: "issuer", Args: []string{testIssuer}},
+		{Name: "audience", Args: []string{testAudience}},
+	}, children...)
+	if err := a.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func writeJWKS(t *testing.T, blob []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, blob, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := testAuth(t, writeJWKS(t, jwks(t, rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey))))
+
+	check := func(t *testing.T, token, expectUser string) {
+		t.Helper()
+		username, err := a.AuthToken(token)
+		if expectUser == "" {
+			if err == nil {
+				t.Fatal("expected error, got username", username)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if username != expectUser {
+			t.Fatal("wrong username:", username)
+		}
+	}
+
+	t.Run("RS256", func(t *testing.T) {
+		check(t, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()), "user@example.org")
+	})
+	t.Run("ES256", func(t *testing.T) {
+		check(t, sign(t, jwt.SigningMethodES256, "ec", ecKey, validClaims()), "user@example.org")
+	})
+	t.Run("no kid", func(t *testing.T) {
+		// Only one key matches the algorithm.
+		check(t, sign(t, jwt.SigningMethodES256, "", ecKey, validClaims()), "user@example.org")
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		check(t, sign(t, jwt.SigningMethodRS256, "rsa", otherKey, validClaims()), "")
+	})
+	t.Run("kid of other key type", func(t *testing.T) {
+		check(t, sign(t, jwt.SigningMethodES256, "rsa", ecKey, validClaims()), "")
+	})
+	t.Run("HMAC", func(t *testing.T) {
+		check(t, sign(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), validClaims()), "")
+	})
+	t.Run("garbage", func(t *testing.T) {
+		check(t, "not a token", "")
+	})
+
+	for name, mutate := range map[string]func(c jwt.MapClaims){
+		"wrong issuer":     func(c jwt.MapClaims) { c["iss"] = "https://evil.example.org" },
+		"wrong audience":   func(c jwt.MapClaims) { c["aud"] = "other" },
+		"no audience":      func(c jwt.MapClaims) { delete(c, "aud") },
+		"expired":          func(c jwt.MapClaims) { c["exp"] = testNow.Add(-2 * time.Minute).Unix() },
+		"no expiration":    func(c jwt.MapClaims) { delete(c, "exp") },
+		"not valid yet":    func(c jwt.MapClaims) { c["nbf"] = testNow.Add(2 * time.Minute).Unix() },
+		"no username":      func(c jwt.MapClaims) { delete(c, "email") },
+		"unverified email": func(c jwt.MapClaims) { c["email_verified"] = false },
+	} {
+		mutate := mutate
+		t.Run(name, func(t *testing.T) {
+			claims := validClaims()
+			mutate(claims)
+			check(t, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims), "")
+		})
+	}
+
+	t.Run("clock skew", func(t *testing.T) {
+		claims := validClaims()
+		claims["exp"] = testNow.Add(-30 * time.Second).Unix()
+		claims["aud"] = testAudience
+		check(t, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims), "user@example.org")
+	})
+}
+
+func TestAuthToken_UsernameClaim(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testAuth(t, writeJWKS(t, jwks(t, rsaJWK("rsa", key))),
+		config.Node{Name: "username_claim", Args: []string{"sub"}})
+
+	claims := validClaims()
+	claims["email_verified"] = false
+	username, err := a.AuthToken(sign(t, jwt.SigningMethodRS256, "rsa", key, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "0d5c7a4e" {
+		t.Fatal("wrong username:", username)
+	}
+}
+
+func TestAuthToken_KeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		lock    sync.Mutex
+		current = jwks(t, rsaJWK("old", oldKey))
+		fetches int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		if current == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(current)
+	}))
+	defer srv.Close()
+
+	a := testAuth(t, srv.URL)
+	now := testNow
+	a.now = func() time.Time { return now }
+
+	if _, err := a.AuthToken(sign(t, jwt.SigningMethodRS256, "old", oldKey, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	current = jwks(t, rsaJWK("new", newKey))
+	lock.Unlock()
+
+	// Unknown keys trigger reload at most once per minute.
+	if _, err := a.AuthToken(sign(t, jwt.SigningMethodRS256, "new", newKey, validClaims())); !errors.Is(err, ErrUnknownKey) {
+		t.Fatal("expected ErrUnknownKey, got", err)
+	}
+	now = now.Add(minReload)
+	if _, err := a.AuthToken(sign(t, jwt.SigningMethodRS256, "new", newKey, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthToken(sign(t, jwt.SigningMethodRS256, "old", oldKey, validClaims())); err == nil {
+		t.Fatal("rotated out key should not be accepted")
+	}
+	if fetches != 2 {
+		t.Fatal("wrong number of fetches:", fetches)
+	}
+
+	// Failed reload keeps the old keys.
+	lock.Lock()
+	current = nil
+	lock.Unlock()
+	now = now.Add(2 * time.Hour)
+	claims := validClaims()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	if _, err := a.AuthToken(sign(t, jwt.SigningMethodRS256, "new", newKey, claims)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthToken_KeysUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Init should not fail if the issuer is down.
+	a := testAuth(t, srv.URL)
+	_, err = a.AuthToken(sign(t, jwt.SigningMethodRS256, "rsa", key, validClaims()))
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("expected temporary error, got", err)
+	}
+	if errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("unavailable keys should not be reported as invalid credentials")
+	}
+}
+
+func TestInit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeJWKS(t, jwks(t, rsaJWK("rsa", key)))
+
+	for name, children := range map[string][]config.Node{
+		"no issuer":    {{Name: "audience", Args: []string{testAudience}}},
+		"no audience":  {{Name: "issuer", Args: []string{testIssuer}}},
+		"refresh":      {{Name: "issuer", Args: []string{testIssuer}}, {Name: "audience", Args: []string{testAudience}}, {Name: "jwks_refresh", Args: []string{"1s"}}},
+		"missing file": {{Name: "issuer", Args: []string{testIssuer}}, {Name: "audience", Args: []string{testAudience}}, {Name: "jwks", Args: []string{path + ".missing"}}},
+	} {
+		children := children
+		t.Run(name, func(t *testing.T) {
+			mod, err := New(modName, "test", nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "missing file" {
+				children = append(children, config.Node{Name: "jwks", Args: []string{path}})
+			}
+			if err := mod.(*Auth).Init(config.NewMap(nil, config.Node{Children: children})); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	if _, err := parseJWKS([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`), testutils.Logger(t, modName)); err == nil {
+		t.Fatal("symmetric keys should not be accepted")
+	}
+}
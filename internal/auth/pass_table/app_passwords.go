@@ -0,0 +1,377 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/text/secure/precis"
+)
+
+var (
+	ErrAppPasswordsDisabled = errors.New("pass_table: app passwords are not configured")
+	ErrUnknownAppPassword   = errors.New("pass_table: unknown app password")
+	ErrAppPasswordExists    = errors.New("pass_table: app password already exists")
+	ErrUnknownUser          = errors.New("pass_table: unknown user")
+)
+
+// AppProtocols lists protocols app passwords can be restricted to.
+var AppProtocols = []string{"imap", "smtp", "managesieve"}
+
+const (
+	appPasswordGroups    = 4
+	appPasswordGroupLen  = 4
+	appPasswordAlphabet  = "abcdefghijklmnopqrstuvwxyz"
+	lastUsedUpdatePeriod = time.Minute
+)
+
+// AppPassword describes an application-specific password. The password
+// itself is shown only once, when it is created.
+type AppPassword struct {
+	Name string `json:"name"`
+	// Empty if the password can be used with any protocol.
+	Protocols []string  `json:"protocols,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Zero if the password was never used.
+	LastUsedAt time.Time `json:"last_used_at"`
+	// Zero if the password does not expire. Only session passwords (see
+	// CreateSessionPassword) expire.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// appPasswordRecord is the stored form of AppPassword.
+type appPasswordRecord struct {
+	AppPassword
+	Hash string `json:"hash"`
+}
+
+func (ap AppPassword) expired(now time.Time) bool {
+	return !ap.ExpiresAt.IsZero() && now.After(ap.ExpiresAt)
+}
+
+// AppPasswordsEnabled reports whether the app_passwords table is
+// configured.
+func (a *Auth) AppPasswordsEnabled() bool {
+	return a.appTable != nil
+}
+
+func (a *Auth) mutableAppTable() (module.MutableTable, error) {
+	if a.appTable == nil {
+		return nil, ErrAppPasswordsDisabled
+	}
+	tbl, ok := a.appTable.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: app_passwords table is not mutable, no management functionality available", a.modName)
+	}
+	return tbl, nil
+}
+
+func (a *Auth) readAppPasswords(key string) ([]appPasswordRecord, error) {
+	val, ok, err := a.appTable.Lookup(context.TODO(), key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	return a.parseAppPasswords(key, val)
+}
+
+func (a *Auth) parseAppPasswords(key, val string) ([]appPasswordRecord, error) {
+	var recs []appPasswordRecord
+	if err := json.Unmarshal([]byte(val), &recs); err != nil {
+		return nil, fmt.Errorf("%s: malformed app passwords for %s: %w", a.modName, key, err)
+	}
+	return recs, nil
+}
+
+func (a *Auth) writeAppPasswords(tbl module.MutableTable, key string, recs []appPasswordRecord) error {
+	if len(recs) == 0 {
+		return tbl.RemoveKey(key)
+	}
+	blob, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(key, string(blob))
+}
+
+// normalizeAppPassword removes separators users may or may not type.
+func normalizeAppPassword(pass string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(pass))
+}
+
+func generateAppPassword() (string, error) {
+	var out strings.Builder
+	max := big.NewInt(int64(len(appPasswordAlphabet)))
+	for i := 0; i < appPasswordGroups*appPasswordGroupLen; i++ {
+		if i != 0 && i%appPasswordGroupLen == 0 {
+			out.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		out.WriteByte(appPasswordAlphabet[n.Int64()])
+	}
+	return out.String(), nil
+}
+
+// protocolAllowed checks whether the app password restricted to protocols
+// can be used with the endpoint protocol. Empty protocol means unknown
+// endpoint and is allowed only for unrestricted passwords.
+func protocolAllowed(protocols []string, protocol string) bool {
+	if len(protocols) == 0 {
+		return true
+	}
+	if protocol == "submission" {
+		protocol = "smtp"
+	}
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func isAppProtocol(protocol string) bool {
+	for _, p := range AppProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// authApp checks the password against app passwords of the user. App
+// passwords are random, so salted SHA-256 is used for them to avoid running
+// a slow hash for each one.
+//
+// appLock is not taken here so logins of different users do not wait for
+// each other. Last use time is updated only if the stored list is still the
+// one that was checked, so a password revoked meanwhile (possibly by another
+// process) is never written back.
+func (a *Auth) authApp(key, password, protocol string) error {
+	val, ok, err := a.appTable.Lookup(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return module.ErrUnknownCredentials
+	}
+	recs, err := a.parseAppPasswords(key, val)
+	if err != nil {
+		return err
+	}
+
+	password = normalizeAppPassword(password)
+	now := time.Now()
+	for i, rec := range recs {
+		if verifySHA256(password, rec.Hash) != nil {
+			continue
+		}
+		if rec.expired(now) {
+			return fmt.Errorf("%s: app password %s expired", a.modName, rec.Name)
+		}
+		if !protocolAllowed(rec.Protocols, protocol) {
+			return fmt.Errorf("%s: app password %s cannot be used with %s", a.modName, rec.Name, protocol)
+		}
+
+		if now.Sub(rec.LastUsedAt) < lastUsedUpdatePeriod {
+			return nil
+		}
+		recs[i].LastUsedAt = now.UTC().Truncate(time.Second)
+		if err := a.updateLastUsed(key, val, recs); err != nil {
+			// Not a reason to reject valid credentials.
+			a.log.Error("failed to update app password last use time", err, "username", key, "name", rec.Name)
+		}
+		return nil
+	}
+	return module.ErrUnknownCredentials
+}
+
+// updateLastUsed replaces the app passwords of the user with recs if the
+// stored value is still old. Tables without conditional updates are left as
+// is and last use time is not tracked for them.
+func (a *Auth) updateLastUsed(key, old string, recs []appPasswordRecord) error {
+	tbl, ok := a.appTable.(module.CompareAndSetTable)
+	if !ok {
+		return nil
+	}
+	blob, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	// Not updated if the list was changed concurrently, the next login will
+	// try again.
+	_, err = tbl.CompareAndSetKey(key, old, string(blob))
+	return err
+}
+
+// ListAppPasswords returns app passwords of the user ordered by creation
+// time. Expired session passwords are not included.
+func (a *Auth) ListAppPasswords(username string) ([]AppPassword, error) {
+	if a.appTable == nil {
+		return nil, ErrAppPasswordsDisabled
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return nil, fmt.Errorf("%s: list app passwords %s (raw): %w", a.modName, username, err)
+	}
+
+	a.appLock.Lock()
+	defer a.appLock.Unlock()
+
+	recs, err := a.readAppPasswords(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: list app passwords %s: %w", a.modName, key, err)
+	}
+	res := make([]AppPassword, 0, len(recs))
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.expired(now) {
+			continue
+		}
+		res = append(res, rec.AppPassword)
+	}
+	return res, nil
+}
+
+// CreateAppPassword generates a new app password for the existing user and
+// returns its description and the password itself. protocols restrict its
+// use to the listed protocols (see AppProtocols), nil allows any.
+func (a *Auth) CreateAppPassword(username, name string, protocols []string) (AppPassword, string, error) {
+	if _, err := a.mutableAppTable(); err != nil {
+		return AppPassword{}, "", err
+	}
+	if name == "" {
+		return AppPassword{}, "", fmt.Errorf("%s: empty app password name", a.modName)
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create app password %s (raw): %w", a.modName, username, err)
+	}
+	_, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	if !ok {
+		return AppPassword{}, "", ErrUnknownUser
+	}
+
+	return a.createAppPassword(key, name, protocols, time.Time{})
+}
+
+// createAppPassword adds the app password for the existing user identified
+// by the normalized key. Expired passwords of the user are removed.
+func (a *Auth) createAppPassword(key, name string, protocols []string, expiresAt time.Time) (AppPassword, string, error) {
+	tbl, err := a.mutableAppTable()
+	if err != nil {
+		return AppPassword{}, "", err
+	}
+	for _, p := range protocols {
+		if !isAppProtocol(p) {
+			return AppPassword{}, "", fmt.Errorf("%s: unknown protocol: %s", a.modName, p)
+		}
+	}
+
+	a.appLock.Lock()
+	defer a.appLock.Unlock()
+
+	recs, err := a.readAppPasswords(key)
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	now := time.Now()
+	valid := recs[:0]
+	for _, rec := range recs {
+		if rec.expired(now) {
+			continue
+		}
+		if rec.Name == name {
+			return AppPassword{}, "", ErrAppPasswordExists
+		}
+		valid = append(valid, rec)
+	}
+	recs = valid
+
+	pass, err := generateAppPassword()
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	hash, err := computeSHA256(HashOpts{}, normalizeAppPassword(pass))
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+
+	ap := AppPassword{
+		Name:      name,
+		Protocols: protocols,
+		CreatedAt: now.UTC().Truncate(time.Second),
+		ExpiresAt: expiresAt,
+	}
+	recs = append(recs, appPasswordRecord{AppPassword: ap, Hash: hash})
+	if err := a.writeAppPasswords(tbl, key, recs); err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create app password %s: %w", a.modName, key, err)
+	}
+	return ap, pass, nil
+}
+
+// DeleteAppPassword revokes the app password of the user.
+func (a *Auth) DeleteAppPassword(username, name string) error {
+	tbl, err := a.mutableAppTable()
+	if err != nil {
+		return err
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: del app password %s (raw): %w", a.modName, username, err)
+	}
+
+	a.appLock.Lock()
+	defer a.appLock.Unlock()
+
+	recs, err := a.readAppPasswords(key)
+	if err != nil {
+		return fmt.Errorf("%s: del app password %s: %w", a.modName, key, err)
+	}
+	for i, rec := range recs {
+		if rec.Name != name {
+			continue
+		}
+		recs = append(recs[:i], recs[i+1:]...)
+		if err := a.writeAppPasswords(tbl, key, recs); err != nil {
+			return fmt.Errorf("%s: del app password %s: %w", a.modName, key, err)
+		}
+		return nil
+	}
+	return ErrUnknownAppPassword
+}
@@ -0,0 +1,213 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	// scramPrefix is the scheme name used in the stored verifier, the
+	// format is the one defined in RFC 5803 and used by PostgreSQL:
+	// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+	scramPrefix = "SCRAM-SHA-256"
+
+	// DefaultSCRAMIterations is the minimal iteration count recommended by
+	// RFC 7677.
+	DefaultSCRAMIterations = 4096
+	scramSaltSize          = 16
+)
+
+// ComputeSCRAM derives SCRAM-SHA-256 verifiers from the password.
+func ComputeSCRAM(password string, iterations int) (module.SCRAMCredentials, error) {
+	salt := make([]byte, scramSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return module.SCRAMCredentials{}, fmt.Errorf("pass_table: failed to generate salt: %w", err)
+	}
+
+	// RFC 5802 requires SASLprep, OpaqueString is its PRECIS replacement.
+	// Passwords that cannot be prepared are used as is.
+	if prepared, err := precis.OpaqueString.String(password); err == nil {
+		password = prepared
+	}
+
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return module.SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func formatSCRAM(creds module.SCRAMCredentials) string {
+	enc := base64.StdEncoding.EncodeToString
+	return scramPrefix + "$" + strconv.Itoa(creds.Iterations) + ":" + enc(creds.Salt) +
+		"$" + enc(creds.StoredKey) + ":" + enc(creds.ServerKey)
+}
+
+func parseSCRAM(s string) (module.SCRAMCredentials, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != scramPrefix {
+		return module.SCRAMCredentials{}, errors.New("pass_table: malformed SCRAM verifier")
+	}
+	iterSalt := strings.Split(parts[1], ":")
+	keys := strings.Split(parts[2], ":")
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return module.SCRAMCredentials{}, errors.New("pass_table: malformed SCRAM verifier")
+	}
+
+	var (
+		creds module.SCRAMCredentials
+		err   error
+	)
+	creds.Iterations, err = strconv.Atoi(iterSalt[0])
+	if err != nil || creds.Iterations <= 0 {
+		return module.SCRAMCredentials{}, errors.New("pass_table: malformed SCRAM verifier iteration count")
+	}
+	for _, f := range []struct {
+		val string
+		out *[]byte
+	}{
+		{iterSalt[1], &creds.Salt},
+		{keys[0], &creds.StoredKey},
+		{keys[1], &creds.ServerKey},
+	} {
+		*f.out, err = base64.StdEncoding.DecodeString(f.val)
+		if err != nil {
+			return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM verifier: %w", err)
+		}
+	}
+	return creds, nil
+}
+
+// SCRAMEnabled reports whether the scram_verifiers table is configured.
+func (a *Auth) SCRAMEnabled() bool {
+	return a.scramTable != nil
+}
+
+// SCRAMSHA256Credentials returns stored SCRAM-SHA-256 verifiers of the user.
+func (a *Auth) SCRAMSHA256Credentials(username string) (module.SCRAMCredentials, error) {
+	if a.scramTable == nil {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+
+	// Verifiers of deleted users may be left in the table if it is
+	// managed externally.
+	_, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+
+	// Verifiers are derived from the main password.
+	required, err := a.totpRequired(key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if required {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+
+	val, ok, err := a.scramTable.Lookup(context.TODO(), key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+	creds, err := parseSCRAM(val)
+	if err != nil {
+		return module.SCRAMCredentials{}, fmt.Errorf("%s: %s: %w", a.modName, key, err)
+	}
+	return creds, nil
+}
+
+// setSCRAM stores verifiers for the password if scram_verifiers table is
+// configured.
+func (a *Auth) setSCRAM(key, password string) error {
+	if a.scramTable == nil {
+		return nil
+	}
+	tbl, ok := a.scramTable.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("%s: scram_verifiers table is not mutable", a.modName)
+	}
+
+	creds, err := ComputeSCRAM(password, a.scramIterations)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(key, formatSCRAM(creds))
+}
+
+// upgradeSCRAM generates verifiers for the user that logged in using the
+// password if they are missing or use a different iteration count. It is
+// how users created before scram_verifiers was configured get them.
+func (a *Auth) upgradeSCRAM(key, password string) {
+	if _, ok := a.scramTable.(module.MutableTable); !ok {
+		return
+	}
+
+	val, ok, err := a.scramTable.Lookup(context.TODO(), key)
+	if err != nil {
+		a.log.Error("failed to read SCRAM verifiers", err, "username", key)
+		return
+	}
+	if ok {
+		if creds, err := parseSCRAM(val); err == nil && creds.Iterations == a.scramIterations {
+			return
+		}
+	}
+
+	// Not a reason to reject valid credentials.
+	if err := a.setSCRAM(key, password); err != nil {
+		a.log.Error("failed to store SCRAM verifiers", err, "username", key)
+		return
+	}
+	a.log.DebugMsg("SCRAM verifiers generated", "username", key)
+}
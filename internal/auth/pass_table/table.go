@@ -20,11 +20,14 @@ package pass_table
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
@@ -34,8 +37,24 @@ type Auth struct {
 	modName    string
 	instName   string
 	inlineArgs []string
+	log        log.Logger
 
 	table module.Table
+
+	// appTable stores app passwords as a JSON list per user, nil if app
+	// passwords are not configured.
+	appTable module.Table
+	appLock  sync.Mutex
+
+	// scramTable stores SCRAM-SHA-256 verifiers, nil if SCRAM is not
+	// configured.
+	scramTable      module.Table
+	scramIterations int
+
+	// totpTable stores TOTP settings as a JSON object per user, nil if
+	// TOTP is not configured.
+	totpTable module.Table
+	totpLock  sync.Mutex
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -43,6 +62,7 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 		modName:    modName,
 		instName:   instName,
 		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
 	}, nil
 }
 
@@ -52,8 +72,17 @@ func (a *Auth) Init(cfg *config.Map) error {
 	}
 
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
-	_, err := cfg.Process()
-	return err
+	cfg.Custom("app_passwords", false, false, nil, modconfig.TableDirective, &a.appTable)
+	cfg.Custom("scram_verifiers", false, false, nil, modconfig.TableDirective, &a.scramTable)
+	cfg.Int("scram_iterations", false, false, DefaultSCRAMIterations, &a.scramIterations)
+	cfg.Custom("totp", false, false, nil, modconfig.TableDirective, &a.totpTable)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if a.scramIterations < DefaultSCRAMIterations {
+		return fmt.Errorf("%s: scram_iterations should be at least %d", a.modName, DefaultSCRAMIterations)
+	}
+	return nil
 }
 
 func (a *Auth) Name() string {
@@ -74,6 +103,13 @@ func (a *Auth) Lookup(ctx context.Context, username string) (string, bool, error
 }
 
 func (a *Auth) AuthPlain(username, password string) error {
+	return a.AuthPlainProtocol(username, password, "")
+}
+
+// AuthPlainProtocol checks the main password or app passwords of the user,
+// app passwords restricted to other protocols are rejected. The main
+// password of users with TOTP enabled is rejected with ErrTOTPRequired.
+func (a *Auth) AuthPlainProtocol(username, password, protocol string) error {
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
 		return err
@@ -87,6 +123,38 @@ func (a *Auth) AuthPlain(username, password string) error {
 		return err
 	}
 
+	if a.appTable != nil {
+		err := a.authApp(key, password, protocol)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, module.ErrUnknownCredentials) {
+			return err
+		}
+	}
+
+	if err := a.verifyHash(key, hash, password); err != nil {
+		return err
+	}
+
+	// Checked after the password so the TOTP status is not revealed to
+	// clients that don't know it.
+	required, err := a.totpRequired(key)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrTOTPRequired
+	}
+
+	if a.scramTable != nil {
+		a.upgradeSCRAM(key, password)
+	}
+	return nil
+}
+
+// verifyHash checks the password against the stored main password hash.
+func (a *Auth) verifyHash(key, hash, password string) error {
 	parts := strings.SplitN(hash, ":", 2)
 	if len(parts) != 2 {
 		return fmt.Errorf("%s: auth plain %s: no hash tag", a.modName, key)
@@ -148,6 +216,9 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 	if err := tbl.SetKey(key, hashAlgo+":"+hash); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
+	if err := a.setSCRAM(key, password); err != nil {
+		return fmt.Errorf("%s: create user %s: SCRAM verifiers: %w", a.modName, key, err)
+	}
 	return nil
 }
 
@@ -173,6 +244,9 @@ func (a *Auth) SetUserPassword(username, password string) error {
 	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
+	if err := a.setSCRAM(key, password); err != nil {
+		return fmt.Errorf("%s: set password %s: SCRAM verifiers: %w", a.modName, key, err)
+	}
 	return nil
 }
 
@@ -190,6 +264,21 @@ func (a *Auth) DeleteUser(username string) error {
 	if err := tbl.RemoveKey(key); err != nil {
 		return fmt.Errorf("%s: del user %s: %w", a.modName, key, err)
 	}
+	if appTbl, ok := a.appTable.(module.MutableTable); ok {
+		if err := appTbl.RemoveKey(key); err != nil {
+			return fmt.Errorf("%s: del user %s: app passwords: %w", a.modName, key, err)
+		}
+	}
+	if scramTbl, ok := a.scramTable.(module.MutableTable); ok {
+		if err := scramTbl.RemoveKey(key); err != nil {
+			return fmt.Errorf("%s: del user %s: SCRAM verifiers: %w", a.modName, key, err)
+		}
+	}
+	if totpTbl, ok := a.totpTable.(module.MutableTable); ok {
+		if err := totpTbl.RemoveKey(key); err != nil {
+			return fmt.Errorf("%s: del user %s: TOTP: %w", a.modName, key, err)
+		}
+	}
 	return nil
 }
 
@@ -19,10 +19,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/totp"
 	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func TestAuth_AuthPlain(t *testing.T) {
@@ -62,3 +72,401 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) CompareAndSetKey(k, old, v string) (bool, error) {
+	if cur, ok := m.M[k]; !ok || cur != old {
+		return false, nil
+	}
+	m.M[k] = v
+	return true, nil
+}
+
+// racingTable calls onLookup once after reading the value to simulate a
+// change made concurrently by another process.
+type racingTable struct {
+	mutableTable
+	onLookup func()
+}
+
+func (r *racingTable) Lookup(ctx context.Context, k string) (string, bool, error) {
+	v, ok, err := r.mutableTable.Lookup(ctx, k)
+	if f := r.onLookup; f != nil {
+		r.onLookup = nil
+		f()
+	}
+	return v, ok, err
+}
+
+func TestAuth_AppPasswords(t *testing.T) {
+	a := &Auth{
+		modName: "pass_table",
+		log:     testutils.Logger(t, "pass_table"),
+		table: mutableTable{testutils.Table{M: map[string]string{
+			"foxcpp": "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
+		}}},
+	}
+
+	if _, _, err := a.CreateAppPassword("foxcpp", "phone", nil); !errors.Is(err, ErrAppPasswordsDisabled) {
+		t.Fatal("expected ErrAppPasswordsDisabled, got", err)
+	}
+	a.appTable = mutableTable{testutils.Table{M: map[string]string{}}}
+
+	_, phonePass, err := a.CreateAppPassword("foxcpp", "phone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap, imapPass, err := a.CreateAppPassword("FOXCPP", "calendar", []string{"imap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.Name != "calendar" || ap.CreatedAt.IsZero() {
+		t.Fatalf("wrong app password: %+v", ap)
+	}
+	if _, _, err := a.CreateAppPassword("foxcpp", "phone", nil); !errors.Is(err, ErrAppPasswordExists) {
+		t.Fatal("expected ErrAppPasswordExists, got", err)
+	}
+	if _, _, err := a.CreateAppPassword("foxcpp", "tablet", []string{"pop3"}); err == nil {
+		t.Fatal("expected error for unknown protocol")
+	}
+	if _, _, err := a.CreateAppPassword("not-foxcpp", "phone", nil); !errors.Is(err, ErrUnknownUser) {
+		t.Fatal("expected ErrUnknownUser, got", err)
+	}
+
+	check := func(pass, protocol string, ok bool) {
+		t.Helper()
+
+		err := a.AuthPlainProtocol("foxcpp", pass, protocol)
+		if (err == nil) != ok {
+			t.Errorf("pass=%s protocol=%s ok=%v, err: %v", pass, protocol, ok, err)
+		}
+	}
+
+	check("password", "submission", true)
+	check(phonePass, "submission", true)
+	check(strings.ToUpper(strings.ReplaceAll(phonePass, "-", "")), "imap", true)
+	check(imapPass, "imap", true)
+	check(imapPass, "submission", false)
+	check(imapPass, "", false)
+	check("different-password", "imap", false)
+
+	list, err := a.ListAppPasswords("foxcpp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "phone" || list[0].LastUsedAt.IsZero() ||
+		list[1].Name != "calendar" || !reflect.DeepEqual(list[1].Protocols, []string{"imap"}) {
+		t.Fatalf("wrong app passwords: %+v", list)
+	}
+
+	if err := a.DeleteAppPassword("foxcpp", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteAppPassword("foxcpp", "phone"); !errors.Is(err, ErrUnknownAppPassword) {
+		t.Fatal("expected ErrUnknownAppPassword, got", err)
+	}
+	check(phonePass, "imap", false)
+
+	if err := a.DeleteUser("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := a.ListAppPasswords("foxcpp"); err != nil || len(list) != 0 {
+		t.Fatal("app passwords should be removed with the user:", list, err)
+	}
+}
+
+func TestAuth_AppPasswordRevokedDuringLogin(t *testing.T) {
+	users := mutableTable{testutils.Table{M: map[string]string{
+		"foxcpp": "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
+	}}}
+	apps := mutableTable{testutils.Table{M: map[string]string{}}}
+	a := &Auth{
+		modName:  "pass_table",
+		log:      testutils.Logger(t, "pass_table"),
+		table:    users,
+		appTable: apps,
+	}
+	// Another process sharing the same tables, e.g. 'maddy creds'.
+	cli := &Auth{
+		modName:  "pass_table",
+		log:      testutils.Logger(t, "pass_table"),
+		table:    users,
+		appTable: apps,
+	}
+
+	_, phonePass, err := a.CreateAppPassword("foxcpp", "phone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.CreateAppPassword("foxcpp", "calendar", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	a.appTable = &racingTable{mutableTable: apps, onLookup: func() {
+		if err := cli.DeleteAppPassword("foxcpp", "phone"); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if err := a.AuthPlainProtocol("foxcpp", phonePass, "imap"); err != nil {
+		t.Fatal("login checked before the revocation should succeed:", err)
+	}
+
+	list, err := a.ListAppPasswords("foxcpp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "calendar" {
+		t.Fatalf("revoked app password was written back: %+v", list)
+	}
+	if err := a.AuthPlainProtocol("foxcpp", phonePass, "imap"); err == nil {
+		t.Fatal("revoked app password should be rejected")
+	}
+}
+
+func TestAuth_SCRAM(t *testing.T) {
+	a := &Auth{
+		modName: "pass_table",
+		log:     testutils.Logger(t, "pass_table"),
+		table: mutableTable{testutils.Table{M: map[string]string{
+			"foxcpp": "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
+		}}},
+		appTable: mutableTable{testutils.Table{M: map[string]string{}}},
+	}
+	if a.SCRAMEnabled() {
+		t.Fatal("SCRAM should be disabled without the table")
+	}
+	scramTable := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.scramTable = scramTable
+	a.scramIterations = DefaultSCRAMIterations
+
+	matches := func(username, password string) bool {
+		t.Helper()
+		creds, err := a.SCRAMSHA256Credentials(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		salted := pbkdf2.Key([]byte(password), creds.Salt, creds.Iterations, sha256.Size, sha256.New)
+		storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+		return bytes.Equal(storedKey[:], creds.StoredKey) &&
+			bytes.Equal(scramHMAC(salted, "Server Key"), creds.ServerKey)
+	}
+
+	if _, err := a.SCRAMSHA256Credentials("foxcpp"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("expected ErrUnknownCredentials, got", err)
+	}
+
+	// Verifiers are not generated from wrong or app passwords.
+	_, appPass, err := a.CreateAppPassword("foxcpp", "phone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", appPass); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", "different-password"); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(scramTable.M) != 0 {
+		t.Fatal("unexpected verifiers:", scramTable.M)
+	}
+
+	// Existing users get verifiers on the next login.
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(scramTable.M["foxcpp"], "SCRAM-SHA-256$4096:") {
+		t.Fatal("wrong verifier:", scramTable.M["foxcpp"])
+	}
+	if !matches("FOXCPP", "password") {
+		t.Fatal("verifier does not match the password")
+	}
+	prev := scramTable.M["foxcpp"]
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if scramTable.M["foxcpp"] != prev {
+		t.Fatal("verifiers should not be regenerated")
+	}
+
+	if err := a.SetUserPassword("foxcpp", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if !matches("foxcpp", "password2") {
+		t.Fatal("verifier should be updated with the password")
+	}
+	if err := a.CreateUser("foxcpp2", "password3"); err != nil {
+		t.Fatal(err)
+	}
+	if !matches("foxcpp2", "password3") {
+		t.Fatal("verifier should be created with the user")
+	}
+
+	if err := a.DeleteUser("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := scramTable.M["foxcpp"]; ok {
+		t.Fatal("verifiers should be removed with the user")
+	}
+
+	// Verifiers of users removed from the main table are ignored.
+	scramTable.M["ghost"] = scramTable.M["foxcpp2"]
+	if _, err := a.SCRAMSHA256Credentials("ghost"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("expected ErrUnknownCredentials, got", err)
+	}
+}
+
+func TestAuth_TOTP(t *testing.T) {
+	a := &Auth{
+		modName: "pass_table",
+		log:     testutils.Logger(t, "pass_table"),
+		table: mutableTable{testutils.Table{M: map[string]string{
+			"foxcpp": "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
+		}}},
+		appTable:        mutableTable{testutils.Table{M: map[string]string{}}},
+		scramTable:      mutableTable{testutils.Table{M: map[string]string{}}},
+		scramIterations: DefaultSCRAMIterations,
+	}
+	if _, _, err := a.EnrollTOTP("foxcpp"); !errors.Is(err, ErrTOTPNotConfigured) {
+		t.Fatal("expected ErrTOTPNotConfigured, got", err)
+	}
+	totpTable := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.totpTable = totpTable
+
+	secret, _, err := a.EnrollTOTP("FOXCPP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.EnrollTOTP("not-foxcpp"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatal("expected ErrUnknownUser, got", err)
+	}
+
+	// Pending enrollment does not affect logins.
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SCRAMSHA256Credentials("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.CreateSessionPassword("foxcpp", "password", "123456", nil, 0); !errors.Is(err, ErrTOTPDisabled) {
+		t.Fatal("expected ErrTOTPDisabled, got", err)
+	}
+
+	// Previous step, so the current code can be used below.
+	code, err := totp.Code(secret, time.Now().Add(-totp.Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ConfirmTOTP("foxcpp", code); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := a.GetTOTPStatus("foxcpp"); err != nil || !status.Enabled {
+		t.Fatal("wrong status:", status, err)
+	}
+
+	if err := a.AuthPlain("foxcpp", "password"); !errors.Is(err, ErrTOTPRequired) {
+		t.Fatal("expected ErrTOTPRequired, got", err)
+	}
+	if err := a.AuthPlain("foxcpp", "wrong-password"); errors.Is(err, ErrTOTPRequired) {
+		t.Fatal("TOTP status should not be revealed for wrong password")
+	}
+	if _, err := a.SCRAMSHA256Credentials("foxcpp"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("SCRAM should not be available with TOTP enabled, got", err)
+	}
+
+	// Regular app passwords still work.
+	_, appPass, err := a.CreateAppPassword("foxcpp", "phone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", appPass); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.CreateSessionPassword("foxcpp", "password", code, nil, 0); !errors.Is(err, ErrInvalidOTP) {
+		t.Fatal("used code should be rejected, got", err)
+	}
+	code, err = totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.CreateSessionPassword("foxcpp", "wrong-password", code, nil, 0); err == nil {
+		t.Fatal("expected error for wrong password")
+	}
+	if _, _, err := a.CreateSessionPassword("foxcpp", "password", code, nil, MaxSessionTTL+time.Hour); err == nil {
+		t.Fatal("expected error for too long session")
+	}
+	ap, sessionPass, err := a.CreateSessionPassword("foxcpp", "password", code, []string{"imap"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ap.Name, "session-") || ap.ExpiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("wrong session password: %+v", ap)
+	}
+	if err := a.AuthPlainProtocol("foxcpp", sessionPass, "imap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlainProtocol("foxcpp", sessionPass, "submission"); err == nil {
+		t.Fatal("session password restricted to imap should be rejected for submission")
+	}
+
+	// Expired passwords are rejected, hidden and removed on the next
+	// creation.
+	_, expiredPass, err := a.createAppPassword("foxcpp", "old-session", nil, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", expiredPass); err == nil {
+		t.Fatal("expired password should be rejected")
+	}
+	list, err := a.ListAppPasswords("foxcpp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatal("wrong list:", list)
+	}
+	if _, _, err := a.CreateAppPassword("foxcpp", "old-session", nil); err != nil {
+		t.Fatal("expired password name should be reusable:", err)
+	}
+
+	if err := a.DisableTOTP("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DisableTOTP("foxcpp"); !errors.Is(err, ErrTOTPDisabled) {
+		t.Fatal("expected ErrTOTPDisabled, got", err)
+	}
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.EnrollTOTP("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteUser("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(totpTable.M) != 0 {
+		t.Fatal("TOTP settings are not removed with the user")
+	}
+}
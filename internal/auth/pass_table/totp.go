@@ -0,0 +1,340 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/totp"
+	"golang.org/x/text/secure/precis"
+)
+
+var (
+	ErrTOTPNotConfigured = errors.New("pass_table: totp is not configured")
+	ErrTOTPEnabled       = errors.New("pass_table: TOTP is already enabled")
+	ErrTOTPDisabled      = errors.New("pass_table: TOTP is not enabled")
+	ErrTOTPNotEnrolled   = errors.New("pass_table: TOTP enrollment is not started")
+	ErrInvalidOTP        = errors.New("pass_table: invalid one-time code")
+
+	// ErrTOTPRequired is returned by AuthPlain if the main password is
+	// correct but the user has TOTP enabled.
+	ErrTOTPRequired = errors.New("pass_table: main password cannot be used with TOTP enabled")
+)
+
+const (
+	totpIssuer = "maddy"
+
+	// DefaultSessionTTL and MaxSessionTTL limit the lifetime of session
+	// passwords issued by CreateSessionPassword.
+	DefaultSessionTTL = 12 * time.Hour
+	MaxSessionTTL     = 30 * 24 * time.Hour
+)
+
+// TOTPStatus describes the second factor configuration of a user.
+type TOTPStatus struct {
+	Enabled bool
+	// Pending is true if enrollment is started but not confirmed yet.
+	Pending bool
+}
+
+// totpRecord is the stored TOTP state of the user.
+type totpRecord struct {
+	Secret      string    `json:"secret"`
+	Enabled     bool      `json:"enabled"`
+	LastCounter int64     `json:"last_counter"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TOTPConfigured reports whether the totp table is configured.
+func (a *Auth) TOTPConfigured() bool {
+	return a.totpTable != nil
+}
+
+func (a *Auth) mutableTOTPTable() (module.MutableTable, error) {
+	if a.totpTable == nil {
+		return nil, ErrTOTPNotConfigured
+	}
+	tbl, ok := a.totpTable.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: totp table is not mutable, no management functionality available", a.modName)
+	}
+	return tbl, nil
+}
+
+func (a *Auth) readTOTP(key string) (*totpRecord, error) {
+	val, ok, err := a.totpTable.Lookup(context.TODO(), key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	var rec totpRecord
+	if err := json.Unmarshal([]byte(val), &rec); err != nil {
+		return nil, fmt.Errorf("%s: malformed TOTP settings for %s: %w", a.modName, key, err)
+	}
+	return &rec, nil
+}
+
+func (a *Auth) writeTOTP(tbl module.MutableTable, key string, rec *totpRecord) error {
+	blob, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(key, string(blob))
+}
+
+// totpRequired reports whether the main password of the user should be
+// rejected.
+func (a *Auth) totpRequired(key string) (bool, error) {
+	if a.totpTable == nil {
+		return false, nil
+	}
+	rec, err := a.readTOTP(key)
+	if err != nil {
+		return false, err
+	}
+	return rec != nil && rec.Enabled, nil
+}
+
+// userKey normalizes the username and checks that the user exists.
+func (a *Auth) userKey(username string) (string, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return "", err
+	}
+	_, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrUnknownUser
+	}
+	return key, nil
+}
+
+func (a *Auth) GetTOTPStatus(username string) (TOTPStatus, error) {
+	if a.totpTable == nil {
+		return TOTPStatus{}, ErrTOTPNotConfigured
+	}
+	key, err := a.userKey(username)
+	if err != nil {
+		return TOTPStatus{}, fmt.Errorf("%s: totp status %s: %w", a.modName, username, err)
+	}
+
+	rec, err := a.readTOTP(key)
+	if err != nil {
+		return TOTPStatus{}, fmt.Errorf("%s: totp status %s: %w", a.modName, key, err)
+	}
+	if rec == nil {
+		return TOTPStatus{}, nil
+	}
+	return TOTPStatus{Enabled: rec.Enabled, Pending: !rec.Enabled}, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. It is not required
+// until the enrollment is confirmed using ConfirmTOTP, calling EnrollTOTP
+// again replaces the pending secret.
+//
+// The returned URI is for authenticator apps (usually shown as a QR code).
+func (a *Auth) EnrollTOTP(username string) (secret, uri string, err error) {
+	tbl, err := a.mutableTOTPTable()
+	if err != nil {
+		return "", "", err
+	}
+	key, err := a.userKey(username)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: enroll totp %s: %w", a.modName, username, err)
+	}
+
+	a.totpLock.Lock()
+	defer a.totpLock.Unlock()
+
+	rec, err := a.readTOTP(key)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: enroll totp %s: %w", a.modName, key, err)
+	}
+	if rec != nil && rec.Enabled {
+		return "", "", ErrTOTPEnabled
+	}
+
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", fmt.Errorf("%s: enroll totp %s: %w", a.modName, key, err)
+	}
+	rec = &totpRecord{
+		Secret:    secret,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := a.writeTOTP(tbl, key, rec); err != nil {
+		return "", "", fmt.Errorf("%s: enroll totp %s: %w", a.modName, key, err)
+	}
+	return secret, totp.KeyURI(totpIssuer, key, secret), nil
+}
+
+// ConfirmTOTP enables the second factor if the code matches the pending
+// secret. After that, the main password is accepted only by
+// CreateSessionPassword.
+func (a *Auth) ConfirmTOTP(username, code string) error {
+	tbl, err := a.mutableTOTPTable()
+	if err != nil {
+		return err
+	}
+	key, err := a.userKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: confirm totp %s: %w", a.modName, username, err)
+	}
+
+	a.totpLock.Lock()
+	defer a.totpLock.Unlock()
+
+	rec, err := a.readTOTP(key)
+	if err != nil {
+		return fmt.Errorf("%s: confirm totp %s: %w", a.modName, key, err)
+	}
+	if rec == nil {
+		return ErrTOTPNotEnrolled
+	}
+	if rec.Enabled {
+		return ErrTOTPEnabled
+	}
+
+	counter, err := totp.Validate(rec.Secret, code, time.Now(), 0)
+	if err != nil {
+		return ErrInvalidOTP
+	}
+	rec.Enabled = true
+	rec.LastCounter = counter
+	if err := a.writeTOTP(tbl, key, rec); err != nil {
+		return fmt.Errorf("%s: confirm totp %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
+// DisableTOTP removes the second factor of the user, including the pending
+// enrollment. Session passwords issued before are kept until they expire.
+func (a *Auth) DisableTOTP(username string) error {
+	tbl, err := a.mutableTOTPTable()
+	if err != nil {
+		return err
+	}
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: disable totp %s (raw): %w", a.modName, username, err)
+	}
+
+	a.totpLock.Lock()
+	defer a.totpLock.Unlock()
+
+	rec, err := a.readTOTP(key)
+	if err != nil {
+		return fmt.Errorf("%s: disable totp %s: %w", a.modName, key, err)
+	}
+	if rec == nil {
+		return ErrTOTPDisabled
+	}
+	if err := tbl.RemoveKey(key); err != nil {
+		return fmt.Errorf("%s: disable totp %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
+// useTOTP checks the code for the user with TOTP enabled, each code is
+// accepted only once.
+func (a *Auth) useTOTP(tbl module.MutableTable, key, code string) error {
+	a.totpLock.Lock()
+	defer a.totpLock.Unlock()
+
+	rec, err := a.readTOTP(key)
+	if err != nil {
+		return err
+	}
+	if rec == nil || !rec.Enabled {
+		return ErrTOTPDisabled
+	}
+
+	counter, err := totp.Validate(rec.Secret, code, time.Now(), rec.LastCounter)
+	if err != nil {
+		return ErrInvalidOTP
+	}
+	rec.LastCounter = counter
+	return a.writeTOTP(tbl, key, rec)
+}
+
+// CreateSessionPassword checks the main password and the TOTP code of the
+// user and issues an app password that expires after ttl. It is how users
+// with TOTP enabled log in using mail clients that don't support
+// OAUTHBEARER.
+//
+// protocols restrict the password use the same way as for
+// CreateAppPassword. Zero ttl means DefaultSessionTTL.
+func (a *Auth) CreateSessionPassword(username, password, code string, protocols []string, ttl time.Duration) (AppPassword, string, error) {
+	tbl, err := a.mutableTOTPTable()
+	if err != nil {
+		return AppPassword{}, "", err
+	}
+	if _, err := a.mutableAppTable(); err != nil {
+		return AppPassword{}, "", err
+	}
+	if ttl == 0 {
+		ttl = DefaultSessionTTL
+	}
+	if ttl < 0 || ttl > MaxSessionTTL {
+		return AppPassword{}, "", fmt.Errorf("%s: session lifetime should be between 0 and %v", a.modName, MaxSessionTTL)
+	}
+	// Checked before the code is used.
+	for _, p := range protocols {
+		if !isAppProtocol(p) {
+			return AppPassword{}, "", fmt.Errorf("%s: unknown protocol: %s", a.modName, p)
+		}
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create session %s (raw): %w", a.modName, username, err)
+	}
+	hash, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create session %s: %w", a.modName, key, err)
+	}
+	if !ok {
+		return AppPassword{}, "", module.ErrUnknownCredentials
+	}
+	if err := a.verifyHash(key, hash, password); err != nil {
+		return AppPassword{}, "", err
+	}
+	if err := a.useTOTP(tbl, key, code); err != nil {
+		return AppPassword{}, "", err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return AppPassword{}, "", fmt.Errorf("%s: create session %s: %w", a.modName, key, err)
+	}
+	now := time.Now().UTC()
+	name := "session-" + now.Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+	return a.createAppPassword(key, name, protocols, now.Add(ttl).Truncate(time.Second))
+}
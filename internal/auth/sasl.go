@@ -20,6 +20,7 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -27,8 +28,11 @@ import (
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
 	"github.com/foxcpp/maddy/internal/authz"
 )
 
@@ -49,10 +53,19 @@ type SASLAuth struct {
 	Log         log.Logger
 	OnlyFirstID bool
 
+	// Protocol is reported in auth.failed events, e.g. "imap".
+	Protocol string
+
 	AuthMap       module.Table
 	AuthNormalize authz.NormalizeFunc
 
 	Plain []module.PlainAuth
+	Token []module.TokenAuth
+	SCRAM []module.SCRAMAuth
+
+	// TLSConfig is the endpoint TLS configuration, SCRAM-SHA-256-PLUS is
+	// offered only if it is set.
+	TLSConfig *tls.Config
 }
 
 func (s *SASLAuth) SASLMechanisms() []string {
@@ -61,6 +74,15 @@ func (s *SASLAuth) SASLMechanisms() []string {
 	if len(s.Plain) != 0 {
 		mechs = append(mechs, sasl.Plain, sasl.Login)
 	}
+	if len(s.SCRAM) != 0 {
+		mechs = append(mechs, SCRAMSHA256)
+		if s.TLSConfig != nil {
+			mechs = append(mechs, SCRAMSHA256Plus)
+		}
+	}
+	if len(s.Token) != 0 {
+		mechs = append(mechs, sasl.OAuthBearer, XOAuth2)
+	}
 
 	return mechs
 }
@@ -105,7 +127,11 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 			return err
 		}
 
-		lastErr = p.AuthPlain(username, password)
+		if pp, ok := p.(module.ProtocolPlainAuth); ok {
+			lastErr = pp.AuthPlainProtocol(username, password, s.Protocol)
+		} else {
+			lastErr = p.AuthPlain(username, password)
+		}
 		if lastErr == nil {
 			return nil
 		}
@@ -114,8 +140,118 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// AuthPlainFrom is AuthPlain that applies brute-force protection (see
+// throttle.Default) to the username and the client address.
+//
+// Attempts from locked out clients are rejected with throttle.LockedError
+// without checking credentials. Temporary errors are not counted as
+// failures.
+func (s *SASLAuth) AuthPlainFrom(remoteAddr net.Addr, username, password string) error {
+	ip := throttle.AddrIP(remoteAddr)
+	if err := throttle.Default.Check(username, ip); err != nil {
+		return err
+	}
+
+	if err := s.AuthPlain(username, password); err != nil {
+		if !exterrors.IsTemporary(err) {
+			throttle.Default.Failed(username, ip)
+		}
+		return err
+	}
+
+	throttle.Default.Succeeded(username)
+	return nil
+}
+
+// AuthToken checks the bearer token using token auth. providers and
+// returns the username it was issued for, translated using auth_map.
+//
+// username is the identity requested by the client, it is optional. If it
+// is set, it should match the token owner.
+func (s *SASLAuth) AuthToken(username, token string) (string, error) {
+	if len(s.Token) == 0 {
+		return "", ErrUnsupportedMech
+	}
+
+	var lastErr error
+	for _, p := range s.Token {
+		owner, err := p.AuthToken(token)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		identity, err := s.usernameForAuth(context.TODO(), owner)
+		if err != nil {
+			return "", err
+		}
+		if username != "" && username != owner && username != identity {
+			return "", fmt.Errorf("token issued for %s used as %s: %w", owner, username, ErrInvalidAuthCred)
+		}
+		return identity, nil
+	}
+
+	return "", fmt.Errorf("no auth. provider accepted token, last err: %w", lastErr)
+}
+
+// AuthTokenFrom is AuthToken that applies brute-force protection the same
+// way AuthPlainFrom does.
+func (s *SASLAuth) AuthTokenFrom(remoteAddr net.Addr, username, token string) (string, error) {
+	ip := throttle.AddrIP(remoteAddr)
+	if err := throttle.Default.Check(username, ip); err != nil {
+		return "", err
+	}
+
+	identity, err := s.AuthToken(username, token)
+	if err != nil {
+		if !exterrors.IsTemporary(err) {
+			throttle.Default.Failed(username, ip)
+		}
+		return "", err
+	}
+
+	throttle.Default.Succeeded(identity)
+	return identity, nil
+}
+
+// scramCredentials returns SCRAM-SHA-256 verifiers for the user from the
+// first SCRAM provider that has them.
+func (s *SASLAuth) scramCredentials(username string) (module.SCRAMCredentials, error) {
+	username, err := s.usernameForAuth(context.TODO(), username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+
+	var lastErr error
+	for _, p := range s.SCRAM {
+		creds, err := p.SCRAMSHA256Credentials(username)
+		if err == nil {
+			return creds, nil
+		}
+		lastErr = err
+	}
+	return module.SCRAMCredentials{}, fmt.Errorf("no auth. provider has SCRAM credentials, last err: %w", lastErr)
+}
+
+// failed handles the failed authentication attempt the same way PLAIN and
+// LOGIN handlers do and returns the error for the client.
+func (s *SASLAuth) failed(remoteAddr net.Addr, username string, err error) error {
+	if !exterrors.IsTemporary(err) {
+		throttle.Default.Failed(username, throttle.AddrIP(remoteAddr))
+	}
+	s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+	PublishFailure(s.Protocol, username, remoteAddr)
+	return ErrInvalidAuthCred
+}
+
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
 func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
+	return s.CreateSASLTLS(mech, remoteAddr, nil, successCb)
+}
+
+// CreateSASLTLS is CreateSASL for connections that may use TLS. tlsState is
+// nil if TLS is not used, it is needed for SCRAM-SHA-256-PLUS.
+func (s *SASLAuth) CreateSASLTLS(mech string, remoteAddr net.Addr, tlsState *tls.ConnectionState, successCb func(identity string) error) sasl.Server {
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
@@ -126,9 +262,10 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return ErrInvalidAuthCred
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlainFrom(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				PublishFailure(s.Protocol, username, remoteAddr)
 				return ErrInvalidAuthCred
 			}
 
@@ -136,14 +273,60 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 		})
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlainFrom(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				PublishFailure(s.Protocol, username, remoteAddr)
 				return ErrInvalidAuthCred
 			}
 
 			return successCb(username)
 		})
+	case sasl.OAuthBearer:
+		return &oauthBearerServer{Server: sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			identity, err := s.AuthTokenFrom(remoteAddr, opts.Username, opts.Token)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "username", opts.Username, "src_ip", remoteAddr)
+				PublishFailure(s.Protocol, opts.Username, remoteAddr)
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+
+			if err := successCb(identity); err != nil {
+				s.Log.Error("failed to set up session", err, "username", identity, "src_ip", remoteAddr)
+				return &sasl.OAuthBearerError{Status: "invalid_request", Schemes: "bearer"}
+			}
+			return nil
+		})}
+	case XOAuth2:
+		return NewXOAuth2Server(func(username, token string) error {
+			identity, err := s.AuthTokenFrom(remoteAddr, username, token)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				PublishFailure(s.Protocol, username, remoteAddr)
+				return ErrInvalidAuthCred
+			}
+
+			return successCb(identity)
+		})
+	case SCRAMSHA256, SCRAMSHA256Plus:
+		if len(s.SCRAM) == 0 {
+			break
+		}
+		srv := &scramServer{
+			auth:        s,
+			remoteAddr:  remoteAddr,
+			successCb:   successCb,
+			plus:        mech == SCRAMSHA256Plus,
+			plusOffered: s.TLSConfig != nil && tlsState != nil,
+			cbErr:       errors.New("TLS is not used"),
+		}
+		if srv.plus && srv.plusOffered {
+			srv.cbData, srv.cbErr = tlsServerEndPoint(s.TLSConfig, tlsState, remoteAddr)
+			if srv.cbErr != nil {
+				s.Log.Error("failed to get channel binding data", srv.cbErr, "src_ip", remoteAddr)
+			}
+		}
+		return srv
 	}
 	return FailingSASLServ{Err: ErrUnsupportedMech}
 }
@@ -161,6 +344,14 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 		s.Plain = append(s.Plain, plainAuth)
 		hasAny = true
 	}
+	if tokenAuth, ok := any.(module.TokenAuth); ok {
+		s.Token = append(s.Token, tokenAuth)
+		hasAny = true
+	}
+	if scramAuth, ok := any.(module.SCRAMAuth); ok && scramAuth.SCRAMEnabled() {
+		s.SCRAM = append(s.SCRAM, scramAuth)
+		hasAny = true
+	}
 
 	if !hasAny {
 		return config.NodeErr(node, "auth: specified module does not provide any SASL mechanism")
@@ -168,6 +359,22 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// PublishFailure publishes the auth.failed event for the failed login
+// attempt.
+func PublishFailure(protocol, username string, remoteAddr net.Addr) {
+	if !events.Enabled() {
+		return
+	}
+	data := map[string]interface{}{
+		"protocol": protocol,
+		"username": username,
+	}
+	if remoteAddr != nil {
+		data["srcIp"] = remoteAddr.String()
+	}
+	events.Publish(events.AuthFailed, data)
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
@@ -19,11 +19,14 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"context"
 	"errors"
 	"net"
 	"testing"
 
+	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -39,6 +42,27 @@ func (m mockAuth) AuthPlain(username, _ string) error {
 	return nil
 }
 
+type mockTokenAuth struct {
+	tokens map[string]string
+}
+
+func (m mockTokenAuth) AuthToken(token string) (string, error) {
+	username, ok := m.tokens[token]
+	if !ok {
+		return "", errors.New("invalid token")
+	}
+	return username, nil
+}
+
+type mockTable struct {
+	db map[string]string
+}
+
+func (m mockTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	val, ok := m.db[key]
+	return val, ok, nil
+}
+
 func TestCreateSASL(t *testing.T) {
 	a := SASLAuth{
 		Log: testutils.Logger(t, "saslauth"),
@@ -87,3 +111,112 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+func TestAuthPlainFrom_Throttle(t *testing.T) {
+	cfg := throttle.DefaultConfig()
+	cfg.MaxUserFailures = 2
+	prev := throttle.Default
+	throttle.Default = throttle.New(cfg)
+	defer func() { throttle.Default = prev }()
+
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	for i := 0; i < 2; i++ {
+		if err := a.AuthPlainFrom(addr, "user2", "aa"); err == nil || errors.Is(err, throttle.ErrLockedOut) {
+			t.Fatal("expected invalid credentials error, got", err)
+		}
+	}
+	if err := a.AuthPlainFrom(addr, "user2", "aa"); !errors.Is(err, throttle.ErrLockedOut) {
+		t.Fatal("expected lockout, got", err)
+	}
+	if err := a.AuthPlainFrom(addr, "user1", "aa"); err != nil {
+		t.Fatal("other user should not be locked out:", err)
+	}
+
+	srv := a.CreateSASL("PLAIN", addr, func(string) error { return nil })
+	if _, _, err := srv.Next([]byte("\x00user2\x00aa")); err == nil {
+		t.Fatal("locked out user should be rejected by SASL")
+	}
+}
+
+func TestCreateSASL_Token(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Token: []module.TokenAuth{
+			mockTokenAuth{
+				tokens: map[string]string{
+					"token1": "sso-user1",
+				},
+			},
+		},
+		AuthMap: mockTable{
+			db: map[string]string{
+				"sso-user1": "user1@example.org",
+			},
+		},
+	}
+
+	mechs := a.SASLMechanisms()
+	if len(mechs) != 2 || mechs[0] != sasl.OAuthBearer || mechs[1] != XOAuth2 {
+		t.Fatal("wrong mechanisms:", mechs)
+	}
+
+	for _, c := range []struct {
+		name     string
+		mech     string
+		response string
+		ok       bool
+	}{
+		{"OAUTHBEARER", sasl.OAuthBearer, "n,,\x01auth=Bearer token1\x01\x01", true},
+		{"OAUTHBEARER with authzid", sasl.OAuthBearer, "n,a=user1@example.org,\x01host=mx.example.org\x01auth=Bearer token1\x01\x01", true},
+		{"OAUTHBEARER with other authzid", sasl.OAuthBearer, "n,a=user2@example.org,\x01auth=Bearer token1\x01\x01", false},
+		{"OAUTHBEARER invalid token", sasl.OAuthBearer, "n,,\x01auth=Bearer token2\x01\x01", false},
+		{"XOAUTH2", XOAuth2, "user=sso-user1\x01auth=Bearer token1\x01\x01", true},
+		{"XOAUTH2 invalid token", XOAuth2, "user=sso-user1\x01auth=Bearer token2\x01\x01", false},
+		{"XOAUTH2 malformed", XOAuth2, "user=sso-user1\x01\x01", false},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var identity string
+			srv := a.CreateSASL(c.mech, &net.TCPAddr{}, func(id string) error {
+				identity = id
+				return nil
+			})
+
+			challenge, done, err := srv.Next([]byte(c.response))
+			if !done && err == nil {
+				// Error challenge, the client acknowledges it with an
+				// empty response.
+				if c.ok {
+					t.Fatal("unexpected challenge:", string(challenge))
+				}
+				_, done, err = srv.Next([]byte{})
+			}
+			if !done {
+				t.Fatal("exchange is not finished")
+			}
+			if !c.ok {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if identity != "user1@example.org" {
+				t.Fatal("wrong identity passed to callback:", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
+)
+
+// SCRAM mechanism names.
+const (
+	SCRAMSHA256     = "SCRAM-SHA-256"
+	SCRAMSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// scramChannelBinding is the only channel binding type supported for
+// SCRAM-SHA-256-PLUS.
+const scramChannelBinding = "tls-server-end-point"
+
+const (
+	scramNonceSize = 24
+	// scramFakeIterations is reported for users without verifiers.
+	scramFakeIterations = 4096
+)
+
+// scramFakeSecret is used to derive stable fake salts for users without
+// verifiers so the exchange does not reveal whether the user exists.
+var scramFakeSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+var errSCRAMMalformed = errors.New("sasl: malformed SCRAM message")
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// decodeSASLName decodes the username escaped as defined in RFC 5802.
+func decodeSASLName(s string) (string, error) {
+	if !strings.Contains(s, "=") {
+		return s, nil
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			out.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			out.WriteByte('=')
+		default:
+			return "", errSCRAMMalformed
+		}
+		i += 2
+	}
+	return out.String(), nil
+}
+
+// tlsServerEndPoint returns tls-server-end-point channel binding data
+// (RFC 5929): the hash of the server certificate.
+//
+// crypto/tls does not report the certificate used for the connection, so it
+// is selected again from cfg using the SNI name and parameters negotiated
+// for the connection.
+func tlsServerEndPoint(cfg *tls.Config, state *tls.ConnectionState, remoteAddr net.Addr) ([]byte, error) {
+	hello := &tls.ClientHelloInfo{
+		ServerName:        state.ServerName,
+		CipherSuites:      []uint16{state.CipherSuite},
+		SupportedVersions: []uint16{state.Version},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521},
+		SupportedPoints:   []uint8{0},
+		SignatureSchemes: []tls.SignatureScheme{
+			tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512,
+			tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512,
+			tls.PKCS1WithSHA256, tls.PKCS1WithSHA384, tls.PKCS1WithSHA512,
+			tls.Ed25519,
+		},
+		Conn: bindingConn{remoteAddr: remoteAddr},
+	}
+
+	if cfg.GetConfigForClient != nil {
+		clientCfg, err := cfg.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if clientCfg != nil {
+			cfg = clientCfg
+		}
+	}
+
+	var cert *tls.Certificate
+	if cfg.GetCertificate != nil {
+		var err error
+		cert, err = cfg.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cert == nil {
+		// Same as crypto/tls does.
+		for i := range cfg.Certificates {
+			if hello.SupportsCertificate(&cfg.Certificates[i]) == nil {
+				cert = &cfg.Certificates[i]
+				break
+			}
+		}
+		if cert == nil && len(cfg.Certificates) != 0 {
+			cert = &cfg.Certificates[0]
+		}
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, errors.New("no server certificate")
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The hash function of the certificate signature is used, MD5 and SHA-1
+	// are replaced with SHA-256.
+	hash := crypto.SHA256
+	switch leaf.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write(leaf.Raw)
+	return h.Sum(nil), nil
+}
+
+// bindingConn provides addresses to certificate selection callbacks that
+// log them, it cannot be used for I/O.
+type bindingConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c bindingConn) RemoteAddr() net.Addr {
+	if c.remoteAddr == nil {
+		return &net.TCPAddr{}
+	}
+	return c.remoteAddr
+}
+
+func (c bindingConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c bindingConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// scramServer implements SCRAM-SHA-256 and SCRAM-SHA-256-PLUS (RFC 5802,
+// RFC 7677) using verifiers from SCRAM providers.
+type scramServer struct {
+	auth       *SASLAuth
+	remoteAddr net.Addr
+	successCb  func(identity string) error
+
+	plus bool
+	// plusOffered is set if the client could use SCRAM-SHA-256-PLUS on this
+	// connection, it is used to detect downgrade attacks.
+	plusOffered bool
+	// cbData is nil if channel binding data is not available, cbErr
+	// explains why.
+	cbData []byte
+	cbErr  error
+
+	step            int
+	username        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           module.SCRAMCredentials
+	credsErr        error
+}
+
+func (a *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		// Generate empty challenge.
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		a.step++
+		challenge, err := a.clientFirst(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		return challenge, false, nil
+	case 1:
+		a.step++
+		challenge, err := a.clientFinal(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		return challenge, false, nil
+	case 2:
+		// The client acknowledges server-final message with an empty
+		// response. Its contents are not checked since go-imap passes the
+		// previous response again for empty lines.
+		a.step++
+		return nil, true, nil
+	}
+	return nil, true, errors.New("sasl: unexpected client response")
+}
+
+func (a *scramServer) clientFirst(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errSCRAMMalformed
+	}
+	cbFlag, authzid, bare := parts[0], parts[1], parts[2]
+
+	switch {
+	case a.plus:
+		if cbFlag != "p="+scramChannelBinding {
+			return nil, fmt.Errorf("sasl: %s channel binding is required", scramChannelBinding)
+		}
+		if a.cbData == nil {
+			return nil, fmt.Errorf("sasl: channel binding is not available: %w", a.cbErr)
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		return nil, errors.New("sasl: channel binding is not supported by " + SCRAMSHA256)
+	case cbFlag == "y":
+		if a.plusOffered {
+			return nil, errors.New("sasl: channel binding is supported, possible downgrade attack")
+		}
+	case cbFlag != "n":
+		return nil, errSCRAMMalformed
+	}
+	if authzid != "" && !strings.HasPrefix(authzid, "a=") {
+		return nil, errSCRAMMalformed
+	}
+	a.gs2Header = cbFlag + "," + authzid + ","
+	a.clientFirstBare = bare
+
+	var clientNonce string
+	for i, attr := range strings.Split(bare, ",") {
+		switch {
+		case i == 0:
+			if !strings.HasPrefix(attr, "n=") {
+				// Includes mandatory extension (m=) which is not
+				// supported.
+				return nil, errSCRAMMalformed
+			}
+			username, err := decodeSASLName(attr[2:])
+			if err != nil {
+				return nil, err
+			}
+			a.username = username
+		case i == 1:
+			if !strings.HasPrefix(attr, "r=") || len(attr) == 2 {
+				return nil, errSCRAMMalformed
+			}
+			clientNonce = attr[2:]
+		}
+	}
+	if a.username == "" || clientNonce == "" {
+		return nil, errSCRAMMalformed
+	}
+	if authzid != "" {
+		identity, err := decodeSASLName(authzid[2:])
+		if err != nil {
+			return nil, err
+		}
+		if identity != a.username {
+			return nil, ErrInvalidAuthCred
+		}
+	}
+
+	if err := throttle.Default.Check(a.username, throttle.AddrIP(a.remoteAddr)); err != nil {
+		return nil, a.auth.failed(a.remoteAddr, a.username, err)
+	}
+
+	a.creds, a.credsErr = a.auth.scramCredentials(a.username)
+	if a.credsErr != nil {
+		if exterrors.IsTemporary(a.credsErr) {
+			return nil, a.credsErr
+		}
+		// Continue the exchange with fake parameters, it will fail at
+		// proof verification.
+		a.creds = module.SCRAMCredentials{
+			Salt:       scramHMAC(scramFakeSecret, a.username)[:16],
+			Iterations: scramFakeIterations,
+		}
+	}
+
+	serverNonce := make([]byte, scramNonceSize)
+	if _, err := io.ReadFull(rand.Reader, serverNonce); err != nil {
+		return nil, err
+	}
+	a.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	a.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", a.nonce,
+		base64.StdEncoding.EncodeToString(a.creds.Salt), a.creds.Iterations)
+	return []byte(a.serverFirst), nil
+}
+
+func (a *scramServer) clientFinal(msg string) ([]byte, error) {
+	proofIdx := strings.LastIndex(msg, ",p=")
+	if proofIdx == -1 {
+		return nil, errSCRAMMalformed
+	}
+	withoutProof := msg[:proofIdx]
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIdx+3:])
+	if err != nil {
+		return nil, errSCRAMMalformed
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, errSCRAMMalformed
+	}
+	cbInput := []byte(a.gs2Header)
+	if a.plus {
+		cbInput = append(cbInput, a.cbData...)
+	}
+	if attrs[0][2:] != base64.StdEncoding.EncodeToString(cbInput) {
+		return nil, a.auth.failed(a.remoteAddr, a.username, errors.New("sasl: channel binding mismatch"))
+	}
+	if attrs[1][2:] != a.nonce {
+		return nil, errSCRAMMalformed
+	}
+
+	if a.credsErr != nil {
+		return nil, a.auth.failed(a.remoteAddr, a.username, a.credsErr)
+	}
+
+	authMessage := a.clientFirstBare + "," + a.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(a.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, a.auth.failed(a.remoteAddr, a.username, errors.New("sasl: invalid proof"))
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], a.creds.StoredKey) != 1 {
+		return nil, a.auth.failed(a.remoteAddr, a.username, errors.New("sasl: invalid proof"))
+	}
+
+	throttle.Default.Succeeded(a.username)
+	if err := a.successCb(a.username); err != nil {
+		return nil, err
+	}
+
+	serverSignature := scramHMAC(a.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
@@ -0,0 +1,308 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type mockSCRAMAuth struct {
+	creds map[string]module.SCRAMCredentials
+}
+
+func (mockSCRAMAuth) SCRAMEnabled() bool {
+	return true
+}
+
+func (m mockSCRAMAuth) SCRAMSHA256Credentials(username string) (module.SCRAMCredentials, error) {
+	creds, ok := m.creds[username]
+	if !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+	return creds, nil
+}
+
+func saltedPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+func scramCreds(password string) module.SCRAMCredentials {
+	salt := []byte("0123456789abcdef")
+	salted := saltedPassword(password, salt, 4096)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return module.SCRAMCredentials{
+		Salt:       salt,
+		Iterations: 4096,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+// scramClient runs the client side of the exchange, it returns the error
+// from the server.
+func scramClient(t *testing.T, srv sasl.Server, gs2Header, username, password string, cbData []byte) error {
+	t.Helper()
+
+	clientFirstBare := "n=" + username + ",r=clientnonce"
+	serverFirst, done, err := srv.Next([]byte(gs2Header + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	if done {
+		t.Fatal("exchange finished after client-first message")
+	}
+
+	var (
+		nonce      string
+		salt       []byte
+		iterations int
+	)
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt, _ = base64.StdEncoding.DecodeString(attr[2:])
+		case "i=":
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, "clientnonce") || len(nonce) == len("clientnonce") {
+		t.Fatal("wrong nonce:", nonce)
+	}
+
+	cbInput := append([]byte(gs2Header), cbData...)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbInput) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	salted := saltedPassword(password, salt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverFinal, done, err := srv.Next([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	if done {
+		t.Fatal("exchange finished without server-final message")
+	}
+	serverSignature := scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	if string(serverFinal) != "v="+base64.StdEncoding.EncodeToString(serverSignature) {
+		t.Fatal("wrong server signature:", string(serverFinal))
+	}
+
+	_, done, err = srv.Next([]byte{})
+	if err != nil {
+		return err
+	}
+	if !done {
+		t.Fatal("exchange is not finished")
+	}
+	return nil
+}
+
+func testTLSConfig(t *testing.T) (*tls.Config, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.org"},
+		DNSNames:     []string{"mx.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same structure as TLS configuration of endpoints.
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cfg, nil
+		},
+	}, cert
+}
+
+func TestCreateSASL_SCRAM(t *testing.T) {
+	cfg := throttle.DefaultConfig()
+	cfg.MaxUserFailures = 3
+	prev := throttle.Default
+	throttle.Default = throttle.New(cfg)
+	defer func() { throttle.Default = prev }()
+
+	tlsConfig, cert := testTLSConfig(t)
+	cbData := sha256.Sum256(cert.Raw)
+	tlsState := &tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		ServerName:  "mx.example.org",
+	}
+
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		SCRAM: []module.SCRAMAuth{
+			mockSCRAMAuth{
+				creds: map[string]module.SCRAMCredentials{
+					"user1@example.org": scramCreds("password1"),
+				},
+			},
+		},
+		AuthMap: mockTable{
+			db: map[string]string{
+				"user1":    "user1@example.org",
+				"us,er=":   "user1@example.org",
+				"user2":    "user2@example.org",
+				"lockuser": "user2@example.org",
+			},
+		},
+	}
+
+	if mechs := a.SASLMechanisms(); len(mechs) != 1 || mechs[0] != SCRAMSHA256 {
+		t.Fatal("wrong mechanisms without TLS:", mechs)
+	}
+	a.TLSConfig = tlsConfig
+	if mechs := a.SASLMechanisms(); len(mechs) != 2 || mechs[1] != SCRAMSHA256Plus {
+		t.Fatal("wrong mechanisms with TLS:", mechs)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	for _, c := range []struct {
+		name      string
+		mech      string
+		tlsState  *tls.ConnectionState
+		gs2Header string
+		username  string
+		password  string
+		cbData    []byte
+		ok        bool
+	}{
+		{"SCRAM-SHA-256", SCRAMSHA256, nil, "n,,", "user1", "password1", nil, true},
+		{"escaped username", SCRAMSHA256, nil, "n,,", "us=2Cer=3D", "password1", nil, true},
+		{"authzid", SCRAMSHA256, nil, "n,a=user1,", "user1", "password1", nil, true},
+		{"other authzid", SCRAMSHA256, nil, "n,a=user2,", "user1", "password1", nil, false},
+		{"wrong password", SCRAMSHA256, nil, "n,,", "user1", "password2", nil, false},
+		{"no verifiers", SCRAMSHA256, nil, "n,,", "user2", "password1", nil, false},
+		{"unknown user", SCRAMSHA256, nil, "n,,", "user3", "password1", nil, false},
+		{"channel binding without PLUS", SCRAMSHA256, tlsState, "p=tls-server-end-point,,", "user1", "password1", cbData[:], false},
+		{"client supports channel binding", SCRAMSHA256, nil, "y,,", "user1", "password1", nil, true},
+		{"downgrade", SCRAMSHA256, tlsState, "y,,", "user1", "password1", nil, false},
+		{"PLUS", SCRAMSHA256Plus, tlsState, "p=tls-server-end-point,,", "user1", "password1", cbData[:], true},
+		{"PLUS wrong binding data", SCRAMSHA256Plus, tlsState, "p=tls-server-end-point,,", "user1", "password1", []byte("wrong"), false},
+		{"PLUS unsupported binding", SCRAMSHA256Plus, tlsState, "p=tls-exporter,,", "user1", "password1", cbData[:], false},
+		{"PLUS without binding", SCRAMSHA256Plus, tlsState, "n,,", "user1", "password1", nil, false},
+		{"PLUS without TLS", SCRAMSHA256Plus, nil, "p=tls-server-end-point,,", "user1", "password1", cbData[:], false},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var identity string
+			srv := a.CreateSASLTLS(c.mech, addr, c.tlsState, func(id string) error {
+				identity = id
+				return nil
+			})
+
+			err := scramClient(t, srv, c.gs2Header, c.username, c.password, c.cbData)
+			if !c.ok {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if identity != "" {
+					t.Fatal("callback called for failed authentication")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if identity == "" {
+				t.Fatal("callback is not called")
+			}
+		})
+	}
+
+	// Failures are counted by the shared throttler.
+	for i := 0; i < 3; i++ {
+		srv := a.CreateSASL(SCRAMSHA256, addr, func(string) error { return nil })
+		_ = scramClient(t, srv, "n,,", "lockuser", "password1", nil)
+	}
+	srv := a.CreateSASL(SCRAMSHA256, addr, func(string) error { return nil })
+	if _, _, err := srv.Next([]byte("n,,n=lockuser,r=clientnonce")); !errors.Is(err, ErrInvalidAuthCred) {
+		t.Fatal("locked out user should be rejected, got", err)
+	}
+	if throttle.Default.Check("lockuser", addr.IP) == nil {
+		t.Fatal("user should be locked out")
+	}
+}
+
+func TestDecodeSASLName(t *testing.T) {
+	for in, out := range map[string]string{
+		"user":         "user",
+		"a=2Cb=3Dc":    "a,b=c",
+		"=3D=3D":       "==",
+		"bad=":         "",
+		"bad=2":        "",
+		"bad=41":       "",
+		"user@example": "user@example",
+	} {
+		res, err := decodeSASLName(in)
+		if out == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", in, res)
+			}
+			continue
+		}
+		if err != nil || res != out {
+			t.Errorf("%s: expected %s, got %s (%v)", in, out, res, err)
+		}
+	}
+}
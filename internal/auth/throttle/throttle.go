@@ -0,0 +1,435 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package throttle implements the brute-force protection for
+// authentication attempts.
+//
+// Failed attempts are counted per username and per client subnet. Once the
+// number of failures reaches the limit, further attempts are rejected
+// without checking credentials for the lockout period, which doubles with
+// each additional failure. The state is kept in memory and shared by all
+// endpoints of the process via Default.
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/log"
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	KindUser = "user"
+	KindIP   = "ip"
+)
+
+// ErrLockedOut is returned by Check for locked out usernames and clients.
+var ErrLockedOut = errors.New("auth: too many failed attempts")
+
+// LockedError is returned by Check if the attempt is rejected. It is
+// temporary in terms of exterrors.IsTemporary.
+type LockedError struct {
+	Kind  string
+	Key   string
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v (%s %s locked until %v)", ErrLockedOut, e.Kind, e.Key, e.Until.Format(time.RFC3339))
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLockedOut
+}
+
+func (e *LockedError) Temporary() bool {
+	return true
+}
+
+type Config struct {
+	// Number of failures after which the username or the client subnet is
+	// locked out. Zero disables the corresponding limit.
+	MaxUserFailures int
+	MaxIPFailures   int
+
+	// Lockout duration after reaching the limit, doubled for each
+	// subsequent failure up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+
+	// Failures are forgotten if there were none for ResetAfter.
+	ResetAfter time.Duration
+
+	// Prefix lengths used to group client addresses.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxUserFailures: 5,
+		MaxIPFailures:   20,
+		Lockout:         time.Minute,
+		MaxLockout:      time.Hour,
+		ResetAfter:      15 * time.Minute,
+		IPv4Prefix:      32,
+		IPv6Prefix:      64,
+	}
+}
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Lockout describes the currently locked out username or client subnet.
+type Lockout struct {
+	Kind     string
+	Key      string
+	Failures int
+	Until    time.Time
+}
+
+// Throttler tracks failed authentication attempts.
+//
+// All methods are safe to call on nil Throttler, in this case no
+// throttling is done.
+type Throttler struct {
+	cfg Config
+	log log.Logger
+
+	lock      sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+// Default is the Throttler used by all authentication endpoints. It is set
+// by the auth_throttle global directive.
+var Default = New(DefaultConfig())
+
+func New(cfg Config) *Throttler {
+	return &Throttler{
+		cfg:     cfg,
+		log:     log.Logger{Name: "auth_throttle"},
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+func entryKey(kind, key string) string {
+	return kind + ":" + key
+}
+
+// userEntryKey returns the entry key for the username. The username is
+// normalized the same way auth.pass_table does it, so case variants share
+// the failure counter. Usernames that fail normalization are used as is.
+func userEntryKey(username string) string {
+	if key, err := precis.UsernameCaseMapped.CompareKey(username); err == nil {
+		username = key
+	}
+	return entryKey(KindUser, username)
+}
+
+// subnet returns the client subnet in the CIDR notation or an empty string
+// if ip is nil.
+func (t *Throttler) subnet(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(t.cfg.IPv4Prefix, 32)), Mask: net.CIDRMask(t.cfg.IPv4Prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(t.cfg.IPv6Prefix, 128)), Mask: net.CIDRMask(t.cfg.IPv6Prefix, 128)}).String()
+}
+
+// AddrIP extracts the IP address from addr. nil is returned if addr is not
+// a TCP or UDP address.
+func AddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// keys returns entry keys for the username and the client subnet. Empty
+// keys are returned for missing values and disabled limits.
+func (t *Throttler) keys(username string, ip net.IP) (userKey, ipKey, subnet string) {
+	if username != "" && t.cfg.MaxUserFailures > 0 {
+		userKey = userEntryKey(username)
+	}
+	subnet = t.subnet(ip)
+	if subnet != "" && t.cfg.MaxIPFailures > 0 {
+		ipKey = entryKey(KindIP, subnet)
+	}
+	return
+}
+
+// Check returns LockedError if the username or the client subnet is locked
+// out. Empty username and nil ip are not checked.
+func (t *Throttler) Check(username string, ip net.IP) error {
+	if t == nil {
+		return nil
+	}
+
+	userKey, ipKey, subnet := t.keys(username, ip)
+	now := t.now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, k := range []struct{ kind, key, entKey string }{
+		{KindUser, username, userKey},
+		{KindIP, subnet, ipKey},
+	} {
+		if k.entKey == "" {
+			continue
+		}
+		ent, ok := t.entries[k.entKey]
+		if ok && now.Before(ent.lockedUntil) {
+			return &LockedError{Kind: k.kind, Key: k.key, Until: ent.lockedUntil}
+		}
+	}
+	return nil
+}
+
+// Failed records the failed attempt for the username and the client
+// subnet.
+func (t *Throttler) Failed(username string, ip net.IP) {
+	if t == nil {
+		return
+	}
+
+	userKey, ipKey, subnet := t.keys(username, ip)
+	now := t.now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sweep(now)
+	if userKey != "" {
+		t.fail(now, KindUser, username, userKey, t.cfg.MaxUserFailures)
+	}
+	if ipKey != "" {
+		t.fail(now, KindIP, subnet, ipKey, t.cfg.MaxIPFailures)
+	}
+}
+
+func (t *Throttler) fail(now time.Time, kind, key, entKey string, max int) {
+	ent, ok := t.entries[entKey]
+	if !ok || t.expired(ent, now) {
+		ent = &entry{}
+		t.entries[entKey] = ent
+	}
+	ent.failures++
+	ent.lastFailure = now
+
+	if ent.failures < max {
+		return
+	}
+
+	// Lockout grows exponentially, the formula is:
+	// lockout * 2 ^ (failures - max)
+	lockout := time.Duration(float64(t.cfg.Lockout) * math.Pow(2, float64(ent.failures-max)))
+	if lockout > t.cfg.MaxLockout || lockout <= 0 {
+		lockout = t.cfg.MaxLockout
+	}
+	ent.lockedUntil = now.Add(lockout)
+
+	t.log.Msg("locked out", kind, key, "failures", ent.failures, "duration", lockout)
+	if events.Enabled() {
+		events.Publish(events.AuthLocked, map[string]interface{}{
+			"kind":     kind,
+			"key":      key,
+			"failures": ent.failures,
+			"until":    ent.lockedUntil.UTC(),
+		})
+	}
+}
+
+// expired reports whether failures counted in the entry should be
+// forgotten. The period is counted from the end of the lockout, so repeated
+// attempts after it keep increasing the lockout duration.
+func (t *Throttler) expired(ent *entry, now time.Time) bool {
+	last := ent.lastFailure
+	if ent.lockedUntil.After(last) {
+		last = ent.lockedUntil
+	}
+	return now.Sub(last) >= t.cfg.ResetAfter
+}
+
+// sweep removes expired entries, it is done at most once per minute.
+// lock should be held.
+func (t *Throttler) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+
+	for k, ent := range t.entries {
+		if t.expired(ent, now) {
+			delete(t.entries, k)
+		}
+	}
+}
+
+// Succeeded resets failures counted for the username. Failures of the client
+// subnet are kept so attackers cannot reset them using a valid account.
+func (t *Throttler) Succeeded(username string) {
+	if t == nil || username == "" {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.entries, userEntryKey(username))
+}
+
+// Lockouts returns currently locked out usernames and client subnets ordered
+// by kind and key.
+func (t *Throttler) Lockouts() []Lockout {
+	if t == nil {
+		return nil
+	}
+
+	now := t.now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := []Lockout{}
+	for k, ent := range t.entries {
+		if !now.Before(ent.lockedUntil) {
+			continue
+		}
+		l := Lockout{Failures: ent.failures, Until: ent.lockedUntil}
+		l.Kind, l.Key, _ = strings.Cut(k, ":")
+		res = append(res, l)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// UnlockUser removes the lockout and failures counted for the username. It
+// returns false if there were none.
+func (t *Throttler) UnlockUser(username string) bool {
+	if t == nil {
+		return false
+	}
+	return t.unlock(userEntryKey(username))
+}
+
+// UnlockIP removes the lockout and failures counted for the client subnet.
+// addr can be an IP address or a subnet as returned by Lockouts. It returns
+// false if there were none.
+func (t *Throttler) UnlockIP(addr string) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		var err error
+		ip, _, err = net.ParseCIDR(addr)
+		if err != nil {
+			return false, fmt.Errorf("auth: invalid IP address: %s", addr)
+		}
+	}
+	return t.unlock(entryKey(KindIP, t.subnet(ip))), nil
+}
+
+func (t *Throttler) unlock(k string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.entries[k]; !ok {
+		return false
+	}
+	delete(t.entries, k)
+	t.log.Msg("lockout removed", "key", k)
+	return true
+}
+
+// Directive parses the auth_throttle global directive.
+//
+//	auth_throttle off
+//	auth_throttle {
+//	    max_user_failures 5
+//	    ...
+//	}
+func Directive(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 1 && node.Args[0] == "off" && len(node.Children) == 0 {
+		return (*Throttler)(nil), nil
+	}
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+
+	cfg := DefaultConfig()
+	child := config.NewMap(m.Globals, node)
+	child.Int("max_user_failures", false, false, cfg.MaxUserFailures, &cfg.MaxUserFailures)
+	child.Int("max_ip_failures", false, false, cfg.MaxIPFailures, &cfg.MaxIPFailures)
+	child.Duration("lockout", false, false, cfg.Lockout, &cfg.Lockout)
+	child.Duration("max_lockout", false, false, cfg.MaxLockout, &cfg.MaxLockout)
+	child.Duration("reset_after", false, false, cfg.ResetAfter, &cfg.ResetAfter)
+	child.Int("ipv4_prefix", false, false, cfg.IPv4Prefix, &cfg.IPv4Prefix)
+	child.Int("ipv6_prefix", false, false, cfg.IPv6Prefix, &cfg.IPv6Prefix)
+	if _, err := child.Process(); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxUserFailures < 0 || cfg.MaxIPFailures < 0 {
+		return nil, config.NodeErr(node, "failures limit should not be negative")
+	}
+	if cfg.Lockout <= 0 || cfg.MaxLockout < cfg.Lockout {
+		return nil, config.NodeErr(node, "lockout should be positive and not greater than max_lockout")
+	}
+	if cfg.IPv4Prefix < 1 || cfg.IPv4Prefix > 32 {
+		return nil, config.NodeErr(node, "ipv4_prefix should be in range 1-32, got %d", cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix < 1 || cfg.IPv6Prefix > 128 {
+		return nil, config.NodeErr(node, "ipv6_prefix should be in range 1-128, got %d", cfg.IPv6Prefix)
+	}
+
+	return New(cfg), nil
+}
+
+// DefaultDirective is the default value for the auth_throttle directive.
+func DefaultDirective() (interface{}, error) {
+	return New(DefaultConfig()), nil
+}
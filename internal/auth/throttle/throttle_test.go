@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package throttle
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func testThrottler(cfg Config) (*Throttler, *time.Time) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := New(cfg)
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestThrottler_UserLockout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUserFailures = 3
+	thr, now := testThrottler(cfg)
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 2; i++ {
+		thr.Failed("user", ip)
+	}
+	if err := thr.Check("user", ip); err != nil {
+		t.Fatal("locked out too early:", err)
+	}
+
+	thr.Failed("user", ip)
+	err := thr.Check("user", ip)
+	var locked *LockedError
+	if !errors.As(err, &locked) || locked.Kind != KindUser || !locked.Until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if !errors.Is(err, ErrLockedOut) || !exterrors.IsTemporary(err) {
+		t.Fatal("lockout error should be temporary ErrLockedOut")
+	}
+	if err := thr.Check("other", ip); err != nil {
+		t.Fatal("other user should not be locked out:", err)
+	}
+
+	// Each failure after the lockout doubles it.
+	*now = now.Add(time.Minute)
+	if err := thr.Check("user", ip); err != nil {
+		t.Fatal("lockout should expire:", err)
+	}
+	thr.Failed("user", ip)
+	if err := thr.Check("user", ip); !errors.As(err, &locked) || !locked.Until.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	// Failures are forgotten after reset_after since the end of the lockout.
+	*now = now.Add(2*time.Minute + cfg.ResetAfter)
+	thr.Failed("user", ip)
+	if err := thr.Check("user", ip); err != nil {
+		t.Fatal("failures should be reset:", err)
+	}
+
+	thr.Succeeded("user")
+	if len(thr.entries) != 1 {
+		t.Fatal("success should reset only user failures:", thr.entries)
+	}
+}
+
+func TestThrottler_UserCaseVariants(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUserFailures = 3
+	thr, _ := testThrottler(cfg)
+
+	for _, username := range []string{"Alice@example.org", "alice@example.org", "ALICE@example.org"} {
+		thr.Failed(username, nil)
+	}
+	for _, username := range []string{"alice@example.org", "aLiCe@EXAMPLE.org"} {
+		if err := thr.Check(username, nil); !errors.Is(err, ErrLockedOut) {
+			t.Fatalf("%s should be locked out, got %v", username, err)
+		}
+	}
+
+	if !thr.UnlockUser("Alice@Example.org") {
+		t.Fatal("unlock failed")
+	}
+	if err := thr.Check("alice@example.org", nil); err != nil {
+		t.Fatal("user should be unlocked:", err)
+	}
+}
+
+func TestThrottler_MaxLockout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUserFailures = 1
+	cfg.MaxLockout = 5 * time.Minute
+	thr, now := testThrottler(cfg)
+
+	var locked *LockedError
+	for i := 0; i < 100; i++ {
+		thr.Failed("user", nil)
+	}
+	if err := thr.Check("user", nil); !errors.As(err, &locked) || !locked.Until.Equal(now.Add(5*time.Minute)) {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
+
+func TestThrottler_IPLockout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxIPFailures = 3
+	cfg.IPv4Prefix = 24
+	thr, _ := testThrottler(cfg)
+
+	thr.Failed("user1", net.ParseIP("192.0.2.1"))
+	thr.Failed("user2", net.ParseIP("192.0.2.2"))
+	thr.Failed("user3", net.ParseIP("192.0.2.3"))
+
+	var locked *LockedError
+	if err := thr.Check("user4", net.ParseIP("192.0.2.200")); !errors.As(err, &locked) || locked.Kind != KindIP || locked.Key != "192.0.2.0/24" {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if err := thr.Check("user4", net.ParseIP("192.0.3.1")); err != nil {
+		t.Fatal("other subnet should not be locked out:", err)
+	}
+	if err := thr.Check("user4", net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatal("IPv6 client should not be locked out:", err)
+	}
+
+	lockouts := thr.Lockouts()
+	if len(lockouts) != 1 || lockouts[0].Key != "192.0.2.0/24" || lockouts[0].Failures != 3 {
+		t.Fatalf("wrong lockouts: %+v", lockouts)
+	}
+
+	if _, err := thr.UnlockIP("not an ip"); err == nil {
+		t.Fatal("expected error for invalid address")
+	}
+	if ok, err := thr.UnlockIP("192.0.2.0/24"); err != nil || !ok {
+		t.Fatal("unlock failed:", ok, err)
+	}
+	if err := thr.Check("user4", net.ParseIP("192.0.2.200")); err != nil {
+		t.Fatal("subnet should be unlocked:", err)
+	}
+	if ok, _ := thr.UnlockIP("192.0.2.1"); ok {
+		t.Fatal("unlock should report there was nothing to unlock")
+	}
+}
+
+func TestThrottler_Unlock(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUserFailures = 1
+	thr, _ := testThrottler(cfg)
+
+	thr.Failed("user", nil)
+	if thr.Check("user", nil) == nil {
+		t.Fatal("user should be locked out")
+	}
+	if !thr.UnlockUser("user") {
+		t.Fatal("unlock failed")
+	}
+	if err := thr.Check("user", nil); err != nil {
+		t.Fatal("user should be unlocked:", err)
+	}
+	if thr.UnlockUser("user") {
+		t.Fatal("unlock should report there was nothing to unlock")
+	}
+}
+
+func TestThrottler_Nil(t *testing.T) {
+	var thr *Throttler
+	thr.Failed("user", net.ParseIP("192.0.2.1"))
+	if err := thr.Check("user", net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal("nil throttler should not reject attempts:", err)
+	}
+	thr.Succeeded("user")
+	if len(thr.Lockouts()) != 0 {
+		t.Fatal("nil throttler should have no lockouts")
+	}
+}
+
+func TestDirective(t *testing.T) {
+	parse := func(node config.Node) (interface{}, error) {
+		return Directive(config.NewMap(nil, config.Node{}), node)
+	}
+
+	val, err := parse(config.Node{Name: "auth_throttle", Args: []string{"off"}})
+	if err != nil || val.(*Throttler) != nil {
+		t.Fatal("off should disable throttling:", val, err)
+	}
+
+	val, err = parse(config.Node{Name: "auth_throttle", Children: []config.Node{
+		{Name: "max_user_failures", Args: []string{"10"}},
+		{Name: "ipv6_prefix", Args: []string{"56"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := val.(*Throttler).cfg
+	if cfg.MaxUserFailures != 10 || cfg.IPv6Prefix != 56 || cfg.MaxIPFailures != DefaultConfig().MaxIPFailures {
+		t.Fatalf("wrong config: %+v", cfg)
+	}
+
+	for _, children := range [][]config.Node{
+		{{Name: "ipv4_prefix", Args: []string{"33"}}},
+		{{Name: "lockout", Args: []string{"2h"}}},
+		{{Name: "max_ip_failures", Args: []string{"-1"}}},
+	} {
+		if _, err := parse(config.Node{Name: "auth_throttle", Children: children}); err == nil {
+			t.Errorf("expected error for %v", children)
+		}
+	}
+}
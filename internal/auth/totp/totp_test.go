@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package totp
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed from RFC 6238 Appendix B.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 test vectors truncated to 6 digits.
+	for ts, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		res, err := Code(rfcSecret, time.Unix(ts, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != code {
+			t.Errorf("%d: expected %s, got %s", ts, code, res)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter, err := Validate(secret, code, now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter != Counter(now) {
+		t.Fatal("wrong counter:", counter)
+	}
+
+	// Used code is not accepted again.
+	if _, err := Validate(secret, code, now, counter); !errors.Is(err, ErrInvalidCode) {
+		t.Fatal("expected ErrInvalidCode for replayed code, got", err)
+	}
+
+	// Clock skew.
+	if _, err := Validate(secret, code, now.Add(Period), 0); err != nil {
+		t.Fatal("code from the previous step should be accepted:", err)
+	}
+	if _, err := Validate(secret, code, now.Add(-Period), 0); err != nil {
+		t.Fatal("code from the next step should be accepted:", err)
+	}
+	if _, err := Validate(secret, code, now.Add(3*Period), 0); !errors.Is(err, ErrInvalidCode) {
+		t.Fatal("expected ErrInvalidCode for old code, got", err)
+	}
+
+	if _, err := Validate(secret, "123 456", now, 0); errors.Is(err, ErrMalformedCode) {
+		t.Fatal("spaces should be ignored")
+	}
+	if _, err := Validate(secret, "12345", now, 0); !errors.Is(err, ErrMalformedCode) {
+		t.Fatal("expected ErrMalformedCode, got", err)
+	}
+}
+
+func TestKeyURI(t *testing.T) {
+	uri := KeyURI("maddy", "root", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/maddy:root?") {
+		t.Fatal("wrong URI:", uri)
+	}
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=maddy") {
+		t.Fatal("wrong URI:", uri)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodes {
+		t.Fatal("wrong count:", len(codes))
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != recoveryCodeLen+1 || code[recoveryCodeLen/2] != '-' {
+			t.Fatal("wrong format:", code)
+		}
+		if seen[code] {
+			t.Fatal("duplicate code:", code)
+		}
+		seen[code] = true
+	}
+
+	if NormalizeRecoveryCode("ABCDE-fghjk") != "abcdefghjk" {
+		t.Fatal("wrong normalization")
+	}
+}
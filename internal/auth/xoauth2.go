@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// The XOAUTH2 mechanism name.
+const XOAuth2 = "XOAUTH2"
+
+// XOAuth2Authenticator verifies the bearer token presented for the username.
+type XOAuth2Authenticator func(username, token string) error
+
+type xoauth2Server struct {
+	done         bool
+	failErr      error
+	authenticate XOAuth2Authenticator
+}
+
+// NewXOAuth2Server creates the server implementation of the XOAUTH2
+// mechanism used by Google and Microsoft mail clients.
+//
+// The client response has the form "user=...\x01auth=Bearer ...\x01\x01".
+// On failure, a JSON error challenge is sent and the exchange is finished
+// after the client acknowledges it with an empty response.
+func NewXOAuth2Server(auth XOAuth2Authenticator) sasl.Server {
+	return &xoauth2Server{authenticate: auth}
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failErr != nil {
+		return nil, true, a.failErr
+	}
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	// Generate empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	var username, token string
+	for _, p := range bytes.Split(response, []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(string(p), "=")
+		if !ok {
+			return nil, true, errors.New("sasl: invalid response, missing '='")
+		}
+		switch key {
+		case "user":
+			username = value
+		case "auth":
+			const prefix = "bearer "
+			if !strings.HasPrefix(strings.ToLower(value), prefix) {
+				return nil, true, errors.New("sasl: unsupported token type")
+			}
+			token = value[len(prefix):]
+		default:
+			return nil, true, errors.New("sasl: invalid response, unknown parameter: " + key)
+		}
+	}
+	if username == "" || token == "" {
+		return nil, true, errors.New("sasl: invalid response, missing user or auth")
+	}
+
+	if err := a.authenticate(username, token); err != nil {
+		a.failErr = err
+		blob, err := json.Marshal(sasl.OAuthBearerError{
+			Status:  "401",
+			Schemes: "bearer",
+		})
+		if err != nil {
+			panic(err)
+		}
+		return blob, false, nil
+	}
+
+	return nil, true, nil
+}
+
+// oauthBearerServer works around sasl.NewOAuthBearerServer indexing the
+// client response to the error challenge without checking its length. Some
+// clients acknowledge the error with an empty response instead of %x01.
+type oauthBearerServer struct {
+	sasl.Server
+	started bool
+}
+
+func (a *oauthBearerServer) Next(response []byte) ([]byte, bool, error) {
+	if a.started && len(response) == 0 {
+		response = []byte{0x01}
+	}
+	if response != nil {
+		a.started = true
+	}
+	return a.Server.Next(response)
+}
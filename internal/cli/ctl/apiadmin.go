@@ -0,0 +1,608 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/rest/admin"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "api-admin",
+			Usage: "REST API administrators management",
+			Description: `These commands manipulate accounts that can access the REST API.
+
+Admin accounts are stored in the database used by storage.imapsql, by default
+the block name should be local_mailboxes (can be changed using --cfg-block
+argument for subcommands).
+
+Admins authenticate using HTTP Basic authentication and have unrestricted
+access. Use 'api-token' subcommands to issue tokens with limited scopes and
+'totp' subcommands to require the second factor.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List REST API admins",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiAdminList(store, ctx)
+					},
+				},
+				{
+					Name:        "create",
+					Usage:       "Create REST API admin",
+					Description: "Reads password from stdin",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:    "password",
+							Aliases: []string{"p"},
+							Usage:   "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiAdminCreate(store, ctx)
+					},
+				},
+				{
+					Name:        "password",
+					Usage:       "Change REST API admin password",
+					Description: "Reads password from stdin",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:    "password",
+							Aliases: []string{"p"},
+							Usage:   "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiAdminPassword(store, ctx)
+					},
+				},
+				{
+					Name:        "remove",
+					Usage:       "Delete REST API admin",
+					Description: "All tokens owned by the admin are revoked too.",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiAdminRemove(store, ctx)
+					},
+				},
+				{
+					Name:  "totp",
+					Usage: "Second factor (TOTP) management",
+					Description: `Admins with TOTP enabled should send the current code from the
+authenticator app or one of recovery codes in the X-Maddy-OTP header in
+addition to the password. API tokens are not affected.
+
+These commands can be used to reset the second factor of an admin that lost
+the device and recovery codes.
+`,
+					Subcommands: []*cli.Command{
+						{
+							Name:      "status",
+							Usage:     "Show TOTP status of the admin",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								store, be, err := openAdminStore(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return apiAdminTOTPStatus(store, ctx)
+							},
+						},
+						{
+							Name:        "enroll",
+							Usage:       "Enable TOTP for the admin",
+							Description: "Prints the secret and asks for the code from the authenticator app to confirm it.\nRecovery codes are printed to stdout, they cannot be shown again.",
+							ArgsUsage:   "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+								&cli.StringFlag{
+									Name:  "code",
+									Usage: "Use `CODE` instead of reading it from stdin",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								store, be, err := openAdminStore(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return apiAdminTOTPEnroll(store, ctx)
+							},
+						},
+						{
+							Name:      "recovery-codes",
+							Usage:     "Replace recovery codes of the admin",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								store, be, err := openAdminStore(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return apiAdminRecoveryCodes(store, ctx)
+							},
+						},
+						{
+							Name:      "disable",
+							Usage:     "Disable TOTP for the admin",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								store, be, err := openAdminStore(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return apiAdminTOTPDisable(store, ctx)
+							},
+						},
+					},
+				},
+			},
+		})
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "api-token",
+			Usage: "REST API tokens management",
+			Description: `These commands manipulate bearer tokens used to access the REST API.
+
+Each token belongs to an admin account and is limited to a set of scopes
+in the "resource:action" form, e.g. users:read or quota:write. Write access
+implies read access, "resource:*" grants both and "*" grants everything.
+
+Tokens can be additionally restricted to a list of domains, in this case
+only users and resources within these domains are accessible.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List issued tokens",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "owner",
+							Usage: "Show only tokens owned by the specified admin",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiTokenList(store, ctx)
+					},
+				},
+				{
+					Name:  "create",
+					Usage: "Issue a new token",
+					Description: `Token is printed to stdout. It is not stored anywhere
+in plain text and cannot be shown again.`,
+					ArgsUsage: "OWNER NAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringSliceFlag{
+							Name:     "scope",
+							Aliases:  []string{"s"},
+							Usage:    "Grant the `SCOPE` to the token, can be repeated",
+							Required: true,
+						},
+						&cli.StringSliceFlag{
+							Name:    "domain",
+							Aliases: []string{"d"},
+							Usage:   "Restrict token to the `DOMAIN`, can be repeated",
+						},
+						&cli.DurationFlag{
+							Name:  "expires-in",
+							Usage: "Make token expire after the specified `DURATION`",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiTokenCreate(store, ctx)
+					},
+				},
+				{
+					Name:      "revoke",
+					Usage:     "Revoke a token",
+					ArgsUsage: "TOKEN_ID",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						store, be, err := openAdminStore(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return apiTokenRevoke(store, ctx)
+					},
+				},
+			},
+		})
+}
+
+func openAdminStore(ctx *cli.Context) (*admin.Store, module.Storage, error) {
+	be, err := openStorage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sqlStore, ok := be.(*imapsql.Storage)
+	if !ok {
+		closeIfNeeded(be)
+		return nil, nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not storage.imapsql", ctx.String("cfg-block")), 2)
+	}
+
+	store := &admin.Store{DB: sqlStore.Back.DB, Driver: sqlStore.Driver()}
+	if err := store.Init(); err != nil {
+		closeIfNeeded(be)
+		return nil, nil, err
+	}
+
+	return store, be, nil
+}
+
+func apiAdminList(store *admin.Store, ctx *cli.Context) error {
+	list, err := store.ListAdmins()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No admins.")
+	}
+
+	for _, name := range list {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func apiAdminCreate(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	var pass string
+	if ctx.IsSet("password") {
+		pass = ctx.String("password")
+	} else {
+		var err error
+		pass, err = clitools2.ReadPassword("Enter password for new admin")
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.CreateAdmin(username, pass)
+}
+
+func apiAdminPassword(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	var pass string
+	if ctx.IsSet("password") {
+		pass = ctx.String("password")
+	} else {
+		var err error
+		pass, err = clitools2.ReadPassword("Enter new password")
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.SetAdminPassword(username, pass)
+}
+
+func apiAdminRemove(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools2.Confirmation("Are you sure you want to delete this admin and all its tokens?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return store.DeleteAdmin(username)
+}
+
+func apiAdminTOTPStatus(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	status, err := store.GetTOTPStatus(username)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status.Enabled:
+		fmt.Printf("enabled, %d recovery codes left\n", status.RecoveryCodes)
+	case status.Pending:
+		fmt.Println("enrollment is not confirmed")
+	default:
+		fmt.Println("disabled")
+	}
+	return nil
+}
+
+func apiAdminTOTPEnroll(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	secret, uri, err := store.EnrollTOTP(username)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Secret:", secret)
+	fmt.Fprintln(os.Stderr, "URI:", uri)
+
+	code, err := readTOTPCode(ctx)
+	if err != nil {
+		return err
+	}
+	codes, err := store.ConfirmTOTP(username, code)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "TOTP enabled, recovery codes:")
+	}
+	for _, code := range codes {
+		fmt.Println(code)
+	}
+	return nil
+}
+
+func readTOTPCode(ctx *cli.Context) (string, error) {
+	if ctx.IsSet("code") {
+		return ctx.String("code"), nil
+	}
+	return clitools2.ReadPassword("Enter the code from the authenticator app")
+}
+
+func apiAdminRecoveryCodes(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	codes, err := store.RegenerateRecoveryCodes(username)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		fmt.Println(code)
+	}
+	return nil
+}
+
+func apiAdminTOTPDisable(store *admin.Store, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	return store.DisableTOTP(username)
+}
+
+func apiTokenList(store *admin.Store, ctx *cli.Context) error {
+	tokens, err := store.ListTokens(ctx.String("owner"))
+	if err != nil {
+		return err
+	}
+
+	if len(tokens) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No tokens.")
+	}
+
+	for _, tok := range tokens {
+		domains := "all domains"
+		if len(tok.Domains) != 0 {
+			domains = strings.Join(tok.Domains, ",")
+		}
+		expires := "never expires"
+		if !tok.ExpiresAt.IsZero() {
+			expires = "expires " + tok.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", tok.ID, tok.Owner, tok.Name,
+			strings.Join(tok.Scopes, ","), domains, expires)
+	}
+	return nil
+}
+
+func apiTokenCreate(store *admin.Store, ctx *cli.Context) error {
+	owner := ctx.Args().Get(0)
+	if owner == "" {
+		return cli.Exit("Error: OWNER is required", 2)
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return cli.Exit("Error: NAME is required", 2)
+	}
+
+	admins, err := store.ListAdmins()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, a := range admins {
+		if a == owner {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return cli.Exit(fmt.Sprintf("Error: unknown admin: %s", owner), 2)
+	}
+
+	var expiresAt time.Time
+	if d := ctx.Duration("expires-in"); d != 0 {
+		expiresAt = time.Now().Add(d)
+	}
+
+	raw, tok, err := store.CreateToken(owner, name, ctx.StringSlice("scope"), ctx.StringSlice("domain"), expiresAt)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "Created token", tok.ID)
+	}
+	fmt.Println(raw)
+	return nil
+}
+
+func apiTokenRevoke(store *admin.Store, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: TOKEN_ID is required", 2)
+	}
+
+	return store.RevokeToken(id)
+}
@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/mailexport"
+	"github.com/urfave/cli/v2"
+)
+
+// printProgress reports each mailbox once to stderr.
+func printProgress(verb string, quiet bool) func(mailexport.Progress) {
+	last := ""
+	return func(p mailexport.Progress) {
+		if quiet || p.Mailbox == last {
+			return
+		}
+		last = p.Mailbox
+		fmt.Fprintf(os.Stderr, "%s %s (%d/%d messages done)\n", verb, p.Mailbox, p.MessagesDone, p.MessagesTotal)
+	}
+}
+
+func imapAcctExport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	format, err := mailexport.ParseFormat(ctx.String("format"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	defer u.Logout()
+
+	var out io.Writer = os.Stdout
+	if path := ctx.String("output"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := mailexport.Export(u, out, format, printProgress("Exporting", ctx.Bool("quiet"))); err != nil {
+		return err
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+func imapAcctImport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	defer u.Logout()
+
+	var in io.Reader = os.Stdin
+	if path := ctx.Args().Get(1); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return mailexport.Import(u, in, printProgress("Importing", ctx.Bool("quiet")))
+}
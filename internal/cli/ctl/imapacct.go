@@ -181,6 +181,157 @@ APPENDLIMIT value (either global or per-account) cannot be larger than
 						return imapAcctAppendlimit(be, ctx)
 					},
 				},
+				{
+					Name:  "quota-recompute",
+					Usage: "Recalculate cached quota usage of accounts",
+					Description: `Storage usage used for quota checks is cached and updated together
+with mailbox contents. This command recalculates it from the stored messages,
+which is only needed after manual changes to the database.
+`,
+					ArgsUsage: "[USERNAME]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "all",
+							Usage: "Recalculate usage of all accounts",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctQuotaRecompute(be, ctx)
+					},
+				},
+				{
+					Name:  "export",
+					Usage: "Export all mailboxes of the account into a tar archive",
+					Description: `The archive contains messages with their flags and internal dates
+in Maildir or mboxrd format together with manifest.json describing mailboxes,
+their special-use attributes and subscriptions. It can be imported back using
+'imap-acct import'.
+`,
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:    "output",
+							Aliases: []string{"o"},
+							Usage:   "Write the archive to the specified file instead of stdout",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Mailbox format, maildir or mbox",
+							Value: "maildir",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctExport(be, ctx)
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "Import mailboxes from an archive created by 'imap-acct export'",
+					Description: `Missing mailboxes are created, messages are added to existing
+mailboxes. Messages are not deduplicated, importing the same archive twice
+creates duplicates.
+
+The account should already exist, see 'imap-acct create'.
+`,
+					ArgsUsage: "USERNAME [FILE]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctImport(be, ctx)
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "Copy all folders of a remote IMAP account into the account",
+					Description: `Folders are created with the same hierarchy, special-use folders
+(Sent, Trash, Junk, Drafts, Archive) are merged into the existing local ones.
+Flags and internal dates are preserved.
+
+The last copied UID of each remote folder is remembered, running the command
+again copies only new messages. Folders with \All attribute (e.g. Gmail's
+"All Mail") are skipped.
+
+Reads password of the remote account from stdin unless --oauth2-token is used.
+`,
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:     "host",
+							Usage:    "Remote server `HOST[:PORT]`",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "tls",
+							Usage: "TLS mode: tls (implicit TLS), starttls or none",
+							Value: "tls",
+						},
+						&cli.BoolFlag{
+							Name:  "tls-skip-verify",
+							Usage: "Do not verify the server certificate",
+						},
+						&cli.StringFlag{
+							Name:  "remote-user",
+							Usage: "Username of the remote account, same as USERNAME by default",
+						},
+						&cli.StringFlag{
+							Name:    "password",
+							Aliases: []string{"p"},
+							Usage:   "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
+						},
+						&cli.StringFlag{
+							Name:    "oauth2-token",
+							Usage:   "Authenticate using XOAUTH2 or OAUTHBEARER with the access `TOKEN`",
+							EnvVars: []string{"MADDY_OAUTH2_TOKEN"},
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctMigrate(be, ctx)
+					},
+				},
 			},
 		})
 }
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/imapmigrate"
+	"github.com/urfave/cli/v2"
+)
+
+// MigrationStateStorage is implemented by storage backends that remember
+// progress of IMAP migrations.
+type MigrationStateStorage interface {
+	MigrationState(username, source string) imapmigrate.State
+}
+
+func imapAcctMigrate(be module.Storage, ctx *cli.Context) error {
+	mbe, ok := be.(MigrationStateStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support IMAP migrations", 2)
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	opts := imapmigrate.Options{
+		Addr:               ctx.String("host"),
+		TLS:                ctx.String("tls"),
+		InsecureSkipVerify: ctx.Bool("tls-skip-verify"),
+		Username:           ctx.String("remote-user"),
+		OAuth2Token:        ctx.String("oauth2-token"),
+	}
+	if _, _, err := net.SplitHostPort(opts.Addr); err != nil {
+		port := "993"
+		if opts.TLS != imapmigrate.TLSImplicit {
+			port = "143"
+		}
+		opts.Addr = net.JoinHostPort(opts.Addr, port)
+	}
+	if opts.Username == "" {
+		opts.Username = username
+	}
+	if opts.OAuth2Token == "" {
+		if ctx.IsSet("password") {
+			opts.Password = ctx.String("password")
+		} else {
+			var err error
+			opts.Password, err = clitools2.ReadPassword("Enter password for " + opts.Source())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	defer u.Logout()
+
+	c, err := imapmigrate.Dial(opts)
+	if err != nil {
+		return err
+	}
+	defer c.Logout() //nolint:errcheck
+
+	last := ""
+	err = imapmigrate.Migrate(c, u, mbe.MigrationState(username, opts.Source()), func(p imapmigrate.Progress) {
+		if ctx.Bool("quiet") || p.Mailbox == last {
+			return
+		}
+		last = p.Mailbox
+		fmt.Fprintf(os.Stderr, "Copying %s (%d/%d folders, %d messages copied)\n", p.Mailbox, p.MailboxesDone+1, p.MailboxesTotal, p.MessagesDone)
+	})
+	if err != nil {
+		return err
+	}
+	if !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "Migration complete.")
+	}
+	return nil
+}
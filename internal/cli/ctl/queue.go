@@ -0,0 +1,362 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/urfave/cli/v2"
+)
+
+func queueAPIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "api-url",
+			Usage:   "REST API base `URL` of the running server",
+			EnvVars: []string{"MADDY_API_URL"},
+			Value:   "http://127.0.0.1:8080",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "REST API `TOKEN` with queue:read or queue:write scope",
+			EnvVars: []string{"MADDY_API_TOKEN"},
+		},
+	}
+}
+
+func queueMsgCommand(name, usage string) *cli.Command {
+	return &cli.Command{
+		Name:      name,
+		Usage:     usage,
+		ArgsUsage: "MSG_ID",
+		Flags:     queueAPIFlags(),
+		Action: func(ctx *cli.Context) error {
+			return queueMsgAction(ctx, name)
+		},
+	}
+}
+
+func queueDomainCommand(name, usage string) *cli.Command {
+	return &cli.Command{
+		Name:      name,
+		Usage:     usage,
+		ArgsUsage: "DOMAIN",
+		Flags: append(queueAPIFlags(),
+			&cli.StringFlag{
+				Name:  "queue",
+				Usage: "Apply only to the queue with the specified `NAME`",
+			},
+		),
+		Action: func(ctx *cli.Context) error {
+			return queueDomainAction(ctx, name)
+		},
+	}
+}
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "queue",
+			Usage: "Outbound queue inspection and management",
+			Description: `These commands inspect and manage messages in target.queue
+instances of the running server.
+
+Queue state is owned by the server process, so commands are sent to the
+REST API (ENABLE_API=true) instead of accessing queue files directly.
+Only queues defined as top-level configuration blocks are accessible.
+Use 'maddy api-token create --scope queue:write' to issue a token.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: append(queueAPIFlags(),
+						&cli.StringFlag{
+							Name:  "queue",
+							Usage: "Show only messages in the queue with the specified `NAME`",
+						},
+						&cli.StringFlag{
+							Name:  "state",
+							Usage: "Show only messages in the `STATE` (scheduled, delivering, held or suspended)",
+						},
+						&cli.StringFlag{
+							Name:  "sender",
+							Usage: "Show only messages from the `ADDRESS`",
+						},
+						&cli.StringFlag{
+							Name:  "domain",
+							Usage: "Show only messages with recipients in the `DOMAIN`",
+						},
+					),
+					Action: queueList,
+				},
+				{
+					Name:      "show",
+					Usage:     "Show queued message details",
+					ArgsUsage: "MSG_ID",
+					Flags:     queueAPIFlags(),
+					Action:    queueShow,
+				},
+				queueMsgCommand("retry", "Attempt delivery immediately, releasing held message"),
+				queueMsgCommand("hold", "Stop delivery attempts until message is released"),
+				queueMsgCommand("release", "Release held message and attempt delivery immediately"),
+				queueMsgCommand("bounce", "Remove message from the queue and send DSN to the sender"),
+				queueMsgCommand("drop", "Remove message from the queue silently"),
+				{
+					Name:  "purge",
+					Usage: "Remove messages by sender or recipient domain",
+					Description: `Recipients matching both --sender and --domain are removed
+from queued messages. Messages without recipients left are dropped without
+notifying the sender.`,
+					Flags: append(queueAPIFlags(),
+						&cli.StringFlag{
+							Name:  "sender",
+							Usage: "Purge messages from the `ADDRESS`",
+						},
+						&cli.StringFlag{
+							Name:  "domain",
+							Usage: "Purge recipients in the `DOMAIN`",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					),
+					Action: queuePurge,
+				},
+				{
+					Name:  "domains",
+					Usage: "List per-domain retry policies and suspended domains",
+					Flags: append(queueAPIFlags(),
+						&cli.StringFlag{
+							Name:  "queue",
+							Usage: "Show only policies of the queue with the specified `NAME`",
+						},
+					),
+					Action: queueDomains,
+				},
+				queueDomainCommand("suspend", "Stop delivery attempts to the domain until it is resumed"),
+				queueDomainCommand("resume", "Resume delivery attempts to the domain"),
+			},
+		})
+}
+
+// queueAPIRequest sends the request to the REST API and decodes the JSON
+// response into out if it is not nil.
+func queueAPIRequest(ctx *cli.Context, method, path string, in, out interface{}) error {
+	token := ctx.String("token")
+	if token == "" {
+		return cli.Exit("Error: --token or MADDY_API_TOKEN is required", 2)
+	}
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(ctx.String("api-url"), "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Message == "" {
+			return fmt.Errorf("Error: %s", resp.Status)
+		}
+		return fmt.Errorf("Error: %s", apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func queueList(ctx *cli.Context) error {
+	query := url.Values{}
+	for _, name := range []string{"queue", "state", "sender", "domain"} {
+		if v := ctx.String(name); v != "" {
+			query.Set(name, v)
+		}
+	}
+
+	var list []model.QueuedMessage
+	if err := queueAPIRequest(ctx, http.MethodGet, "/v1/queue?"+query.Encode(), nil, &list); err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "Queue is empty.")
+	}
+	for _, msg := range list {
+		next := msg.State
+		if msg.NextAttempt != nil {
+			next = "next attempt " + msg.NextAttempt.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s %s (%d bytes) from %s, %s\n", msg.ID, msg.Queue, msg.Size, msg.From, next)
+		for _, rcpt := range msg.Recipients {
+			fmt.Printf("\t%s, %d tries", rcpt.Address, rcpt.Tries)
+			if rcpt.LastError != "" {
+				fmt.Printf(": %s", rcpt.LastError)
+			}
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+func queueShow(ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: MSG_ID is required", 2)
+	}
+
+	var msg model.QueuedMessage
+	if err := queueAPIRequest(ctx, http.MethodGet, "/v1/queue/"+url.PathEscape(id), nil, &msg); err != nil {
+		return err
+	}
+
+	fmt.Println("ID:", msg.ID)
+	fmt.Println("Queue:", msg.Queue)
+	fmt.Println("State:", msg.State)
+	fmt.Println("From:", msg.From)
+	fmt.Println("Size:", msg.Size)
+	fmt.Println("First attempt:", msg.FirstAttempt.Local().Format(time.RFC3339))
+	fmt.Println("Last attempt:", msg.LastAttempt.Local().Format(time.RFC3339))
+	if msg.NextAttempt != nil {
+		fmt.Println("Next attempt:", msg.NextAttempt.Local().Format(time.RFC3339))
+	}
+	fmt.Println("Recipients:")
+	for _, rcpt := range msg.Recipients {
+		fmt.Printf("\t%s, %d tries\n", rcpt.Address, rcpt.Tries)
+		if rcpt.LastError != "" {
+			fmt.Printf("\t\tLast error: %s\n", rcpt.LastError)
+		}
+	}
+	return nil
+}
+
+func queueMsgAction(ctx *cli.Context, action string) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: MSG_ID is required", 2)
+	}
+
+	method, path := http.MethodPost, "/v1/queue/"+url.PathEscape(id)+"/"+action
+	if action == "drop" {
+		method, path = http.MethodDelete, "/v1/queue/"+url.PathEscape(id)
+	}
+	return queueAPIRequest(ctx, method, path, nil, nil)
+}
+
+func queuePurge(ctx *cli.Context) error {
+	req := model.QueuePurgeRequest{
+		Sender: ctx.String("sender"),
+		Domain: ctx.String("domain"),
+	}
+	if req.Sender == "" && req.Domain == "" {
+		return cli.Exit("Error: --sender or --domain is required", 2)
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools2.Confirmation("Are you sure you want to purge matching messages without notifying senders?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	var resp model.QueuePurgeResponse
+	if err := queueAPIRequest(ctx, http.MethodPost, "/v1/queue/purge", req, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d messages.\n", resp.Purged)
+	return nil
+}
+
+func queueDomains(ctx *cli.Context) error {
+	query := url.Values{}
+	if v := ctx.String("queue"); v != "" {
+		query.Set("queue", v)
+	}
+
+	var list []model.QueuePolicies
+	if err := queueAPIRequest(ctx, http.MethodGet, "/v1/queue/domains?"+query.Encode(), nil, &list); err != nil {
+		return err
+	}
+
+	printPolicy := func(name string, p model.QueueDomainPolicy) {
+		lifetime := "unlimited"
+		if p.MaxLifetimeSeconds != 0 {
+			lifetime = (time.Duration(p.MaxLifetimeSeconds) * time.Second).String()
+		}
+		fmt.Printf("\t%s: initial retry %v, scale %v, max %d tries, lifetime %s",
+			name, time.Duration(p.InitialRetrySeconds)*time.Second, p.RetryScale, p.MaxTries, lifetime)
+		if p.Suspended {
+			fmt.Print(", SUSPENDED")
+		}
+		fmt.Println()
+	}
+	for _, q := range list {
+		fmt.Println(q.Queue + ":")
+		printPolicy("(default)", q.Defaults)
+		for _, p := range q.Domains {
+			printPolicy(p.Domain, p)
+		}
+	}
+	return nil
+}
+
+func queueDomainAction(ctx *cli.Context, action string) error {
+	domain := ctx.Args().First()
+	if domain == "" {
+		return cli.Exit("Error: DOMAIN is required", 2)
+	}
+
+	query := url.Values{}
+	if v := ctx.String("queue"); v != "" {
+		query.Set("queue", v)
+	}
+	path := "/v1/queue/domains/" + url.PathEscape(domain) + "/" + action + "?" + query.Encode()
+	return queueAPIRequest(ctx, http.MethodPost, path, nil, nil)
+}
@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli/v2"
+)
+
+// QuotaUsageStorage is implemented by storage backends that cache quota
+// usage of accounts.
+type QuotaUsageStorage interface {
+	RecomputeQuotaUsage(username string) (module.Quota, error)
+}
+
+func imapAcctQuotaRecompute(be module.Storage, ctx *cli.Context) error {
+	qbe, ok := be.(QuotaUsageStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not cache quota usage", 2)
+	}
+
+	var usernames []string
+	if ctx.Bool("all") {
+		mbe, ok := be.(module.ManageableStorage)
+		if !ok {
+			return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
+		}
+		var err error
+		usernames, err = mbe.ListIMAPAccts()
+		if err != nil {
+			return err
+		}
+	} else {
+		username := ctx.Args().First()
+		if username == "" {
+			return cli.Exit("Error: USERNAME or --all is required", 2)
+		}
+		usernames = []string{username}
+	}
+
+	for _, username := range usernames {
+		q, err := qbe.RecomputeQuotaUsage(username)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d bytes, %d messages\n", username, q.StorageUsed, q.MessagesUsed)
+	}
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth/pass_table"
@@ -162,6 +163,164 @@ using command flags. Otherwise, these options cannot be used.
 						return usersPassword(be, ctx)
 					},
 				},
+				{
+					Name:  "app-password",
+					Usage: "Application-specific passwords management",
+					Description: `App passwords are generated random passwords that can be used
+				instead of the main password, e.g. by a phone or a calendar app, and revoked
+				individually. They require app_passwords table in the pass_table
+				configuration.
+				`,
+					Subcommands: []*cli.Command{
+						{
+							Name:      "list",
+							Usage:     "List app passwords of the user",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_authdb",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPasswordsList(be, ctx)
+							},
+						},
+						{
+							Name:  "create",
+							Usage: "Generate new app password",
+							Description: `Generated password is printed to stdout, it cannot be
+				retrieved later.`,
+							ArgsUsage: "USERNAME NAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_authdb",
+								},
+								&cli.StringSliceFlag{
+									Name:  "protocol",
+									Usage: "Allow password use only with `PROTOCOL` (" + strings.Join(pass_table.AppProtocols, ", ") + "), can be specified multiple times",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPasswordsCreate(be, ctx)
+							},
+						},
+						{
+							Name:      "remove",
+							Usage:     "Revoke app password",
+							ArgsUsage: "USERNAME NAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_authdb",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return appPasswordsRemove(be, ctx)
+							},
+						},
+					},
+				},
+				{
+					Name:  "totp",
+					Usage: "Second factor (TOTP) management",
+					Description: `Users with TOTP enabled cannot log in using the main password,
+				only using app passwords or session passwords issued via the REST API
+				(POST /v1/users/:id/totp/session) for the main password and the code.
+				Requires totp table in the pass_table configuration.
+				`,
+					Subcommands: []*cli.Command{
+						{
+							Name:      "status",
+							Usage:     "Show TOTP status of the user",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_authdb",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return usersTOTPStatus(be, ctx)
+							},
+						},
+						{
+							Name:      "enroll",
+							Usage:     "Enable TOTP for the user",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_authdb",
+								},
+								&cli.StringFlag{
+									Name:  "code",
+									Usage: "Use `CODE` instead of reading it from stdin",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return usersTOTPEnroll(be, ctx)
+							},
+						},
+						{
+							Name:      "disable",
+							Usage:     "Disable TOTP for the user",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_authdb",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openUserDB(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return usersTOTPDisable(be, ctx)
+							},
+						},
+					},
+				},
 			},
 		})
 }
@@ -244,3 +403,153 @@ func usersPassword(be module.PlainUserDB, ctx *cli.Context) error {
 
 	return be.SetUserPassword(username, pass)
 }
+
+func appPasswordDB(be module.PlainUserDB) (*pass_table.Auth, error) {
+	db, ok := be.(*pass_table.Auth)
+	if !ok {
+		return nil, cli.Exit("Error: app passwords are supported only by auth.pass_table", 2)
+	}
+	if !db.AppPasswordsEnabled() {
+		return nil, cli.Exit("Error: app_passwords table is not configured", 2)
+	}
+	return db, nil
+}
+
+func appPasswordsList(be module.PlainUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	db, err := appPasswordDB(be)
+	if err != nil {
+		return err
+	}
+
+	list, err := db.ListAppPasswords(username)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No app passwords.")
+	}
+	for _, ap := range list {
+		protocols := "any protocol"
+		if len(ap.Protocols) != 0 {
+			protocols = strings.Join(ap.Protocols, ", ")
+		}
+		lastUsed := "never used"
+		if !ap.LastUsedAt.IsZero() {
+			lastUsed = "last used " + ap.LastUsedAt.Local().Format(time.RFC3339)
+		}
+		expires := ""
+		if !ap.ExpiresAt.IsZero() {
+			expires = ", expires " + ap.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s (%s), created %s, %s%s\n", ap.Name, protocols, ap.CreatedAt.Local().Format(time.RFC3339), lastUsed, expires)
+	}
+	return nil
+}
+
+func appPasswordsCreate(be module.PlainUserDB, ctx *cli.Context) error {
+	username, name := ctx.Args().Get(0), ctx.Args().Get(1)
+	if username == "" || name == "" {
+		return cli.Exit("Error: USERNAME and NAME are required", 2)
+	}
+	db, err := appPasswordDB(be)
+	if err != nil {
+		return err
+	}
+
+	_, pass, err := db.CreateAppPassword(username, name, ctx.StringSlice("protocol"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(pass)
+	return nil
+}
+
+func appPasswordsRemove(be module.PlainUserDB, ctx *cli.Context) error {
+	username, name := ctx.Args().Get(0), ctx.Args().Get(1)
+	if username == "" || name == "" {
+		return cli.Exit("Error: USERNAME and NAME are required", 2)
+	}
+	db, err := appPasswordDB(be)
+	if err != nil {
+		return err
+	}
+
+	return db.DeleteAppPassword(username, name)
+}
+
+func totpDB(be module.PlainUserDB) (*pass_table.Auth, error) {
+	db, ok := be.(*pass_table.Auth)
+	if !ok {
+		return nil, cli.Exit("Error: TOTP is supported only by auth.pass_table", 2)
+	}
+	if !db.TOTPConfigured() {
+		return nil, cli.Exit("Error: totp table is not configured", 2)
+	}
+	return db, nil
+}
+
+func usersTOTPStatus(be module.PlainUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	db, err := totpDB(be)
+	if err != nil {
+		return err
+	}
+
+	status, err := db.GetTOTPStatus(username)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status.Enabled:
+		fmt.Println("enabled")
+	case status.Pending:
+		fmt.Println("enrollment is not confirmed")
+	default:
+		fmt.Println("disabled")
+	}
+	return nil
+}
+
+func usersTOTPEnroll(be module.PlainUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	db, err := totpDB(be)
+	if err != nil {
+		return err
+	}
+
+	secret, uri, err := db.EnrollTOTP(username)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Secret:", secret)
+	fmt.Fprintln(os.Stderr, "URI:", uri)
+
+	code, err := readTOTPCode(ctx)
+	if err != nil {
+		return err
+	}
+	return db.ConfirmTOTP(username, code)
+}
+
+func usersTOTPDisable(be module.PlainUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	db, err := totpDB(be)
+	if err != nil {
+		return err
+	}
+
+	return db.DisableTOTP(username)
+}
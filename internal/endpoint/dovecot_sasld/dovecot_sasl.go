@@ -54,7 +54,8 @@ func New(_ string, addrs []string) (module.Module, error) {
 	return &Endpoint{
 		addrs: addrs,
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/saslauth"},
+			Log:      log.Logger{Name: modName + "/saslauth"},
+			Protocol: modName,
 		},
 		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
 	}, nil
@@ -68,6 +69,20 @@ func (endp *Endpoint) InstanceName() string {
 	return modName
 }
 
+// serviceProtocol maps the Dovecot service name to the protocol passed to
+// authentication providers, so app passwords restricted to e.g. imap work
+// via Dovecot. Unknown services are reported as dovecot_sasld.
+func serviceProtocol(service string) string {
+	switch service {
+	case "imap", "smtp", "submission":
+		return service
+	case "sieve", "managesieve":
+		return "managesieve"
+	default:
+		return modName
+	}
+}
+
 func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
@@ -92,7 +107,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string) error { return nil })
+			saslAuth := endp.saslAuth
+			saslAuth.Protocol = serviceProtocol(req.Service)
+			return saslAuth.CreateSASL(mech, remoteAddr, func(_ string) error { return nil })
 		})
 	}
 
@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package eventsink implements the 'events' block that forwards events
+// published on the framework/events bus to HTTP webhooks and local unix
+// sockets.
+//
+//	events {
+//	    webhook https://hooks.example.org/maddy {
+//	        secret {env:WEBHOOK_SECRET}
+//	        events message.* user.*
+//	    }
+//	    socket unix:///run/maddy/events.sock
+//	}
+package eventsink
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "events"
+
+// sink is an events.Sink that owns background resources.
+type sink interface {
+	events.Sink
+	Close() error
+}
+
+type Endpoint struct {
+	logger log.Logger
+
+	sinks       []sink
+	unsubscribe []func()
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%s: no arguments expected", modName)
+	}
+	return &Endpoint{
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Callback("webhook", func(m *config.Map, node config.Node) error {
+		w, err := newWebhook(m.Globals, node, e.logger)
+		if err != nil {
+			return err
+		}
+		e.sinks = append(e.sinks, w)
+		return nil
+	})
+	cfg.Callback("socket", func(m *config.Map, node config.Node) error {
+		s, err := newSocket(m.Globals, node, e.logger)
+		if err != nil {
+			return err
+		}
+		e.sinks = append(e.sinks, s)
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		e.Close() //nolint:errcheck
+		return err
+	}
+	if len(e.sinks) == 0 {
+		return fmt.Errorf("%s: at least one webhook or socket should be configured", modName)
+	}
+
+	for _, s := range e.sinks {
+		e.unsubscribe = append(e.unsubscribe, events.Subscribe(s))
+	}
+	return nil
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	for _, unsub := range e.unsubscribe {
+		unsub()
+	}
+	e.unsubscribe = nil
+
+	var lastErr error
+	for _, s := range e.sinks {
+		if err := s.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	e.sinks = nil
+	return lastErr
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,209 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventsink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func directive(name string, args ...string) config.Node {
+	return config.Node{Name: name, Args: args}
+}
+
+func initEndpoint(t *testing.T, children ...config.Node) *Endpoint {
+	t.Helper()
+	mod, err := New(modName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	e.logger = testutils.Logger(t, modName)
+	if err := e.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []request
+		received = make(chan struct{}, 10)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, request{header: r.Header, body: body})
+		n := len(requests)
+		mu.Unlock()
+
+		switch n {
+		case 1:
+			// The first attempt of the first event is retried.
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			// Client errors are not retried.
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	webhook := config.Node{
+		Name: "webhook",
+		Args: []string{srv.URL},
+		Children: []config.Node{
+			directive("secret", "s3cret"),
+			directive("events", "user.*"),
+			directive("retry_delay", "10ms"),
+		},
+	}
+	initEndpoint(t, webhook)
+
+	events.Publish(events.AuthFailed, nil)
+	events.Publish(events.UserCreated, map[string]interface{}{"username": "foo@example.org"})
+	events.Publish(events.UserDeleted, map[string]interface{}{"username": "foo@example.org"})
+	events.Publish(events.UserPasswordChanged, map[string]interface{}{"username": "bar@example.org"})
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d requests received", i)
+		}
+	}
+	select {
+	case <-received:
+		t.Fatal("unexpected request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{events.UserCreated, events.UserCreated, events.UserDeleted, events.UserPasswordChanged}
+	for i, req := range requests {
+		var ev events.Event
+		if err := json.Unmarshal(req.body, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != expected[i] || req.header.Get(EventHeader) != expected[i] {
+			t.Errorf("request %d: expected %s, got %s", i, expected[i], ev.Type)
+		}
+		if req.header.Get(DeliveryHeader) != ev.ID {
+			t.Errorf("request %d: wrong delivery ID", i)
+		}
+		if sig := req.header.Get(SignatureHeader); sig != "sha256="+Sign([]byte("s3cret"), req.body) {
+			t.Errorf("request %d: wrong signature: %s", i, sig)
+		}
+	}
+	if string(requests[0].body) != string(requests[1].body) {
+		t.Error("retried request should have the same body")
+	}
+}
+
+func TestSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	socket := config.Node{
+		Name:     "socket",
+		Args:     []string{"unix://" + path},
+		Children: []config.Node{directive("events", "message.*")},
+	}
+	initEndpoint(t, socket)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the client to be registered.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events.Publish(events.MessageAccepted, map[string]interface{}{"msgId": "1"})
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)) //nolint:errcheck
+		var b [1]byte
+		if _, err := conn.Read(b[:]); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no events received")
+		}
+	}
+	conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	events.Publish(events.UserCreated, nil)
+	events.Publish(events.MessageBounced, map[string]interface{}{"msgId": "2"})
+
+	// Skip events published while waiting.
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ev events.Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			continue
+		}
+		if ev.Type == events.MessageAccepted {
+			continue
+		}
+		if ev.Type != events.MessageBounced || ev.Data["msgId"] != "2" {
+			t.Errorf("wrong event: %+v", ev)
+		}
+		break
+	}
+}
+
+func TestInit_Errors(t *testing.T) {
+	for _, children := range [][]config.Node{
+		nil,
+		{directive("webhook", "ftp://example.org")},
+		{directive("webhook")},
+		{directive("socket", "tcp://127.0.0.1:0")},
+	} {
+		mod, err := New(modName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{Children: children})); err == nil {
+			mod.(*Endpoint).Close()
+			t.Errorf("expected error for %v", children)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventsink
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// socketClientQueue is the amount of events buffered for each client.
+// Events are dropped for clients that do not keep up.
+const socketClientQueue = 256
+
+// socket streams events as newline-delimited JSON to all clients connected
+// to the unix socket. Clients are not expected to send anything.
+type socket struct {
+	endp   config.Endpoint
+	filter []string
+	log    log.Logger
+
+	l       net.Listener
+	clients map[*socketClient]struct{}
+	closed  bool
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+}
+
+type socketClient struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+func newSocket(globals map[string]interface{}, node config.Node, logger log.Logger) (*socket, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument is required (unix://PATH)")
+	}
+	endp, err := config.ParseEndpoint(node.Args[0])
+	if err != nil {
+		return nil, config.NodeErr(node, "malformed endpoint: %v", err)
+	}
+	if endp.Network() != "unix" {
+		return nil, config.NodeErr(node, "only unix sockets are supported")
+	}
+
+	s := &socket{
+		endp:    endp,
+		log:     logger,
+		clients: map[*socketClient]struct{}{},
+	}
+	s.log.Name = modName + "/socket"
+
+	var permStr string
+	m := config.NewMap(globals, node)
+	m.StringList("events", false, false, nil, &s.filter)
+	m.String("permissions", false, false, "0660", &permStr)
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+	perm, err := strconv.ParseUint(permStr, 8, 32)
+	if err != nil || perm > 0o777 {
+		return nil, config.NodeErr(node, "invalid permissions: %s", permStr)
+	}
+
+	s.l, err = net.Listen(endp.Network(), endp.Address())
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	if err := os.Chmod(endp.Address(), os.FileMode(perm)); err != nil {
+		s.l.Close()
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	s.log.Println("listening on", endp.String())
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *socket) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error("accept failed", err)
+			}
+			return
+		}
+
+		c := &socketClient{
+			conn:  conn,
+			queue: make(chan []byte, socketClientQueue),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.write(c)
+	}
+}
+
+func (s *socket) write(c *socketClient) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	for line := range c.queue {
+		if _, err := c.conn.Write(line); err != nil {
+			s.log.DebugMsg("client disconnected", "reason", err.Error())
+			return
+		}
+	}
+}
+
+func (s *socket) Handle(ev events.Event) {
+	if !events.Match(s.filter, ev.Type) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.clients) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		s.log.Error("failed to serialize event", err, "event", ev.Type, "id", ev.ID)
+		return
+	}
+	line = append(line, '\n')
+
+	for c := range s.clients {
+		select {
+		case c.queue <- line:
+		default:
+			s.log.Msg("client is too slow, event dropped", "event", ev.Type, "id", ev.ID)
+		}
+	}
+}
+
+func (s *socket) Close() error {
+	err := s.l.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		close(c.queue)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
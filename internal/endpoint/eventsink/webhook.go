@@ -0,0 +1,248 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventsink
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	// SignatureHeader contains "sha256=" followed by the hex-encoded
+	// HMAC-SHA256 of the request body if secret is set.
+	SignatureHeader = "X-Maddy-Signature"
+	EventHeader     = "X-Maddy-Event"
+	DeliveryHeader  = "X-Maddy-Delivery"
+)
+
+// webhook POSTs events as JSON to the URL.
+//
+// Events are delivered in order by a single goroutine. Failed requests are
+// retried with exponentially growing delay, the event is dropped after
+// maxTries attempts. If the queue is full, new events are dropped.
+type webhook struct {
+	url        string
+	secret     []byte
+	filter     []string
+	maxTries   int
+	retryDelay time.Duration
+	client     http.Client
+	log        log.Logger
+
+	queue chan events.Event
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+const (
+	defaultMaxTries   = 8
+	defaultRetryDelay = 5 * time.Second
+	defaultTimeout    = 10 * time.Second
+	defaultQueueSize  = 1000
+)
+
+func newWebhook(globals map[string]interface{}, node config.Node, logger log.Logger) (*webhook, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument is required (URL)")
+	}
+	w, err := newWebhookURL(node.Args[0], logger)
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+
+	var (
+		secret    string
+		queueSize int
+	)
+	m := config.NewMap(globals, node)
+	m.String("secret", false, false, "", &secret)
+	m.StringList("events", false, false, nil, &w.filter)
+	m.Int("max_tries", false, false, defaultMaxTries, &w.maxTries)
+	m.Duration("retry_delay", false, false, defaultRetryDelay, &w.retryDelay)
+	m.Duration("timeout", false, false, defaultTimeout, &w.client.Timeout)
+	m.Int("queue_size", false, false, defaultQueueSize, &queueSize)
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+	if w.maxTries < 1 {
+		return nil, config.NodeErr(node, "max_tries should be at least 1")
+	}
+	if queueSize < 1 {
+		return nil, config.NodeErr(node, "queue_size should be at least 1")
+	}
+	w.secret = []byte(secret)
+
+	w.start(queueSize)
+	return w, nil
+}
+
+// newWebhookURL creates the webhook with default settings, it should be
+// started using start.
+func newWebhookURL(rawURL string, logger log.Logger) (*webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %s", rawURL)
+	}
+
+	w := &webhook{
+		url:        rawURL,
+		maxTries:   defaultMaxTries,
+		retryDelay: defaultRetryDelay,
+		client:     http.Client{Timeout: defaultTimeout},
+		log:        logger,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	w.log.Name = modName + "/webhook"
+	return w, nil
+}
+
+func (w *webhook) start(queueSize int) {
+	w.queue = make(chan events.Event, queueSize)
+	go w.run()
+}
+
+// SubscribeWebhook starts a webhook sink with default settings for events
+// matching filter. It is meant for modules that have their own webhook
+// directive. The returned function unsubscribes and stops the sink.
+func SubscribeWebhook(rawURL string, filter []string, logger log.Logger) (func(), error) {
+	w, err := newWebhookURL(rawURL, logger)
+	if err != nil {
+		return nil, err
+	}
+	w.filter = filter
+	w.start(defaultQueueSize)
+
+	unsubscribe := events.Subscribe(w)
+	return func() {
+		unsubscribe()
+		w.Close() //nolint:errcheck
+	}, nil
+}
+
+func (w *webhook) Handle(ev events.Event) {
+	if !events.Match(w.filter, ev.Type) {
+		return
+	}
+	select {
+	case w.queue <- ev:
+	default:
+		w.log.Msg("queue is full, event dropped", "url", w.url, "event", ev.Type, "id", ev.ID)
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for {
+		select {
+		case ev := <-w.queue:
+			w.deliver(ev)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// deliver tries to send the event until it succeeds, fails permanently or
+// the sink is closed.
+func (w *webhook) deliver(ev events.Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		w.log.Error("failed to serialize event", err, "event", ev.Type, "id", ev.ID)
+		return
+	}
+
+	delay := w.retryDelay
+	for attempt := 1; ; attempt++ {
+		permanent, err := w.send(ev, body)
+		if err == nil {
+			w.log.DebugMsg("event delivered", "url", w.url, "event", ev.Type, "id", ev.ID)
+			return
+		}
+		if permanent || attempt >= w.maxTries {
+			w.log.Error("event dropped", err, "url", w.url, "event", ev.Type, "id", ev.ID, "attempts", attempt)
+			return
+		}
+		w.log.Error("webhook request failed, will retry", err, "url", w.url, "event", ev.Type, "id", ev.ID,
+			"attempt", attempt, "next_try_delay", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+			return
+		}
+		delay *= 2
+	}
+}
+
+// send makes a single request. permanent is true if retrying will not help.
+func (w *webhook) send(ev events.Event, body []byte) (permanent bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, ev.Type)
+	req.Header.Set(DeliveryHeader, ev.ID)
+	if len(w.secret) != 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	case resp.StatusCode/100 == 4:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+}
+
+func (w *webhook) Close() error {
+	close(w.stop)
+	<-w.done
+	return nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of body. Receivers can use it
+// to verify the SignatureHeader value.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
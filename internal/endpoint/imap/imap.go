@@ -65,6 +65,10 @@ type Endpoint struct {
 	authNormalize    authz.NormalizeFunc
 	authMap          module.Table
 
+	// quotaMoveExempt lists mailboxes that accept MOVE regardless of their
+	// quota caps.
+	quotaMoveExempt []string
+
 	Log log.Logger
 }
 
@@ -73,7 +77,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: modName,
 		},
 	}
 
@@ -97,6 +102,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.StringList("quota_move_exempt", false, false, nil, &endp.quotaMoveExempt)
 	config.EnumMapped(cfg, "storage_map_normalize", false, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.storageNormalize)
 	modconfig.Table(cfg, "storage_map", false, false, nil, &endp.storageMap)
@@ -141,10 +147,11 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 	endp.saslAuth.AuthNormalize = endp.authNormalize
 	endp.saslAuth.AuthMap = endp.authMap
+	endp.saslAuth.TLSConfig = endp.tlsConfig
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
+			return endp.saslAuth.CreateSASLTLS(mech, c.Info().RemoteAddr, c.Info().TLS, func(identity string) error {
 				return endp.openAccount(c, identity)
 			})
 		})
@@ -284,9 +291,10 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.AuthPlainFrom(connInfo.RemoteAddr, username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
+		auth.PublishFailure(endp.saslAuth.Protocol, username, connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
@@ -318,6 +326,10 @@ func (endp *Endpoint) enableExtensions() error {
 			endp.serv.Enable(i18nlevel.NewExtension())
 		case "SORT":
 			endp.serv.Enable(sortthread.NewSortExtension())
+		case "QUOTA":
+			if be, ok := endp.Store.(module.QuotaStorage); ok {
+				newQuotaExtension(be, endp.Log, endp.quotaMoveExempt).enableMove(endp.serv)
+			}
 		}
 		if strings.HasPrefix(ext, "THREAD") {
 			endp.serv.Enable(sortthread.NewThreadExtension())
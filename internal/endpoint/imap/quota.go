@@ -0,0 +1,442 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Each account has a single quota root named "" that covers all its
+// mailboxes.
+const quotaRoot = ""
+
+// quotaExtension implements the QUOTA extension (RFC 9208) on top of
+// module.QuotaStorage.
+//
+// APPEND and COPY (including UID COPY) are rejected with OVERQUOTA if they
+// would make the account exceed its limits or, if the store implements
+// module.MailboxQuotaStorage, the target mailbox exceed its cap. MOVE does
+// not change the account usage, so only the cap of the target mailbox is
+// checked for it. Mailboxes listed in moveExempt (e.g. Trash) accept MOVE
+// regardless of their cap so users can clean up a full account.
+//
+// After successful APPEND and COPY, quota warnings are checked if the store
+// implements module.QuotaWarningStorage.
+type quotaExtension struct {
+	store      module.QuotaStorage
+	log        log.Logger
+	moveExempt map[string]bool
+
+	// moveEnabled is set by enableMove, see Command.
+	moveEnabled bool
+}
+
+func newQuotaExtension(store module.QuotaStorage, log log.Logger, moveExempt []string) *quotaExtension {
+	ext := &quotaExtension{store: store, log: log, moveExempt: make(map[string]bool, len(moveExempt))}
+	for _, mbox := range moveExempt {
+		ext.moveExempt[imap.CanonicalMailboxName(mbox)] = true
+	}
+	return ext
+}
+
+// enableMove registers the extension on the server along with the MOVE
+// handler.
+//
+// imapserver.Server.Enable ignores extensions that return a MOVE handler
+// since it assumes they duplicate the built-in one, so MOVE is returned by
+// Command only after the extension is registered.
+func (ext *quotaExtension) enableMove(srv *imapserver.Server) {
+	srv.Enable(ext)
+	ext.moveEnabled = true
+}
+
+func (ext *quotaExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+
+	return []string{"QUOTA", "QUOTA=RES-STORAGE", "QUOTA=RES-MESSAGE"}
+}
+
+func (ext *quotaExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() imapserver.Handler {
+			return &getQuotaHandler{ext: ext}
+		}
+	case "GETQUOTAROOT":
+		return func() imapserver.Handler {
+			return &getQuotaRootHandler{ext: ext}
+		}
+	case "APPEND":
+		return func() imapserver.Handler {
+			return &quotaAppendHandler{ext: ext}
+		}
+	case "COPY":
+		return func() imapserver.Handler {
+			return &quotaCopyHandler{ext: ext}
+		}
+	case "MOVE":
+		if !ext.moveEnabled {
+			return nil
+		}
+		return func() imapserver.Handler {
+			return &quotaMoveHandler{ext: ext}
+		}
+	}
+	return nil
+}
+
+func (ext *quotaExtension) quota(u imapbackend.User) (module.Quota, error) {
+	q, err := ext.store.GetQuota(u.Username())
+	if err != nil {
+		ext.log.Error("failed to get quota", err, "username", u.Username())
+		return module.Quota{}, fmt.Errorf("internal server error")
+	}
+	return q, nil
+}
+
+func exceeds(q module.Quota, size, count int64) bool {
+	return (q.StorageLimit != 0 && q.StorageUsed+size > q.StorageLimit) ||
+		(q.MessagesLimit != 0 && q.MessagesUsed+count > q.MessagesLimit)
+}
+
+func overQuota() error {
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "OVERQUOTA",
+		Info: "Quota exceeded",
+	}}
+}
+
+// publishOverQuota publishes the quota.exceeded event for rejected APPEND
+// or COPY.
+func publishOverQuota(username, mailbox string, q module.Quota, size int64) {
+	if !events.Enabled() {
+		return
+	}
+	data := map[string]interface{}{
+		"username":      username,
+		"protocol":      "imap",
+		"size":          size,
+		"usedBytes":     q.StorageUsed,
+		"quotaBytes":    q.StorageLimit,
+		"messagesUsed":  q.MessagesUsed,
+		"messagesQuota": q.MessagesLimit,
+	}
+	if mailbox != "" {
+		data["mailbox"] = mailbox
+	}
+	events.Publish(events.QuotaExceeded, data)
+}
+
+// check returns the OVERQUOTA status response if adding messages of
+// the specified total size to the mailbox would exceed limits of the
+// account or of the mailbox itself.
+func (ext *quotaExtension) check(u imapbackend.User, mailbox string, size, count int64) error {
+	q, err := ext.quota(u)
+	if err != nil {
+		return err
+	}
+
+	if exceeds(q, size, count) {
+		ext.log.Msg("quota exceeded", "username", u.Username(),
+			"used_bytes", q.StorageUsed, "limit_bytes", q.StorageLimit,
+			"used_messages", q.MessagesUsed, "limit_messages", q.MessagesLimit)
+		publishOverQuota(u.Username(), "", q, size)
+		return overQuota()
+	}
+
+	return ext.checkMailbox(u, mailbox, size, count)
+}
+
+// checkMailbox is similar to check but only checks the cap of the mailbox.
+func (ext *quotaExtension) checkMailbox(u imapbackend.User, mailbox string, size, count int64) error {
+	mboxStore, ok := ext.store.(module.MailboxQuotaStorage)
+	if !ok {
+		return nil
+	}
+	mq, err := mboxStore.GetMailboxQuota(u.Username(), mailbox)
+	if err != nil {
+		ext.log.Error("failed to get mailbox quota", err, "username", u.Username(), "mailbox", mailbox)
+		return fmt.Errorf("internal server error")
+	}
+	if exceeds(mq, size, count) {
+		ext.log.Msg("mailbox quota exceeded", "username", u.Username(), "mailbox", mailbox,
+			"used_bytes", mq.StorageUsed, "limit_bytes", mq.StorageLimit,
+			"used_messages", mq.MessagesUsed, "limit_messages", mq.MessagesLimit)
+		publishOverQuota(u.Username(), mailbox, mq, size)
+		return overQuota()
+	}
+	return nil
+}
+
+// warn checks quota warnings of the account after messages are added to it.
+func (ext *quotaExtension) warn(u imapbackend.User) {
+	if warnStore, ok := ext.store.(module.QuotaWarningStorage); ok {
+		warnStore.CheckQuotaWarnings(u.Username())
+	}
+}
+
+// quotaResources returns the resource list for the QUOTA response. Only
+// limited resources are included. STORAGE is reported in units of
+// 1024 octets, usage is rounded up and limit is rounded down.
+func quotaResources(q module.Quota) []interface{} {
+	res := []interface{}{}
+	if q.StorageLimit != 0 {
+		res = append(res, imap.RawString("STORAGE"),
+			number((q.StorageUsed+1023)/1024), number(q.StorageLimit/1024))
+	}
+	if q.MessagesLimit != 0 {
+		res = append(res, imap.RawString("MESSAGE"),
+			number(q.MessagesUsed), number(q.MessagesLimit))
+	}
+	return res
+}
+
+func number(n int64) imap.RawString {
+	return imap.RawString(strconv.FormatInt(n, 10))
+}
+
+type quotaResp struct {
+	root      string
+	resources []interface{}
+}
+
+func (r *quotaResp) WriteTo(w *imap.Writer) error {
+	return (&imap.DataResp{Fields: []interface{}{imap.RawString("QUOTA"), r.root, r.resources}}).WriteTo(w)
+}
+
+type quotaRootResp struct {
+	mailbox string
+	roots   []string
+}
+
+func (r *quotaRootResp) WriteTo(w *imap.Writer) error {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(r.mailbox)
+	fields := []interface{}{imap.RawString("QUOTAROOT"), imap.FormatMailboxName(mailbox)}
+	for _, root := range r.roots {
+		fields = append(fields, root)
+	}
+	return (&imap.DataResp{Fields: fields}).WriteTo(w)
+}
+
+type getQuotaHandler struct {
+	ext  *quotaExtension
+	root string
+}
+
+func (h *getQuotaHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTA expects a single argument")
+	}
+	root, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.root = root
+	return nil
+}
+
+func (h *getQuotaHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	q, err := h.ext.quota(ctx.User)
+	if err != nil {
+		return err
+	}
+	resources := quotaResources(q)
+	if h.root != quotaRoot || len(resources) == 0 {
+		return errors.New("No such quota root")
+	}
+
+	return conn.WriteResp(&quotaResp{root: quotaRoot, resources: resources})
+}
+
+type getQuotaRootHandler struct {
+	ext     *quotaExtension
+	mailbox string
+}
+
+func (h *getQuotaRootHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTAROOT expects a single argument")
+	}
+	mailbox, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	mailbox, err = utf7.Encoding.NewDecoder().String(mailbox)
+	if err != nil {
+		return err
+	}
+	h.mailbox = imap.CanonicalMailboxName(mailbox)
+	return nil
+}
+
+func (h *getQuotaRootHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if _, err := ctx.User.Status(h.mailbox, []imap.StatusItem{imap.StatusUidValidity}); err != nil {
+		return err
+	}
+
+	q, err := h.ext.quota(ctx.User)
+	if err != nil {
+		return err
+	}
+	resources := quotaResources(q)
+	if len(resources) == 0 {
+		return conn.WriteResp(&quotaRootResp{mailbox: h.mailbox})
+	}
+
+	if err := conn.WriteResp(&quotaRootResp{mailbox: h.mailbox, roots: []string{quotaRoot}}); err != nil {
+		return err
+	}
+	return conn.WriteResp(&quotaResp{root: quotaRoot, resources: resources})
+}
+
+type quotaAppendHandler struct {
+	imapserver.Append
+	ext *quotaExtension
+}
+
+func (h *quotaAppendHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if err := h.ext.check(ctx.User, h.Mailbox, int64(h.Message.Len()), 1); err != nil {
+		return err
+	}
+	if err := h.Append.Handle(conn); err != nil {
+		return err
+	}
+	h.ext.warn(ctx.User)
+	return nil
+}
+
+// selectedSize returns the total size and the number of messages in the
+// set from the selected mailbox.
+func selectedSize(mbox imapbackend.Mailbox, uid bool, seqSet *imap.SeqSet) (size, count int64, err error) {
+	var (
+		ch   = make(chan *imap.Message)
+		done = make(chan error, 1)
+	)
+	go func() {
+		done <- mbox.ListMessages(uid, seqSet, []imap.FetchItem{imap.FetchRFC822Size}, ch)
+	}()
+	for msg := range ch {
+		size += int64(msg.Size)
+		count++
+	}
+	return size, count, <-done
+}
+
+type quotaCopyHandler struct {
+	imapserver.Copy
+	ext *quotaExtension
+}
+
+func (h *quotaCopyHandler) check(conn imapserver.Conn, uid bool) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	size, count, err := selectedSize(ctx.Mailbox, uid, h.SeqSet)
+	if err != nil {
+		return err
+	}
+	return h.ext.check(ctx.User, h.Mailbox, size, count)
+}
+
+func (h *quotaCopyHandler) Handle(conn imapserver.Conn) error {
+	if err := h.check(conn, false); err != nil {
+		return err
+	}
+	if err := h.Copy.Handle(conn); err != nil {
+		return err
+	}
+	h.ext.warn(conn.Context().User)
+	return nil
+}
+
+func (h *quotaCopyHandler) UidHandle(conn imapserver.Conn) error {
+	if err := h.check(conn, true); err != nil {
+		return err
+	}
+	if err := h.Copy.UidHandle(conn); err != nil {
+		return err
+	}
+	h.ext.warn(conn.Context().User)
+	return nil
+}
+
+type quotaMoveHandler struct {
+	imapserver.Move
+	ext *quotaExtension
+}
+
+func (h *quotaMoveHandler) check(conn imapserver.Conn, uid bool) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if h.ext.moveExempt[h.Mailbox] || ctx.Mailbox.Name() == h.Mailbox {
+		return nil
+	}
+
+	size, count, err := selectedSize(ctx.Mailbox, uid, h.SeqSet)
+	if err != nil {
+		return err
+	}
+	return h.ext.checkMailbox(ctx.User, h.Mailbox, size, count)
+}
+
+func (h *quotaMoveHandler) Handle(conn imapserver.Conn) error {
+	if err := h.check(conn, false); err != nil {
+		return err
+	}
+	return h.Move.Handle(conn)
+}
+
+func (h *quotaMoveHandler) UidHandle(conn imapserver.Conn) error {
+	if err := h.check(conn, true); err != nil {
+		return err
+	}
+	return h.Move.UidHandle(conn)
+}
@@ -0,0 +1,360 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockQuotaStorage struct {
+	module.Storage
+
+	lock  sync.Mutex
+	quota module.Quota
+}
+
+func (m *mockQuotaStorage) GetQuota(username string) (module.Quota, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.quota, nil
+}
+
+func (m *mockQuotaStorage) set(q module.Quota) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.quota = q
+}
+
+type mockMailboxQuotaStorage struct {
+	mockQuotaStorage
+
+	mailboxes map[string]module.Quota
+}
+
+func (m *mockMailboxQuotaStorage) GetMailboxQuota(username, mailbox string) (module.Quota, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.mailboxes[mailbox], nil
+}
+
+type mockWarningQuotaStorage struct {
+	mockQuotaStorage
+
+	checked []string
+}
+
+func (m *mockWarningQuotaStorage) CheckQuotaWarnings(username string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checked = append(m.checked, username)
+}
+
+func (m *mockWarningQuotaStorage) checks() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.checked)
+}
+
+type quotaConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// cmd sends the command and returns all response lines, including the
+// tagged one.
+func (c *quotaConn) cmd(line string) []string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte("T " + line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	var lines []string
+	for {
+		l, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		l = strings.TrimRight(l, "\r\n")
+		lines = append(lines, l)
+		if strings.HasPrefix(l, "T ") {
+			return lines
+		}
+	}
+}
+
+func setupQuotaServer(t *testing.T, store module.QuotaStorage, moveExempt ...string) *quotaConn {
+	t.Helper()
+
+	srv := imapserver.New(memory.New())
+	srv.AllowInsecureAuth = true
+	srv.ErrorLog = testutils.Logger(t, "imap")
+	newQuotaExtension(store, testutils.Logger(t, "imap"), moveExempt).enableMove(srv)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &quotaConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if _, err := c.r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if res := c.cmd("LOGIN username password"); !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("login failed: %v", res)
+	}
+	return c
+}
+
+func TestQuota_Report(t *testing.T) {
+	store := &mockQuotaStorage{quota: module.Quota{
+		StorageUsed:  1500,
+		StorageLimit: 10240,
+	}}
+	c := setupQuotaServer(t, store)
+
+	res := c.cmd("CAPABILITY")
+	if !strings.Contains(res[0], " QUOTA ") || !strings.Contains(res[0], "QUOTA=RES-STORAGE") {
+		t.Errorf("QUOTA is not advertised: %v", res[0])
+	}
+
+	res = c.cmd("GETQUOTAROOT INBOX")
+	if len(res) != 3 || res[0] != `* QUOTAROOT INBOX ""` || res[1] != `* QUOTA "" (STORAGE 2 10)` {
+		t.Errorf("unexpected GETQUOTAROOT response: %q", res)
+	}
+
+	res = c.cmd(`GETQUOTA ""`)
+	if len(res) != 2 || res[0] != `* QUOTA "" (STORAGE 2 10)` {
+		t.Errorf("unexpected GETQUOTA response: %q", res)
+	}
+
+	res = c.cmd(`GETQUOTA "other"`)
+	if !strings.HasPrefix(res[0], "T NO") {
+		t.Errorf("unexpected GETQUOTA response for unknown root: %q", res)
+	}
+
+	store.set(module.Quota{
+		StorageUsed:   1500,
+		StorageLimit:  10240,
+		MessagesUsed:  1,
+		MessagesLimit: 100,
+	})
+	res = c.cmd(`GETQUOTA ""`)
+	if res[0] != `* QUOTA "" (STORAGE 2 10 MESSAGE 1 100)` {
+		t.Errorf("unexpected GETQUOTA response: %q", res)
+	}
+
+	res = c.cmd("GETQUOTAROOT Nonexistent")
+	if !strings.HasPrefix(res[0], "T NO") {
+		t.Errorf("unexpected GETQUOTAROOT response for missing mailbox: %q", res)
+	}
+}
+
+func TestQuota_Unlimited(t *testing.T) {
+	c := setupQuotaServer(t, &mockQuotaStorage{})
+
+	res := c.cmd("GETQUOTAROOT INBOX")
+	if len(res) != 2 || res[0] != `* QUOTAROOT INBOX` {
+		t.Errorf("unexpected GETQUOTAROOT response: %q", res)
+	}
+
+	res = c.cmd(`GETQUOTA ""`)
+	if !strings.HasPrefix(res[0], "T NO") {
+		t.Errorf("unexpected GETQUOTA response: %q", res)
+	}
+
+	res = c.cmd("APPEND INBOX {5+}\r\nHello")
+	if !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Errorf("APPEND failed: %q", res)
+	}
+}
+
+func TestQuota_Append(t *testing.T) {
+	store := &mockQuotaStorage{quota: module.Quota{
+		StorageUsed:  1000,
+		StorageLimit: 1024,
+	}}
+	c := setupQuotaServer(t, store)
+
+	res := c.cmd("APPEND INBOX {30+}\r\n" + strings.Repeat("a", 30))
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("APPEND over quota: %q", res)
+	}
+
+	res = c.cmd("APPEND INBOX {20+}\r\n" + strings.Repeat("a", 20))
+	if !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Errorf("APPEND within quota failed: %q", res)
+	}
+
+	store.set(module.Quota{MessagesUsed: 10, MessagesLimit: 10})
+	res = c.cmd("APPEND INBOX {20+}\r\n" + strings.Repeat("a", 20))
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("APPEND over message quota: %q", res)
+	}
+}
+
+func TestQuota_Copy(t *testing.T) {
+	store := &mockQuotaStorage{quota: module.Quota{
+		StorageLimit: 100,
+	}}
+	c := setupQuotaServer(t, store)
+
+	if res := c.cmd("SELECT INBOX"); !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("SELECT failed: %q", res)
+	}
+
+	// The test message in memory backend is larger than 100 bytes.
+	res := c.cmd("COPY 1 INBOX")
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("COPY over quota: %q", res)
+	}
+	res = c.cmd("UID COPY 1:* INBOX")
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("UID COPY over quota: %q", res)
+	}
+
+	store.set(module.Quota{StorageLimit: 4096})
+	res = c.cmd("COPY 1 INBOX")
+	if !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Errorf("COPY within quota failed: %q", res)
+	}
+}
+
+func TestQuota_Warnings(t *testing.T) {
+	store := &mockWarningQuotaStorage{mockQuotaStorage: mockQuotaStorage{quota: module.Quota{
+		StorageLimit: 100,
+	}}}
+	c := setupQuotaServer(t, store)
+
+	res := c.cmd("APPEND INBOX {120+}\r\n" + strings.Repeat("a", 120))
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("APPEND over quota: %q", res)
+	}
+	if n := store.checks(); n != 0 {
+		t.Fatalf("warnings checked for rejected APPEND")
+	}
+
+	res = c.cmd("APPEND INBOX {20+}\r\n" + strings.Repeat("a", 20))
+	if !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("APPEND within quota failed: %q", res)
+	}
+	if n := store.checks(); n != 1 {
+		t.Fatalf("warnings checked %d times after APPEND, want 1", n)
+	}
+
+	store.set(module.Quota{StorageLimit: 4096})
+	if res := c.cmd("SELECT INBOX"); !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("SELECT failed: %q", res)
+	}
+	res = c.cmd("UID COPY 1 INBOX")
+	if !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("UID COPY within quota failed: %q", res)
+	}
+	if n := store.checks(); n != 2 {
+		t.Fatalf("warnings checked %d times after COPY, want 2", n)
+	}
+	if store.checked[1] != "username" {
+		t.Errorf("wrong account checked: %s", store.checked[1])
+	}
+}
+
+func TestQuota_MailboxCap(t *testing.T) {
+	store := &mockMailboxQuotaStorage{mailboxes: map[string]module.Quota{
+		"INBOX": {MessagesUsed: 1, MessagesLimit: 1},
+	}}
+	c := setupQuotaServer(t, store)
+
+	res := c.cmd("APPEND INBOX {20+}\r\n" + strings.Repeat("a", 20))
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("APPEND over mailbox cap: %q", res)
+	}
+
+	if res := c.cmd("SELECT INBOX"); !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("SELECT failed: %q", res)
+	}
+	res = c.cmd("COPY 1 INBOX")
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("COPY over mailbox cap: %q", res)
+	}
+
+	store.lock.Lock()
+	store.mailboxes["INBOX"] = module.Quota{MessagesUsed: 1, MessagesLimit: 10}
+	store.lock.Unlock()
+	res = c.cmd("APPEND INBOX {20+}\r\n" + strings.Repeat("a", 20))
+	if !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Errorf("APPEND within mailbox cap failed: %q", res)
+	}
+}
+
+func TestQuota_MoveMailboxCap(t *testing.T) {
+	store := &mockMailboxQuotaStorage{
+		// The account quota is not checked for MOVE.
+		mockQuotaStorage: mockQuotaStorage{quota: module.Quota{StorageLimit: 1}},
+		mailboxes: map[string]module.Quota{
+			"Archive": {MessagesUsed: 1, MessagesLimit: 1},
+			"Trash":   {MessagesUsed: 1, MessagesLimit: 1},
+		},
+	}
+	c := setupQuotaServer(t, store, "Trash")
+
+	for _, mbox := range []string{"Archive", "Trash"} {
+		if res := c.cmd("CREATE " + mbox); !strings.HasPrefix(res[len(res)-1], "T OK") {
+			t.Fatalf("CREATE failed: %q", res)
+		}
+	}
+	if res := c.cmd("SELECT INBOX"); !strings.HasPrefix(res[len(res)-1], "T OK") {
+		t.Fatalf("SELECT failed: %q", res)
+	}
+
+	res := c.cmd("MOVE 1 Archive")
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("MOVE over mailbox cap: %q", res)
+	}
+	res = c.cmd("UID MOVE 1:* Archive")
+	if res[len(res)-1] != "T NO [OVERQUOTA] Quota exceeded" {
+		t.Errorf("UID MOVE over mailbox cap: %q", res)
+	}
+
+	// The memory backend does not implement MOVE, so the command still
+	// fails, but not because of the cap.
+	res = c.cmd("MOVE 1 Trash")
+	if strings.Contains(res[len(res)-1], "OVERQUOTA") {
+		t.Errorf("MOVE into exempt mailbox: %q", res)
+	}
+	res = c.cmd("MOVE 1 INBOX")
+	if strings.Contains(res[len(res)-1], "OVERQUOTA") {
+		t.Errorf("MOVE within unlimited mailbox: %q", res)
+	}
+}
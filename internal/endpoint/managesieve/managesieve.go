@@ -0,0 +1,269 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package managesieve implements the ManageSieve (RFC 5804) endpoint that
+// allows users to manage Sieve scripts used by imap.filter.sieve.
+package managesieve
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+)
+
+const (
+	modName = "managesieve"
+
+	// Connections without any command for that long are closed.
+	idleTimeout = 30 * time.Minute
+)
+
+type scriptStore interface {
+	List(username string) ([]sieve.ScriptInfo, error)
+	Get(username, name string) (string, error)
+	Put(username, name, content string) error
+	SetActive(username, name string) error
+	Delete(username, name string) error
+	Rename(username, oldName, newName string) error
+}
+
+type Endpoint struct {
+	addrs         []string
+	listeners     []net.Listener
+	proxyProtocol *proxy_protocol.ProxyProtocol
+	tlsConfig     *tls.Config
+	insecureAuth  bool
+	listenersWg   sync.WaitGroup
+
+	saslAuth auth.SASLAuth
+	store    scriptStore
+
+	maxScriptSize int
+	maxScripts    int
+
+	storageNormalize authz.NormalizeFunc
+	storageMap       module.Table
+	authNormalize    authz.NormalizeFunc
+	authMap          module.Table
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+
+	Log log.Logger
+}
+
+func New(_ string, addrs []string) (module.Module, error) {
+	return &Endpoint{
+		addrs: addrs,
+		Log:   log.Logger{Name: modName},
+		saslAuth: auth.SASLAuth{
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: modName,
+		},
+		conns: map[net.Conn]struct{}{},
+	}, nil
+}
+
+func (endp *Endpoint) Init(cfg *config.Map) error {
+	var (
+		storage       module.Storage
+		maxScriptSize int64
+	)
+
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddProvider(m, node)
+	})
+	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &storage)
+	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Bool("insecure_auth", false, false, &endp.insecureAuth)
+	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.DataSize("max_script_size", false, false, 64*1024, &maxScriptSize)
+	cfg.Int("max_scripts", false, false, 16, &endp.maxScripts)
+	config.EnumMapped(cfg, "storage_map_normalize", false, false, authz.NormalizeFuncs, authz.NormalizeAuto,
+		&endp.storageNormalize)
+	modconfig.Table(cfg, "storage_map", false, false, nil, &endp.storageMap)
+	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
+		&endp.authNormalize)
+	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.authMap)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	endp.maxScriptSize = int(maxScriptSize)
+
+	sqlStorage, ok := storage.(*imapsql.Storage)
+	if !ok {
+		return errors.New("managesieve: storage.imapsql is required")
+	}
+	store := &sieve.Store{DB: sqlStorage.Back.DB, Driver: sqlStorage.Driver()}
+	if err := store.Init(); err != nil {
+		return err
+	}
+	endp.store = store
+
+	endp.saslAuth.AuthNormalize = endp.authNormalize
+	endp.saslAuth.AuthMap = endp.authMap
+	endp.saslAuth.TLSConfig = endp.tlsConfig
+
+	if endp.insecureAuth {
+		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
+	}
+	if endp.tlsConfig == nil {
+		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
+		endp.insecureAuth = true
+	}
+
+	return endp.setupListeners()
+}
+
+func (endp *Endpoint) setupListeners() error {
+	for _, addr := range endp.addrs {
+		saddr, err := config.ParseEndpoint(addr)
+		if err != nil {
+			return fmt.Errorf("managesieve: invalid address: %s", addr)
+		}
+
+		l, err := net.Listen(saddr.Network(), saddr.Address())
+		if err != nil {
+			return fmt.Errorf("managesieve: %v", err)
+		}
+		endp.Log.Printf("listening on %v", saddr)
+
+		isTLS := saddr.IsTLS()
+		if isTLS {
+			if endp.tlsConfig == nil {
+				return errors.New("managesieve: can't bind on TLS endpoint without TLS configuration")
+			}
+			l = tls.NewListener(l, endp.tlsConfig)
+		}
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
+		}
+
+		endp.listeners = append(endp.listeners, l)
+
+		endp.listenersWg.Add(1)
+		go func() {
+			defer endp.listenersWg.Done()
+			endp.serve(l, isTLS)
+		}()
+	}
+
+	return nil
+}
+
+func (endp *Endpoint) serve(l net.Listener, isTLS bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				endp.Log.Printf("failed to accept connection on %v: %v", l.Addr(), err)
+			}
+			return
+		}
+
+		endp.listenersWg.Add(1)
+		go func() {
+			defer endp.listenersWg.Done()
+			endp.handleConn(conn, isTLS)
+		}()
+	}
+}
+
+func (endp *Endpoint) handleConn(conn net.Conn, isTLS bool) {
+	endp.connsLock.Lock()
+	endp.conns[conn] = struct{}{}
+	endp.connsLock.Unlock()
+
+	defer func() {
+		endp.connsLock.Lock()
+		delete(endp.conns, conn)
+		endp.connsLock.Unlock()
+		conn.Close()
+	}()
+
+	newSession(endp, conn, isTLS).serve()
+}
+
+func (endp *Endpoint) usernameForStorage(ctx context.Context, saslUsername string) (string, error) {
+	saslUsername, err := endp.storageNormalize(saslUsername)
+	if err != nil {
+		return "", err
+	}
+
+	if endp.storageMap == nil {
+		return saslUsername, nil
+	}
+
+	mapped, ok, err := endp.storageMap.Lookup(ctx, saslUsername)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", auth.ErrInvalidAuthCred
+	}
+
+	if saslUsername != mapped {
+		endp.Log.DebugMsg("using mapped username for storage", "username", saslUsername, "mapped_username", mapped)
+	}
+
+	return mapped, nil
+}
+
+func (endp *Endpoint) Name() string {
+	return modName
+}
+
+func (endp *Endpoint) InstanceName() string {
+	return modName
+}
+
+func (endp *Endpoint) Close() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+
+	endp.connsLock.Lock()
+	for conn := range endp.conns {
+		conn.Close()
+	}
+	endp.connsLock.Unlock()
+
+	endp.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,362 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package managesieve
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockAuth struct{}
+
+func (mockAuth) AuthPlain(username, password string) error {
+	if username == "user@example.org" && password == "secret" {
+		return nil
+	}
+	return errors.New("invalid creds")
+}
+
+type script struct {
+	content string
+	active  bool
+}
+
+// mockStore is an in-memory scriptStore for a single account.
+type mockStore map[string]*script
+
+func (m mockStore) List(string) ([]sieve.ScriptInfo, error) {
+	var res []sieve.ScriptInfo
+	for name, s := range m {
+		res = append(res, sieve.ScriptInfo{Name: name, Active: s.active})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (m mockStore) Get(_, name string) (string, error) {
+	s, ok := m[name]
+	if !ok {
+		return "", sieve.ErrNoScript
+	}
+	return s.content, nil
+}
+
+func (m mockStore) Put(_, name, content string) error {
+	if s, ok := m[name]; ok {
+		s.content = content
+		return nil
+	}
+	m[name] = &script{content: content}
+	return nil
+}
+
+func (m mockStore) SetActive(_, name string) error {
+	if _, ok := m[name]; !ok && name != "" {
+		return sieve.ErrNoScript
+	}
+	for n, s := range m {
+		s.active = n == name
+	}
+	return nil
+}
+
+func (m mockStore) Delete(_, name string) error {
+	s, ok := m[name]
+	if !ok {
+		return sieve.ErrNoScript
+	}
+	if s.active {
+		return sieve.ErrActiveScript
+	}
+	delete(m, name)
+	return nil
+}
+
+func (m mockStore) Rename(_, oldName, newName string) error {
+	if _, ok := m[newName]; ok {
+		return sieve.ErrScriptExists
+	}
+	s, ok := m[oldName]
+	if !ok {
+		return sieve.ErrNoScript
+	}
+	delete(m, oldName)
+	m[newName] = s
+	return nil
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func testSession(t *testing.T, store mockStore) *client {
+	t.Helper()
+
+	endp := &Endpoint{
+		Log:              testutils.Logger(t, modName),
+		saslAuth:         auth.SASLAuth{Plain: []module.PlainAuth{mockAuth{}}},
+		store:            store,
+		insecureAuth:     true,
+		maxScriptSize:    1024,
+		maxScripts:       2,
+		storageNormalize: authz.NormalizeAuto,
+		conns:            map[net.Conn]struct{}{},
+	}
+
+	srvConn, cliConn := net.Pipe()
+	go endp.handleConn(srvConn, false)
+	t.Cleanup(func() { cliConn.Close() })
+
+	c := &client{t: t, conn: cliConn, r: bufio.NewReader(cliConn)}
+	greeting := c.readResponse()
+	if !strings.HasPrefix(greeting[len(greeting)-1], "OK") {
+		t.Fatalf("unexpected greeting: %v", greeting)
+	}
+	return c
+}
+
+// readResponse reads lines up to and including the final OK/NO/BYE line.
+func (c *client) readResponse() []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read failed: %v (lines so far: %v)", err, lines)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		for _, status := range []string{"OK", "NO", "BYE"} {
+			if line == status || strings.HasPrefix(line, status+" ") {
+				return lines
+			}
+		}
+	}
+}
+
+func (c *client) cmd(line string) []string {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\r\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.readResponse()
+}
+
+func (c *client) login() {
+	c.t.Helper()
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00secret"))
+	resp := c.cmd(`AUTHENTICATE "PLAIN" "` + ir + `"`)
+	if !strings.HasPrefix(resp[0], "OK") {
+		c.t.Fatalf("authentication failed: %v", resp)
+	}
+}
+
+func last(lines []string) string {
+	return lines[len(lines)-1]
+}
+
+func TestCapabilities(t *testing.T) {
+	c := testSession(t, mockStore{})
+	resp := c.cmd("CAPABILITY")
+	caps := strings.Join(resp, "\n")
+	for _, want := range []string{`"SASL" "PLAIN LOGIN"`, `"SIEVE" "`, `"VERSION" "1.0"`, `"IMPLEMENTATION"`} {
+		if !strings.Contains(caps, want) {
+			t.Errorf("missing %s in capabilities:\n%s", want, caps)
+		}
+	}
+	if strings.Contains(caps, "STARTTLS") {
+		t.Errorf("STARTTLS advertised without TLS configuration")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	c := testSession(t, mockStore{})
+
+	if resp := c.cmd("LISTSCRIPTS"); !strings.HasPrefix(last(resp), "NO") {
+		t.Fatalf("LISTSCRIPTS allowed before authentication: %v", resp)
+	}
+
+	// Challenge-response form.
+	if _, err := io.WriteString(c.conn, "AUTHENTICATE \"PLAIN\"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge != "\"\"\r\n" {
+		t.Fatalf("unexpected challenge: %q", challenge)
+	}
+	resp := c.cmd(`"` + base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00wrong")) + `"`)
+	if !strings.HasPrefix(last(resp), "NO") {
+		t.Fatalf("wrong password accepted: %v", resp)
+	}
+
+	c.login()
+	resp = c.cmd("CAPABILITY")
+	if !strings.Contains(strings.Join(resp, "\n"), `"OWNER" "user@example.org"`) {
+		t.Errorf("OWNER is missing: %v", resp)
+	}
+
+	if resp := c.cmd("UNAUTHENTICATE"); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("UNAUTHENTICATE failed: %v", resp)
+	}
+	if resp := c.cmd("LISTSCRIPTS"); !strings.HasPrefix(last(resp), "NO") {
+		t.Fatalf("LISTSCRIPTS allowed after UNAUTHENTICATE: %v", resp)
+	}
+}
+
+func TestAuthenticate_TooManyFailures(t *testing.T) {
+	c := testSession(t, mockStore{})
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00wrong"))
+	for i := 0; i < maxAuthFailures-1; i++ {
+		if resp := c.cmd(`AUTHENTICATE "PLAIN" "` + ir + `"`); !strings.HasPrefix(last(resp), "NO") {
+			t.Fatalf("unexpected response: %v", resp)
+		}
+	}
+	if resp := c.cmd(`AUTHENTICATE "PLAIN" "` + ir + `"`); !strings.HasPrefix(last(resp), "BYE") {
+		t.Fatalf("expected BYE, got %v", resp)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	store := mockStore{}
+	c := testSession(t, store)
+	c.login()
+
+	scriptSrc := "require \"fileinto\";\r\nif header :contains \"subject\" \"spam\" { fileinto \"Junk\"; }\r\n"
+
+	resp := c.cmd("PUTSCRIPT \"main\" {" + strconv.Itoa(len(scriptSrc)) + "+}\r\n" + scriptSrc)
+	if !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("PUTSCRIPT failed: %v", resp)
+	}
+	if store["main"] == nil || store["main"].content != scriptSrc {
+		t.Fatalf("script was not stored: %+v", store["main"])
+	}
+
+	resp = c.cmd(`PUTSCRIPT "broken" "fileinto \"Junk\";"`)
+	if !strings.HasPrefix(last(resp), "NO") || !strings.Contains(last(resp), "line 1") {
+		t.Fatalf("invalid script accepted: %v", resp)
+	}
+	if _, ok := store["broken"]; ok {
+		t.Fatal("invalid script was stored")
+	}
+
+	if resp := c.cmd(`CHECKSCRIPT "keep;"`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("CHECKSCRIPT failed: %v", resp)
+	}
+	if resp := c.cmd(`CHECKSCRIPT "foo;"`); !strings.HasPrefix(last(resp), "NO") {
+		t.Fatalf("CHECKSCRIPT accepted invalid script: %v", resp)
+	}
+
+	if resp := c.cmd(`SETACTIVE "missing"`); last(resp) != `NO (NONEXISTENT) "There is no script with that name"` {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	if resp := c.cmd(`SETACTIVE "main"`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("SETACTIVE failed: %v", resp)
+	}
+
+	resp = c.cmd("LISTSCRIPTS")
+	if len(resp) != 2 || resp[0] != `"main" ACTIVE` {
+		t.Fatalf("unexpected LISTSCRIPTS: %v", resp)
+	}
+
+	resp = c.cmd(`GETSCRIPT "main"`)
+	want := "{" + strconv.Itoa(len(scriptSrc)) + "}"
+	if resp[0] != want || !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("unexpected GETSCRIPT: %v", resp)
+	}
+
+	if resp := c.cmd(`DELETESCRIPT "main"`); !strings.HasPrefix(last(resp), "NO (ACTIVE)") {
+		t.Fatalf("active script deleted: %v", resp)
+	}
+
+	if resp := c.cmd(`PUTSCRIPT "second" "keep;"`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("PUTSCRIPT failed: %v", resp)
+	}
+	if resp := c.cmd(`HAVESPACE "third" 10`); !strings.HasPrefix(last(resp), "NO (QUOTA/MAXSCRIPTS)") {
+		t.Fatalf("unexpected HAVESPACE: %v", resp)
+	}
+	if resp := c.cmd(`HAVESPACE "second" 100000`); !strings.HasPrefix(last(resp), "NO (QUOTA/MAXSIZE)") {
+		t.Fatalf("unexpected HAVESPACE: %v", resp)
+	}
+	if resp := c.cmd(`HAVESPACE "second" 100`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("unexpected HAVESPACE: %v", resp)
+	}
+
+	if resp := c.cmd(`RENAMESCRIPT "second" "main"`); !strings.HasPrefix(last(resp), "NO (ALREADYEXISTS)") {
+		t.Fatalf("unexpected RENAMESCRIPT: %v", resp)
+	}
+	if resp := c.cmd(`RENAMESCRIPT "second" "other"`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("RENAMESCRIPT failed: %v", resp)
+	}
+	if resp := c.cmd(`DELETESCRIPT "other"`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("DELETESCRIPT failed: %v", resp)
+	}
+
+	if resp := c.cmd(`SETACTIVE ""`); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("SETACTIVE failed: %v", resp)
+	}
+	if store["main"].active {
+		t.Fatal("script is still active")
+	}
+
+	if resp := c.cmd("LOGOUT"); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("LOGOUT failed: %v", resp)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	c := testSession(t, mockStore{})
+	if resp := c.cmd(`CHECKSCRIPT "unterminated`); !strings.HasPrefix(last(resp), "NO") {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	// Connection is still usable.
+	if resp := c.cmd("NOOP"); !strings.HasPrefix(last(resp), "OK") {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"simple":        `"simple"`,
+		`with "quote"`:  `"with \"quote\""`,
+		`back\slash`:    `"back\\slash"`,
+		"multi\r\nline": "{11}\r\nmulti\r\nline",
+	} {
+		if got := quote(in); got != want {
+			t.Errorf("quote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
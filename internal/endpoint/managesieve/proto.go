@@ -0,0 +1,195 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package managesieve
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Maximum length of atoms and quoted strings. Larger values should be sent
+// as literals.
+const maxQuotedLen = 4096
+
+var (
+	// errSyntax is returned for malformed lines, the rest of the line is
+	// discarded and the connection can be used further.
+	errSyntax = errors.New("managesieve: syntax error")
+
+	// errTooBig is returned for literals that exceed the limit, the
+	// connection cannot be used further.
+	errTooBig = errors.New("managesieve: literal is too big")
+)
+
+// reader reads client lines (RFC 5804, Section 4).
+type reader struct {
+	r          *bufio.Reader
+	maxLiteral int
+}
+
+// readLine reads a single line consisting of atoms and strings, including
+// literals ({N+} or {N}) that may span multiple physical lines.
+func (r *reader) readLine() ([]string, error) {
+	var words []string
+	for {
+		ch, err := r.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case ch == ' ':
+			continue
+		case ch == '\r':
+			if next, err := r.r.ReadByte(); err != nil {
+				return nil, err
+			} else if next != '\n' {
+				return nil, r.discardLine(next)
+			}
+			return words, nil
+		case ch == '\n':
+			return words, nil
+		case ch == '"':
+			s, err := r.quoted()
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, s)
+		case ch == '{':
+			s, err := r.literal()
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, s)
+		default:
+			s, err := r.atom(ch)
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, s)
+		}
+	}
+}
+
+// discardLine skips the rest of the line and returns errSyntax.
+func (r *reader) discardLine(last byte) error {
+	if last == '\n' {
+		return errSyntax
+	}
+	if _, err := r.r.ReadSlice('\n'); err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+	return errSyntax
+}
+
+func (r *reader) atom(first byte) (string, error) {
+	var b strings.Builder
+	b.WriteByte(first)
+	for {
+		ch, err := r.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if ch == ' ' || ch == '\r' || ch == '\n' {
+			if err := r.r.UnreadByte(); err != nil {
+				return "", err
+			}
+			return b.String(), nil
+		}
+		if ch == '"' || ch == '{' || ch < 0x20 || ch == 0x7f {
+			return "", r.discardLine(ch)
+		}
+		if b.Len() >= maxQuotedLen {
+			return "", r.discardLine(ch)
+		}
+		b.WriteByte(ch)
+	}
+}
+
+func (r *reader) quoted() (string, error) {
+	var b strings.Builder
+	for {
+		ch, err := r.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch ch {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			ch, err = r.r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			if ch != '\\' && ch != '"' {
+				return "", r.discardLine(ch)
+			}
+		case '\r', '\n', 0:
+			return "", r.discardLine(ch)
+		}
+		if b.Len() >= maxQuotedLen {
+			return "", r.discardLine(ch)
+		}
+		b.WriteByte(ch)
+	}
+}
+
+// literal reads the literal after the opening brace. Both synchronizing and
+// non-synchronizing forms are accepted, no continuation is sent for the
+// former.
+func (r *reader) literal() (string, error) {
+	spec, err := r.r.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	spec = strings.TrimSuffix(strings.TrimSuffix(spec, "}"), "+")
+	size, err := strconv.Atoi(spec)
+	if err != nil || size < 0 || len(spec) > 10 {
+		return "", r.discardLine('}')
+	}
+
+	if crlf, err := r.r.ReadString('\n'); err != nil {
+		return "", err
+	} else if crlf != "\r\n" && crlf != "\n" {
+		return "", errSyntax
+	}
+
+	if size > r.maxLiteral {
+		return "", errTooBig
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// quote formats the string as a quoted string or a literal if it cannot be
+// quoted.
+func quote(s string) string {
+	if len(s) > 1024 || strings.ContainsAny(s, "\r\n\x00") {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
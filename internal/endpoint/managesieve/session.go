@@ -0,0 +1,537 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package managesieve
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+const (
+	// Connection is closed after that many failed authentication attempts.
+	maxAuthFailures = 3
+
+	maxScriptNameLen = 128
+)
+
+type session struct {
+	endp  *Endpoint
+	log   log.Logger
+	conn  net.Conn
+	isTLS bool
+
+	r reader
+	w *bufio.Writer
+
+	// Storage account name, empty if not authenticated.
+	account      string
+	authFailures int
+}
+
+// response is the final response to a command (RFC 5804, Section 1.3).
+type response struct {
+	status string // OK, NO or BYE
+	code   string
+	text   string
+}
+
+func ok(text string) response {
+	return response{status: "OK", text: text}
+}
+
+func no(code, text string) response {
+	return response{status: "NO", code: code, text: text}
+}
+
+func newSession(endp *Endpoint, conn net.Conn, isTLS bool) *session {
+	s := &session{
+		endp:  endp,
+		log:   endp.Log,
+		isTLS: isTLS,
+	}
+	s.setConn(conn)
+	s.log.Debugf("connection from %v", conn.RemoteAddr())
+	return s
+}
+
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.r = reader{r: bufio.NewReader(conn), maxLiteral: s.endp.maxScriptSize}
+	s.w = bufio.NewWriter(conn)
+}
+
+func (s *session) serve() {
+	s.writeCapabilities()
+	s.writeResponse(ok("maddy ManageSieve ready"))
+	if err := s.w.Flush(); err != nil {
+		return
+	}
+
+	for {
+		if err := s.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+		words, err := s.r.readLine()
+		if err != nil {
+			switch {
+			case errors.Is(err, errSyntax):
+				s.writeResponse(no("", "Syntax error"))
+				if s.w.Flush() != nil {
+					return
+				}
+				continue
+			case errors.Is(err, errTooBig):
+				s.writeResponse(response{status: "BYE", code: "QUOTA/MAXSIZE", text: "Script is too big"})
+				s.w.Flush()
+			}
+			return
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		resp, done := s.handle(strings.ToUpper(words[0]), words[1:])
+		if resp.status != "" {
+			s.writeResponse(resp)
+		}
+		if err := s.w.Flush(); err != nil || done {
+			return
+		}
+	}
+}
+
+func (s *session) authAllowed() bool {
+	return s.isTLS || s.endp.insecureAuth
+}
+
+func (s *session) writeCapabilities() {
+	mechs := ""
+	if s.authAllowed() {
+		mechs = strings.Join(s.endp.saslAuth.SASLMechanisms(), " ")
+	}
+
+	fmt.Fprintf(s.w, "%s\r\n", `"IMPLEMENTATION" "maddy"`)
+	fmt.Fprintf(s.w, "\"SASL\" %s\r\n", quote(mechs))
+	fmt.Fprintf(s.w, "\"SIEVE\" %s\r\n", quote(strings.Join(sieve.Extensions, " ")))
+	if !s.isTLS && s.endp.tlsConfig != nil {
+		fmt.Fprintf(s.w, "%s\r\n", `"STARTTLS"`)
+	}
+	fmt.Fprintf(s.w, "\"MAXREDIRECTS\" %s\r\n", quote(strconv.Itoa(sieve.MaxRedirects)))
+	if s.account != "" {
+		fmt.Fprintf(s.w, "\"OWNER\" %s\r\n", quote(s.account))
+	}
+	fmt.Fprintf(s.w, "%s\r\n", `"VERSION" "1.0"`)
+}
+
+func (s *session) writeResponse(resp response) {
+	s.w.WriteString(resp.status)
+	if resp.code != "" {
+		s.w.WriteString(" (" + resp.code + ")")
+	}
+	if resp.text != "" {
+		s.w.WriteString(" " + quote(resp.text))
+	}
+	s.w.WriteString("\r\n")
+}
+
+// handle executes the command. done is true if the connection should be
+// closed after the response is sent.
+func (s *session) handle(cmd string, args []string) (resp response, done bool) {
+	switch cmd {
+	case "LOGOUT":
+		return ok("Bye"), true
+	case "NOOP":
+		if len(args) > 1 {
+			return no("", "Too many arguments"), false
+		}
+		if len(args) == 1 {
+			return response{status: "OK", code: "TAG " + quote(args[0]), text: "Done"}, false
+		}
+		return ok("Done"), false
+	case "CAPABILITY":
+		s.writeCapabilities()
+		return ok("Capability completed"), false
+	case "STARTTLS":
+		return s.startTLS()
+	case "AUTHENTICATE":
+		return s.authenticate(args)
+	}
+
+	if s.account == "" {
+		return no("", "Authenticate first"), false
+	}
+
+	switch cmd {
+	case "UNAUTHENTICATE":
+		s.account = ""
+		return ok("Unauthenticated"), false
+	case "LISTSCRIPTS":
+		return s.listScripts(args), false
+	case "GETSCRIPT":
+		return s.getScript(args), false
+	case "PUTSCRIPT":
+		return s.putScript(args), false
+	case "CHECKSCRIPT":
+		return s.checkScript(args), false
+	case "HAVESPACE":
+		return s.haveSpace(args), false
+	case "SETACTIVE":
+		return s.setActive(args), false
+	case "DELETESCRIPT":
+		return s.deleteScript(args), false
+	case "RENAMESCRIPT":
+		return s.renameScript(args), false
+	default:
+		return no("", "Unknown command"), false
+	}
+}
+
+func (s *session) startTLS() (response, bool) {
+	if s.isTLS {
+		return no("", "TLS is already active"), false
+	}
+	if s.endp.tlsConfig == nil {
+		return no("", "TLS is not available"), false
+	}
+
+	s.writeResponse(ok("Begin TLS negotiation now"))
+	if err := s.w.Flush(); err != nil {
+		return response{}, true
+	}
+
+	tlsConn := tls.Server(s.conn, s.endp.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		s.log.Error("TLS handshake failed", err, "src_ip", s.conn.RemoteAddr())
+		return response{}, true
+	}
+	s.setConn(tlsConn)
+	s.isTLS = true
+
+	// Capabilities are sent again after TLS negotiation (RFC 5804, Section
+	// 2.2).
+	s.writeCapabilities()
+	return ok("TLS negotiation successful"), false
+}
+
+func (s *session) authenticate(args []string) (response, bool) {
+	if s.account != "" {
+		return no("", "Already authenticated"), false
+	}
+	if !s.authAllowed() {
+		return no("ENCRYPT-NEEDED", "Use STARTTLS first"), false
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return no("", "Wrong number of arguments"), false
+	}
+
+	mech := strings.ToUpper(args[0])
+	supported := false
+	for _, m := range s.endp.saslAuth.SASLMechanisms() {
+		if m == mech {
+			supported = true
+		}
+	}
+	if !supported {
+		return no("", "Unsupported authentication mechanism"), false
+	}
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	var identity string
+	srv := s.endp.saslAuth.CreateSASLTLS(mech, s.conn.RemoteAddr(), tlsState, func(id string) error {
+		identity = id
+		return nil
+	})
+
+	var (
+		saslResp []byte
+		err      error
+	)
+	if len(args) == 2 {
+		saslResp, err = base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return no("", "Malformed initial response"), false
+		}
+	}
+
+	for {
+		challenge, done, err := srv.Next(saslResp)
+		if err != nil {
+			return s.authFailed(err)
+		}
+		if done {
+			break
+		}
+
+		fmt.Fprintf(s.w, "%s\r\n", quote(base64.StdEncoding.EncodeToString(challenge)))
+		if err := s.w.Flush(); err != nil {
+			return response{}, true
+		}
+
+		words, err := s.r.readLine()
+		if err != nil {
+			if errors.Is(err, errSyntax) {
+				return no("", "Syntax error"), false
+			}
+			return response{}, true
+		}
+		if len(words) != 1 {
+			return no("", "Syntax error"), false
+		}
+		if words[0] == "*" {
+			return no("", "Authentication cancelled"), false
+		}
+		saslResp, err = base64.StdEncoding.DecodeString(words[0])
+		if err != nil {
+			return no("", "Malformed response"), false
+		}
+	}
+
+	account, err := s.endp.usernameForStorage(context.TODO(), identity)
+	if err != nil {
+		return s.authFailed(err)
+	}
+	s.account = account
+	s.log.DebugMsg("authenticated", "username", identity, "account", account, "src_ip", s.conn.RemoteAddr())
+	return ok("Authenticated"), false
+}
+
+func (s *session) authFailed(err error) (response, bool) {
+	s.authFailures++
+	s.log.DebugMsg("authentication failed", "reason", err.Error(), "src_ip", s.conn.RemoteAddr())
+	if s.authFailures >= maxAuthFailures {
+		return response{status: "BYE", text: "Too many failed authentication attempts"}, true
+	}
+	return no("", "Authentication failed"), false
+}
+
+// validScriptName checks the name against RFC 5804, Section 1.6.
+func validScriptName(name string) bool {
+	if name == "" || len(name) > maxScriptNameLen || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == ' ' || r == ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+func storeError(err error) response {
+	switch {
+	case errors.Is(err, sieve.ErrNoScript):
+		return no("NONEXISTENT", "There is no script with that name")
+	case errors.Is(err, sieve.ErrScriptExists):
+		return no("ALREADYEXISTS", "Script with that name already exists")
+	case errors.Is(err, sieve.ErrActiveScript):
+		return no("ACTIVE", "Script is active")
+	default:
+		return no("TRYLATER", "Internal server error")
+	}
+}
+
+func (s *session) storeFailed(op string, err error) response {
+	resp := storeError(err)
+	if resp.code == "TRYLATER" {
+		s.log.Error(op+" failed", err, "account", s.account)
+	}
+	return resp
+}
+
+// validate checks the script, returning the response to use if it is
+// invalid.
+func (s *session) validate(content string) (response, bool) {
+	if len(content) > s.endp.maxScriptSize {
+		return no("QUOTA/MAXSIZE", "Script is too big"), false
+	}
+	if _, err := sieve.Parse(content); err != nil {
+		var sieveErr *sieve.Error
+		if errors.As(err, &sieveErr) {
+			return no("", fmt.Sprintf("line %d: %s", sieveErr.Line, sieveErr.Message)), false
+		}
+		return no("", err.Error()), false
+	}
+	return response{}, true
+}
+
+func (s *session) listScripts(args []string) response {
+	if len(args) != 0 {
+		return no("", "Too many arguments")
+	}
+	list, err := s.endp.store.List(s.account)
+	if err != nil {
+		return s.storeFailed("LISTSCRIPTS", err)
+	}
+	for _, info := range list {
+		s.w.WriteString(quote(info.Name))
+		if info.Active {
+			s.w.WriteString(" ACTIVE")
+		}
+		s.w.WriteString("\r\n")
+	}
+	return ok("Listscripts completed")
+}
+
+func (s *session) getScript(args []string) response {
+	if len(args) != 1 {
+		return no("", "Wrong number of arguments")
+	}
+	content, err := s.endp.store.Get(s.account, args[0])
+	if err != nil {
+		return s.storeFailed("GETSCRIPT", err)
+	}
+	fmt.Fprintf(s.w, "{%d}\r\n%s\r\n", len(content), content)
+	return ok("Getscript completed")
+}
+
+func (s *session) putScript(args []string) response {
+	if len(args) != 2 {
+		return no("", "Wrong number of arguments")
+	}
+	name, content := args[0], args[1]
+	if !validScriptName(name) {
+		return no("", "Invalid script name")
+	}
+	if resp, valid := s.validate(content); !valid {
+		return resp
+	}
+	if resp := s.checkSpace(name, len(content)); resp.status != "" {
+		return resp
+	}
+
+	if err := s.endp.store.Put(s.account, name, content); err != nil {
+		return s.storeFailed("PUTSCRIPT", err)
+	}
+	s.log.DebugMsg("script uploaded", "account", s.account, "script", name)
+	return ok("Putscript completed")
+}
+
+func (s *session) checkScript(args []string) response {
+	if len(args) != 1 {
+		return no("", "Wrong number of arguments")
+	}
+	if resp, valid := s.validate(args[0]); !valid {
+		return resp
+	}
+	return ok("Script is valid")
+}
+
+// checkSpace checks whether the script of that size can be stored, empty
+// response is returned if it can.
+func (s *session) checkSpace(name string, size int) response {
+	if size > s.endp.maxScriptSize {
+		return no("QUOTA/MAXSIZE", "Script is too big")
+	}
+	list, err := s.endp.store.List(s.account)
+	if err != nil {
+		return s.storeFailed("HAVESPACE", err)
+	}
+	for _, info := range list {
+		if info.Name == name {
+			return response{}
+		}
+	}
+	if len(list) >= s.endp.maxScripts {
+		return no("QUOTA/MAXSCRIPTS", "Too many scripts")
+	}
+	return response{}
+}
+
+func (s *session) haveSpace(args []string) response {
+	if len(args) != 2 {
+		return no("", "Wrong number of arguments")
+	}
+	size, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return no("", "Invalid script size")
+	}
+	if !validScriptName(args[0]) {
+		return no("", "Invalid script name")
+	}
+	if size > uint64(s.endp.maxScriptSize) {
+		return no("QUOTA/MAXSIZE", "Script is too big")
+	}
+	if resp := s.checkSpace(args[0], int(size)); resp.status != "" {
+		return resp
+	}
+	return ok("Putscript would succeed")
+}
+
+func (s *session) setActive(args []string) response {
+	if len(args) != 1 {
+		return no("", "Wrong number of arguments")
+	}
+	if args[0] != "" {
+		// Do not activate scripts that are broken, e.g. because the set of
+		// supported extensions changed.
+		content, err := s.endp.store.Get(s.account, args[0])
+		if err != nil {
+			return s.storeFailed("SETACTIVE", err)
+		}
+		if resp, valid := s.validate(content); !valid {
+			return resp
+		}
+	}
+	if err := s.endp.store.SetActive(s.account, args[0]); err != nil {
+		return s.storeFailed("SETACTIVE", err)
+	}
+	s.log.DebugMsg("active script changed", "account", s.account, "script", args[0])
+	return ok("Setactive completed")
+}
+
+func (s *session) deleteScript(args []string) response {
+	if len(args) != 1 {
+		return no("", "Wrong number of arguments")
+	}
+	if err := s.endp.store.Delete(s.account, args[0]); err != nil {
+		return s.storeFailed("DELETESCRIPT", err)
+	}
+	return ok("Deletescript completed")
+}
+
+func (s *session) renameScript(args []string) response {
+	if len(args) != 2 {
+		return no("", "Wrong number of arguments")
+	}
+	if !validScriptName(args[1]) {
+		return no("", "Invalid script name")
+	}
+	if err := s.endp.store.Rename(s.account, args[0], args[1]); err != nil {
+		return s.storeFailed("RENAMESCRIPT", err)
+	}
+	return ok("Renamescript completed")
+}
@@ -38,6 +38,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -155,9 +156,10 @@ func (s *Session) AuthPlain(username, password string) error {
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err := s.endp.saslAuth.AuthPlainFrom(s.connState.RemoteAddr, username, password)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
+		auth.PublishFailure(s.endp.name, username, s.connState.RemoteAddr)
 
 		failedLogins.WithLabelValues(s.endp.name).Inc()
 
@@ -100,7 +100,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		buffer:     buffer.BufferInMemory,
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: modName,
 		},
 	}
 	return endp, nil
@@ -314,6 +315,7 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}
 	endp.saslAuth.AuthNormalize = endp.authNormalize
 	endp.saslAuth.AuthMap = endp.authMap
+	endp.saslAuth.TLSConfig = endp.serv.TLSConfig
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		// The code below lacks handling to set AuthPassword. Don't
 		// override sasl.Plain handler so Login() will be called as usual.
@@ -324,7 +326,11 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		mech := mech
 
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Conn().RemoteAddr(), func(id string) error {
+			var tlsState *tls.ConnectionState
+			if state, ok := c.TLSConnectionState(); ok {
+				tlsState = &state
+			}
+			return endp.saslAuth.CreateSASLTLS(mech, c.Conn().RemoteAddr(), tlsState, func(id string) error {
 				c.Session().(*Session).connState.AuthUser = id
 				return nil
 			})
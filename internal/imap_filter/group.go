@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imap_filter
 
 import (
+	"errors"
+
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
@@ -45,15 +47,48 @@ func NewGroup(_, instName string, _, _ []string) (module.Module, error) {
 }
 
 func (g *Group) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	folder, flags, commit, err := g.IMAPFilterDeferred(accountName, rcptTo, meta, hdr, body)
+	if commit != nil {
+		commit()
+	}
+	return folder, flags, err
+}
+
+// IMAPFilterDeferred runs all filters and collects side effects of the ones
+// that implement module.DeferredIMAPFilter into the returned commit function.
+// Side effects of other filters are not deferred.
+func (g *Group) IMAPFilterDeferred(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, commit func(), err error) {
 	if g == nil {
-		return "", nil, nil
+		return "", nil, nil, nil
 	}
 	var (
 		finalFolder string
 		finalFlags  = make([]string, 0, len(g.Filters))
+		commits     []func()
 	)
+	commitAll := func() {
+		for _, c := range commits {
+			c()
+		}
+	}
 	for _, f := range g.Filters {
-		folder, flags, err := f.IMAPFilter(accountName, rcptTo, meta, hdr, body)
+		var (
+			folder string
+			flags  []string
+			commit func()
+			err    error
+		)
+		if df, ok := f.(module.DeferredIMAPFilter); ok {
+			folder, flags, commit, err = df.IMAPFilterDeferred(accountName, rcptTo, meta, hdr, body)
+		} else {
+			folder, flags, err = f.IMAPFilter(accountName, rcptTo, meta, hdr, body)
+		}
+		if commit != nil {
+			commits = append(commits, commit)
+		}
+		if errors.Is(err, module.ErrDiscard) {
+			return "", nil, commitAll, err
+		}
 		if err != nil {
 			g.log.Error("IMAP filter failed", err)
 			continue
@@ -63,7 +98,10 @@ func (g *Group) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMe
 		}
 		finalFlags = append(finalFlags, flags...)
 	}
-	return finalFolder, finalFlags, nil
+	if len(commits) == 0 {
+		return finalFolder, finalFlags, nil, nil
+	}
+	return finalFolder, finalFlags, commitAll, nil
 }
 
 func (g *Group) Init(cfg *config.Map) error {
@@ -0,0 +1,464 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements imap.filter.sieve, an IMAP filter that runs the
+// active per-account Sieve script stored in the storage.imapsql database.
+//
+// fileinto and keep select the folder and flags of the stored message.
+// redirect, reject and vacation generate new messages that are passed to
+// the configured "send" pipeline once the delivery to storage is committed.
+// If the script cancels the implicit keep, the message is not stored for the
+// account.
+package sieve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	sievelang "github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/srs"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/target/autoreply"
+)
+
+const (
+	modName = "imap.filter.sieve"
+
+	// Header field added to redirected messages, used to detect loops.
+	redirectedHeader = "X-Sieve-Redirected-By"
+)
+
+type scriptStore interface {
+	Active(username string) (name, content string, err error)
+}
+
+type repliesLog interface {
+	MarkReplied(username, sender string, now time.Time, window time.Duration) (bool, error)
+}
+
+type cachedScript struct {
+	content string
+	script  *sievelang.Script
+}
+
+type Filter struct {
+	instName string
+	log      log.Logger
+
+	storage          module.Storage
+	send             module.DeliveryTarget
+	hostname         string
+	autogenMsgDomain string
+	srs              srs.Rewriter
+
+	// Storage module may be not initialized yet when the filter is
+	// initialized (filter is defined inside of it), so database is
+	// resolved on the first use.
+	initOnce sync.Once
+	initErr  error
+	scripts  scriptStore
+	replies  repliesLog
+
+	cacheLock sync.Mutex
+	cache     map[string]cachedScript
+
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("imap.filter.sieve: inline arguments are not used")
+	}
+
+	return &Filter{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		cache:    map[string]cachedScript{},
+		now:      time.Now,
+	}, nil
+}
+
+func (f *Filter) Init(cfg *config.Map) error {
+	var secrets []string
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &f.storage)
+	cfg.String("hostname", true, true, "", &f.hostname)
+	cfg.String("autogenerated_msg_domain", true, true, "", &f.autogenMsgDomain)
+	cfg.String("srs_domain", false, false, "", &f.srs.Domain)
+	cfg.StringList("srs_secrets", false, false, nil, &secrets)
+	cfg.Duration("srs_max_age", false, false, srs.DefaultMaxAge, &f.srs.MaxAge)
+	cfg.Custom("send", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		return msgpipeline.New(m.Globals, node.Children)
+	}, &f.send)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if _, ok := f.storage.(*imapsql.Storage); !ok {
+		return errors.New("imap.filter.sieve: storage.imapsql is required")
+	}
+	if f.srs.Domain != "" && len(secrets) == 0 {
+		return errors.New("imap.filter.sieve: srs_secrets are required if srs_domain is set")
+	}
+	for _, secret := range secrets {
+		if secret == "" {
+			return errors.New("imap.filter.sieve: empty SRS secret")
+		}
+		f.srs.Secrets = append(f.srs.Secrets, []byte(secret))
+	}
+
+	f.send.(*msgpipeline.MsgPipeline).Hostname = f.hostname
+	f.send.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "sieve/pipeline", Debug: f.log.Debug}
+
+	return nil
+}
+
+func (f *Filter) Name() string {
+	return modName
+}
+
+func (f *Filter) InstanceName() string {
+	return f.instName
+}
+
+func (f *Filter) initStores() error {
+	f.initOnce.Do(func() {
+		sqlStorage := f.storage.(*imapsql.Storage)
+		if sqlStorage.Back == nil {
+			f.initErr = errors.New("imap.filter.sieve: storage is not initialized")
+			return
+		}
+
+		scripts := &sievelang.Store{DB: sqlStorage.Back.DB, Driver: sqlStorage.Driver()}
+		if err := scripts.Init(); err != nil {
+			f.initErr = err
+			return
+		}
+		replies := &autoreply.Store{DB: sqlStorage.Back.DB, Driver: sqlStorage.Driver()}
+		if err := replies.Init(); err != nil {
+			f.initErr = err
+			return
+		}
+		f.scripts, f.replies = scripts, replies
+	})
+	return f.initErr
+}
+
+// activeScript returns the parsed active script of the account or nil if
+// there is none. Parsed scripts are cached until the script content changes.
+func (f *Filter) activeScript(accountName string) (*sievelang.Script, error) {
+	if err := f.initStores(); err != nil {
+		return nil, err
+	}
+
+	_, content, err := f.scripts.Active(accountName)
+	if err != nil {
+		if errors.Is(err, sievelang.ErrNoScript) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+
+	if cached, ok := f.cache[accountName]; ok && cached.content == content {
+		return cached.script, nil
+	}
+	script, err := sievelang.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	f.cache[accountName] = cachedScript{content: content, script: script}
+	return script, nil
+}
+
+func headerSize(hdr textproto.Header) int {
+	var buf bytes.Buffer
+	_ = textproto.WriteHeader(&buf, hdr)
+	return buf.Len()
+}
+
+func (f *Filter) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	folder, flags, commit, err := f.IMAPFilterDeferred(accountName, rcptTo, meta, hdr, body)
+	if commit != nil {
+		commit()
+	}
+	return folder, flags, err
+}
+
+// IMAPFilterDeferred runs the script of the account. Messages generated by
+// redirect, reject and vacation actions are sent only when commit is called.
+func (f *Filter) IMAPFilterDeferred(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, commit func(), err error) {
+	script, err := f.activeScript(accountName)
+	if err != nil || script == nil {
+		return "", nil, nil, err
+	}
+
+	// On error, message is stored as if there was no script (RFC 5228,
+	// Section 2.10.6).
+	actions, err := script.Execute(sievelang.Message{
+		Header:   hdr,
+		Size:     headerSize(hdr) + body.Len(),
+		MailFrom: meta.OriginalFrom,
+		RcptTo:   rcptTo,
+	})
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("imap.filter.sieve: %s: %w", accountName, err)
+	}
+
+	dl := target.DeliveryLogger(f.log, meta)
+	ctx := context.Background()
+	stored := false
+	var deferred []func()
+	for _, action := range actions {
+		switch action := action.(type) {
+		case sievelang.Keep:
+			if stored {
+				dl.Msg("storing multiple copies is not supported, ignoring keep", "rcpt", accountName)
+				continue
+			}
+			stored = true
+			flags = action.Flags
+		case sievelang.FileInto:
+			if stored {
+				dl.Msg("storing multiple copies is not supported, ignoring fileinto", "rcpt", accountName, "mailbox", action.Mailbox)
+				continue
+			}
+			stored = true
+			folder, flags = action.Mailbox, action.Flags
+		case sievelang.Redirect:
+			deferred = append(deferred, func() {
+				f.redirect(ctx, dl, accountName, action, meta, hdr, body)
+			})
+		case sievelang.Reject:
+			deferred = append(deferred, func() {
+				f.reject(ctx, dl, accountName, rcptTo, action, meta, hdr)
+			})
+		case sievelang.Vacation:
+			deferred = append(deferred, func() {
+				f.vacation(ctx, dl, accountName, rcptTo, action, meta, hdr)
+			})
+		case sievelang.Discard:
+		}
+	}
+	if len(deferred) != 0 {
+		commit = func() {
+			for _, action := range deferred {
+				action()
+			}
+		}
+	}
+
+	if !stored {
+		return "", nil, commit, module.ErrDiscard
+	}
+	dl.DebugMsg("sieve result", "rcpt", accountName, "folder", folder, "flags", flags)
+	return folder, flags, commit, nil
+}
+
+// submit passes the message to the send pipeline.
+func (f *Filter) submit(ctx context.Context, meta *module.MsgMetadata, mailFrom, rcptTo string, hdr textproto.Header, body buffer.Buffer) (err error) {
+	dl, err := f.send.Start(ctx, meta, mailFrom)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if abortErr := dl.Abort(ctx); abortErr != nil {
+				f.log.Error("failed to abort delivery", abortErr, "msg_id", meta.ID)
+			}
+		}
+	}()
+
+	if err = dl.AddRcpt(ctx, rcptTo, smtp.RcptOptions{}); err != nil {
+		return err
+	}
+	if err = dl.Body(ctx, hdr, body); err != nil {
+		return err
+	}
+	return dl.Commit(ctx)
+}
+
+func (f *Filter) redirect(ctx context.Context, dl log.Logger, accountName string, action sievelang.Redirect, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) {
+	for _, by := range hdr.Values(redirectedHeader) {
+		if strings.EqualFold(strings.TrimSpace(by), accountName) {
+			dl.Msg("redirect loop detected, not redirecting", "rcpt", accountName, "redirect_to", action.Address)
+			return
+		}
+	}
+
+	mailFrom := meta.OriginalFrom
+	if f.srs.Domain != "" {
+		rewritten, err := f.srs.Forward(mailFrom)
+		if err != nil {
+			dl.Error("cannot rewrite sender, redirecting as is", err, "from", mailFrom)
+		} else {
+			mailFrom = rewritten
+		}
+	}
+
+	// Queue uses message ID to name its files, so it should differ from the
+	// one used by other deliveries of the same message.
+	redirMeta := meta.DeepCopy()
+	redirMeta.ID = meta.ID + "-sieve"
+	redirMeta.OriginalRcpts = map[string]string{}
+
+	redirHdr := hdr.Copy()
+	redirHdr.Add(redirectedHeader, accountName)
+
+	if err := f.submit(ctx, redirMeta, mailFrom, action.Address, redirHdr, body); err != nil {
+		dl.Error("failed to redirect message", err, "rcpt", accountName, "redirect_to", action.Address)
+		return
+	}
+	dl.Msg("message redirected", "rcpt", accountName, "redirect_to", action.Address)
+}
+
+func (f *Filter) reject(ctx context.Context, dl log.Logger, accountName, rcptTo string, action sievelang.Reject, meta *module.MsgMetadata, hdr textproto.Header) {
+	// Never send rejections in response to bounces.
+	if meta.OriginalFrom == "" {
+		dl.Msg("message rejected by sieve script", "rcpt", accountName)
+		return
+	}
+
+	dsnID, err := module.GenerateMsgID()
+	if err != nil {
+		dl.Error("rand.Rand error", err)
+		return
+	}
+
+	dsnEnvelope := dsn.Envelope{
+		MsgID: "<" + dsnID + "@" + f.autogenMsgDomain + ">",
+		From:  "MAILER-DAEMON@" + f.autogenMsgDomain,
+		To:    meta.OriginalFrom,
+	}
+	mtaInfo := dsn.ReportingMTAInfo{
+		ReportingMTA:    f.hostname,
+		XSender:         meta.OriginalFrom,
+		XMessageID:      meta.ID,
+		ArrivalDate:     f.now(),
+		LastAttemptDate: f.now(),
+	}
+	reason := strings.TrimSpace(action.Reason)
+	rcptInfo := []dsn.RecipientInfo{{
+		FinalRecipient: rcptTo,
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 7, 1},
+		DiagnosticCode: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected by recipient: " + strings.Join(strings.Fields(reason), " "),
+		},
+	}}
+
+	var dsnBody bytes.Buffer
+	dsnHeader, err := dsn.GenerateDSN(meta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, hdr, &dsnBody)
+	if err != nil {
+		dl.Error("failed to generate rejection DSN", err)
+		return
+	}
+
+	dsnMeta := &module.MsgMetadata{
+		ID: dsnID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8: meta.SMTPOpts.UTF8,
+		},
+	}
+	if err := f.submit(ctx, dsnMeta, "", meta.OriginalFrom, dsnHeader, buffer.MemoryBuffer{Slice: dsnBody.Bytes()}); err != nil {
+		dl.Error("failed to enqueue rejection DSN", err, "rcpt", accountName, "dsn_id", dsnID)
+		return
+	}
+	dl.Msg("message rejected by sieve script", "rcpt", accountName, "dsn_id", dsnID)
+}
+
+func (f *Filter) vacation(ctx context.Context, dl log.Logger, accountName, rcptTo string, action sievelang.Vacation, meta *module.MsgMetadata, hdr textproto.Header) {
+	if reason := autoreply.SkipReason(meta.OriginalFrom, hdr); reason != "" {
+		dl.DebugMsg("not sending vacation reply", "reason", reason, "rcpt", accountName)
+		return
+	}
+	sender, err := address.ForLookup(meta.OriginalFrom)
+	if err != nil || sender == accountName {
+		return
+	}
+
+	addrs := append([]string{rcptTo, accountName, meta.OriginalRcpts[rcptTo]}, action.Addresses...)
+	if !autoreply.AddressedTo(hdr, addrs...) {
+		dl.DebugMsg("not sending vacation reply", "reason", "recipient is not listed in header", "rcpt", accountName)
+		return
+	}
+
+	now := f.now()
+	send, err := f.replies.MarkReplied(accountName, sender, now, time.Duration(action.Days)*24*time.Hour)
+	if err != nil {
+		dl.Error("failed to check replies log", err, "rcpt", accountName)
+		return
+	}
+	if !send {
+		dl.DebugMsg("not sending vacation reply", "reason", "already replied", "rcpt", accountName)
+		return
+	}
+
+	replyID, err := module.GenerateMsgID()
+	if err != nil {
+		dl.Error("rand.Rand error", err)
+		return
+	}
+	from := action.From
+	if from == "" {
+		from = rcptTo
+	}
+	replyHdr, replyBody := autoreply.BuildReply(from, meta.OriginalFrom, replyID+"@"+f.autogenMsgDomain, autoreply.Settings{
+		Enabled: true,
+		Subject: action.Subject,
+		Body:    action.Reason,
+	}, hdr, now)
+
+	replyMeta := &module.MsgMetadata{
+		ID: replyID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8: meta.SMTPOpts.UTF8,
+		},
+	}
+	// Null return-path, per RFC 5230, Section 5.
+	if err := f.submit(ctx, replyMeta, "", meta.OriginalFrom, replyHdr, buffer.MemoryBuffer{Slice: replyBody}); err != nil {
+		dl.Error("failed to enqueue vacation reply", err, "rcpt", accountName, "reply_id", replyID)
+		return
+	}
+	dl.Msg("sent vacation reply", "rcpt", accountName, "reply_id", replyID)
+}
+
+func init() {
+	module.Register(modName, New)
+}
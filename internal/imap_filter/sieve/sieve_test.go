@@ -0,0 +1,252 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	sievelang "github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockScripts map[string]string
+
+func (m mockScripts) Active(username string) (string, string, error) {
+	content, ok := m[username]
+	if !ok {
+		return "", "", sievelang.ErrNoScript
+	}
+	return "main", content, nil
+}
+
+type mockReplies map[string]bool
+
+func (m mockReplies) MarkReplied(username, sender string, _ time.Time, _ time.Duration) (bool, error) {
+	key := username + " " + sender
+	if m[key] {
+		return false, nil
+	}
+	m[key] = true
+	return true, nil
+}
+
+func testFilter(t *testing.T, scripts mockScripts) (*Filter, *testutils.Target) {
+	t.Helper()
+	send := &testutils.Target{}
+	f := &Filter{
+		log:              testutils.Logger(t, modName),
+		send:             send,
+		hostname:         "mx.example.com",
+		autogenMsgDomain: "mx.example.com",
+		scripts:          scripts,
+		replies:          mockReplies{},
+		cache:            map[string]cachedScript{},
+		now:              func() time.Time { return time.Unix(1000000000, 0) },
+	}
+	f.initOnce.Do(func() {})
+	return f, send
+}
+
+func testHeader(fields ...string) textproto.Header {
+	var h textproto.Header
+	for i := 0; i < len(fields); i += 2 {
+		h.Add(fields[i], fields[i+1])
+	}
+	return h
+}
+
+func runFilter(f *Filter, account string, hdr textproto.Header) (string, []string, error) {
+	meta := &module.MsgMetadata{
+		ID:            "test",
+		OriginalFrom:  "sender@example.org",
+		OriginalRcpts: map[string]string{},
+	}
+	return f.IMAPFilter(account, account, meta, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")})
+}
+
+func TestFilter_NoScript(t *testing.T) {
+	f, send := testFilter(t, mockScripts{})
+	folder, flags, err := runFilter(f, "user@example.com", testHeader("Subject", "Hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "" || flags != nil {
+		t.Errorf("unexpected result: %q %v", folder, flags)
+	}
+	if len(send.Messages) != 0 {
+		t.Errorf("unexpected messages sent: %d", len(send.Messages))
+	}
+}
+
+func TestFilter_FileInto(t *testing.T) {
+	f, _ := testFilter(t, mockScripts{
+		"user@example.com": `require ["fileinto", "imap4flags"];
+			if header :contains "subject" "report" {
+				addflag "$Report";
+				fileinto "Reports";
+			}`,
+	})
+
+	folder, flags, err := runFilter(f, "user@example.com", testHeader("Subject", "Weekly report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "Reports" || !reflect.DeepEqual(flags, []string{"$Report"}) {
+		t.Errorf("unexpected result: %q %v", folder, flags)
+	}
+
+	folder, flags, err = runFilter(f, "user@example.com", testHeader("Subject", "Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "" || flags != nil {
+		t.Errorf("unexpected result: %q %v", folder, flags)
+	}
+}
+
+func TestFilter_Discard(t *testing.T) {
+	f, _ := testFilter(t, mockScripts{"user@example.com": `discard;`})
+	_, _, err := runFilter(f, "user@example.com", testHeader("Subject", "Hi"))
+	if !errors.Is(err, module.ErrDiscard) {
+		t.Fatalf("expected ErrDiscard, got %v", err)
+	}
+}
+
+func TestFilter_BrokenScript(t *testing.T) {
+	f, _ := testFilter(t, mockScripts{"user@example.com": `fileinto "Junk";`})
+	_, _, err := runFilter(f, "user@example.com", testHeader("Subject", "Hi"))
+	if err == nil || errors.Is(err, module.ErrDiscard) {
+		t.Fatalf("expected script error, got %v", err)
+	}
+}
+
+func TestFilter_Redirect(t *testing.T) {
+	f, send := testFilter(t, mockScripts{"user@example.com": `redirect "other@example.net";`})
+	_, _, err := runFilter(f, "user@example.com", testHeader("Subject", "Hi"))
+	if !errors.Is(err, module.ErrDiscard) {
+		t.Fatalf("expected ErrDiscard, got %v", err)
+	}
+	if len(send.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(send.Messages))
+	}
+	msg := send.Messages[0]
+	if msg.MailFrom != "sender@example.org" || !reflect.DeepEqual(msg.RcptTo, []string{"other@example.net"}) {
+		t.Errorf("wrong envelope: %s %v", msg.MailFrom, msg.RcptTo)
+	}
+	if msg.Header.Get(redirectedHeader) != "user@example.com" {
+		t.Errorf("missing %s", redirectedHeader)
+	}
+	if string(msg.Body) != "foobar\r\n" {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+
+	// Already redirected by the same account.
+	_, _, err = runFilter(f, "user@example.com", testHeader(redirectedHeader, "user@example.com"))
+	if !errors.Is(err, module.ErrDiscard) {
+		t.Fatalf("expected ErrDiscard, got %v", err)
+	}
+	if len(send.Messages) != 1 {
+		t.Fatalf("loop was not detected")
+	}
+}
+
+func TestFilter_Reject(t *testing.T) {
+	f, send := testFilter(t, mockScripts{"user@example.com": `require "reject"; reject "Not interested";`})
+	_, _, err := runFilter(f, "user@example.com", testHeader("Subject", "Hi"))
+	if !errors.Is(err, module.ErrDiscard) {
+		t.Fatalf("expected ErrDiscard, got %v", err)
+	}
+	if len(send.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(send.Messages))
+	}
+	msg := send.Messages[0]
+	if msg.MailFrom != "" || !reflect.DeepEqual(msg.RcptTo, []string{"sender@example.org"}) {
+		t.Errorf("wrong envelope: %q %v", msg.MailFrom, msg.RcptTo)
+	}
+	if !strings.Contains(string(msg.Body), "Not interested") {
+		t.Errorf("rejection reason is missing from DSN:\n%s", msg.Body)
+	}
+}
+
+func TestFilter_Vacation(t *testing.T) {
+	f, send := testFilter(t, mockScripts{
+		"user@example.com": `require "vacation"; vacation :subject "Away" "I'm away";`,
+	})
+
+	hdr := testHeader("To", "user@example.com", "Subject", "Hi")
+	for i := 0; i < 2; i++ {
+		folder, _, err := runFilter(f, "user@example.com", hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if folder != "" {
+			t.Errorf("unexpected folder: %q", folder)
+		}
+	}
+	if len(send.Messages) != 1 {
+		t.Fatalf("expected 1 reply, got %d", len(send.Messages))
+	}
+	msg := send.Messages[0]
+	if msg.MailFrom != "" || !reflect.DeepEqual(msg.RcptTo, []string{"sender@example.org"}) {
+		t.Errorf("wrong envelope: %q %v", msg.MailFrom, msg.RcptTo)
+	}
+	if msg.Header.Get("Auto-Submitted") != "auto-replied" {
+		t.Errorf("wrong Auto-Submitted: %q", msg.Header.Get("Auto-Submitted"))
+	}
+
+	// Not addressed to the account directly.
+	send.Messages = nil
+	if _, _, err := runFilter(f, "user@example.com", testHeader("To", "list@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if len(send.Messages) != 0 {
+		t.Errorf("unexpected reply")
+	}
+}
+
+func TestFilter_Deferred(t *testing.T) {
+	f, send := testFilter(t, mockScripts{"user@example.com": `redirect "other@example.net"; keep;`})
+	meta := &module.MsgMetadata{
+		ID:            "test",
+		OriginalFrom:  "sender@example.org",
+		OriginalRcpts: map[string]string{},
+	}
+	_, _, commit, err := f.IMAPFilterDeferred("user@example.com", "user@example.com", meta,
+		testHeader("Subject", "Hi"), buffer.MemoryBuffer{Slice: []byte("foobar\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(send.Messages) != 0 {
+		t.Fatal("message redirected before commit")
+	}
+	if commit == nil {
+		t.Fatal("no commit function returned")
+	}
+	commit()
+	if len(send.Messages) != 1 {
+		t.Fatalf("expected 1 message after commit, got %d", len(send.Messages))
+	}
+}
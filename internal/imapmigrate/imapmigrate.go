@@ -0,0 +1,515 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package imapmigrate copies messages from a remote IMAP account into a
+// local storage account.
+//
+// Every remote folder is copied into the local folder with the same path
+// (converted to the local hierarchy delimiter) or, for special-use folders,
+// into the local folder with the same special-use attribute. Flags and
+// INTERNALDATE are preserved. The last copied UID of each remote folder is
+// recorded in State so the migration can be re-run to copy only new
+// messages.
+package imapmigrate
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+const (
+	TLSImplicit = "tls"
+	TLSStartTLS = "starttls"
+	TLSNone     = "none"
+
+	dialTimeout    = 30 * time.Second
+	commandTimeout = 5 * time.Minute
+
+	// fetchBatch is the amount of messages fetched at once.
+	fetchBatch = 50
+)
+
+// Options describe the remote account.
+type Options struct {
+	// Addr is host:port of the remote server.
+	Addr string
+	// TLS is one of TLSImplicit (default), TLSStartTLS or TLSNone.
+	TLS                string
+	InsecureSkipVerify bool
+
+	Username string
+	// Password is used for LOGIN if OAuth2Token is empty.
+	Password string
+	// OAuth2Token is an access token used with XOAUTH2 or OAUTHBEARER.
+	OAuth2Token string
+
+	// CheckAddr, if set, is called with the resolved address of the remote
+	// server before connecting (see CheckPublicAddr).
+	CheckAddr func(ip net.IP) error
+}
+
+// ErrAddrNotAllowed is returned by CheckPublicAddr functions.
+var ErrAddrNotAllowed = errors.New("imapmigrate: remote address is not allowed")
+
+// CheckPublicAddr returns the CheckAddr function that refuses loopback,
+// link-local, multicast and unspecified addresses, so the server cannot be
+// used to reach its own services. Private addresses are refused as well
+// unless allowPrivate is set.
+func CheckPublicAddr(allowPrivate bool) func(ip net.IP) error {
+	return func(ip net.IP) error {
+		if ip == nil || ip.IsUnspecified() || ip.IsLoopback() ||
+			ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+			ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+			return ErrAddrNotAllowed
+		}
+		if !allowPrivate && ip.IsPrivate() {
+			return ErrAddrNotAllowed
+		}
+		return nil
+	}
+}
+
+// Source returns the identifier of the remote account used as the State
+// key.
+func (o Options) Source() string {
+	return o.Username + "@" + o.Addr
+}
+
+// State stores the migration progress of each remote folder.
+type State interface {
+	LastUID(mailbox string) (uidValidity, uid uint32, err error)
+	SetLastUID(mailbox string, uidValidity, uid uint32) error
+}
+
+// Progress is reported after each copied message.
+type Progress struct {
+	Mailbox        string
+	MailboxesDone  int
+	MailboxesTotal int
+	// MessagesTotal is the amount of new messages found in folders
+	// processed so far.
+	MessagesDone  int
+	MessagesTotal int
+}
+
+// SpecialUseUser is implemented by accounts of storage backends that support
+// the SPECIAL-USE extension.
+type SpecialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// specialUseAttrs are attributes assigned to created local folders.
+var specialUseAttrs = []string{
+	imap.ArchiveAttr,
+	imap.DraftsAttr,
+	imap.JunkAttr,
+	imap.SentAttr,
+	imap.TrashAttr,
+}
+
+// wellKnownNames are used to detect special-use folders on servers without
+// the SPECIAL-USE extension. Keys are lower-cased last path elements.
+var wellKnownNames = map[string]string{
+	"sent":             imap.SentAttr,
+	"sent items":       imap.SentAttr,
+	"sent messages":    imap.SentAttr,
+	"sent mail":        imap.SentAttr,
+	"trash":            imap.TrashAttr,
+	"deleted items":    imap.TrashAttr,
+	"deleted messages": imap.TrashAttr,
+	"bin":              imap.TrashAttr,
+	"junk":             imap.JunkAttr,
+	"junk e-mail":      imap.JunkAttr,
+	"junk email":       imap.JunkAttr,
+	"spam":             imap.JunkAttr,
+	"bulk mail":        imap.JunkAttr,
+	"drafts":           imap.DraftsAttr,
+	"draft":            imap.DraftsAttr,
+	"archive":          imap.ArchiveAttr,
+	"archives":         imap.ArchiveAttr,
+}
+
+// Dial connects to the remote server and authenticates.
+func Dial(opts Options) (*client.Client, error) {
+	host, _, err := net.SplitHostPort(opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("imapmigrate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: opts.InsecureSkipVerify, //nolint:gosec
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if opts.CheckAddr != nil {
+		// Checked for each resolved address right before connecting, so
+		// host names resolving to refused addresses are refused too.
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return opts.CheckAddr(net.ParseIP(host))
+		}
+	}
+
+	var c *client.Client
+	switch opts.TLS {
+	case TLSImplicit, "":
+		c, err = client.DialWithDialerTLS(dialer, opts.Addr, tlsConfig)
+	case TLSStartTLS, TLSNone:
+		c, err = client.DialWithDialer(dialer, opts.Addr)
+	default:
+		return nil, fmt.Errorf("imapmigrate: unknown TLS mode: %s", opts.TLS)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("imapmigrate: connect: %w", err)
+	}
+	c.Timeout = commandTimeout
+
+	if opts.TLS == TLSStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout() //nolint:errcheck
+			return nil, fmt.Errorf("imapmigrate: STARTTLS: %w", err)
+		}
+	}
+
+	if err := authenticate(c, opts); err != nil {
+		c.Logout() //nolint:errcheck
+		return nil, fmt.Errorf("imapmigrate: authenticate: %w", err)
+	}
+	return c, nil
+}
+
+func authenticate(c *client.Client, opts Options) error {
+	if opts.OAuth2Token == "" {
+		return c.Login(opts.Username, opts.Password)
+	}
+
+	if ok, err := c.SupportAuth("XOAUTH2"); err != nil {
+		return err
+	} else if ok {
+		return c.Authenticate(&xoauth2Client{username: opts.Username, token: opts.OAuth2Token})
+	}
+	if ok, err := c.SupportAuth(sasl.OAuthBearer); err != nil {
+		return err
+	} else if ok {
+		return c.Authenticate(sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: opts.Username,
+			Token:    opts.OAuth2Token,
+		}))
+	}
+	return errors.New("server does not support XOAUTH2 or OAUTHBEARER")
+}
+
+type checkedUser struct {
+	backend.User
+	check func(mailbox string, size int64) error
+}
+
+// WithCheck returns the account that calls check with the mailbox name and
+// the message size before each imported message is stored. Migrate stores
+// messages using backend.User.CreateMessage directly, so limits enforced by
+// the IMAP endpoint (e.g. quota) should be checked this way.
+func WithCheck(u backend.User, check func(mailbox string, size int64) error) backend.User {
+	cu := &checkedUser{User: u, check: check}
+	if suu, ok := u.(SpecialUseUser); ok {
+		return &checkedSpecialUseUser{checkedUser: cu, SpecialUseUser: suu}
+	}
+	return cu
+}
+
+type checkedSpecialUseUser struct {
+	*checkedUser
+	SpecialUseUser
+}
+
+func (u *checkedUser) CreateMessage(mbox string, flags []string, date time.Time, body imap.Literal, selected backend.Mailbox) error {
+	if err := u.check(mbox, int64(body.Len())); err != nil {
+		return err
+	}
+	return u.User.CreateMessage(mbox, flags, date, body, selected)
+}
+
+// Migrate copies all remote folders of the authenticated client c into the
+// local account.
+//
+// Folders with the \All attribute (such as "All Mail" in Gmail) are skipped
+// since they only contain messages from other folders.
+func Migrate(c *client.Client, u backend.User, state State, progress func(Progress)) error {
+	remote, err := listRemote(c)
+	if err != nil {
+		return err
+	}
+	m, err := newMapping(u)
+	if err != nil {
+		return err
+	}
+
+	p := Progress{MailboxesTotal: len(remote)}
+	for _, info := range remote {
+		local, err := m.localMailbox(info)
+		if err != nil {
+			return fmt.Errorf("imapmigrate: %s: %w", info.Name, err)
+		}
+
+		p.Mailbox = info.Name
+		if progress != nil {
+			progress(p)
+		}
+		if err := copyMailbox(c, u, state, info.Name, local, &p, progress); err != nil {
+			return fmt.Errorf("imapmigrate: %s: %w", info.Name, err)
+		}
+		p.MailboxesDone++
+	}
+	if progress != nil {
+		progress(p)
+	}
+	return nil
+}
+
+func listRemote(c *client.Client) ([]*imap.MailboxInfo, error) {
+	ch := make(chan *imap.MailboxInfo, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.List("", "*", ch)
+	}()
+
+	var res []*imap.MailboxInfo
+	for info := range ch {
+		if hasAttr(info.Attributes, imap.NoSelectAttr) ||
+			hasAttr(info.Attributes, "\\NonExistent") ||
+			hasAttr(info.Attributes, imap.AllAttr) {
+			continue
+		}
+		res = append(res, info)
+	}
+	if err := <-errCh; err != nil {
+		return nil, fmt.Errorf("imapmigrate: LIST: %w", err)
+	}
+
+	// Parents first so they are created before children.
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteSpecialUse returns the special-use attribute of the remote folder,
+// either reported by the server or guessed from its name.
+func remoteSpecialUse(info *imap.MailboxInfo) string {
+	for _, attr := range specialUseAttrs {
+		if hasAttr(info.Attributes, attr) {
+			return attr
+		}
+	}
+
+	name := info.Name
+	if info.Delimiter != "" {
+		if i := strings.LastIndex(name, info.Delimiter); i != -1 {
+			name = name[i+len(info.Delimiter):]
+		}
+	}
+	return wellKnownNames[strings.ToLower(name)]
+}
+
+// mapping resolves local folders for remote ones.
+type mapping struct {
+	u         backend.User
+	delimiter string
+	exists    map[string]bool
+	// special are local folders by special-use attribute.
+	special map[string]string
+}
+
+func newMapping(u backend.User) (*mapping, error) {
+	infos, err := u.ListMailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mapping{
+		u:       u,
+		exists:  make(map[string]bool, len(infos)),
+		special: map[string]string{},
+	}
+	for _, info := range infos {
+		m.exists[info.Name] = true
+		if info.Delimiter != "" {
+			m.delimiter = info.Delimiter
+		}
+		for _, attr := range specialUseAttrs {
+			if _, ok := m.special[attr]; !ok && hasAttr(info.Attributes, attr) {
+				m.special[attr] = info.Name
+			}
+		}
+	}
+	return m, nil
+}
+
+// localMailbox returns the name of the local folder for the remote one,
+// creating it if needed.
+func (m *mapping) localMailbox(info *imap.MailboxInfo) (string, error) {
+	if strings.EqualFold(info.Name, "INBOX") {
+		return "INBOX", nil
+	}
+
+	attr := remoteSpecialUse(info)
+	if name, ok := m.special[attr]; ok {
+		return name, nil
+	}
+
+	name := info.Name
+	if info.Delimiter != "" && m.delimiter != "" && info.Delimiter != m.delimiter {
+		name = strings.ReplaceAll(name, info.Delimiter, m.delimiter)
+	}
+	if m.exists[name] {
+		return name, nil
+	}
+
+	var err error
+	if suu, ok := m.u.(SpecialUseUser); ok && attr != "" {
+		err = suu.CreateMailboxSpecial(name, attr)
+		if err == nil {
+			m.special[attr] = name
+		}
+	} else {
+		err = m.u.CreateMailbox(name)
+	}
+	if err != nil && !errors.Is(err, backend.ErrMailboxAlreadyExists) {
+		return "", err
+	}
+	m.exists[name] = true
+	return name, nil
+}
+
+// copyMailbox copies messages of the remote folder with UIDs above the last
+// copied one. If UIDVALIDITY changed, all messages are copied again.
+func copyMailbox(c *client.Client, u backend.User, state State, remote, local string, p *Progress, progress func(Progress)) error {
+	status, err := c.Select(remote, true)
+	if err != nil {
+		return err
+	}
+
+	validity, lastUID, err := state.LastUID(remote)
+	if err != nil {
+		return err
+	}
+	if validity != status.UidValidity {
+		lastUID = 0
+	}
+	if status.Messages == 0 {
+		return state.SetLastUID(remote, status.UidValidity, lastUID)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(lastUID+1, 0)
+	found, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	// "N:*" always matches the last message, even if its UID is below N.
+	uids := found[:0]
+	for _, uid := range found {
+		if uid > lastUID {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	p.MessagesTotal += len(uids)
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	for start := 0; start < len(uids); start += fetchBatch {
+		end := start + fetchBatch
+		if end > len(uids) {
+			end = len(uids)
+		}
+		seq := new(imap.SeqSet)
+		seq.AddNum(uids[start:end]...)
+
+		ch := make(chan *imap.Message, fetchBatch)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- c.UidFetch(seq, items, ch)
+		}()
+		var msgs []*imap.Message
+		for msg := range ch {
+			msgs = append(msgs, msg)
+		}
+		if err := <-errCh; err != nil {
+			return err
+		}
+		sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid < msgs[j].Uid })
+
+		for _, msg := range msgs {
+			var body imap.Literal
+			for _, b := range msg.Body {
+				body = b
+				break
+			}
+			if body == nil {
+				return fmt.Errorf("no body returned for UID %d", msg.Uid)
+			}
+
+			if err := u.CreateMessage(local, messageFlags(msg.Flags), msg.InternalDate, body, nil); err != nil {
+				return err
+			}
+			if err := state.SetLastUID(remote, status.UidValidity, msg.Uid); err != nil {
+				return err
+			}
+
+			p.MessagesDone++
+			if progress != nil {
+				progress(*p)
+			}
+		}
+	}
+	return nil
+}
+
+// messageFlags returns flags that should be set on the local copy.
+func messageFlags(flags []string) []string {
+	res := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if strings.EqualFold(f, imap.RecentFlag) {
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
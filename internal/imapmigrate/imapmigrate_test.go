@@ -0,0 +1,334 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapmigrate
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type memState map[string][2]uint32
+
+func (s memState) LastUID(mailbox string) (uint32, uint32, error) {
+	v := s[mailbox]
+	return v[0], v[1], nil
+}
+
+func (s memState) SetLastUID(mailbox string, uidValidity, uid uint32) error {
+	s[mailbox] = [2]uint32{uidValidity, uid}
+	return nil
+}
+
+// localUser is the memory backend account that reports "." as the
+// delimiter and special-use attributes of some folders.
+type localUser struct {
+	backend.User
+	special map[string]string
+}
+
+func (u *localUser) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
+	infos, err := u.User.ListMailboxes(subscribed)
+	for i := range infos {
+		infos[i].Delimiter = "."
+		if attr, ok := u.special[infos[i].Name]; ok {
+			infos[i].Attributes = append(infos[i].Attributes, attr)
+		}
+	}
+	return infos, err
+}
+
+func memoryUser(t *testing.T, be *memory.Backend) backend.User {
+	t.Helper()
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func addMsg(t *testing.T, u backend.User, mbox string, flags []string, date time.Time, body string) {
+	t.Helper()
+	if err := u.CreateMessage(mbox, flags, date, bytes.NewBufferString(body), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setupRemote(t *testing.T) (backend.User, string) {
+	t.Helper()
+
+	be := memory.New()
+	srv := imapserver.New(be)
+	srv.AllowInsecureAuth = true
+	srv.ErrorLog = testutils.Logger(t, "imap")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { srv.Close() })
+
+	return memoryUser(t, be), l.Addr().String()
+}
+
+// dumpMailbox returns "flags date body" of each message in the mailbox.
+func dumpMailbox(t *testing.T, u backend.User, name string) []string {
+	t.Helper()
+
+	_, mbox, err := u.GetMailbox(name, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	section := &imap.BodySectionName{Peek: true}
+	ch := make(chan *imap.Message, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}, ch)
+	}()
+	var res []string
+	for msg := range ch {
+		flags := append([]string(nil), msg.Flags...)
+		sort.Strings(flags)
+		var body bytes.Buffer
+		for _, b := range msg.Body {
+			body.ReadFrom(b) //nolint:errcheck
+		}
+		res = append(res, msg.InternalDate.UTC().Format(time.RFC3339)+" "+flags2str(flags)+" "+body.String())
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func flags2str(flags []string) string {
+	var buf bytes.Buffer
+	for i, f := range flags {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(f)
+	}
+	return buf.String()
+}
+
+func TestMigrate(t *testing.T) {
+	date := time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)
+
+	remote, addr := setupRemote(t)
+	for _, name := range []string{"Sent Items", "Work", "Work/Projects"} {
+		if err := remote.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addMsg(t, remote, "Sent Items", []string{imap.SeenFlag}, date, "Subject: Sent\r\n\r\nSent\r\n")
+	addMsg(t, remote, "Work/Projects", []string{imap.FlaggedFlag, "$Label"}, date.Add(time.Hour), "Subject: Work\r\n\r\nWork\r\n")
+
+	local := &localUser{
+		User:    memoryUser(t, memory.New()),
+		special: map[string]string{"Sent": imap.SentAttr},
+	}
+	_, inbox, err := local.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox.(*memory.SelectedMailbox).Messages = nil
+	if err := local.CreateMailbox("Sent"); err != nil {
+		t.Fatal(err)
+	}
+
+	state := memState{}
+	migrate := func(password string) (Progress, error) {
+		c, err := Dial(Options{Addr: addr, TLS: TLSNone, Username: "username", Password: password})
+		if err != nil {
+			return Progress{}, err
+		}
+		defer c.Logout() //nolint:errcheck
+
+		var last Progress
+		err = Migrate(c, local, state, func(p Progress) { last = p })
+		return last, err
+	}
+
+	if _, err := migrate("wrong"); err == nil {
+		t.Fatal("expected authentication error")
+	}
+
+	p, err := migrate("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MessagesDone != 3 || p.MailboxesDone != 4 || p.MailboxesTotal != 4 {
+		t.Errorf("wrong progress: %+v", p)
+	}
+
+	if got := dumpMailbox(t, local, "Sent"); !reflect.DeepEqual(got, []string{"2024-03-01T10:20:30Z \\Seen Subject: Sent\r\n\r\nSent\r\n"}) {
+		t.Errorf("wrong Sent contents: %q", got)
+	}
+	// go-imap client lower-cases keywords.
+	if got := dumpMailbox(t, local, "Work.Projects"); !reflect.DeepEqual(got, []string{"2024-03-01T11:20:30Z $label,\\Flagged Subject: Work\r\n\r\nWork\r\n"}) {
+		t.Errorf("wrong Work.Projects contents: %q", got)
+	}
+	if got := dumpMailbox(t, local, "INBOX"); len(got) != 1 {
+		t.Errorf("wrong INBOX contents: %q", got)
+	}
+	if _, err := local.Status("Sent Items", nil); err == nil {
+		t.Error("Sent Items should be mapped to Sent")
+	}
+
+	// Second run copies only new messages.
+	addMsg(t, remote, "INBOX", nil, date, "Subject: New\r\n\r\nNew\r\n")
+	p, err = migrate("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MessagesDone != 1 || p.MessagesTotal != 1 {
+		t.Errorf("wrong progress: %+v", p)
+	}
+	if got := dumpMailbox(t, local, "INBOX"); len(got) != 2 {
+		t.Errorf("wrong INBOX contents: %q", got)
+	}
+
+	// Changed UIDVALIDITY copies the folder again.
+	state["Work/Projects"] = [2]uint32{12345, 1}
+	if _, err := migrate("password"); err != nil {
+		t.Fatal(err)
+	}
+	if got := dumpMailbox(t, local, "Work.Projects"); len(got) != 2 {
+		t.Errorf("wrong Work.Projects contents: %q", got)
+	}
+}
+
+func TestMigrate_Check(t *testing.T) {
+	remote, addr := setupRemote(t)
+	addMsg(t, remote, "INBOX", nil, time.Now(), "Subject: First\r\n\r\nFirst\r\n")
+	addMsg(t, remote, "INBOX", nil, time.Now(), "Subject: Second\r\n\r\nSecond\r\n")
+
+	local := &localUser{User: memoryUser(t, memory.New())}
+	_, inbox, err := local.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox.(*memory.SelectedMailbox).Messages = nil
+
+	c, err := Dial(Options{Addr: addr, TLS: TLSNone, Username: "username", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+
+	errOverQuota := errors.New("over quota")
+	imported := 0
+	checked := WithCheck(local, func(mailbox string, size int64) error {
+		if mailbox != "INBOX" || size == 0 {
+			t.Errorf("wrong check arguments: %s, %d", mailbox, size)
+		}
+		if imported == 1 {
+			return errOverQuota
+		}
+		imported++
+		return nil
+	})
+	state := memState{}
+	if err := Migrate(c, checked, state, nil); !errors.Is(err, errOverQuota) {
+		t.Fatal("expected the check error, got", err)
+	}
+	if got := dumpMailbox(t, local, "INBOX"); len(got) != 1 {
+		t.Errorf("wrong INBOX contents: %q", got)
+	}
+
+	// The rejected message is copied by the next run.
+	if err := Migrate(c, local, state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(dumpMailbox(t, local, "INBOX")), len(dumpMailbox(t, remote, "INBOX")); got != want {
+		t.Errorf("wrong INBOX contents: %d messages, want %d", got, want)
+	}
+}
+
+func TestCheckPublicAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr         string
+		allowPrivate bool
+		ok           bool
+	}{
+		{"192.0.2.1", false, true},
+		{"2001:db8::1", false, true},
+		{"127.0.0.1", true, false},
+		{"::1", true, false},
+		{"169.254.169.254", true, false},
+		{"fe80::1", true, false},
+		{"0.0.0.0", true, false},
+		{"224.0.0.1", true, false},
+		{"10.0.0.1", false, false},
+		{"10.0.0.1", true, true},
+		{"fd00::1", false, false},
+	} {
+		err := CheckPublicAddr(c.allowPrivate)(net.ParseIP(c.addr))
+		if (err == nil) != c.ok {
+			t.Errorf("%s (allowPrivate=%v): expected ok=%v, got %v", c.addr, c.allowPrivate, c.ok, err)
+		}
+	}
+
+	_, err := Dial(Options{Addr: "127.0.0.1:143", TLS: TLSNone, CheckAddr: CheckPublicAddr(true)})
+	if !errors.Is(err, ErrAddrNotAllowed) {
+		t.Fatal("expected ErrAddrNotAllowed, got", err)
+	}
+}
+
+func TestRemoteSpecialUse(t *testing.T) {
+	for _, c := range []struct {
+		info     imap.MailboxInfo
+		expected string
+	}{
+		{imap.MailboxInfo{Name: "Deleted Items", Delimiter: "/"}, imap.TrashAttr},
+		{imap.MailboxInfo{Name: "INBOX.Spam", Delimiter: "."}, imap.JunkAttr},
+		{imap.MailboxInfo{Name: "[Gmail]/Sent Mail", Delimiter: "/", Attributes: []string{imap.SentAttr}}, imap.SentAttr},
+		{imap.MailboxInfo{Name: "Papers", Delimiter: "/", Attributes: []string{"\\Drafts"}}, imap.DraftsAttr},
+		{imap.MailboxInfo{Name: "Projects", Delimiter: "/"}, ""},
+	} {
+		if got := remoteSpecialUse(&c.info); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.info.Name, c.expected, got)
+		}
+	}
+}
+
+func TestXOAUTH2(t *testing.T) {
+	mech, ir, err := (&xoauth2Client{username: "user@example.org", token: "tok"}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "XOAUTH2" || string(ir) != "user=user@example.org\x01auth=Bearer tok\x01\x01" {
+		t.Errorf("wrong initial response: %s %q", mech, ir)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailexport
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// fetchBatch is the amount of message bodies fetched at once.
+const fetchBatch = 100
+
+type message struct {
+	uid   uint32
+	flags []string
+	date  time.Time
+}
+
+// Export writes all mailboxes of the account into w as a tar archive.
+//
+// Messages are read using BODY.PEEK[] so the export does not change flags.
+// Messages added after the export started are not included.
+func Export(u backend.User, w io.Writer, format Format, progress func(Progress)) error {
+	if format != FormatMaildir && format != FormatMbox {
+		return fmt.Errorf("mailexport: unknown format: %s", format)
+	}
+
+	manifest, messages, err := scanAccount(u, format)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	blob, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     manifestName,
+		Typeflag: tar.TypeReg,
+		Mode:     0o600,
+		Size:     int64(len(blob)),
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(blob); err != nil {
+		return err
+	}
+
+	p := Progress{}
+	for _, mbox := range manifest.Mailboxes {
+		p.MessagesTotal += mbox.Messages
+	}
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	for i, mbox := range manifest.Mailboxes {
+		p.Mailbox = mbox.Name
+		report()
+
+		switch format {
+		case FormatMaildir:
+			err = exportMaildir(tw, u, mbox, messages[i], func() { p.MessagesDone++; report() })
+		case FormatMbox:
+			err = exportMbox(tw, u, mbox, messages[i], func() { p.MessagesDone++; report() })
+		}
+		if err != nil {
+			return fmt.Errorf("mailexport: %s: %w", mbox.Name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// scanAccount builds the manifest and lists messages of each mailbox.
+func scanAccount(u backend.User, format Format) (*Manifest, [][]message, error) {
+	all, err := u.ListMailboxes(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	subscribed, err := u.ListMailboxes(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	isSubscribed := make(map[string]bool, len(subscribed))
+	for _, info := range subscribed {
+		isSubscribed[info.Name] = true
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	manifest := &Manifest{
+		Version:  manifestVersion,
+		Format:   format,
+		Username: u.Username(),
+	}
+	var messages [][]message
+	for _, info := range all {
+		if hasAttr(info.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+
+		msgs, err := listMessages(u, info.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("mailexport: %s: %w", info.Name, err)
+		}
+
+		seen := map[string]bool{}
+		var keywords []string
+		for _, msg := range msgs {
+			for _, kw := range messageKeywords(msg.flags) {
+				if !seen[kw] {
+					seen[kw] = true
+					keywords = append(keywords, kw)
+				}
+			}
+		}
+		sort.Strings(keywords)
+
+		manifest.Mailboxes = append(manifest.Mailboxes, Mailbox{
+			Name:       info.Name,
+			Path:       mailboxPath(info.Name),
+			Delimiter:  info.Delimiter,
+			SpecialUse: specialUse(info.Attributes),
+			Subscribed: isSubscribed[info.Name],
+			Messages:   len(msgs),
+			Keywords:   keywords,
+		})
+		messages = append(messages, msgs)
+	}
+
+	return manifest, messages, nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func listMessages(u backend.User, name string) ([]message, error) {
+	_, mbox, err := u.GetMailbox(name, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer mbox.Close()
+
+	seq, err := imap.ParseSeqSet("1:*")
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *imap.Message)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate}, ch)
+	}()
+
+	var msgs []message
+	for msg := range ch {
+		msgs = append(msgs, message{
+			uid:   msg.Uid,
+			flags: msg.Flags,
+			date:  msg.InternalDate,
+		})
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].uid < msgs[j].uid })
+	return msgs, nil
+}
+
+// fetchBodies calls fn for each message with its full body. Messages removed
+// since they were listed are skipped.
+func fetchBodies(u backend.User, name string, msgs []message, fn func(message, imap.Literal) error) error {
+	_, mbox, err := u.GetMailbox(name, true, nil)
+	if err != nil {
+		return err
+	}
+	defer mbox.Close()
+
+	byUID := make(map[uint32]message, len(msgs))
+	for _, msg := range msgs {
+		byUID[msg.uid] = msg
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+
+	for start := 0; start < len(msgs); start += fetchBatch {
+		end := start + fetchBatch
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		seq := new(imap.SeqSet)
+		for _, msg := range msgs[start:end] {
+			seq.AddNum(msg.uid)
+		}
+
+		ch := make(chan *imap.Message)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- mbox.ListMessages(true, seq, items, ch)
+		}()
+
+		var fnErr error
+		for msg := range ch {
+			if fnErr != nil {
+				continue
+			}
+			for _, body := range msg.Body {
+				fnErr = fn(byUID[msg.Uid], body)
+				break
+			}
+		}
+		if err := <-errCh; err != nil {
+			return err
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+	return nil
+}
+
+func exportMaildir(tw *tar.Writer, u backend.User, mbox Mailbox, msgs []message, done func()) error {
+	dir := mailboxesDir + mbox.Path + "/"
+	for _, sub := range []string{"", "cur/", "new/", "tmp/"} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     dir + sub,
+			Typeflag: tar.TypeDir,
+			Mode:     0o700,
+			ModTime:  time.Now(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return fetchBodies(u, mbox.Name, msgs, func(msg message, body imap.Literal) error {
+		name := fmt.Sprintf("%scur/%d.M%d.maddy%s", dir, msg.date.Unix(), msg.uid, maildirInfo(msg.flags, mbox.Keywords))
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o600,
+			Size:     int64(body.Len()),
+			ModTime:  msg.date,
+		}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, body); err != nil {
+			return err
+		}
+		done()
+		return nil
+	})
+}
+
+// exportMbox writes the mailbox into a temporary file first since the size
+// of tar entries should be known in advance.
+func exportMbox(tw *tar.Writer, u backend.User, mbox Mailbox, msgs []message, done func()) error {
+	f, err := os.CreateTemp("", "maddy-export-*.mbox")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = fetchBodies(u, mbox.Name, msgs, func(msg message, body imap.Literal) error {
+		if err := writeMboxMessage(w, msg, body); err != nil {
+			return err
+		}
+		done()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     mailboxesDir + mbox.Path + ".mbox",
+		Typeflag: tar.TypeReg,
+		Mode:     0o600,
+		Size:     size,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
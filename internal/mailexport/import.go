@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailexport
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// literal is a tar entry passed to CreateMessage.
+type literal struct {
+	io.Reader
+	size int
+}
+
+func (l literal) Len() int {
+	return l.size
+}
+
+// Import adds messages from the archive created by Export to the account.
+//
+// Missing mailboxes are created with their special-use attribute, existing
+// ones are kept and messages are added to them. Import does not check for
+// duplicates, importing the same archive twice duplicates all messages.
+func Import(u backend.User, r io.Reader, progress func(Progress)) error {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("mailexport: read archive: %w", err)
+	}
+	if hdr.Name != manifestName {
+		return fmt.Errorf("mailexport: archive does not start with %s", manifestName)
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("mailexport: malformed manifest: %w", err)
+	}
+	if manifest.Version != manifestVersion {
+		return fmt.Errorf("mailexport: unsupported archive version: %d", manifest.Version)
+	}
+	if manifest.Format != FormatMaildir && manifest.Format != FormatMbox {
+		return fmt.Errorf("mailexport: unknown format: %s", manifest.Format)
+	}
+
+	byPath, err := createMailboxes(u, manifest.Mailboxes)
+	if err != nil {
+		return err
+	}
+
+	p := Progress{}
+	for _, mbox := range manifest.Mailboxes {
+		p.MessagesTotal += mbox.Messages
+	}
+	add := func(mbox *Mailbox, flags []string, date time.Time, body imap.Literal) error {
+		if err := u.CreateMessage(mbox.Name, flags, date, body, nil); err != nil {
+			return fmt.Errorf("mailexport: %s: %w", mbox.Name, err)
+		}
+		p.Mailbox = mbox.Name
+		p.MessagesDone++
+		if progress != nil {
+			progress(p)
+		}
+		return nil
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("mailexport: read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, mailboxesDir) {
+			continue
+		}
+		name := strings.TrimPrefix(hdr.Name, mailboxesDir)
+
+		switch manifest.Format {
+		case FormatMaildir:
+			dir, file := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+			if sub := path.Base(dir); sub != "cur" && sub != "new" {
+				continue
+			}
+			mbox, ok := byPath[path.Dir(dir)]
+			if !ok {
+				return fmt.Errorf("mailexport: %s: mailbox is not in the manifest", hdr.Name)
+			}
+			flags := parseMaildirInfo(file, mbox.Keywords)
+			if err := add(mbox, flags, hdr.ModTime, literal{Reader: tr, size: int(hdr.Size)}); err != nil {
+				return err
+			}
+		case FormatMbox:
+			if !strings.HasSuffix(name, ".mbox") {
+				continue
+			}
+			mbox, ok := byPath[strings.TrimSuffix(name, ".mbox")]
+			if !ok {
+				return fmt.Errorf("mailexport: %s: mailbox is not in the manifest", hdr.Name)
+			}
+			err := readMbox(tr, func(msg *mboxMessage) error {
+				return add(mbox, msg.flags, msg.date, &msg.body)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// createMailboxes creates mailboxes missing in the account and returns the
+// manifest entries by path with names converted to the account hierarchy
+// delimiter.
+func createMailboxes(u backend.User, mailboxes []Mailbox) (map[string]*Mailbox, error) {
+	existing, err := u.ListMailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(existing))
+	delim := ""
+	for _, info := range existing {
+		exists[info.Name] = true
+		if info.Delimiter != "" {
+			delim = info.Delimiter
+		}
+	}
+
+	sorted := make([]Mailbox, len(mailboxes))
+	copy(sorted, mailboxes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	byPath := make(map[string]*Mailbox, len(sorted))
+	for i := range sorted {
+		mbox := &sorted[i]
+		if mbox.Delimiter != "" && delim != "" && mbox.Delimiter != delim {
+			mbox.Name = strings.ReplaceAll(mbox.Name, mbox.Delimiter, delim)
+		}
+		byPath[mbox.Path] = mbox
+
+		if !exists[mbox.Name] {
+			var err error
+			if suu, ok := u.(SpecialUseUser); ok && mbox.SpecialUse != "" {
+				err = suu.CreateMailboxSpecial(mbox.Name, mbox.SpecialUse)
+			} else {
+				err = u.CreateMailbox(mbox.Name)
+			}
+			if err != nil && !errors.Is(err, backend.ErrMailboxAlreadyExists) {
+				return nil, fmt.Errorf("mailexport: create %s: %w", mbox.Name, err)
+			}
+			exists[mbox.Name] = true
+		}
+
+		if mbox.Subscribed {
+			if err := u.SetSubscribed(mbox.Name, true); err != nil {
+				return nil, fmt.Errorf("mailexport: subscribe %s: %w", mbox.Name, err)
+			}
+		}
+	}
+	return byPath, nil
+}
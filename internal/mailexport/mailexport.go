@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mailexport implements export of storage accounts into tar
+// archives and import of such archives back.
+//
+// The archive starts with manifest.json describing the account mailboxes,
+// followed by mailbox contents under mailboxes/ in one of the formats:
+//
+//	maildir: mailboxes/<name>/cur/<date>.M<uid>.maddy:2,<flags>
+//	mbox:    mailboxes/<name>.mbox (mboxrd)
+//
+// where <name> is the path-escaped mailbox name. Only backend.User methods
+// are used so any storage backend can be exported.
+package mailexport
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+type Format string
+
+const (
+	FormatMaildir Format = "maildir"
+	FormatMbox    Format = "mbox"
+)
+
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 1
+	mailboxesDir    = "mailboxes/"
+
+	// maildirKeywords is the amount of keywords that can be encoded in
+	// Maildir file names (letters a-z).
+	maildirKeywords = 26
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatMaildir, FormatMbox:
+		return f, nil
+	case "":
+		return FormatMaildir, nil
+	default:
+		return "", fmt.Errorf("mailexport: unknown format: %s", s)
+	}
+}
+
+// Manifest describes the exported account.
+type Manifest struct {
+	Version   int       `json:"version"`
+	Format    Format    `json:"format"`
+	Username  string    `json:"username"`
+	Mailboxes []Mailbox `json:"mailboxes"`
+}
+
+// Mailbox describes a single exported mailbox.
+type Mailbox struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Delimiter  string `json:"delimiter,omitempty"`
+	SpecialUse string `json:"specialUse,omitempty"`
+	Subscribed bool   `json:"subscribed"`
+	Messages   int    `json:"messages"`
+
+	// Keywords used by messages of the mailbox. In Maildir format, keyword
+	// at index i is stored as letter 'a'+i in the file name.
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// Progress is reported after each exported or imported message.
+type Progress struct {
+	Mailbox       string
+	MessagesDone  int
+	MessagesTotal int
+}
+
+// SpecialUseUser is implemented by accounts of storage backends that support
+// the SPECIAL-USE extension.
+type SpecialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+var specialUseAttrs = []string{
+	imap.AllAttr,
+	imap.ArchiveAttr,
+	imap.DraftsAttr,
+	imap.FlaggedAttr,
+	imap.JunkAttr,
+	imap.SentAttr,
+	imap.TrashAttr,
+}
+
+func specialUse(attrs []string) string {
+	for _, attr := range attrs {
+		for _, su := range specialUseAttrs {
+			if strings.EqualFold(attr, su) {
+				return su
+			}
+		}
+	}
+	return ""
+}
+
+func mailboxPath(name string) string {
+	return url.PathEscape(name)
+}
+
+// maildirFlags maps system flags to Maildir info letters.
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// maildirInfo returns the Maildir info suffix for the flags. Keywords that
+// are not in the keywords list are not encoded.
+func maildirInfo(flags []string, keywords []string) string {
+	var letters []byte
+	for _, f := range flags {
+		if l, ok := maildirFlags[f]; ok {
+			letters = append(letters, l)
+			continue
+		}
+		for i, kw := range keywords {
+			if kw == f && i < maildirKeywords {
+				letters = append(letters, byte('a'+i))
+				break
+			}
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return ":2," + string(letters)
+}
+
+// parseMaildirInfo returns flags encoded in the Maildir file name.
+func parseMaildirInfo(filename string, keywords []string) []string {
+	_, info, ok := strings.Cut(filename, ":2,")
+	if !ok {
+		return nil
+	}
+
+	var flags []string
+	for i := 0; i < len(info); i++ {
+		l := info[i]
+		if l >= 'a' && l <= 'z' {
+			if idx := int(l - 'a'); idx < len(keywords) {
+				flags = append(flags, keywords[idx])
+			}
+			continue
+		}
+		for f, fl := range maildirFlags {
+			if fl == l {
+				flags = append(flags, f)
+				break
+			}
+		}
+	}
+	return flags
+}
+
+// messageKeywords returns flags that are not system flags.
+func messageKeywords(flags []string) []string {
+	var res []string
+	for _, f := range flags {
+		if strings.HasPrefix(f, "\\") {
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailexport
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+// emptyUser returns the memory backend account with the sample message
+// removed from INBOX.
+func emptyUser(t *testing.T) backend.User {
+	t.Helper()
+
+	u, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox.(*memory.SelectedMailbox).Messages = nil
+	return u
+}
+
+func addMsg(t *testing.T, u backend.User, mbox string, flags []string, date time.Time, body string) {
+	t.Helper()
+	if err := u.CreateMessage(mbox, flags, date, bytes.NewBufferString(body), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dumpAccount returns "mailbox flags date body" for each message.
+func dumpAccount(t *testing.T, u backend.User) []string {
+	t.Helper()
+
+	infos, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, info := range infos {
+		msgs, err := listMessages(u, info.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fetchBodies(u, info.Name, msgs, func(msg message, body imap.Literal) error {
+			var buf bytes.Buffer
+			if _, err := buf.ReadFrom(body); err != nil {
+				return err
+			}
+			flags := append([]string(nil), msg.flags...)
+			sort.Strings(flags)
+			res = append(res, strings.Join([]string{info.Name, strings.Join(flags, ","), msg.date.UTC().Format(time.RFC3339), buf.String()}, " "))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestExportImport(t *testing.T) {
+	date := time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)
+
+	src := emptyUser(t)
+	for _, name := range []string{"Archive", "Work", "Work/Projects"} {
+		if err := src.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.SetSubscribed("Work/Projects", true); err != nil {
+		t.Fatal(err)
+	}
+	addMsg(t, src, "INBOX", []string{imap.SeenFlag, "$Label1"}, date,
+		"Subject: One\r\n\r\nFrom the start\r\n>From quoted\r\n\r\n")
+	addMsg(t, src, "INBOX", []string{imap.FlaggedFlag, imap.AnsweredFlag, imap.DraftFlag}, date.Add(time.Hour),
+		"Subject: Two\r\n\r\nHello\r\n")
+	addMsg(t, src, "Work/Projects", []string{"$Label2", "$Label1"}, date.Add(2*time.Hour),
+		"Subject: Three\r\n\r\nStatus: not a header\r\n")
+	expected := dumpAccount(t, src)
+	if len(expected) != 3 {
+		t.Fatalf("wrong source account: %q", expected)
+	}
+
+	for _, format := range []Format{FormatMaildir, FormatMbox} {
+		format := format
+		t.Run(string(format), func(t *testing.T) {
+			var archive bytes.Buffer
+			var last Progress
+			if err := Export(src, &archive, format, func(p Progress) { last = p }); err != nil {
+				t.Fatal(err)
+			}
+			if last.MessagesDone != 3 || last.MessagesTotal != 3 {
+				t.Errorf("wrong export progress: %+v", last)
+			}
+
+			dst := emptyUser(t)
+			last = Progress{}
+			if err := Import(dst, &archive, func(p Progress) { last = p }); err != nil {
+				t.Fatal(err)
+			}
+			if last.MessagesDone != 3 || last.MessagesTotal != 3 {
+				t.Errorf("wrong import progress: %+v", last)
+			}
+
+			if actual := dumpAccount(t, dst); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("imported account differs\nexpected: %q\nactual:   %q", expected, actual)
+			}
+
+			subscribed, err := dst.ListMailboxes(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(subscribed) != 1 || subscribed[0].Name != "Work/Projects" {
+				t.Errorf("wrong subscriptions: %v", subscribed)
+			}
+		})
+	}
+}
+
+func TestImport_Malformed(t *testing.T) {
+	if err := Import(emptyUser(t), strings.NewReader("not a tar archive"), nil); err == nil {
+		t.Error("expected error for malformed archive")
+	}
+}
+
+func TestMaildirInfo(t *testing.T) {
+	keywords := []string{"$Label1", "$Label2"}
+	flags := []string{imap.SeenFlag, "$Label2", imap.RecentFlag, imap.DeletedFlag, "$Unknown"}
+
+	info := maildirInfo(flags, keywords)
+	if info != ":2,STb" {
+		t.Errorf("wrong info: %s", info)
+	}
+
+	parsed := parseMaildirInfo("1.M1.maddy"+info, keywords)
+	sort.Strings(parsed)
+	expected := []string{"$Label2", imap.SeenFlag, imap.DeletedFlag}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("wrong flags: %v", parsed)
+	}
+}
+
+func TestMbox_Quoting(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	body := "Subject: Test\r\n\r\nFrom here\r\n>From there\r\nFromage\r\n"
+	if err := writeMboxMessage(w, message{date: time.Unix(0, 0)}, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	expected := "From MAILER-DAEMON Thu Jan  1 00:00:00 1970\n" +
+		"Status: O\n" +
+		"Subject: Test\n\n>From here\n>>From there\nFromage\n\n"
+	if buf.String() != expected {
+		t.Errorf("wrong mbox:\n%q\nexpected:\n%q", buf.String(), expected)
+	}
+
+	var msgs []string
+	err := readMbox(&buf, func(msg *mboxMessage) error {
+		msgs = append(msgs, msg.body.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0] != body {
+		t.Errorf("wrong messages read back: %q", msgs)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailexport
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Flags are stored in Status, X-Status and X-Keywords headers prepended to
+// the message, the convention used by most mbox readers. The headers are
+// removed on import.
+
+var mboxXStatus = []struct {
+	flag   string
+	letter byte
+}{
+	{imap.AnsweredFlag, 'A'},
+	{imap.FlaggedFlag, 'F'},
+	{imap.DraftFlag, 'T'},
+	{imap.DeletedFlag, 'D'},
+}
+
+// isFromLine reports whether the line has to be quoted in mboxrd format.
+func isFromLine(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, ">"), "From ")
+}
+
+// writeMboxMessage writes the message in mboxrd format, line endings are
+// converted to LF.
+func writeMboxMessage(w *bufio.Writer, msg message, body io.Reader) error {
+	w.WriteString("From MAILER-DAEMON " + msg.date.UTC().Format(time.ANSIC) + "\n")
+
+	status := "O"
+	var xstatus []byte
+	for _, f := range msg.flags {
+		if f == imap.SeenFlag {
+			status = "RO"
+		}
+		for _, xs := range mboxXStatus {
+			if xs.flag == f {
+				xstatus = append(xstatus, xs.letter)
+			}
+		}
+	}
+	w.WriteString("Status: " + status + "\n")
+	if len(xstatus) != 0 {
+		w.WriteString("X-Status: " + string(xstatus) + "\n")
+	}
+	if kw := messageKeywords(msg.flags); len(kw) != 0 {
+		w.WriteString("X-Keywords: " + strings.Join(kw, " ") + "\n")
+	}
+
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if isFromLine(line) {
+				w.WriteByte('>')
+			}
+			w.WriteString(line)
+			w.WriteByte('\n')
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.WriteString("\n")
+	return err
+}
+
+// mboxMessage is a message read from mbox file, body uses CRLF line endings.
+type mboxMessage struct {
+	date  time.Time
+	flags []string
+	body  bytes.Buffer
+}
+
+// readMbox calls fn for each message in the mboxrd file.
+func readMbox(r io.Reader, fn func(*mboxMessage) error) error {
+	var (
+		msg *mboxMessage
+		// blanks is the amount of empty lines not yet written, the last
+		// empty line before the next message is the separator.
+		blanks int
+		// meta is true while reading flag headers at the message start.
+		meta bool
+	)
+	flush := func() error {
+		if msg == nil {
+			return nil
+		}
+		for ; blanks > 1; blanks-- {
+			msg.body.WriteString("\r\n")
+		}
+		blanks = 0
+		return fn(msg)
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		switch {
+		case strings.HasPrefix(line, "From "):
+			if err := flush(); err != nil {
+				return err
+			}
+			msg = &mboxMessage{date: parseFromLine(line)}
+			meta = true
+		case msg == nil:
+			// Garbage before the first message.
+		case line == "":
+			meta = false
+			blanks++
+		default:
+			if meta && parseMboxMeta(msg, line) {
+				break
+			}
+			meta = false
+			for ; blanks > 0; blanks-- {
+				msg.body.WriteString("\r\n")
+			}
+			if strings.HasPrefix(line, ">") && isFromLine(line) {
+				line = line[1:]
+			}
+			msg.body.WriteString(line)
+			msg.body.WriteString("\r\n")
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return flush()
+}
+
+func parseFromLine(line string) time.Time {
+	fields := strings.Fields(strings.TrimPrefix(line, "From "))
+	if len(fields) < 2 {
+		return time.Time{}
+	}
+	date, err := time.Parse(time.ANSIC, strings.Join(fields[1:], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// parseMboxMeta adds flags from the Status, X-Status or X-Keywords header.
+// It returns false if the line is not one of these headers.
+func parseMboxMeta(msg *mboxMessage, line string) bool {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return false
+	}
+	value = strings.TrimSpace(value)
+
+	switch strings.ToLower(name) {
+	case "status":
+		if strings.ContainsRune(value, 'R') {
+			msg.flags = append(msg.flags, imap.SeenFlag)
+		}
+	case "x-status":
+		for _, xs := range mboxXStatus {
+			if strings.IndexByte(value, xs.letter) != -1 {
+				msg.flags = append(msg.flags, xs.flag)
+			}
+		}
+	case "x-keywords":
+		msg.flags = append(msg.flags, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ' ' || r == ','
+		})...)
+	default:
+		return false
+	}
+	return true
+}
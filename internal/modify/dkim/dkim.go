@@ -24,9 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -98,9 +98,16 @@ type (
 	Modifier struct {
 		instName string
 
+		// keysLck protects domains, signers and selectors. genLck serializes
+		// key generation and rotation, which may take a while and should
+		// not block signing.
+		keysLck sync.RWMutex
+		genLck  sync.Mutex
+
 		domains         []string
 		selector        string
 		signers         map[string]crypto.Signer
+		selectors       map[string]string
 		oversignHeader  []string
 		signHeader      []string
 		headerCanon     dkim.Canonicalization
@@ -125,15 +132,18 @@ type (
 		DNSName    string        `json:"dnsName"`
 		DNSValue   string        `json:"dnsValue"`
 		Expires    time.Time     `json:"expires,omitempty"`
+		Selector   string        `json:"selector,omitempty"`
+		Previous   []KeyRecord   `json:"previous,omitempty"`
 		pkey       crypto.Signer `json:"-"`
 	}
 )
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
-		instName: instName,
-		signers:  map[string]crypto.Signer{},
-		log:      log.Logger{Name: "modify.dkim"},
+		instName:  instName,
+		signers:   map[string]crypto.Signer{},
+		selectors: map[string]string{},
+		log:       log.Logger{Name: "modify.dkim"},
 	}
 
 	if len(inlineArgs) == 0 {
@@ -211,89 +221,106 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		}
 	}
 
-	storeKeysInDB := m.storeKeysInDB && m.table != nil
-
 	for _, domain := range m.domains {
-		if _, err := idna.ToASCII(domain); err != nil {
-			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
-		}
-
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(m.keyPathTemplate)
-
-		signer, newKey, err := m.loadOrGenerateKey(domain, keyPath, m.newKeyAlgo, storeKeysInDB)
-		if err != nil {
+		if _, _, err := m.loadKey(domain); err != nil {
 			return err
 		}
-
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				m.newKeyAlgo, keyPath, dnsPath, m.selector, domain)
-		}
-
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
-		}
-		m.signers[normDomain] = signer
 	}
 
 	return nil
 }
 
-func (m *Modifier) AddKey(domain string) error {
-	if m.table != nil {
-		ctx := context.Background()
-		_, ok, err := m.table.Lookup(ctx, domain)
-		if err != nil {
-			return err
-		}
-
-		if ok {
-			return nil
-		}
-
-		m.domains = append(m.domains, domain)
+// loadKey loads or generates the signing key for the domain and makes it
+// available for signing. Already loaded key is returned as is.
+func (m *Modifier) loadKey(domain string) (crypto.Signer, string, error) {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return nil, "", fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
 	}
 
-	storeKeysInDB := m.storeKeysInDB && m.table != nil
+	m.genLck.Lock()
+	defer m.genLck.Unlock()
 
-	if _, err := idna.ToASCII(domain); err != nil {
-		m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
+	m.keysLck.RLock()
+	signer, ok := m.signers[normDomain]
+	selector := m.selectors[normDomain]
+	m.keysLck.RUnlock()
+	if ok {
+		return signer, selector, nil
 	}
 
-	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-	keyPath := keyValues.Replace(m.keyPathTemplate)
-
-	signer, newKey, err := m.loadOrGenerateKey(domain, keyPath, m.newKeyAlgo, storeKeysInDB)
+	signer, selector, err = m.generateKeyForDomain(domain)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	if newKey {
-		dnsPath := keyPath + ".dns"
-		if filepath.Ext(keyPath) == ".key" {
-			dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+	m.keysLck.Lock()
+	defer m.keysLck.Unlock()
+	m.signers[normDomain] = signer
+	m.selectors[normDomain] = selector
+	known := false
+	for _, d := range m.domains {
+		if strings.EqualFold(d, domain) {
+			known = true
+			break
 		}
-		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-			"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-			m.newKeyAlgo, keyPath, dnsPath, m.selector, domain)
 	}
+	if !known {
+		m.domains = append(m.domains, domain)
+	}
+
+	return signer, selector, nil
+}
 
+// AddKey loads or generates the signing key for the domain so messages from
+// it will be signed. It is a no-op if the key is already loaded.
+func (m *Modifier) AddKey(domain string) error {
+	_, _, err := m.loadKey(domain)
+	return err
+}
+
+// RemoveKey stops signing messages for the domain. Key stored in domain_table
+// is removed too, key files are left intact.
+func (m *Modifier) RemoveKey(domain string) error {
 	normDomain, err := dns.ForLookup(domain)
 	if err != nil {
 		return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
 	}
-	m.signers[normDomain] = signer
+
+	m.genLck.Lock()
+	defer m.genLck.Unlock()
+
+	m.keysLck.Lock()
+	delete(m.signers, normDomain)
+	delete(m.selectors, normDomain)
+	for i, d := range m.domains {
+		if strings.EqualFold(d, domain) {
+			m.domains = append(m.domains[:i], m.domains[i+1:]...)
+			break
+		}
+	}
+	m.keysLck.Unlock()
+
+	if m.storeKeysInDB && m.table != nil {
+		if err := m.table.RemoveKey(domain); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// firstDomain returns the domain used to sign messages with null return
+// path, it is empty if there are no domains.
+func (m *Modifier) firstDomain() string {
+	m.keysLck.RLock()
+	defer m.keysLck.RUnlock()
+	if len(m.domains) == 0 {
+		return ""
+	}
+	return m.domains[0]
+}
+
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
@@ -364,12 +391,15 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	}
 	// Use first key for null return path (<>) and postmaster (<postmaster>)
 	if domain == "" {
-		domain = s.m.domains[0]
+		domain = s.m.firstDomain()
+		if domain == "" {
+			s.log.Msg("no domains configured, not signing")
+			return nil
+		}
 	}
-	selector := s.m.selector
 
 	if s.m.signSubdomains {
-		topDomain := s.m.domains[0]
+		topDomain := s.m.firstDomain()
 		if strings.HasSuffix(domain, "."+topDomain) {
 			domain = topDomain
 		}
@@ -379,19 +409,20 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
+	s.m.keysLck.RLock()
 	keySigner := s.m.signers[normDomain]
+	selector := s.m.selectors[normDomain]
+	s.m.keysLck.RUnlock()
 	if keySigner == nil {
 		if s.m.table == nil {
 			s.log.Msg("no key for domain", "domain", normDomain)
 			return nil
 		}
-		keySigner, err = s.m.generateKeyForDomain(normDomain)
+		keySigner, selector, err = s.m.loadKey(normDomain)
 		if err != nil {
 			s.log.Msg("no key for domain", "domain", normDomain)
 			return err
 		}
-		s.m.signers[normDomain] = keySigner
-		s.m.domains = append(s.m.domains, domain)
 	}
 
 	// If the message is non-EAI, we are not allowed to use domains in U-labels,
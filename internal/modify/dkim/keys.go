@@ -36,41 +36,123 @@ import (
 	"strings"
 	"time"
 
-	"github.com/foxcpp/maddy/framework/dns"
 	"golang.org/x/net/idna"
 )
 
-func (m *Modifier) generateKeyForDomain(domain string) (crypto.Signer, error) {
+// keyPath returns the path of the private key file for the domain and
+// selector.
+func (m *Modifier) keyPath(domain, selector string) string {
+	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", selector)
+	return keyValues.Replace(m.keyPathTemplate)
+}
+
+// statePath returns the path of the file that holds the key rotation state
+// of the domain if keys are stored in files.
+func (m *Modifier) statePath(domain string) string {
+	return filepath.Join(filepath.Dir(m.keyPath(domain, m.selector)), domain+".selector.json")
+}
+
+// loadState reads the key rotation state of the domain. If the key was never
+// rotated, the configured selector is returned.
+func (m *Modifier) loadState(domain string) (keyState, error) {
+	st := keyState{}
+
+	if m.storeKeysInDB && m.table != nil {
+		keyData, ok, err := m.table.Lookup(context.Background(), domain)
+		if err != nil {
+			return keyState{}, err
+		}
+		if ok && keyData != "" {
+			var dkimKey DKIM
+			if err := json.Unmarshal([]byte(keyData), &dkimKey); err != nil {
+				return keyState{}, err
+			}
+			st.Selector = dkimKey.Selector
+			st.Previous = dkimKey.Previous
+		}
+	} else {
+		blob, err := os.ReadFile(m.statePath(domain))
+		if err != nil && !os.IsNotExist(err) {
+			return keyState{}, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(blob, &st); err != nil {
+				return keyState{}, fmt.Errorf("modify.dkim: %s: %w", m.statePath(domain), err)
+			}
+		}
+	}
+
+	if st.Selector == "" {
+		st.Selector = m.selector
+	}
+	return st, nil
+}
+
+// saveState persists the key rotation state of the domain. If keys are
+// stored in domain_table, the key record must already exist.
+func (m *Modifier) saveState(domain string, st keyState) error {
+	if m.storeKeysInDB && m.table != nil {
+		keyData, ok, err := m.table.Lookup(context.Background(), domain)
+		if err != nil {
+			return err
+		}
+		if !ok || keyData == "" {
+			return fmt.Errorf("modify.dkim: no key record for %s", domain)
+		}
+		var dkimKey DKIM
+		if err := json.Unmarshal([]byte(keyData), &dkimKey); err != nil {
+			return err
+		}
+		dkimKey.Selector = st.Selector
+		dkimKey.Previous = st.Previous
+		blob, err := json.Marshal(dkimKey)
+		if err != nil {
+			return err
+		}
+		return m.table.SetKey(domain, string(blob))
+	}
+
+	blob, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.statePath(domain), blob, 0o644)
+}
+
+// generateKeyForDomain loads the key for the domain using the selector from
+// its rotation state, generating a new key if there is none yet.
+func (m *Modifier) generateKeyForDomain(domain string) (crypto.Signer, string, error) {
 	if _, err := idna.ToASCII(domain); err != nil {
 		m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 	}
 
-	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-	keyPath := keyValues.Replace(m.keyPathTemplate)
+	st, err := m.loadState(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	keyPath := m.keyPath(domain, st.Selector)
 
 	storeInDB := m.storeKeysInDB && m.table != nil
 	signer, newKey, err := m.loadOrGenerateKey(domain, keyPath, m.newKeyAlgo, storeInDB)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if newKey {
-		dnsPath := keyPath + ".dns"
-		if filepath.Ext(keyPath) == ".key" {
-			dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		if storeInDB {
+			m.log.Printf("generated a new %s keypair for %s, it is stored in domain_table,\n"+
+				"put the TXT record with its public key into %s._domainkey.%s to make signing and verification work",
+				m.newKeyAlgo, domain, st.Selector, domain)
+		} else {
+			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+				m.newKeyAlgo, keyPath, dnsRecordPath(keyPath), st.Selector, domain)
 		}
-		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-			"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-			m.newKeyAlgo, keyPath, dnsPath, m.selector, domain)
 	}
 
-	normDomain, err := dns.ForLookup(domain)
-	if err != nil {
-		return nil, fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
-	}
-	m.signers[normDomain] = signer
-	return signer, nil
+	return signer, st.Selector, nil
 }
+
 func (m *Modifier) loadOrGenerateKey(domain, keyPath, newKeyAlgo string, storeInDB bool) (pkey crypto.Signer, newKey bool, err error) {
 	var pemBlob []byte
 	if storeInDB && m.table != nil {
@@ -80,7 +162,7 @@ func (m *Modifier) loadOrGenerateKey(domain, keyPath, newKeyAlgo string, storeIn
 			return nil, false, err
 		}
 		if !ok || keyData == "" {
-			pkey, err = m.generateAndWrite(domain, keyPath, newKeyAlgo, storeInDB)
+			pkey, err = m.generateAndWrite(domain, m.selector, keyPath, newKeyAlgo, storeInDB)
 			return pkey, true, err
 		}
 		var dkimKey DKIM
@@ -92,7 +174,7 @@ func (m *Modifier) loadOrGenerateKey(domain, keyPath, newKeyAlgo string, storeIn
 		f, err := os.Open(keyPath)
 		if err != nil {
 			if os.IsNotExist(err) {
-				pkey, err = m.generateAndWrite(domain, keyPath, newKeyAlgo, storeInDB)
+				pkey, err = m.generateAndWrite(domain, m.selector, keyPath, newKeyAlgo, storeInDB)
 				return pkey, true, err
 			}
 			return nil, false, err
@@ -151,64 +233,51 @@ func (m *Modifier) loadOrGenerateKey(domain, keyPath, newKeyAlgo string, storeIn
 	}
 }
 
-func (m *Modifier) generateAndWrite(domain, keyPath, newKeyAlgo string, storeInDB bool) (crypto.Signer, error) {
+func (m *Modifier) generateAndWrite(domain, selector, keyPath, newKeyAlgo string, storeInDB bool) (crypto.Signer, error) {
+	reference := keyPath
+	if storeInDB && m.table != nil {
+		reference = domain
+	}
 	wrapErr := func(err error) error {
-		return fmt.Errorf("modify.dkim: generate %s: %w", keyPath, err)
+		return fmt.Errorf("modify.dkim: generate %s: %w", reference, err)
 	}
 
 	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
 
-	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
-	)
-	switch newKeyAlgo {
-	case "rsa4096":
-		dkimName = "rsa"
-		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
-	case "rsa2048":
-		dkimName = "rsa"
-		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
-	case "ed25519":
-		_, pkey, err = ed25519.GenerateKey(rand.Reader)
-	default:
-		err = fmt.Errorf("unknown key algorithm: %s", newKeyAlgo)
-	}
+	pkey, err := generateKey(newKeyAlgo)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
 
-	keyBlob, err := x509.MarshalPKCS8PrivateKey(pkey)
-	if err != nil {
-		return nil, wrapErr(err)
-	}
+	if storeInDB && m.table != nil {
+		dkimKey, err := keyToJSON(domain, selector, pkey)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		dkimKey.Expires = time.Now().Add(m.sigExpiry)
 
-	selector := fmt.Sprintf("%s._domainkey.%s", m.selector, domain)
-	dkimKey, err := keyToJSON(domain, selector, newKeyAlgo)
-	if err != nil {
-		return nil, wrapErr(err)
+		resultString, err := json.Marshal(dkimKey)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		if err := m.table.SetKey(domain, string(resultString)); err != nil {
+			return nil, wrapErr(err)
+		}
+		return pkey, nil
 	}
 
-	dkimKey.Expires = time.Now().Add(m.sigExpiry)
-
-	resultString, err := json.Marshal(dkimKey)
+	keyBlob, err := x509.MarshalPKCS8PrivateKey(pkey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
 
-	if storeInDB && m.table != nil {
-		err = m.table.SetKey(domain, string(resultString))
-		return pkey, err
-	}
-
 	// 0777 because we have public keys in here too and they don't
 	// need protection. Individual private key files have 0600 perms.
 	if err := os.MkdirAll(filepath.Dir(keyPath), 0o777); err != nil {
 		return nil, wrapErr(err)
 	}
 
-	_, err = writeDNSRecord(keyPath, dkimName, pkey)
+	_, err = writeDNSRecord(keyPath, pkey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
@@ -217,6 +286,7 @@ func (m *Modifier) generateAndWrite(domain, keyPath, newKeyAlgo string, storeInD
 	if err != nil {
 		return nil, wrapErr(err)
 	}
+	defer f.Close()
 
 	if err := pem.Encode(f, &pem.Block{
 		Type:  "PRIVATE KEY",
@@ -228,75 +298,62 @@ func (m *Modifier) generateAndWrite(domain, keyPath, newKeyAlgo string, storeInD
 	return pkey, nil
 }
 
-func keyToJSON(domain, selector, algo string) (result DKIM, err error) {
-	var (
-		dkimName   = algo
-		pkey       crypto.Signer
-		pubKeyBlob []byte
-	)
-
+func generateKey(algo string) (crypto.Signer, error) {
 	switch algo {
 	case "rsa4096":
-		dkimName = "rsa"
-		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
+		return rsa.GenerateKey(rand.Reader, 4096)
 	case "rsa2048":
-		dkimName = "rsa"
-		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
+		return rsa.GenerateKey(rand.Reader, 2048)
 	case "ed25519":
-		_, pkey, err = ed25519.GenerateKey(rand.Reader)
+		_, pkey, err := ed25519.GenerateKey(rand.Reader)
+		return pkey, err
 	default:
-		err = fmt.Errorf("unknown key algorithm: %s", algo)
-	}
-	if err != nil {
-		return DKIM{}, err
+		return nil, fmt.Errorf("unknown key algorithm: %s", algo)
 	}
+}
 
+// keyToJSON builds the domain_table record for the key.
+func keyToJSON(domain, selector string, pkey crypto.Signer) (DKIM, error) {
 	keyBlob, err := x509.MarshalPKCS8PrivateKey(pkey)
 	if err != nil {
 		return DKIM{}, err
 	}
-
-	pubkey := pkey.Public()
-	switch pubkey := pubkey.(type) {
-	case *rsa.PublicKey:
-		var err error
-		pubKeyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
-		if err != nil {
-			return DKIM{}, err
-		}
-	case ed25519.PublicKey:
-		pubKeyBlob = pubkey
-	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
-	}
-
-	pubKeyString := base64.StdEncoding.EncodeToString(pubKeyBlob)
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimName, pubKeyString)
-
 	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBlob})
 	if keyBytes == nil {
-		err := fmt.Errorf("failed to encode private key")
+		return DKIM{}, fmt.Errorf("failed to encode private key")
+	}
+
+	pubKeyString, err := publicKeyString(pkey)
+	if err != nil {
+		return DKIM{}, err
+	}
+	keyRecord, err := dnsRecordValue(pkey)
+	if err != nil {
 		return DKIM{}, err
 	}
 
-	result = DKIM{
+	return DKIM{
 		DNSValue:   keyRecord,
 		PrivateKey: string(keyBytes),
 		PublicKey:  pubKeyString,
 		pkey:       pkey,
 		Domain:     domain,
-		DNSName:    selector,
-	}
+		DNSName:    dnsName(domain, selector),
+		Selector:   selector,
+	}, nil
+}
 
-	return result, nil
+// dnsName returns the name of the TXT record for the selector.
+func dnsName(domain, selector string) string {
+	if aDomain, err := idna.ToASCII(domain); err == nil {
+		domain = aDomain
+	}
+	return selector + "._domainkey." + domain
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
-	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
-	)
-	switch pubkey := pubkey.(type) {
+func publicKeyString(pkey crypto.Signer) (string, error) {
+	var keyBlob []byte
+	switch pubkey := pkey.Public().(type) {
 	case *rsa.PublicKey:
 		var err error
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
@@ -306,18 +363,47 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 	case ed25519.PublicKey:
 		keyBlob = pubkey
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		return "", fmt.Errorf("unknown key algorithm: %T", pubkey)
 	}
+	return base64.StdEncoding.EncodeToString(keyBlob), nil
+}
 
-	dnsPath := keyPath + ".dns"
+// dnsRecordValue returns the TXT record value that publishes the public key.
+func dnsRecordValue(pkey crypto.Signer) (string, error) {
+	var dkimAlgoName string
+	switch pkey.Public().(type) {
+	case *rsa.PublicKey:
+		dkimAlgoName = "rsa"
+	case ed25519.PublicKey:
+		dkimAlgoName = "ed25519"
+	}
+
+	pubKey, err := publicKeyString(pkey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, pubKey), nil
+}
+
+func dnsRecordPath(keyPath string) string {
 	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		return keyPath[:len(keyPath)-4] + ".dns"
 	}
+	return keyPath + ".dns"
+}
+
+func writeDNSRecord(keyPath string, pkey crypto.Signer) (string, error) {
+	keyRecord, err := dnsRecordValue(pkey)
+	if err != nil {
+		return "", err
+	}
+
+	dnsPath := dnsRecordPath(keyPath)
 	dnsF, err := os.Create(dnsPath)
 	if err != nil {
 		return "", err
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
+	defer dnsF.Close()
 	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
 		return "", err
 	}
@@ -0,0 +1,288 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+var (
+	ErrNoKey           = errors.New("modify.dkim: no key for domain")
+	ErrInvalidSelector = errors.New("modify.dkim: invalid selector")
+	ErrSelectorInUse   = errors.New("modify.dkim: selector is already in use")
+	ErrActiveSelector  = errors.New("modify.dkim: active selector cannot be revoked, rotate the key first")
+	ErrUnknownSelector = errors.New("modify.dkim: unknown selector")
+)
+
+// KeyRecord describes a DKIM public key that should be published in DNS.
+type KeyRecord struct {
+	Selector string `json:"selector"`
+	DNSName  string `json:"dnsName"`
+	DNSValue string `json:"dnsValue"`
+
+	// PublishUntil is set for replaced keys, the record should be kept in DNS
+	// until then so messages signed before the rotation can be verified.
+	PublishUntil time.Time `json:"publishUntil,omitempty"`
+}
+
+// KeyInfo lists DNS records for the active and replaced keys of a domain.
+type KeyInfo struct {
+	Domain   string
+	Active   KeyRecord
+	Previous []KeyRecord
+}
+
+// keyState is the persisted key rotation state of a domain.
+type keyState struct {
+	Selector string      `json:"selector"`
+	Previous []KeyRecord `json:"previous,omitempty"`
+}
+
+// pruneExpired drops replaced keys whose overlap period has passed.
+func (st *keyState) pruneExpired(now time.Time) {
+	kept := st.Previous[:0]
+	for _, rec := range st.Previous {
+		if rec.PublishUntil.After(now) {
+			kept = append(kept, rec)
+		}
+	}
+	st.Previous = kept
+}
+
+// validSelector checks that the selector is a sequence of DNS labels
+// (RFC 6376, Section 3.1).
+func validSelector(selector string) bool {
+	if selector == "" || len(selector) > 63 {
+		return false
+	}
+	labelStart := true
+	for i := 0; i < len(selector); i++ {
+		ch := selector[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+			labelStart = false
+		case ch == '-':
+			if labelStart || i == len(selector)-1 || selector[i+1] == '.' {
+				return false
+			}
+		case ch == '.':
+			if labelStart || i == len(selector)-1 {
+				return false
+			}
+			labelStart = true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// KeyInfo returns DNS records that should be published for the domain.
+func (m *Modifier) KeyInfo(domain string) (KeyInfo, error) {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+	}
+
+	m.genLck.Lock()
+	defer m.genLck.Unlock()
+
+	return m.keyInfo(domain, normDomain)
+}
+
+func (m *Modifier) keyInfo(domain, normDomain string) (KeyInfo, error) {
+	m.keysLck.RLock()
+	signer, ok := m.signers[normDomain]
+	selector := m.selectors[normDomain]
+	m.keysLck.RUnlock()
+	if !ok {
+		return KeyInfo{}, ErrNoKey
+	}
+
+	st, err := m.loadState(domain)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	st.pruneExpired(time.Now())
+
+	value, err := dnsRecordValue(signer)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	return KeyInfo{
+		Domain: domain,
+		Active: KeyRecord{
+			Selector: selector,
+			DNSName:  dnsName(domain, selector),
+			DNSValue: value,
+		},
+		Previous: st.Previous,
+	}, nil
+}
+
+// RotateKey generates a new key for the domain under newSelector and starts
+// signing with it immediately. The replaced key is reported by KeyInfo for the
+// overlap period so its DNS record stays published while messages signed
+// with it are still in transit.
+//
+// If keys are stored in files, key_path should include {selector} so keys for
+// different selectors do not collide.
+func (m *Modifier) RotateKey(domain, newSelector string, overlap time.Duration) (KeyInfo, error) {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+	}
+	if !validSelector(newSelector) {
+		return KeyInfo{}, ErrInvalidSelector
+	}
+
+	m.genLck.Lock()
+	defer m.genLck.Unlock()
+
+	m.keysLck.RLock()
+	oldSigner, ok := m.signers[normDomain]
+	oldSelector := m.selectors[normDomain]
+	m.keysLck.RUnlock()
+	if !ok {
+		return KeyInfo{}, ErrNoKey
+	}
+
+	st, err := m.loadState(domain)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	now := time.Now()
+	st.pruneExpired(now)
+
+	if newSelector == oldSelector {
+		return KeyInfo{}, ErrSelectorInUse
+	}
+	for _, rec := range st.Previous {
+		if rec.Selector == newSelector {
+			return KeyInfo{}, ErrSelectorInUse
+		}
+	}
+
+	storeInDB := m.storeKeysInDB && m.table != nil
+	keyPath := m.keyPath(domain, newSelector)
+	if !storeInDB {
+		if keyPath == m.keyPath(domain, oldSelector) {
+			return KeyInfo{}, errors.New("modify.dkim: key_path should contain {selector} to allow key rotation")
+		}
+		if _, err := os.Stat(keyPath); err == nil {
+			return KeyInfo{}, ErrSelectorInUse
+		}
+	}
+
+	oldValue, err := dnsRecordValue(oldSigner)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	signer, err := m.generateAndWrite(domain, newSelector, keyPath, m.newKeyAlgo, storeInDB)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	st.Selector = newSelector
+	if overlap > 0 {
+		st.Previous = append(st.Previous, KeyRecord{
+			Selector:     oldSelector,
+			DNSName:      dnsName(domain, oldSelector),
+			DNSValue:     oldValue,
+			PublishUntil: now.Add(overlap),
+		})
+	}
+	if err := m.saveState(domain, st); err != nil {
+		return KeyInfo{}, err
+	}
+
+	m.keysLck.Lock()
+	m.signers[normDomain] = signer
+	m.selectors[normDomain] = newSelector
+	m.keysLck.Unlock()
+
+	m.log.Msg("rotated key", "domain", domain, "old_selector", oldSelector, "selector", newSelector, "overlap", overlap)
+
+	return m.keyInfo(domain, normDomain)
+}
+
+// RevokeKey ends the overlap period of a replaced key early. Its DNS record
+// should be removed or replaced with one that has an empty "p=" tag. If keys
+// are stored in files, the private key file of the selector is removed.
+func (m *Modifier) RevokeKey(domain, selector string) error {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+	}
+
+	m.genLck.Lock()
+	defer m.genLck.Unlock()
+
+	m.keysLck.RLock()
+	_, ok := m.signers[normDomain]
+	activeSelector := m.selectors[normDomain]
+	m.keysLck.RUnlock()
+	if !ok {
+		return ErrNoKey
+	}
+	if selector == activeSelector {
+		return ErrActiveSelector
+	}
+
+	st, err := m.loadState(domain)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, rec := range st.Previous {
+		if rec.Selector == selector {
+			st.Previous = append(st.Previous[:i], st.Previous[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrUnknownSelector
+	}
+	st.pruneExpired(time.Now())
+
+	if err := m.saveState(domain, st); err != nil {
+		return err
+	}
+
+	if !(m.storeKeysInDB && m.table != nil) {
+		keyPath := m.keyPath(domain, selector)
+		for _, path := range []string{keyPath, dnsRecordPath(keyPath)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	m.log.Msg("revoked key", "domain", domain, "selector", selector)
+
+	return nil
+}
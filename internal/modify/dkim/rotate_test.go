@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newRotationTestModifier(t *testing.T, dir string) *Modifier {
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"maddy.test"}},
+			{Name: "selector", Args: []string{"default"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+			{Name: "newkey_algo", Args: []string{"ed25519"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// verifyWithRecords checks the message signature against the published records
+// and returns the selector used.
+func verifyWithRecords(t *testing.T, records []KeyRecord, hdr textproto.Header, body []byte) string {
+	t.Helper()
+
+	zones := map[string]mockdns.Zone{}
+	for _, rec := range records {
+		zones[rec.DNSName+"."] = mockdns.Zone{TXT: []string{rec.DNSValue}}
+	}
+	resolver := &mockdns.Resolver{Zones: zones}
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+		t.Fatal(err)
+	}
+	fullBody.Write(body)
+
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(fullBody.Bytes()), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(context.Background(), domain)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != 1 {
+		t.Fatalf("expected one signature, got %d", len(verifs))
+	}
+	if verifs[0].Err != nil {
+		t.Fatal("verification failed:", verifs[0].Err)
+	}
+
+	for _, field := range strings.Split(hdr.Get("Dkim-Signature"), ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		if key == "s" {
+			return value
+		}
+	}
+	t.Fatal("no selector in signature")
+	return ""
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := t.TempDir()
+	m := newRotationTestModifier(t, dir)
+
+	before, err := m.KeyInfo("maddy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Active.Selector != "default" || before.Active.DNSName != "default._domainkey.maddy.test" {
+		t.Fatalf("unexpected active key: %+v", before.Active)
+	}
+	if len(before.Previous) != 0 {
+		t.Fatalf("unexpected previous keys: %+v", before.Previous)
+	}
+
+	after, err := m.RotateKey("maddy.test", "s2", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Active.Selector != "s2" || after.Active.DNSValue == before.Active.DNSValue {
+		t.Fatalf("key was not rotated: %+v", after.Active)
+	}
+	if len(after.Previous) != 1 || after.Previous[0].Selector != "default" ||
+		after.Previous[0].DNSValue != before.Active.DNSValue {
+		t.Fatalf("replaced key is not published: %+v", after.Previous)
+	}
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	if sel := verifyWithRecords(t, append(after.Previous, after.Active), hdr, body); sel != "s2" {
+		t.Fatalf("message signed using selector %s, want s2", sel)
+	}
+
+	// Rotation state should survive restart.
+	m = newRotationTestModifier(t, dir)
+	reloaded, err := m.KeyInfo("maddy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Active != after.Active || len(reloaded.Previous) != 1 {
+		t.Fatalf("rotation state is not persisted: %+v", reloaded)
+	}
+
+	if _, err := m.RotateKey("maddy.test", "default", time.Hour); !errors.Is(err, ErrSelectorInUse) {
+		t.Fatal("expected ErrSelectorInUse, got", err)
+	}
+	if _, err := m.RotateKey("maddy.test", "bad_selector", time.Hour); !errors.Is(err, ErrInvalidSelector) {
+		t.Fatal("expected ErrInvalidSelector, got", err)
+	}
+	if _, err := m.RotateKey("unknown.test", "s3", time.Hour); !errors.Is(err, ErrNoKey) {
+		t.Fatal("expected ErrNoKey, got", err)
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	dir := t.TempDir()
+	m := newRotationTestModifier(t, dir)
+
+	if _, err := m.RotateKey("maddy.test", "s2", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RevokeKey("maddy.test", "s2"); !errors.Is(err, ErrActiveSelector) {
+		t.Fatal("expected ErrActiveSelector, got", err)
+	}
+	if err := m.RevokeKey("maddy.test", "s3"); !errors.Is(err, ErrUnknownSelector) {
+		t.Fatal("expected ErrUnknownSelector, got", err)
+	}
+	if err := m.RevokeKey("maddy.test", "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.KeyInfo("maddy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Previous) != 0 {
+		t.Fatalf("revoked key is still listed: %+v", info.Previous)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "maddy.test_default.key")); !os.IsNotExist(err) {
+		t.Fatal("private key of revoked selector is not removed:", err)
+	}
+}
+
+func TestRotateKey_NoOverlap(t *testing.T) {
+	m := newRotationTestModifier(t, t.TempDir())
+
+	info, err := m.RotateKey("maddy.test", "s2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Previous) != 0 {
+		t.Fatalf("replaced key is published without overlap: %+v", info.Previous)
+	}
+}
+
+func TestValidSelector(t *testing.T) {
+	for sel, valid := range map[string]bool{
+		"default":      true,
+		"s2024-01":     true,
+		"brisbane.dc1": true,
+		"":             false,
+		"-s":           false,
+		"s-":           false,
+		"s..x":         false,
+		".s":           false,
+		"s_1":          false,
+		"s/../x":       false,
+	} {
+		if got := validSelector(sel); got != valid {
+			t.Errorf("validSelector(%q) = %v, want %v", sel, got, valid)
+		}
+	}
+}
@@ -27,10 +27,12 @@ import (
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/target"
 )
 
 // checkRunner runs groups of checks, collects and merges results.
@@ -51,6 +53,10 @@ type checkRunner struct {
 
 	log log.Logger
 
+	// publishEvents enables message.rejected events, it is set only for the
+	// first pipeline so nested ones do not report the message again.
+	publishEvents bool
+
 	states map[module.Check]module.CheckState
 
 	mergedRes module.CheckResult
@@ -244,12 +250,14 @@ func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Chec
 
 	// checkStates will run CheckConnection and CheckSender.
 	_, err := cr.checkStates(ctx, checks)
+	cr.publishRejected(err, "")
 	return err
 }
 
 func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcptTo string) error {
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
+		cr.publishRejected(err, rcptTo)
 		return err
 	}
 
@@ -270,12 +278,14 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 	})
 
 	cr.checkedRcpts = append(cr.checkedRcpts, rcptTo)
+	cr.publishRejected(err, rcptTo)
 	return err
 }
 
 func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, header textproto.Header, body buffer.Buffer) error {
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
+		cr.publishRejected(err, "")
 		return err
 	}
 
@@ -284,10 +294,12 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
+	cr.publishRejected(err, "")
+	return err
 }
 
 func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
@@ -306,7 +318,7 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 				code = 450
 				enchCode[0] = 4
 			}
-			return &exterrors.SMTPError{
+			err := &exterrors.SMTPError{
 				Code:         code,
 				EnhancedCode: enchCode,
 				Message:      "DMARC check failed",
@@ -319,6 +331,8 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 					"spf_from":    dmarcRes.SPFResult.From,
 				},
 			}
+			cr.publishRejected(err, "")
+			return err
 		case dmarc.PolicyQuarantine:
 			cr.msgMeta.Quarantine = true
 
@@ -343,6 +357,33 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// publishRejected publishes the message.rejected event if err is not nil.
+func (cr *checkRunner) publishRejected(err error, rcptTo string) {
+	if err == nil || !cr.publishEvents || !events.Enabled() {
+		return
+	}
+
+	fields := exterrors.Fields(err)
+	data := map[string]interface{}{
+		"smtpCode":  exterrors.SMTPCode(err, 451, 554),
+		"temporary": exterrors.IsTemporary(err),
+		"reason":    err.Error(),
+	}
+	if code, ok := fields["smtp_code"]; ok {
+		data["smtpCode"] = code
+	}
+	if check, ok := fields["check"]; ok {
+		data["check"] = check
+	}
+	if cr.mailFromReceived {
+		data["from"] = cr.mailFrom
+	}
+	if rcptTo != "" {
+		data["rcpt"] = rcptTo
+	}
+	target.PublishEvent(events.MessageRejected, cr.msgMeta, data)
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
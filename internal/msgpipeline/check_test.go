@@ -20,10 +20,14 @@ package msgpipeline
 
 import (
 	"errors"
+	"net"
+	"reflect"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -446,3 +450,80 @@ func TestMsgPipeline_RcptCheck_Errors(t *testing.T) {
 			check_.UnclosedStates, sourceCheck.UnclosedStates, globalCheck.UnclosedStates)
 	}
 }
+
+type eventSink []events.Event
+
+func (s *eventSink) Handle(ev events.Event) {
+	*s = append(*s, ev)
+}
+
+func TestMsgPipeline_Events(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		FirstPipeline: true,
+		Log:           testutils.Logger(t, "msgpipeline"),
+	}
+
+	var sink eventSink
+	defer events.Subscribe(&sink)()
+
+	meta := func() *module.MsgMetadata {
+		return &module.MsgMetadata{
+			Conn: &module.ConnState{
+				Proto:      "ESMTP",
+				Hostname:   "client.example.org",
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525},
+				AuthUser:   "sender@example.org",
+			},
+		}
+	}
+	testutils.DoTestDeliveryMeta(t, &d, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"}, meta())
+
+	check.RcptRes = module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:      550,
+			Message:   "Go away",
+			CheckName: "test_check",
+		},
+	}
+	if _, err := testutils.DoTestDeliveryErrMeta(t, &d, "sender@example.org", []string{"rcpt1@example.org"}, meta()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if len(sink) != 2 {
+		t.Fatalf("wrong events: %+v", sink)
+	}
+	if sink[0].Type != events.MessageAccepted ||
+		!reflect.DeepEqual(sink[0].Data["rcpts"], []string{"rcpt1@example.org", "rcpt2@example.org"}) ||
+		sink[0].Data["from"] != "sender@example.org" ||
+		sink[0].Data["srcIp"] != "192.0.2.1:2525" ||
+		sink[0].Data["authUser"] != "sender@example.org" {
+		t.Errorf("wrong accepted event: %+v", sink[0])
+	}
+	if sink[1].Type != events.MessageRejected ||
+		sink[1].Data["check"] != "test_check" ||
+		sink[1].Data["rcpt"] != "rcpt1@example.org" ||
+		sink[1].Data["smtpCode"] != 550 {
+		t.Errorf("wrong rejected event: %+v", sink[1])
+	}
+
+	// Nested pipelines do not publish events.
+	d.FirstPipeline = false
+	sink = nil
+	testutils.DoTestDeliveryErrMeta(t, &d, "sender@example.org", []string{"rcpt1@example.org"}, meta()) //nolint:errcheck
+	if len(sink) != 0 {
+		t.Errorf("unexpected events: %+v", sink)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
@@ -127,6 +128,7 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.publishEvents = d.FirstPipeline
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -275,6 +277,9 @@ type msgpipelineDelivery struct {
 	deliveries  map[module.DeliveryTarget]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+
+	// Accepted recipients, reported in the message.accepted event.
+	rcpts []string
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
@@ -372,6 +377,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		}
 	}
 
+	dd.rcpts = append(dd.rcpts, originalTo)
 	return nil
 }
 
@@ -510,6 +516,14 @@ func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 			return err
 		}
 	}
+
+	if dd.d.FirstPipeline {
+		target.PublishEvent(events.MessageAccepted, dd.msgMeta, map[string]interface{}{
+			"from":       dd.checkRunner.mailFrom,
+			"rcpts":      dd.rcpts,
+			"quarantine": dd.msgMeta.Quarantine,
+		})
+	}
 	return nil
 }
 
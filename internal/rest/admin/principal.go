@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ScopeAll grants access to every resource and action.
+const ScopeAll = "*"
+
+// Principal is the authenticated identity of a REST API request.
+type Principal struct {
+	// Admin is the name of the admin account that made the request or owns
+	// the token used.
+	Admin string
+
+	// TokenID is empty if the request was authenticated using admin
+	// credentials directly.
+	TokenID string
+
+	Scopes []string
+
+	// Domains limits access to users and resources within listed domains.
+	// Empty list means no restriction.
+	Domains []string
+
+	// ExpiresAt is the expiry time of the token used, zero if the principal
+	// does not expire.
+	ExpiresAt time.Time
+}
+
+// ValidateScope checks that scope has the "resource:action" form where
+// action is "read", "write" or "*". The ScopeAll wildcard is also accepted.
+func ValidateScope(scope string) error {
+	if scope == ScopeAll {
+		return nil
+	}
+	resource, action, ok := strings.Cut(scope, ":")
+	if !ok || resource == "" {
+		return fmt.Errorf("admin: malformed scope: %q", scope)
+	}
+	switch action {
+	case "read", "write", "*":
+		return nil
+	default:
+		return fmt.Errorf("admin: unknown scope action: %q", scope)
+	}
+}
+
+// scopeCovers reports whether the granted scope permits the wanted one.
+// "write" access to a resource implies "read" access.
+func scopeCovers(granted, want string) bool {
+	if granted == ScopeAll || granted == want {
+		return true
+	}
+	if want == ScopeAll {
+		return false
+	}
+
+	gRes, gAct, _ := strings.Cut(granted, ":")
+	wRes, wAct, _ := strings.Cut(want, ":")
+	if gRes != wRes {
+		return false
+	}
+	return gAct == "*" || (gAct == "write" && wAct == "read")
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if scopeCovers(granted, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unrestricted reports whether the principal can access all domains.
+func (p *Principal) Unrestricted() bool {
+	return len(p.Domains) == 0
+}
+
+func (p *Principal) HasDomain(domain string) bool {
+	if p.Unrestricted() {
+		return true
+	}
+	for _, d := range p.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanDelegate reports whether the principal may issue a token with the
+// specified scopes and domains. Tokens can never grant more than the
+// principal creating them has.
+func (p *Principal) CanDelegate(scopes, domains []string) bool {
+	for _, scope := range scopes {
+		if !p.HasScope(scope) {
+			return false
+		}
+	}
+	if p.Unrestricted() {
+		return true
+	}
+	if len(domains) == 0 {
+		return false
+	}
+	for _, domain := range domains {
+		if !p.HasDomain(domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// DelegatedExpiry returns the expiry time for a token issued by the
+// principal with the requested expiresAt (zero means no expiry). Issued
+// tokens cannot outlive the principal: later times are capped at its expiry
+// and false is returned if a non-expiring token is requested by an expiring
+// principal.
+func (p *Principal) DelegatedExpiry(expiresAt time.Time) (time.Time, bool) {
+	if p.ExpiresAt.IsZero() {
+		return expiresAt, true
+	}
+	if expiresAt.IsZero() {
+		return time.Time{}, false
+	}
+	if expiresAt.After(p.ExpiresAt) {
+		return p.ExpiresAt, true
+	}
+	return expiresAt, true
+}
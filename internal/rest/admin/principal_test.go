@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrincipal_HasScope(t *testing.T) {
+	test := func(granted []string, want string, ok bool) {
+		t.Helper()
+		p := Principal{Scopes: granted}
+		if p.HasScope(want) != ok {
+			t.Errorf("HasScope(%v, %s) != %v", granted, want, ok)
+		}
+	}
+
+	test([]string{"*"}, "users:write", true)
+	test([]string{"users:read"}, "users:read", true)
+	test([]string{"users:read"}, "users:write", false)
+	test([]string{"users:write"}, "users:read", true)
+	test([]string{"users:*"}, "users:write", true)
+	test([]string{"users:*"}, "quota:read", false)
+	test([]string{"users:write"}, "users:*", false)
+	test([]string{"users:*"}, "*", false)
+	test([]string{"quota:read", "users:write"}, "users:write", true)
+	test(nil, "users:read", false)
+}
+
+func TestPrincipal_CanDelegate(t *testing.T) {
+	admin := Principal{Scopes: []string{ScopeAll}}
+	if !admin.CanDelegate([]string{"users:write"}, nil) {
+		t.Error("admin should be able to delegate anything")
+	}
+
+	reseller := Principal{
+		Scopes:  []string{"users:write", "tokens:write"},
+		Domains: []string{"example.org"},
+	}
+	if !reseller.CanDelegate([]string{"users:read"}, []string{"example.org"}) {
+		t.Error("should be able to delegate a subset")
+	}
+	if reseller.CanDelegate([]string{"users:read"}, nil) {
+		t.Error("should not be able to lift domain restriction")
+	}
+	if reseller.CanDelegate([]string{"users:read"}, []string{"example.com"}) {
+		t.Error("should not be able to delegate other domains")
+	}
+	if reseller.CanDelegate([]string{"quota:write"}, []string{"example.org"}) {
+		t.Error("should not be able to delegate scopes it does not have")
+	}
+}
+
+func TestPrincipal_DelegatedExpiry(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	admin := Principal{Scopes: []string{ScopeAll}}
+	if exp, ok := admin.DelegatedExpiry(time.Time{}); !ok || !exp.IsZero() {
+		t.Error("non-expiring principal should be able to issue non-expiring tokens:", exp, ok)
+	}
+
+	tok := Principal{Scopes: []string{"tokens:write"}, ExpiresAt: now.Add(time.Hour)}
+	if _, ok := tok.DelegatedExpiry(time.Time{}); ok {
+		t.Error("expiring principal should not be able to issue non-expiring tokens")
+	}
+	if exp, ok := tok.DelegatedExpiry(now.Add(24 * time.Hour)); !ok || !exp.Equal(tok.ExpiresAt) {
+		t.Error("expiry should be capped at the principal expiry:", exp, ok)
+	}
+	if exp, ok := tok.DelegatedExpiry(now.Add(time.Minute)); !ok || !exp.Equal(now.Add(time.Minute)) {
+		t.Error("earlier expiry should be kept:", exp, ok)
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	for _, scope := range []string{"*", "users:read", "users:write", "users:*"} {
+		if err := ValidateScope(scope); err != nil {
+			t.Errorf("%s: unexpected error: %v", scope, err)
+		}
+	}
+	for _, scope := range []string{"", "users", ":read", "users:delete"} {
+		if err := ValidateScope(scope); err == nil {
+			t.Errorf("%s: expected error", scope)
+		}
+	}
+}
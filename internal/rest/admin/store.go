@@ -0,0 +1,452 @@
+package admin
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/sqldialect"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TokenPrefix is prepended to every issued API token so they are easy to
+// recognize in configuration files and secret scanners.
+const TokenPrefix = "mdy_"
+
+var (
+	ErrUnknownAdmin = errors.New("admin: unknown admin")
+	ErrAdminExists  = errors.New("admin: admin already exists")
+	ErrUnknownToken = errors.New("admin: unknown token")
+	ErrInvalidToken = errors.New("admin: invalid token")
+	ErrTokenExpired = errors.New("admin: token expired")
+)
+
+// Token describes a persisted API token. The secret part of the token is
+// never stored, only its hash.
+type Token struct {
+	ID         string
+	Owner      string
+	Name       string
+	Scopes     []string
+	Domains    []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // zero = never
+	LastUsedAt time.Time // zero = never used
+}
+
+// Store keeps REST API administrators and their tokens in the SQL database
+// shared with storage.imapsql.
+type Store struct {
+	DB *sql.DB
+	// Driver is the name of the SQL driver used for DB, queries are adapted
+	// to it using sqldialect.Rebind.
+	Driver string
+}
+
+func (s *Store) rebind(query string) string {
+	return sqldialect.Rebind(s.Driver, query)
+}
+
+// Init creates the tables used by the store if they don't exist.
+func (s *Store) Init() error {
+	_, err := s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS api_admins (
+			username VARCHAR(255) NOT NULL PRIMARY KEY,
+			password VARCHAR(255) NOT NULL,
+			created_at BIGINT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("admin: init: %w", err)
+	}
+
+	_, err = s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			owner VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			hash VARCHAR(255) NOT NULL,
+			scopes TEXT NOT NULL,
+			domains TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			last_used_at BIGINT NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("admin: init: %w", err)
+	}
+
+	_, err = s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS api_admin_totp (
+			username VARCHAR(255) NOT NULL PRIMARY KEY,
+			secret VARCHAR(255) NOT NULL,
+			enabled INTEGER NOT NULL DEFAULT 0,
+			last_counter BIGINT NOT NULL DEFAULT 0,
+			created_at BIGINT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("admin: init: %w", err)
+	}
+
+	_, err = s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS api_admin_recovery_codes (
+			username VARCHAR(255) NOT NULL,
+			hash VARCHAR(255) NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("admin: init: %w", err)
+	}
+	return nil
+}
+
+func hashSecret(secret string) (string, error) {
+	hash, err := pass_table.HashCompute[pass_table.DefaultHash](pass_table.HashOpts{
+		BcryptCost: bcrypt.DefaultCost,
+	}, secret)
+	if err != nil {
+		return "", err
+	}
+	return pass_table.DefaultHash + ":" + hash, nil
+}
+
+func verifySecret(secret, stored string) error {
+	parts := strings.SplitN(stored, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("admin: no hash tag")
+	}
+	hashVerify := pass_table.HashVerify[parts[0]]
+	if hashVerify == nil {
+		return fmt.Errorf("admin: unknown hash: %s", parts[0])
+	}
+	return hashVerify(secret, parts[1])
+}
+
+func (s *Store) CreateAdmin(username, password string) error {
+	if username == "" {
+		return errors.New("admin: empty username")
+	}
+
+	var exists bool
+	err := s.DB.QueryRow(s.rebind("SELECT EXISTS(SELECT 1 FROM api_admins WHERE username = $1)"), username).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("admin: create %s: %w", username, err)
+	}
+	if exists {
+		return ErrAdminExists
+	}
+
+	hash, err := hashSecret(password)
+	if err != nil {
+		return fmt.Errorf("admin: create %s: hash generation: %w", username, err)
+	}
+
+	_, err = s.DB.Exec(s.rebind("INSERT INTO api_admins (username, password, created_at) VALUES ($1, $2, $3)"),
+		username, hash, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("admin: create %s: %w", username, err)
+	}
+	return nil
+}
+
+// EnsureAdmin creates the admin account unless it already exists. The
+// password of an existing account is left untouched.
+func (s *Store) EnsureAdmin(username, password string) error {
+	err := s.CreateAdmin(username, password)
+	if errors.Is(err, ErrAdminExists) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) SetAdminPassword(username, password string) error {
+	hash, err := hashSecret(password)
+	if err != nil {
+		return fmt.Errorf("admin: set password %s: hash generation: %w", username, err)
+	}
+
+	res, err := s.DB.Exec(s.rebind("UPDATE api_admins SET password = $1 WHERE username = $2"), hash, username)
+	if err != nil {
+		return fmt.Errorf("admin: set password %s: %w", username, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUnknownAdmin
+	}
+	return nil
+}
+
+// DeleteAdmin removes the admin account together with all tokens it owns
+// and its TOTP settings.
+func (s *Store) DeleteAdmin(username string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("admin: delete %s: %w", username, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	res, err := tx.Exec(s.rebind("DELETE FROM api_admins WHERE username = $1"), username)
+	if err != nil {
+		return fmt.Errorf("admin: delete %s: %w", username, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUnknownAdmin
+	}
+	for _, query := range []string{
+		"DELETE FROM api_tokens WHERE owner = $1",
+		"DELETE FROM api_admin_totp WHERE username = $1",
+		"DELETE FROM api_admin_recovery_codes WHERE username = $1",
+	} {
+		if _, err := tx.Exec(s.rebind(query), username); err != nil {
+			return fmt.Errorf("admin: delete %s: %w", username, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) ListAdmins() ([]string, error) {
+	rows, err := s.DB.Query("SELECT username FROM api_admins ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("admin: list: %w", err)
+	}
+	defer rows.Close()
+
+	admins := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("admin: list: %w", err)
+		}
+		admins = append(admins, name)
+	}
+	return admins, rows.Err()
+}
+
+// AuthAdmin checks the admin credentials and returns the principal with
+// unrestricted access.
+//
+// If the admin has TOTP enabled, otp should be the current code or one of
+// recovery codes. ErrOTPRequired is returned if it is empty and the
+// password is correct.
+func (s *Store) AuthAdmin(username, password, otp string) (*Principal, error) {
+	var hash string
+	err := s.DB.QueryRow(s.rebind("SELECT password FROM api_admins WHERE username = $1"), username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownAdmin
+	}
+	if err != nil {
+		return nil, fmt.Errorf("admin: auth %s: %w", username, err)
+	}
+
+	if err := verifySecret(password, hash); err != nil {
+		return nil, err
+	}
+	if err := s.verifyOTP(username, otp); err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		Admin:  username,
+		Scopes: []string{ScopeAll},
+	}, nil
+}
+
+// CreateToken issues a new token for the owner. The returned string is the
+// only copy of the token secret, it cannot be recovered later.
+func (s *Store) CreateToken(owner, name string, scopes, domains []string, expiresAt time.Time) (string, *Token, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("admin: at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if err := ValidateScope(scope); err != nil {
+			return "", nil, err
+		}
+	}
+	for i, domain := range domains {
+		domains[i] = strings.ToLower(domain)
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, fmt.Errorf("admin: create token: %w", err)
+	}
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, fmt.Errorf("admin: create token: %w", err)
+	}
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	hash, err := hashSecret(secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("admin: create token: hash generation: %w", err)
+	}
+
+	tok := &Token{
+		ID:        id,
+		Owner:     owner,
+		Name:      name,
+		Scopes:    scopes,
+		Domains:   domains,
+		CreatedAt: time.Now().Truncate(time.Second),
+		ExpiresAt: expiresAt,
+	}
+
+	_, err = s.DB.Exec(s.rebind(`
+		INSERT INTO api_tokens (id, owner, name, hash, scopes, domains, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`), id, owner, name, hash, strings.Join(scopes, ","), strings.Join(domains, ","),
+		tok.CreatedAt.Unix(), unixOrZero(expiresAt))
+	if err != nil {
+		return "", nil, fmt.Errorf("admin: create token: %w", err)
+	}
+
+	return TokenPrefix + id + "." + secret, tok, nil
+}
+
+// ListTokens returns tokens owned by owner or all tokens if owner is empty.
+func (s *Store) ListTokens(owner string) ([]Token, error) {
+	query := `SELECT id, owner, name, scopes, domains, created_at, expires_at, last_used_at FROM api_tokens`
+	args := []interface{}{}
+	if owner != "" {
+		query += ` WHERE owner = $1`
+		args = append(args, owner)
+	}
+	query += ` ORDER BY created_at`
+
+	rows, err := s.DB.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("admin: list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		tok, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("admin: list tokens: %w", err)
+		}
+		tokens = append(tokens, *tok)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *Store) GetToken(id string) (*Token, error) {
+	row := s.DB.QueryRow(s.rebind(`
+		SELECT id, owner, name, scopes, domains, created_at, expires_at, last_used_at
+		FROM api_tokens WHERE id = $1
+	`), id)
+	tok, err := scanToken(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("admin: get token %s: %w", id, err)
+	}
+	return tok, nil
+}
+
+func (s *Store) RevokeToken(id string) error {
+	res, err := s.DB.Exec(s.rebind("DELETE FROM api_tokens WHERE id = $1"), id)
+	if err != nil {
+		return fmt.Errorf("admin: revoke token %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUnknownToken
+	}
+	return nil
+}
+
+// AuthToken checks the raw bearer token and returns the principal
+// restricted to the token scopes and domains.
+func (s *Store) AuthToken(raw string) (*Principal, error) {
+	if !strings.HasPrefix(raw, TokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(raw, TokenPrefix), ".")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrInvalidToken
+	}
+
+	var hash string
+	err := s.DB.QueryRow(s.rebind("SELECT hash FROM api_tokens WHERE id = $1"), id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("admin: auth token %s: %w", id, err)
+	}
+	if err := verifySecret(secret, hash); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	tok, err := s.GetToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if !tok.ExpiresAt.IsZero() && time.Now().After(tok.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	if _, err := s.DB.Exec(s.rebind("UPDATE api_tokens SET last_used_at = $1 WHERE id = $2"), time.Now().Unix(), id); err != nil {
+		return nil, fmt.Errorf("admin: auth token %s: %w", id, err)
+	}
+
+	return &Principal{
+		Admin:     tok.Owner,
+		TokenID:   tok.ID,
+		Scopes:    tok.Scopes,
+		Domains:   tok.Domains,
+		ExpiresAt: tok.ExpiresAt,
+	}, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var (
+		tok                          Token
+		scopes, domains              string
+		createdAt, expiresAt, usedAt int64
+	)
+	if err := row.Scan(&tok.ID, &tok.Owner, &tok.Name, &scopes, &domains, &createdAt, &expiresAt, &usedAt); err != nil {
+		return nil, err
+	}
+	tok.Scopes = splitList(scopes)
+	tok.Domains = splitList(domains)
+	tok.CreatedAt = time.Unix(createdAt, 0)
+	tok.ExpiresAt = timeOrZero(expiresAt)
+	tok.LastUsedAt = timeOrZero(usedAt)
+	return &tok, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
@@ -0,0 +1,262 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/auth/totp"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(testutils.Dir(t), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := &Store{DB: db}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore_Admins(t *testing.T) {
+	s := testStore(t)
+
+	if err := s.CreateAdmin("root", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateAdmin("root", "other"); !errors.Is(err, ErrAdminExists) {
+		t.Fatal("expected ErrAdminExists, got", err)
+	}
+	if err := s.EnsureAdmin("root", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AuthAdmin("root", "other", ""); err == nil {
+		t.Fatal("EnsureAdmin should not change the password")
+	}
+	p, err := s.AuthAdmin("root", "hunter2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasScope("users:write") || !p.Unrestricted() {
+		t.Fatal("admin should have unrestricted access")
+	}
+
+	if err := s.SetAdminPassword("root", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthAdmin("root", "other", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAdminPassword("nobody", "other"); !errors.Is(err, ErrUnknownAdmin) {
+		t.Fatal("expected ErrUnknownAdmin, got", err)
+	}
+}
+
+func TestStore_Tokens(t *testing.T) {
+	s := testStore(t)
+
+	if err := s.CreateAdmin("root", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, tok, err := s.CreateToken("root", "reseller", []string{"users:write"}, []string{"Example.org"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.AuthToken(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Admin != "root" || p.TokenID != tok.ID {
+		t.Fatal("wrong principal:", p)
+	}
+	if !p.HasScope("users:read") || p.HasScope("quota:read") {
+		t.Fatal("wrong scopes:", p.Scopes)
+	}
+	if !p.HasDomain("example.org") || p.HasDomain("example.com") {
+		t.Fatal("wrong domains:", p.Domains)
+	}
+
+	if _, err := s.AuthToken(raw + "x"); err == nil {
+		t.Fatal("token with wrong secret accepted")
+	}
+
+	tokens, err := s.ListTokens("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].LastUsedAt.IsZero() {
+		t.Fatal("wrong tokens list:", tokens)
+	}
+
+	if err := s.DeleteAdmin("root"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthToken(raw); !errors.Is(err, ErrUnknownToken) {
+		t.Fatal("token of deleted admin should be revoked, got", err)
+	}
+}
+
+func TestStore_TokenExpiry(t *testing.T) {
+	s := testStore(t)
+
+	raw, _, err := s.CreateToken("root", "short", []string{"*"}, nil, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthToken(raw); !errors.Is(err, ErrTokenExpired) {
+		t.Fatal("expected ErrTokenExpired, got", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	raw, _, err = s.CreateToken("root", "long", []string{"*"}, nil, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.AuthToken(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.ExpiresAt.Equal(expiresAt) {
+		t.Fatal("principal should carry the token expiry:", p.ExpiresAt)
+	}
+}
+
+// wrongCode returns a code that is not valid for the secret at any time step
+// accepted now.
+func wrongCode(t *testing.T, secret string) string {
+	t.Helper()
+	valid := map[string]bool{}
+	for i := -totp.Skew - 1; i <= totp.Skew+1; i++ {
+		code, err := totp.Code(secret, time.Now().Add(time.Duration(i)*totp.Period))
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid[code] = true
+	}
+	for i := 0; ; i++ {
+		code := fmt.Sprintf("%06d", i)
+		if !valid[code] {
+			return code
+		}
+	}
+}
+
+func TestStore_TOTP(t *testing.T) {
+	s := testStore(t)
+
+	if err := s.CreateAdmin("root", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, uri, err := s.EnrollTOTP("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri == "" {
+		t.Fatal("empty key URI")
+	}
+
+	// Not required until confirmed.
+	if _, err := s.AuthAdmin("root", "hunter2", ""); err != nil {
+		t.Fatal("pending enrollment should not require code:", err)
+	}
+	if _, err := s.ConfirmTOTP("root", wrongCode(t, secret)); !errors.Is(err, ErrInvalidOTP) {
+		t.Fatal("expected ErrInvalidOTP, got", err)
+	}
+
+	// Previous time step, so the code for the current one can be used
+	// below.
+	code, err := totp.Code(secret, time.Now().Add(-totp.Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := s.ConfirmTOTP("root", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != totp.RecoveryCodes {
+		t.Fatal("wrong number of recovery codes:", len(recovery))
+	}
+	if _, _, err := s.EnrollTOTP("root"); !errors.Is(err, ErrTOTPEnabled) {
+		t.Fatal("expected ErrTOTPEnabled, got", err)
+	}
+
+	if _, err := s.AuthAdmin("root", "hunter2", ""); !errors.Is(err, ErrOTPRequired) {
+		t.Fatal("expected ErrOTPRequired, got", err)
+	}
+	if _, err := s.AuthAdmin("root", "other", ""); errors.Is(err, ErrOTPRequired) {
+		t.Fatal("code requirement should not be revealed for wrong password")
+	}
+
+	prevCode := code
+	code, err = totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthAdmin("root", "hunter2", code); err != nil {
+		t.Fatal(err)
+	}
+	// Basic authentication sends the same code with every request.
+	if _, err := s.AuthAdmin("root", "hunter2", code); err != nil {
+		t.Fatal("repeated code of the last used step should be accepted, got", err)
+	}
+	if _, err := s.AuthAdmin("root", "hunter2", prevCode); !errors.Is(err, ErrInvalidOTP) {
+		t.Fatal("code of an earlier step should be rejected, got", err)
+	}
+
+	// Recovery codes are single-use, format does not matter.
+	if _, err := s.AuthAdmin("root", "hunter2", strings.ToUpper(recovery[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthAdmin("root", "hunter2", recovery[0]); !errors.Is(err, ErrInvalidOTP) {
+		t.Fatal("used recovery code should be rejected, got", err)
+	}
+	status, err := s.GetTOTPStatus("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Enabled || status.RecoveryCodes != totp.RecoveryCodes-1 {
+		t.Fatal("wrong status:", status)
+	}
+
+	newRecovery, err := s.RegenerateRecoveryCodes("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthAdmin("root", "hunter2", recovery[1]); !errors.Is(err, ErrInvalidOTP) {
+		t.Fatal("old recovery code should be rejected, got", err)
+	}
+	if _, err := s.AuthAdmin("root", "hunter2", newRecovery[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DisableTOTP("root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DisableTOTP("root"); !errors.Is(err, ErrTOTPDisabled) {
+		t.Fatal("expected ErrTOTPDisabled, got", err)
+	}
+	if _, err := s.AuthAdmin("root", "hunter2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.EnrollTOTP("nobody"); !errors.Is(err, ErrUnknownAdmin) {
+		t.Fatal("expected ErrUnknownAdmin, got", err)
+	}
+}
@@ -0,0 +1,316 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/auth/totp"
+)
+
+// TOTPIssuer is the issuer name shown by authenticator apps.
+const TOTPIssuer = "maddy"
+
+var (
+	ErrOTPRequired     = errors.New("admin: one-time code required")
+	ErrInvalidOTP      = errors.New("admin: invalid one-time code")
+	ErrTOTPEnabled     = errors.New("admin: TOTP is already enabled")
+	ErrTOTPDisabled    = errors.New("admin: TOTP is not enabled")
+	ErrTOTPNotEnrolled = errors.New("admin: TOTP enrollment is not started")
+)
+
+// TOTPStatus describes the second factor configuration of an admin.
+type TOTPStatus struct {
+	Enabled bool
+	// Pending is true if enrollment is started but not confirmed yet.
+	Pending bool
+	// RecoveryCodes is the number of unused recovery codes.
+	RecoveryCodes int
+}
+
+func (s *Store) checkAdmin(username string) error {
+	var exists bool
+	err := s.DB.QueryRow(s.rebind("SELECT EXISTS(SELECT 1 FROM api_admins WHERE username = $1)"), username).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownAdmin
+	}
+	return nil
+}
+
+func (s *Store) GetTOTPStatus(username string) (TOTPStatus, error) {
+	if err := s.checkAdmin(username); err != nil {
+		return TOTPStatus{}, err
+	}
+
+	var (
+		status  TOTPStatus
+		enabled bool
+	)
+	err := s.DB.QueryRow(s.rebind("SELECT enabled FROM api_admin_totp WHERE username = $1"), username).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return TOTPStatus{}, fmt.Errorf("admin: totp status %s: %w", username, err)
+	}
+	status.Enabled = enabled
+	status.Pending = !enabled
+
+	err = s.DB.QueryRow(s.rebind("SELECT COUNT(*) FROM api_admin_recovery_codes WHERE username = $1"), username).Scan(&status.RecoveryCodes)
+	if err != nil {
+		return TOTPStatus{}, fmt.Errorf("admin: totp status %s: %w", username, err)
+	}
+	return status, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the admin. The second factor is
+// not required until the enrollment is confirmed using ConfirmTOTP, calling
+// EnrollTOTP again replaces the pending secret.
+//
+// The returned URI is for authenticator apps (usually shown as a QR code).
+func (s *Store) EnrollTOTP(username string) (secret, uri string, err error) {
+	status, err := s.GetTOTPStatus(username)
+	if err != nil {
+		return "", "", err
+	}
+	if status.Enabled {
+		return "", "", ErrTOTPEnabled
+	}
+
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", fmt.Errorf("admin: enroll totp %s: %w", username, err)
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return "", "", fmt.Errorf("admin: enroll totp %s: %w", username, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(s.rebind("DELETE FROM api_admin_totp WHERE username = $1"), username); err != nil {
+		return "", "", fmt.Errorf("admin: enroll totp %s: %w", username, err)
+	}
+	_, err = tx.Exec(s.rebind("INSERT INTO api_admin_totp (username, secret, enabled, last_counter, created_at) VALUES ($1, $2, 0, 0, $3)"),
+		username, secret, time.Now().Unix())
+	if err != nil {
+		return "", "", fmt.Errorf("admin: enroll totp %s: %w", username, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", fmt.Errorf("admin: enroll totp %s: %w", username, err)
+	}
+
+	return secret, totp.KeyURI(TOTPIssuer, username, secret), nil
+}
+
+// ConfirmTOTP enables the second factor if the code matches the pending
+// secret and returns the recovery codes. Recovery codes are not stored in
+// plain text and cannot be shown again.
+func (s *Store) ConfirmTOTP(username, code string) ([]string, error) {
+	var (
+		secret  string
+		enabled bool
+	)
+	err := s.DB.QueryRow(s.rebind("SELECT secret, enabled FROM api_admin_totp WHERE username = $1"), username).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("admin: confirm totp %s: %w", username, err)
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	counter, err := totp.Validate(secret, code, time.Now(), 0)
+	if err != nil {
+		return nil, ErrInvalidOTP
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("admin: confirm totp %s: %w", username, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	_, err = tx.Exec(s.rebind("UPDATE api_admin_totp SET enabled = 1, last_counter = $1 WHERE username = $2"), counter, username)
+	if err != nil {
+		return nil, fmt.Errorf("admin: confirm totp %s: %w", username, err)
+	}
+	codes, err := s.replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, fmt.Errorf("admin: confirm totp %s: %w", username, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("admin: confirm totp %s: %w", username, err)
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes invalidates existing recovery codes of the admin
+// and returns new ones.
+func (s *Store) RegenerateRecoveryCodes(username string) ([]string, error) {
+	status, err := s.GetTOTPStatus(username)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Enabled {
+		return nil, ErrTOTPDisabled
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("admin: recovery codes %s: %w", username, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	codes, err := s.replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, fmt.Errorf("admin: recovery codes %s: %w", username, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("admin: recovery codes %s: %w", username, err)
+	}
+	return codes, nil
+}
+
+func (s *Store) replaceRecoveryCodes(tx *sql.Tx, username string) ([]string, error) {
+	codes, err := totp.GenerateRecoveryCodes(totp.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(s.rebind("DELETE FROM api_admin_recovery_codes WHERE username = $1"), username); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		hash, err := hashSecret(totp.NormalizeRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(s.rebind("INSERT INTO api_admin_recovery_codes (username, hash) VALUES ($1, $2)"), username, hash); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes the second factor of the admin, including the pending
+// enrollment and recovery codes.
+func (s *Store) DisableTOTP(username string) error {
+	if err := s.checkAdmin(username); err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("admin: disable totp %s: %w", username, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	res, err := tx.Exec(s.rebind("DELETE FROM api_admin_totp WHERE username = $1"), username)
+	if err != nil {
+		return fmt.Errorf("admin: disable totp %s: %w", username, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrTOTPDisabled
+	}
+	if _, err := tx.Exec(s.rebind("DELETE FROM api_admin_recovery_codes WHERE username = $1"), username); err != nil {
+		return fmt.Errorf("admin: disable totp %s: %w", username, err)
+	}
+
+	return tx.Commit()
+}
+
+// verifyOTP checks the second factor of the admin if it is enabled. code can
+// be either the current TOTP code or one of recovery codes, used recovery
+// codes are removed.
+//
+// Basic authentication checks the code on every API request, so the code of
+// the last used step is accepted again until it expires. Codes of earlier
+// steps are still rejected.
+func (s *Store) verifyOTP(username, code string) error {
+	var (
+		secret      string
+		lastCounter int64
+	)
+	err := s.DB.QueryRow(s.rebind("SELECT secret, last_counter FROM api_admin_totp WHERE username = $1 AND enabled = 1"), username).Scan(&secret, &lastCounter)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("admin: verify otp %s: %w", username, err)
+	}
+	if code == "" {
+		return ErrOTPRequired
+	}
+
+	counter, err := totp.Validate(secret, code, time.Now(), lastCounter-1)
+	switch {
+	case err == nil:
+		if counter == lastCounter {
+			return nil
+		}
+		// The condition rejects the code if a code of a later step was used
+		// by a concurrent request.
+		res, err := s.DB.Exec(s.rebind("UPDATE api_admin_totp SET last_counter = $1 WHERE username = $2 AND last_counter <= $3"), counter, username, counter)
+		if err != nil {
+			return fmt.Errorf("admin: verify otp %s: %w", username, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			// MySQL does not count rows that are not changed, the same code
+			// could be stored by a concurrent request.
+			if err := s.DB.QueryRow(s.rebind("SELECT last_counter FROM api_admin_totp WHERE username = $1"), username).Scan(&lastCounter); err != nil {
+				return fmt.Errorf("admin: verify otp %s: %w", username, err)
+			}
+			if lastCounter != counter {
+				return ErrInvalidOTP
+			}
+		}
+		return nil
+	case errors.Is(err, totp.ErrMalformedCode):
+		return s.useRecoveryCode(username, code)
+	default:
+		return ErrInvalidOTP
+	}
+}
+
+func (s *Store) useRecoveryCode(username, code string) error {
+	rows, err := s.DB.Query(s.rebind("SELECT hash FROM api_admin_recovery_codes WHERE username = $1"), username)
+	if err != nil {
+		return fmt.Errorf("admin: verify otp %s: %w", username, err)
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("admin: verify otp %s: %w", username, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("admin: verify otp %s: %w", username, err)
+	}
+
+	code = totp.NormalizeRecoveryCode(code)
+	for _, hash := range hashes {
+		if verifySecret(code, hash) != nil {
+			continue
+		}
+		res, err := s.DB.Exec(s.rebind("DELETE FROM api_admin_recovery_codes WHERE username = $1 AND hash = $2"), username, hash)
+		if err != nil {
+			return fmt.Errorf("admin: verify otp %s: %w", username, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrInvalidOTP
+		}
+		return nil
+	}
+	return ErrInvalidOTP
+}
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+type (
+	CreateAdminDto struct {
+		Username string `json:"username" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	CreateTokenDto struct {
+		Name      string     `json:"name" validate:"required"`
+		Scopes    []string   `json:"scopes" validate:"required,min=1"`
+		Domains   []string   `json:"domains,omitempty" validate:"dive,fqdn"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+
+	// Token is the API token representation. Token field is set only
+	// once, in the response to the token creation request.
+	Token struct {
+		ID         string     `json:"id"`
+		Owner      string     `json:"owner"`
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		Domains    []string   `json:"domains"`
+		CreatedAt  time.Time  `json:"createdAt"`
+		ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+		LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+		Token      string     `json:"token,omitempty"`
+	}
+)
@@ -0,0 +1,22 @@
+package model
+
+type (
+	// CreateAliasDto is the request body for creating an alias. Alias is
+	// either an address or "*@domain" for a catch-all.
+	CreateAliasDto struct {
+		Alias        string   `json:"alias" validate:"required"`
+		Destinations []string `json:"destinations" validate:"required,min=1,dive,email"`
+	}
+
+	// UpdateAliasDto replaces the destinations of an alias
+	UpdateAliasDto struct {
+		Destinations []string `json:"destinations" validate:"required,min=1,dive,email"`
+	}
+
+	// Alias represents an alias and the addresses mail is redirected to
+	Alias struct {
+		Alias        string   `json:"alias"`
+		Destinations []string `json:"destinations"`
+		CatchAll     bool     `json:"catchAll"`
+	}
+)
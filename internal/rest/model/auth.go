@@ -0,0 +1,55 @@
+package model
+
+import "time"
+
+type (
+	// AuthLockout is a username or a client subnet locked out after too
+	// many failed authentication attempts
+	AuthLockout struct {
+		Kind        string    `json:"kind"` // "user" or "ip"
+		Key         string    `json:"key"`  // username or subnet in CIDR notation
+		Failures    int       `json:"failures"`
+		LockedUntil time.Time `json:"lockedUntil"`
+	}
+
+	// AuthUnlockRequest is the request body for removing lockouts. Failures
+	// counted for the username and the client subnet are also reset.
+	AuthUnlockRequest struct {
+		Username string `json:"username" validate:"required_without=IP"`
+		IP       string `json:"ip"` // address or subnet as listed in lockouts
+	}
+
+	// TOTPStatus is the second factor configuration of an admin or a user.
+	TOTPStatus struct {
+		Enabled bool `json:"enabled"`
+		Pending bool `json:"pending"` // enrollment is not confirmed yet
+		// Number of unused recovery codes, admins only.
+		RecoveryCodes *int `json:"recoveryCodes,omitempty"`
+	}
+
+	// TOTPEnrollment contains the new TOTP secret, URI is the otpauth://
+	// link for authenticator apps.
+	TOTPEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	TOTPCodeDto struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	// RecoveryCodes are shown only once, in the response to the TOTP
+	// confirmation or regeneration request.
+	RecoveryCodes struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+
+	// CreateSessionDto is the request for a session password of the user
+	// with TOTP enabled.
+	CreateSessionDto struct {
+		Password   string   `json:"password" validate:"required"`
+		Code       string   `json:"code" validate:"required"`
+		Protocols  []string `json:"protocols,omitempty" validate:"dive,oneof=imap smtp managesieve"`
+		TTLSeconds int64    `json:"ttlSeconds,omitempty" validate:"gte=0"` // 0 = 12 hours
+	}
+)
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+type (
+	// RotateDKIMDto is the request body for rotating the DKIM key of a domain
+	RotateDKIMDto struct {
+		Selector string `json:"selector" validate:"required,max=63"`
+		// Hours to keep publishing the replaced key, defaults to 168 (7 days)
+		OverlapHours *int `json:"overlapHours" validate:"omitempty,gte=0"`
+	}
+
+	// DKIMRecord is a TXT record that publishes a DKIM public key
+	DKIMRecord struct {
+		Selector     string     `json:"selector"`
+		DNSName      string     `json:"dnsName"`
+		DNSValue     string     `json:"dnsValue"`
+		PublishUntil *time.Time `json:"publishUntil,omitempty"` // set for replaced keys only
+	}
+
+	// DKIMResponse lists DKIM records that should be published for a domain
+	DKIMResponse struct {
+		Domain   string       `json:"domain"`
+		Active   DKIMRecord   `json:"active"`
+		Previous []DKIMRecord `json:"previous"`
+	}
+)
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+type (
+	CreateDomainDto struct {
+		Domain     string `json:"domain" validate:"required,fqdn"`
+		QuotaBytes int64  `json:"quotaBytes" validate:"gte=0"` // 0 = unlimited
+	}
+
+	// Domain represents a domain in the domain registry
+	Domain struct {
+		Domain     string    `json:"domain"`
+		CreatedAt  time.Time `json:"createdAt"`
+		UserCount  int64     `json:"userCount"`
+		QuotaBytes int64     `json:"quotaBytes"` // 0 = unlimited
+	}
+)
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// ExportRequest is the request body for starting an account export
+type ExportRequest struct {
+	Format string `json:"format" validate:"omitempty,oneof=maildir mbox"` // defaults to maildir
+}
+
+// AccountJob represents a background export, import or migration of an
+// account
+type AccountJob struct {
+	ID            string     `json:"id"`
+	Type          string     `json:"type"` // "export", "import" or "migration"
+	Username      string     `json:"username"`
+	Format        string     `json:"format,omitempty"`
+	Source        string     `json:"source,omitempty"` // remote account of a migration
+	Status        string     `json:"status"`           // "running", "done" or "failed"
+	Mailbox       string     `json:"mailbox,omitempty"`
+	MessagesDone  int        `json:"messagesDone"`
+	MessagesTotal int        `json:"messagesTotal"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+}
+
+// MigrationRequest is the request body for starting an IMAP migration from
+// a remote server. Either password or oauth2Token is required.
+type MigrationRequest struct {
+	Host               string `json:"host" validate:"required"`
+	Port               int    `json:"port" validate:"gte=0,lte=65535"` // defaults to 993, or 143 without implicit TLS
+	TLS                string `json:"tls" validate:"omitempty,oneof=tls starttls none"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	Username           string `json:"username" validate:"required"`
+	Password           string `json:"password" validate:"required_without=OAuth2Token"`
+	OAuth2Token        string `json:"oauth2Token"`
+}
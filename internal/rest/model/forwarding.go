@@ -0,0 +1,10 @@
+package model
+
+type (
+	// Forwarding is the forwarding rule of a user. If KeepCopy is set,
+	// messages are also delivered to the local mailbox.
+	Forwarding struct {
+		Destinations []string `json:"destinations" validate:"required,min=1,dive,email"`
+		KeepCopy     bool     `json:"keepCopy"`
+	}
+)
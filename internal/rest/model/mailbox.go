@@ -0,0 +1,71 @@
+package model
+
+import "time"
+
+type (
+	// Mailbox is an IMAP folder of a user
+	Mailbox struct {
+		Name        string `json:"name"`
+		SpecialUse  string `json:"specialUse,omitempty"` // "\Sent", "\Trash", "\Junk", "\Drafts" or "\Archive"
+		Subscribed  bool   `json:"subscribed"`
+		Messages    uint32 `json:"messages"`
+		Unseen      uint32 `json:"unseen"`
+		UsedBytes   int64  `json:"usedBytes"`
+		UidNext     uint32 `json:"uidNext"`
+		UidValidity uint32 `json:"uidValidity"`
+	}
+
+	// CreateMailboxRequest is the optional request body for creating a mailbox
+	CreateMailboxRequest struct {
+		SpecialUse string `json:"specialUse"`
+	}
+
+	// UpdateMailboxRequest renames the mailbox and changes its attributes,
+	// omitted fields are left unchanged
+	UpdateMailboxRequest struct {
+		Name       *string `json:"name" validate:"omitempty,min=1"`
+		SpecialUse *string `json:"specialUse"` // "" removes the attribute
+		Subscribed *bool   `json:"subscribed"`
+	}
+
+	// Address is a message envelope address
+	Address struct {
+		Name    string `json:"name,omitempty"`
+		Address string `json:"address"`
+	}
+
+	// Message is the metadata of a stored message
+	Message struct {
+		UID          uint32     `json:"uid"`
+		Flags        []string   `json:"flags"`
+		Size         uint32     `json:"size"`
+		InternalDate time.Time  `json:"internalDate"`
+		Date         *time.Time `json:"date,omitempty"`
+		Subject      string     `json:"subject"`
+		From         []Address  `json:"from"`
+		To           []Address  `json:"to"`
+		Cc           []Address  `json:"cc,omitempty"`
+		MessageID    string     `json:"messageId,omitempty"`
+		InReplyTo    string     `json:"inReplyTo,omitempty"`
+	}
+
+	// MessageList is a page of messages ordered from newest to oldest
+	MessageList struct {
+		Total      uint32    `json:"total"`
+		Messages   []Message `json:"messages"`
+		NextBefore uint32    `json:"nextBefore,omitempty"` // pass as ?before= to get the next page
+	}
+
+	// UpdateFlagsRequest adds, removes or replaces flags of messages
+	UpdateFlagsRequest struct {
+		UIDs  []uint32 `json:"uids" validate:"required,min=1"`
+		Op    string   `json:"op" validate:"required,oneof=add remove set"`
+		Flags []string `json:"flags"`
+	}
+
+	// CopyMessagesRequest copies or moves messages to another mailbox
+	CopyMessagesRequest struct {
+		UIDs        []uint32 `json:"uids" validate:"required,min=1"`
+		Destination string   `json:"destination" validate:"required"`
+	}
+)
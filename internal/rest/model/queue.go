@@ -0,0 +1,55 @@
+package model
+
+import "time"
+
+type (
+	// QueuedMessage represents a message waiting in an outbound queue
+	QueuedMessage struct {
+		ID           string            `json:"id"`
+		Queue        string            `json:"queue"`
+		State        string            `json:"state"` // "scheduled", "delivering", "held" or "suspended"
+		From         string            `json:"from"`
+		Recipients   []QueuedRecipient `json:"recipients"`
+		Size         int64             `json:"size"`
+		FirstAttempt time.Time         `json:"firstAttempt"`
+		LastAttempt  time.Time         `json:"lastAttempt"`
+		NextAttempt  *time.Time        `json:"nextAttempt,omitempty"` // not set for held messages and messages being delivered
+	}
+
+	// QueuedRecipient is a recipient delivery is still pending for
+	QueuedRecipient struct {
+		Address   string `json:"address"`
+		Tries     int    `json:"tries"`
+		LastError string `json:"lastError,omitempty"`
+	}
+
+	// QueuePurgeRequest is the request body for purging queued messages.
+	// Recipients that match both filters are removed, messages without
+	// recipients left are dropped.
+	QueuePurgeRequest struct {
+		Sender string `json:"sender" validate:"required_without=Domain"`
+		Domain string `json:"domain"` // recipient domain
+	}
+
+	// QueuePurgeResponse is the result of purging queued messages
+	QueuePurgeResponse struct {
+		Purged int `json:"purged"`
+	}
+
+	// QueueDomainPolicy is the retry schedule used for recipients in a domain
+	QueueDomainPolicy struct {
+		Domain              string  `json:"domain,omitempty"` // empty for queue defaults
+		InitialRetrySeconds int64   `json:"initialRetrySeconds"`
+		RetryScale          float64 `json:"retryScale"`
+		MaxTries            int     `json:"maxTries"`
+		MaxLifetimeSeconds  int64   `json:"maxLifetimeSeconds"` // 0 = unlimited
+		Suspended           bool    `json:"suspended"`
+	}
+
+	// QueuePolicies lists retry policies of an outbound queue
+	QueuePolicies struct {
+		Queue    string              `json:"queue"`
+		Defaults QueueDomainPolicy   `json:"defaults"`
+		Domains  []QueueDomainPolicy `json:"domains"` // overridden or suspended domains
+	}
+)
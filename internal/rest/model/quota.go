@@ -2,27 +2,42 @@ package model
 
 // UserQuotaResponse represents quota information for a single user
 type UserQuotaResponse struct {
-	Username    string         `json:"username"`
-	UsedBytes   int64          `json:"usedBytes"`
-	QuotaBytes  int64          `json:"quotaBytes"`  // 0 = unlimited
-	QuotaSource string         `json:"quotaSource"` // "user", "domain", or "none"
-	Mailboxes   []MailboxUsage `json:"mailboxes"`
+	Username      string         `json:"username"`
+	UsedBytes     int64          `json:"usedBytes"`
+	QuotaBytes    int64          `json:"quotaBytes"` // 0 = unlimited
+	MessageCount  int64          `json:"messageCount"`
+	QuotaMessages int64          `json:"quotaMessages"` // 0 = unlimited
+	QuotaSource   string         `json:"quotaSource"`   // "user", "domain", or "none"
+	Mailboxes     []MailboxUsage `json:"mailboxes"`
+	MailboxQuotas []MailboxQuota `json:"mailboxQuotas,omitempty"` // caps set for the user
 }
 
 // MailboxUsage represents storage usage for a single mailbox
 type MailboxUsage struct {
-	Name         string `json:"name"`
-	MessageCount int64  `json:"messageCount"`
-	UsedBytes    int64  `json:"usedBytes"`
+	Name          string `json:"name"`
+	MessageCount  int64  `json:"messageCount"`
+	UsedBytes     int64  `json:"usedBytes"`
+	QuotaBytes    int64  `json:"quotaBytes,omitempty"`    // effective cap, 0 = not capped
+	QuotaMessages int64  `json:"quotaMessages,omitempty"` // effective cap, 0 = not capped
+}
+
+// MailboxQuota caps a single mailbox in addition to the account quota
+type MailboxQuota struct {
+	Mailbox       string `json:"mailbox" validate:"required"`
+	QuotaBytes    int64  `json:"quotaBytes" validate:"gte=0"`
+	QuotaPercent  int64  `json:"quotaPercent" validate:"gte=0,lte=100"` // of the account quota, used if quotaBytes is 0
+	QuotaMessages int64  `json:"quotaMessages" validate:"gte=0"`
 }
 
 // DomainQuotaResponse represents quota information for a domain
 type DomainQuotaResponse struct {
-	Domain     string      `json:"domain"`
-	UsedBytes  int64       `json:"usedBytes"`
-	QuotaBytes int64       `json:"quotaBytes"` // 0 = unlimited
-	UserCount  int64       `json:"userCount"`
-	Users      []UserUsage `json:"users"`
+	Domain        string         `json:"domain"`
+	UsedBytes     int64          `json:"usedBytes"`
+	QuotaBytes    int64          `json:"quotaBytes"`    // 0 = unlimited
+	QuotaMessages int64          `json:"quotaMessages"` // 0 = unlimited
+	UserCount     int64          `json:"userCount"`
+	Users         []UserUsage    `json:"users"`
+	MailboxQuotas []MailboxQuota `json:"mailboxQuotas,omitempty"`
 }
 
 // UserUsage represents storage usage for a user within a domain
@@ -32,7 +47,10 @@ type UserUsage struct {
 	QuotaOverride *int64 `json:"quotaOverride,omitempty"` // nil if using domain quota
 }
 
-// SetQuotaRequest is the request body for setting quota limits
+// SetQuotaRequest is the request body for setting quota limits. It replaces
+// all limits of the user or the domain.
 type SetQuotaRequest struct {
-	QuotaBytes int64 `json:"quotaBytes" validate:"gte=0"`
+	QuotaBytes    int64          `json:"quotaBytes" validate:"gte=0"`
+	QuotaMessages int64          `json:"quotaMessages" validate:"gte=0"`
+	Mailboxes     []MailboxQuota `json:"mailboxes" validate:"dive"`
 }
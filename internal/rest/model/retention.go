@@ -0,0 +1,27 @@
+package model
+
+// RetentionRule expunges messages of the mailbox older than maxAgeDays
+type RetentionRule struct {
+	Mailbox    string `json:"mailbox" validate:"required"`
+	MaxAgeDays int64  `json:"maxAgeDays" validate:"gte=0"` // 0 = keep forever, disables inherited rule
+}
+
+// EffectiveRetentionRule is a rule applied to a user along with its origin
+type EffectiveRetentionRule struct {
+	Mailbox    string `json:"mailbox"`
+	MaxAgeDays int64  `json:"maxAgeDays"`
+	Source     string `json:"source"` // "config", "global", "domain" or "user"
+}
+
+// RetentionResponse represents retention rules set at a single level
+type RetentionResponse struct {
+	Rules     []RetentionRule          `json:"rules"`
+	Defaults  []RetentionRule          `json:"defaults,omitempty"`  // from the server configuration, global only
+	Effective []EffectiveRetentionRule `json:"effective,omitempty"` // rules applied to the user, user only
+}
+
+// SetRetentionRequest is the request body for setting retention rules. It
+// replaces all rules of the level.
+type SetRetentionRequest struct {
+	Rules []RetentionRule `json:"rules" validate:"dive"`
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type (
 	User struct {
 		Username string `json:"username" validate:"email"`
@@ -15,4 +17,20 @@ type (
 	Password struct {
 		Password string `json:"password,omitempty" validate:"required"`
 	}
+
+	// AppPassword is an application-specific password of a user. Password
+	// field is set only once, in the response to the creation request.
+	AppPassword struct {
+		Name       string     `json:"name"`
+		Protocols  []string   `json:"protocols"` // empty = any protocol
+		CreatedAt  time.Time  `json:"createdAt"`
+		LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+		ExpiresAt  *time.Time `json:"expiresAt,omitempty"` // session passwords only
+		Password   string     `json:"password,omitempty"`
+	}
+
+	CreateAppPasswordDto struct {
+		Name      string   `json:"name" validate:"required"`
+		Protocols []string `json:"protocols,omitempty" validate:"dive,oneof=imap smtp managesieve"`
+	}
 )
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+type (
+	// Vacation is the auto-reply configuration of a user. Replies are sent
+	// while Enabled is set and the current time is within the optional
+	// StartDate/EndDate period.
+	Vacation struct {
+		Enabled   bool       `json:"enabled"`
+		Subject   string     `json:"subject" validate:"max=998"`
+		Body      string     `json:"body" validate:"required"`
+		StartDate *time.Time `json:"startDate,omitempty"`
+		EndDate   *time.Time `json:"endDate,omitempty"`
+	}
+)
@@ -0,0 +1,159 @@
+package api_auth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/auth/throttle"
+	"github.com/foxcpp/maddy/internal/rest/admin"
+)
+
+const principalKey = "principal"
+
+// HeaderOTP carries the TOTP or recovery code of admins with the second
+// factor enabled. It is set to "required" in the response if the code is
+// missing.
+const HeaderOTP = "X-Maddy-OTP"
+
+// Authenticate accepts either a bearer API token or admin credentials via
+// HTTP Basic authentication and stores the resulting principal in the
+// request context.
+//
+// Admins with TOTP enabled should also send the code in the X-Maddy-OTP
+// header. The same code is accepted for all requests made until it
+// expires. Bearer tokens are not subject to it, they are issued by
+// authenticated admins and can be revoked separately.
+//
+// Failed admin logins are counted by throttle.Default, requests from locked
+// out admins or clients are rejected with 429 without checking credentials.
+func Authenticate(store *admin.Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var (
+				p   *admin.Principal
+				err error
+			)
+
+			authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
+			scheme, value, _ := strings.Cut(authHeader, " ")
+			switch {
+			case strings.EqualFold(scheme, "Bearer"):
+				p, err = store.AuthToken(strings.TrimSpace(value))
+			case strings.EqualFold(scheme, "Basic"):
+				username, password, ok := c.Request().BasicAuth()
+				if !ok {
+					return unauthorized(c)
+				}
+				// Forwarding headers are not trusted here, they would
+				// allow bypassing the per-client limit.
+				host, _, _ := net.SplitHostPort(c.Request().RemoteAddr)
+				ip := net.ParseIP(host)
+				if err := throttle.Default.Check(username, ip); err != nil {
+					return tooManyAttempts(c, err)
+				}
+				p, err = store.AuthAdmin(username, password, c.Request().Header.Get(HeaderOTP))
+				switch {
+				case errors.Is(err, admin.ErrOTPRequired):
+					// Password is correct, the client should retry with
+					// the code.
+					c.Response().Header().Set(HeaderOTP, "required")
+					return echo.NewHTTPError(http.StatusUnauthorized, "one-time code required")
+				case err != nil:
+					throttle.Default.Failed(username, ip)
+				default:
+					throttle.Default.Succeeded(username)
+				}
+			default:
+				return unauthorized(c)
+			}
+			if err != nil {
+				c.Logger().Debugf("API authentication failed: %v", err)
+				return unauthorized(c)
+			}
+
+			c.Set(principalKey, p)
+			return next(c)
+		}
+	}
+}
+
+func tooManyAttempts(c echo.Context, err error) error {
+	c.Logger().Debugf("API authentication rejected: %v", err)
+	var locked *throttle.LockedError
+	if errors.As(err, &locked) {
+		retryAfter := int(time.Until(locked.Until).Seconds()) + 1
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	}
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed authentication attempts")
+}
+
+func unauthorized(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="maddy", Basic realm="maddy"`)
+	return echo.ErrUnauthorized
+}
+
+// Principal returns the principal of the authenticated request.
+func Principal(c echo.Context) *admin.Principal {
+	p, ok := c.Get(principalKey).(*admin.Principal)
+	if !ok {
+		// Should not happen as long as Authenticate is used for the group.
+		return &admin.Principal{}
+	}
+	return p
+}
+
+// RequireScope rejects requests made by principals without the scope.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !Principal(c).HasScope(scope) {
+				return echo.NewHTTPError(http.StatusForbidden, "missing scope: "+scope)
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireUnrestricted rejects principals limited to a set of domains, it is
+// used for resources that are not scoped to a domain (admin accounts,
+// queued messages, authentication lockouts).
+func RequireUnrestricted(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !Principal(c).Unrestricted() {
+			return echo.NewHTTPError(http.StatusForbidden, "available only to unrestricted admins")
+		}
+		return next(c)
+	}
+}
+
+// RequireParamDomain rejects requests where the path parameter refers to a
+// domain (or an address within a domain) the principal has no access to.
+func RequireParamDomain(param string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := CheckDomain(c, c.Param(param)); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// CheckDomain verifies that the principal can access the domain. Email
+// addresses are also accepted and checked against their domain part.
+func CheckDomain(c echo.Context, domainOrAddr string) error {
+	domain := domainOrAddr
+	if idx := strings.LastIndexByte(domainOrAddr, '@'); idx != -1 {
+		domain = domainOrAddr[idx+1:]
+	}
+	if !Principal(c).HasDomain(domain) {
+		return echo.NewHTTPError(http.StatusForbidden, "access to domain denied: "+domain)
+	}
+	return nil
+}
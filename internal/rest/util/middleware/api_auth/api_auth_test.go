@@ -0,0 +1,112 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package api_auth
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/auth/totp"
+	"github.com/foxcpp/maddy/internal/rest/admin"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testServer(t *testing.T) (*echo.Echo, *admin.Store) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(testutils.Dir(t), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &admin.Store{DB: db}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateAdmin("root", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	admins := e.Group("/admins", Authenticate(store), RequireUnrestricted)
+	admins.POST("", func(c echo.Context) error {
+		return c.NoContent(http.StatusCreated)
+	}, RequireScope("admins:write"))
+	return e, store
+}
+
+func TestRequireUnrestricted(t *testing.T) {
+	e, store := testServer(t)
+
+	do := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admins", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	scoped, _, err := store.CreateToken("root", "reseller", []string{"admins:write"}, []string{"example.org"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := do(scoped); code != http.StatusForbidden {
+		t.Fatal("domain-restricted token should be rejected, got", code)
+	}
+
+	global, _, err := store.CreateToken("root", "panel", []string{"admins:write"}, nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := do(global); code != http.StatusCreated {
+		t.Fatal("unrestricted token should be accepted, got", code)
+	}
+}
+
+func TestAuthenticate_RepeatedOTP(t *testing.T) {
+	e, store := testServer(t)
+
+	secret, _, err := store.EnrollTOTP("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ConfirmTOTP("root", code); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(otp string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admins", nil)
+		req.SetBasicAuth("root", "hunter2")
+		if otp != "" {
+			req.Header.Set(HeaderOTP, otp)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get(HeaderOTP) != "required" {
+		t.Fatal("missing code should be reported, got", rec.Code, rec.Header().Get(HeaderOTP))
+	}
+
+	// Clients using Basic authentication send the same code with every
+	// request.
+	for i := 0; i < 2; i++ {
+		if rec := do(code); rec.Code != http.StatusCreated {
+			t.Fatalf("request %d with the current code failed: %d", i+1, rec.Code)
+		}
+	}
+}
@@ -44,7 +44,7 @@ func corsHeaders() echo.MiddlewareFunc {
 		MaxAge:           86400,
 		AllowMethods:     []string{"POST", "GET", "PUT", "DELETE", "PATCH", "HEAD"},
 		AllowHeaders:     []string{"*"},
-		ExposeHeaders:    []string{"Content-Length", "Page", "NextCursor", "PreviousCursor", "TotalResults", "TotalPages"},
+		ExposeHeaders:    []string{"Content-Length", "Page", "NextCursor", "PreviousCursor", "TotalResults", "TotalPages", "X-Maddy-OTP"},
 		AllowCredentials: true,
 	})
 }
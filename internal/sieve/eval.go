@@ -0,0 +1,501 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const (
+	// DefaultVacationDays is the :days value used if it is not specified.
+	DefaultVacationDays = 7
+	// MaxVacationDays is the upper limit for :days.
+	MaxVacationDays = 90
+
+	// Maximum number of redirect actions per script execution.
+	MaxRedirects = 4
+)
+
+// Message is the message the script is evaluated against.
+type Message struct {
+	Header textproto.Header
+	// Size of the message, header included.
+	Size int
+
+	// Envelope sender and recipient, used by the "envelope" test.
+	MailFrom string
+	RcptTo   string
+}
+
+// Action is an action produced by the script.
+//
+// It is one of Keep, FileInto, Redirect, Reject, Discard or Vacation.
+type Action interface {
+	isAction()
+}
+
+// Keep stores the message in the default mailbox.
+type Keep struct {
+	Flags []string
+}
+
+// FileInto stores the message in the specified mailbox.
+type FileInto struct {
+	Mailbox string
+	Flags   []string
+}
+
+// Redirect sends the message to another address.
+type Redirect struct {
+	Address string
+}
+
+// Reject refuses the message, the sender should be notified.
+type Reject struct {
+	Reason string
+}
+
+// Discard silently drops the message. It is returned as the only action if
+// the script cancelled the implicit keep and produced no other actions.
+type Discard struct{}
+
+// Vacation sends an auto-reply (RFC 5230).
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	Handle    string
+	Reason    string
+}
+
+func (Keep) isAction()     {}
+func (FileInto) isAction() {}
+func (Redirect) isAction() {}
+func (Reject) isAction()   {}
+func (Discard) isAction()  {}
+func (Vacation) isAction() {}
+
+var errStop = errors.New("stop")
+
+type runtime struct {
+	msg       Message
+	actions   []Action
+	flags     []string
+	keep      bool // implicit keep
+	redirects int
+}
+
+// Execute evaluates the script. Returned actions include the implicit keep
+// if it was not cancelled.
+//
+// If an error is returned, the caller should store the message as if the
+// script did nothing (RFC 5228, Section 2.10.6).
+func (s *Script) Execute(msg Message) ([]Action, error) {
+	rt := &runtime{msg: msg, keep: true}
+	if err := rt.run(s.cmds); err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+
+	if rt.keep {
+		rt.addAction(Keep{Flags: rt.currentFlags()})
+	}
+
+	hasStore, hasReject, hasVacation := false, false, false
+	for _, a := range rt.actions {
+		switch a.(type) {
+		case Keep, FileInto:
+			hasStore = true
+		case Reject:
+			hasReject = true
+		case Vacation:
+			hasVacation = true
+		}
+	}
+	if hasReject && (hasStore || hasVacation) {
+		return nil, errors.New("sieve: reject cannot be used with keep, fileinto or vacation")
+	}
+
+	if len(rt.actions) == 0 {
+		return []Action{Discard{}}, nil
+	}
+	return rt.actions, nil
+}
+
+func (rt *runtime) currentFlags() []string {
+	if len(rt.flags) == 0 {
+		return nil
+	}
+	return append([]string(nil), rt.flags...)
+}
+
+// addAction adds the action, dropping exact duplicates (RFC 5228,
+// Section 2.10.3).
+func (rt *runtime) addAction(a Action) {
+	for i, existing := range rt.actions {
+		switch existing := existing.(type) {
+		case Keep:
+			if _, ok := a.(Keep); ok {
+				rt.actions[i] = Keep{Flags: mergeFlags(existing.Flags, a.(Keep).Flags)}
+				return
+			}
+		case FileInto:
+			if fi, ok := a.(FileInto); ok && fi.Mailbox == existing.Mailbox {
+				rt.actions[i] = FileInto{Mailbox: existing.Mailbox, Flags: mergeFlags(existing.Flags, fi.Flags)}
+				return
+			}
+		case Redirect:
+			if r, ok := a.(Redirect); ok && strings.EqualFold(r.Address, existing.Address) {
+				return
+			}
+		}
+	}
+	rt.actions = append(rt.actions, a)
+}
+
+func (rt *runtime) run(cmds []command) error {
+	for _, cmd := range cmds {
+		if err := cmd.exec(rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type command interface {
+	exec(rt *runtime) error
+}
+
+type ifBranch struct {
+	test  test
+	block []command
+}
+
+type cmdIf struct {
+	branches  []ifBranch
+	elseBlock []command
+	hasElse   bool
+}
+
+func (c *cmdIf) exec(rt *runtime) error {
+	for _, b := range c.branches {
+		if b.test.eval(rt) {
+			return rt.run(b.block)
+		}
+	}
+	return rt.run(c.elseBlock)
+}
+
+type cmdStop struct{}
+
+func (cmdStop) exec(*runtime) error {
+	return errStop
+}
+
+type cmdKeep struct {
+	flags    []string
+	hasFlags bool
+}
+
+func (c cmdKeep) exec(rt *runtime) error {
+	flags := rt.currentFlags()
+	if c.hasFlags {
+		flags = c.flags
+	}
+	rt.addAction(Keep{Flags: flags})
+	rt.keep = false
+	return nil
+}
+
+type cmdDiscard struct{}
+
+func (cmdDiscard) exec(rt *runtime) error {
+	rt.keep = false
+	return nil
+}
+
+type cmdFileInto struct {
+	mailbox  string
+	flags    []string
+	hasFlags bool
+}
+
+func (c cmdFileInto) exec(rt *runtime) error {
+	flags := rt.currentFlags()
+	if c.hasFlags {
+		flags = c.flags
+	}
+	rt.addAction(FileInto{Mailbox: c.mailbox, Flags: flags})
+	rt.keep = false
+	return nil
+}
+
+type cmdRedirect struct {
+	address string
+}
+
+func (c cmdRedirect) exec(rt *runtime) error {
+	rt.redirects++
+	if rt.redirects > MaxRedirects {
+		return fmt.Errorf("sieve: too many redirects (max %d)", MaxRedirects)
+	}
+	rt.addAction(Redirect{Address: c.address})
+	rt.keep = false
+	return nil
+}
+
+type cmdReject struct {
+	reason string
+}
+
+func (c cmdReject) exec(rt *runtime) error {
+	for _, a := range rt.actions {
+		if _, ok := a.(Reject); ok {
+			return errors.New("sieve: multiple reject actions")
+		}
+	}
+	rt.addAction(Reject{Reason: c.reason})
+	rt.keep = false
+	return nil
+}
+
+type cmdFlags struct {
+	op    string
+	flags []string
+}
+
+func (c cmdFlags) exec(rt *runtime) error {
+	switch c.op {
+	case "setflag":
+		rt.flags = mergeFlags(nil, c.flags)
+	case "addflag":
+		rt.flags = mergeFlags(rt.flags, c.flags)
+	case "removeflag":
+		kept := rt.flags[:0]
+		for _, f := range rt.flags {
+			if !containsFold(c.flags, f) {
+				kept = append(kept, f)
+			}
+		}
+		rt.flags = kept
+	}
+	return nil
+}
+
+type cmdVacation struct {
+	v Vacation
+}
+
+func (c cmdVacation) exec(rt *runtime) error {
+	for _, a := range rt.actions {
+		if _, ok := a.(Vacation); ok {
+			return errors.New("sieve: multiple vacation actions")
+		}
+	}
+	rt.actions = append(rt.actions, c.v)
+	return nil
+}
+
+// splitFlags splits space-separated flag lists (RFC 5232, Section 3).
+func splitFlags(list []string) []string {
+	var res []string
+	for _, s := range list {
+		res = append(res, strings.Fields(s)...)
+	}
+	return res
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeFlags(a, b []string) []string {
+	res := append([]string(nil), a...)
+	for _, f := range b {
+		if !containsFold(res, f) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+type test interface {
+	eval(rt *runtime) bool
+}
+
+type testBool bool
+
+func (t testBool) eval(*runtime) bool {
+	return bool(t)
+}
+
+type testNot struct {
+	t test
+}
+
+func (t testNot) eval(rt *runtime) bool {
+	return !t.t.eval(rt)
+}
+
+type testList struct {
+	all   bool
+	tests []test
+}
+
+func (t testList) eval(rt *runtime) bool {
+	for _, sub := range t.tests {
+		if sub.eval(rt) != t.all {
+			return !t.all
+		}
+	}
+	return t.all
+}
+
+type testExists struct {
+	headers []string
+}
+
+func (t testExists) eval(rt *runtime) bool {
+	for _, h := range t.headers {
+		if !rt.msg.Header.Has(h) {
+			return false
+		}
+	}
+	return true
+}
+
+type testSize struct {
+	over  bool
+	limit uint64
+}
+
+func (t testSize) eval(rt *runtime) bool {
+	if t.over {
+		return uint64(rt.msg.Size) > t.limit
+	}
+	return uint64(rt.msg.Size) < t.limit
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Reader}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+type testHeader struct {
+	m       matcher
+	headers []string
+	keys    []string
+}
+
+func (t testHeader) eval(rt *runtime) bool {
+	for _, name := range t.headers {
+		for _, value := range rt.msg.Header.Values(name) {
+			if t.m.matchAny(strings.TrimSpace(decodeHeader(value)), t.keys) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type testAddress struct {
+	m        matcher
+	part     string
+	fields   []string
+	keys     []string
+	envelope bool
+}
+
+func addressPartOf(addr, part string) string {
+	if part == "all" {
+		return addr
+	}
+	local, domain, err := address.Split(addr)
+	if err != nil {
+		return ""
+	}
+	if part == "localpart" {
+		return local
+	}
+	return domain
+}
+
+func (t testAddress) addresses(rt *runtime, field string) []string {
+	if t.envelope {
+		if field == "from" {
+			return []string{rt.msg.MailFrom}
+		}
+		return []string{rt.msg.RcptTo}
+	}
+
+	h := mail.Header{Header: message.Header{Header: rt.msg.Header}}
+	list, err := h.AddressList(field)
+	if err != nil {
+		return nil
+	}
+	addrs := make([]string, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, a.Address)
+	}
+	return addrs
+}
+
+func (t testAddress) eval(rt *runtime) bool {
+	for _, field := range t.fields {
+		for _, addr := range t.addresses(rt, field) {
+			if t.m.matchAny(addressPartOf(addr, t.part), t.keys) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type testHasFlag struct {
+	m    matcher
+	keys []string
+}
+
+func (t testHasFlag) eval(rt *runtime) bool {
+	for _, flag := range rt.flags {
+		if t.m.matchAny(flag, splitFlags(t.keys)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string // identifier or tag name (without ':'), string value, punctuation
+	num  uint64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of script"
+	case tokTag:
+		return "tag :" + t.text
+	case tokNumber:
+		return "number " + strconv.FormatUint(t.num, 10)
+	case tokString:
+		return "string"
+	default:
+		return strconv.Quote(t.text)
+	}
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func isAlpha(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_'
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// skipSpace skips whitespace and comments (RFC 5228, Section 2.3).
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch ch := l.src[l.pos]; {
+		case ch == '\n':
+			l.line++
+			l.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			l.pos++
+		case ch == '#':
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end == -1 {
+				l.pos = len(l.src)
+			} else {
+				l.pos += end
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end == -1 {
+				return errorf(l.line, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += 2 + end + 2
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	start := l.pos
+	ch := l.src[l.pos]
+	switch {
+	case ch == '"':
+		return l.quotedString()
+	case isAlpha(ch):
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		ident := l.src[start:l.pos]
+		if strings.EqualFold(ident, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiLine()
+		}
+		return token{kind: tokIdent, text: strings.ToLower(ident), line: l.line}, nil
+	case ch == ':':
+		l.pos++
+		if l.pos >= len(l.src) || !isAlpha(l.src[l.pos]) {
+			return token{}, errorf(l.line, "malformed tag")
+		}
+		nameStart := l.pos
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokTag, text: strings.ToLower(l.src[nameStart:l.pos]), line: l.line}, nil
+	case isDigit(ch):
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		num, err := strconv.ParseUint(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, errorf(l.line, "number is out of range")
+		}
+		if l.pos < len(l.src) {
+			var mult uint64
+			switch l.src[l.pos] {
+			case 'k', 'K':
+				mult = 1 << 10
+			case 'm', 'M':
+				mult = 1 << 20
+			case 'g', 'G':
+				mult = 1 << 30
+			}
+			if mult != 0 {
+				l.pos++
+				if num > (1<<63)/mult {
+					return token{}, errorf(l.line, "number is out of range")
+				}
+				num *= mult
+			}
+		}
+		return token{kind: tokNumber, num: num, line: l.line}, nil
+	case strings.IndexByte("[](){},;", ch) != -1:
+		l.pos++
+		return token{kind: tokPunct, text: string(ch), line: l.line}, nil
+	default:
+		return token{}, errorf(l.line, "unexpected character %q", ch)
+	}
+}
+
+func (l *lexer) quotedString() (token, error) {
+	startLine := l.line
+	l.pos++ // opening quote
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch ch {
+		case '"':
+			l.pos++
+			return token{kind: tokString, text: b.String(), line: startLine}, nil
+		case '\\':
+			// Only \\ and \" are meaningful, other escapes are removed.
+			l.pos++
+			if l.pos >= len(l.src) {
+				return token{}, errorf(startLine, "unterminated string")
+			}
+			ch = l.src[l.pos]
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(ch)
+		l.pos++
+	}
+	return token{}, errorf(startLine, "unterminated string")
+}
+
+// multiLine reads the "text:" string, up to the line containing a single dot.
+func (l *lexer) multiLine() (token, error) {
+	startLine := l.line
+
+	// Rest of the "text:" line can contain only whitespace and a comment.
+	eol := strings.IndexByte(l.src[l.pos:], '\n')
+	if eol == -1 {
+		return token{}, errorf(startLine, "unterminated multi-line string")
+	}
+	rest := strings.TrimSpace(l.src[l.pos : l.pos+eol])
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return token{}, errorf(startLine, "unexpected characters after text:")
+	}
+	l.pos += eol + 1
+	l.line++
+
+	var b strings.Builder
+	for {
+		eol := strings.IndexByte(l.src[l.pos:], '\n')
+		if eol == -1 {
+			if strings.TrimSuffix(l.src[l.pos:], "\r") == "." {
+				l.pos = len(l.src)
+				return token{kind: tokString, text: b.String(), line: startLine}, nil
+			}
+			return token{}, errorf(startLine, "unterminated multi-line string")
+		}
+		line := strings.TrimSuffix(l.src[l.pos:l.pos+eol], "\r")
+		l.pos += eol + 1
+		l.line++
+
+		if line == "." {
+			return token{kind: tokString, text: b.String(), line: startLine}, nil
+		}
+		// Dot-stuffing.
+		line = strings.TrimPrefix(line, ".")
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+}
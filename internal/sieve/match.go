@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"strings"
+)
+
+// matcher implements comparators and match types (RFC 5228, Section 2.7).
+type matcher struct {
+	comparator string // "i;ascii-casemap" or "i;octet"
+	matchType  string // "is", "contains" or "matches"
+}
+
+func asciiUpper(r rune) rune {
+	if r >= 'a' && r <= 'z' {
+		return r - 'a' + 'A'
+	}
+	return r
+}
+
+func (m matcher) fold(s string) string {
+	if m.comparator == "i;octet" {
+		return s
+	}
+	return strings.Map(asciiUpper, s)
+}
+
+func (m matcher) match(value, key string) bool {
+	value, key = m.fold(value), m.fold(key)
+	switch m.matchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return wildcardMatch([]rune(key), []rune(value))
+	default:
+		return value == key
+	}
+}
+
+func (m matcher) matchAny(value string, keys []string) bool {
+	for _, key := range keys {
+		if m.match(value, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches the value against the :matches pattern. "*" matches
+// zero or more characters, "?" matches exactly one character, "\" escapes
+// the next character.
+func wildcardMatch(pattern, value []rune) bool {
+	px, vx := 0, 0
+	starPx, starVx := -1, 0
+	for vx < len(value) || px < len(pattern) {
+		if px < len(pattern) {
+			switch ch := pattern[px]; ch {
+			case '*':
+				starPx, starVx = px, vx
+				px++
+				continue
+			case '?':
+				if vx < len(value) {
+					px++
+					vx++
+					continue
+				}
+			case '\\':
+				lit, width := ch, 1
+				if px+1 < len(pattern) {
+					lit, width = pattern[px+1], 2
+				}
+				if vx < len(value) && value[vx] == lit {
+					px += width
+					vx++
+					continue
+				}
+			default:
+				if vx < len(value) && value[vx] == ch {
+					px++
+					vx++
+					continue
+				}
+			}
+		}
+		// Mismatch, let the last "*" consume one more character.
+		if starPx != -1 && starVx < len(value) {
+			starVx++
+			px, vx = starPx+1, starVx
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+)
+
+// Error is a syntax or semantic error in the script.
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sieve: line %d: %s", e.Line, e.Message)
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Message: fmt.Sprintf(format, args...)}
+}
+
+// Maximum nesting of blocks and tests, protects against stack exhaustion by
+// malicious scripts.
+const maxNesting = 32
+
+type argKind int
+
+const (
+	argTag argKind = iota
+	argNumber
+	argStrings
+)
+
+type argument struct {
+	kind   argKind
+	tag    string
+	num    uint64
+	strs   []string
+	isList bool // strs was specified using [] syntax
+	line   int
+}
+
+type testNode struct {
+	name  string
+	args  []argument
+	tests []testNode
+	line  int
+}
+
+type commandNode struct {
+	name  string
+	args  []argument
+	tests []testNode
+	block []commandNode
+	line  int
+}
+
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) isPunct(ch string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == ch
+}
+
+func (p *parser) expectPunct(ch string) error {
+	if !p.isPunct(ch) {
+		return errorf(p.tok.line, "expected %q, got %v", ch, p.tok)
+	}
+	return p.advance()
+}
+
+// parse parses the script into the list of commands (RFC 5228, Section 8.2).
+func parse(src string) ([]commandNode, error) {
+	p := parser{lex: lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	cmds, err := p.commands(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, errorf(p.tok.line, "unexpected %v", p.tok)
+	}
+	return cmds, nil
+}
+
+func (p *parser) commands(depth int) ([]commandNode, error) {
+	if depth > maxNesting {
+		return nil, errorf(p.tok.line, "too many nested blocks")
+	}
+
+	var cmds []commandNode
+	for p.tok.kind == tokIdent {
+		cmd := commandNode{name: p.tok.text, line: p.tok.line}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		var err error
+		cmd.args, cmd.tests, err = p.arguments(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case p.isPunct(";"):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		case p.isPunct("{"):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			cmd.block, err = p.commands(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if cmd.block == nil {
+				cmd.block = []commandNode{}
+			}
+			if err := p.expectPunct("}"); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errorf(p.tok.line, "expected \";\" or block after %s, got %v", cmd.name, p.tok)
+		}
+
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// arguments parses the arguments of a command or test followed by an
+// optional test or test list.
+func (p *parser) arguments(depth int) ([]argument, []testNode, error) {
+	var args []argument
+	for {
+		arg := argument{line: p.tok.line}
+		switch {
+		case p.tok.kind == tokTag:
+			arg.kind = argTag
+			arg.tag = p.tok.text
+		case p.tok.kind == tokNumber:
+			arg.kind = argNumber
+			arg.num = p.tok.num
+		case p.tok.kind == tokString:
+			arg.kind = argStrings
+			arg.strs = []string{p.tok.text}
+		case p.isPunct("["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, argument{kind: argStrings, strs: list, isList: true, line: arg.line})
+			continue
+		default:
+			tests, err := p.testsAfterArgs(depth)
+			return args, tests, err
+		}
+		args = append(args, arg)
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	if err := p.expectPunct("["); err != nil {
+		return nil, err
+	}
+	var list []string
+	for {
+		if p.tok.kind != tokString {
+			return nil, errorf(p.tok.line, "expected string in list, got %v", p.tok)
+		}
+		list = append(list, p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.isPunct("]") {
+			return list, p.advance()
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) testsAfterArgs(depth int) ([]testNode, error) {
+	switch {
+	case p.tok.kind == tokIdent:
+		test, err := p.test(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return []testNode{test}, nil
+	case p.isPunct("("):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		var tests []testNode
+		for {
+			test, err := p.test(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, test)
+			if p.isPunct(")") {
+				return tests, p.advance()
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, nil
+	}
+}
+
+func (p *parser) test(depth int) (testNode, error) {
+	if depth > maxNesting {
+		return testNode{}, errorf(p.tok.line, "too many nested tests")
+	}
+	if p.tok.kind != tokIdent {
+		return testNode{}, errorf(p.tok.line, "expected test, got %v", p.tok)
+	}
+
+	test := testNode{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return testNode{}, err
+	}
+
+	var err error
+	test.args, test.tests, err = p.arguments(depth)
+	return test, err
+}
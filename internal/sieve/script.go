@@ -0,0 +1,636 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements the Sieve mail filtering language (RFC 5228).
+//
+// Besides the base specification, the following extensions are supported:
+// fileinto, reject (RFC 5429), envelope, imap4flags (RFC 5232) and
+// vacation (RFC 5230, without :mime). Scripts are parsed and checked by
+// Parse and evaluated against a message by Script.Execute, which returns the
+// list of actions to perform. Performing them is up to the caller.
+package sieve
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// Extensions lists capabilities that can be used in "require".
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"vacation",
+}
+
+func isSupported(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Script is a parsed and checked Sieve script.
+type Script struct {
+	cmds []command
+}
+
+// Parse parses the script and checks that it uses only supported commands,
+// tests and extensions.
+func Parse(src string) (*Script, error) {
+	nodes, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler{requires: map[string]bool{}}
+	cmds, err := c.block(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds}, nil
+}
+
+type compiler struct {
+	requires map[string]bool
+}
+
+func (c *compiler) require(ext string, line int) error {
+	if !c.requires[ext] {
+		return errorf(line, "missing require %q", ext)
+	}
+	return nil
+}
+
+// taggedArgs are command or test arguments split into tagged and positional
+// ones. Tags are required to precede positional arguments.
+type taggedArgs struct {
+	tags map[string]argument
+	pos  []argument
+}
+
+// splitArgs splits arguments using spec that lists allowed tags and whether
+// they are followed by a value.
+func splitArgs(name string, line int, args []argument, spec map[string]bool) (taggedArgs, error) {
+	res := taggedArgs{tags: map[string]argument{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.kind != argTag {
+			res.pos = args[i:]
+			break
+		}
+		hasValue, ok := spec[arg.tag]
+		if !ok {
+			return res, errorf(arg.line, "unknown tag :%s for %s", arg.tag, name)
+		}
+		if _, dup := res.tags[arg.tag]; dup {
+			return res, errorf(arg.line, "duplicate tag :%s", arg.tag)
+		}
+		if hasValue {
+			if i+1 >= len(args) || args[i+1].kind == argTag {
+				return res, errorf(arg.line, "missing value for :%s", arg.tag)
+			}
+			i++
+			res.tags[arg.tag] = args[i]
+		} else {
+			res.tags[arg.tag] = arg
+		}
+	}
+	for _, arg := range res.pos {
+		if arg.kind == argTag {
+			return res, errorf(arg.line, "tag :%s should precede other arguments of %s", arg.tag, name)
+		}
+	}
+	return res, nil
+}
+
+func (t taggedArgs) has(tag string) bool {
+	_, ok := t.tags[tag]
+	return ok
+}
+
+func expectPositional(name string, line int, args []argument, kinds ...argKind) error {
+	if len(args) != len(kinds) {
+		return errorf(line, "%s expects %d positional arguments, got %d", name, len(kinds), len(args))
+	}
+	for i, kind := range kinds {
+		if args[i].kind != kind {
+			return errorf(args[i].line, "wrong type of argument %d for %s", i+1, name)
+		}
+	}
+	return nil
+}
+
+func singleString(name string, arg argument) (string, error) {
+	if arg.kind != argStrings || arg.isList || len(arg.strs) != 1 {
+		return "", errorf(arg.line, "%s expects a string", name)
+	}
+	return arg.strs[0], nil
+}
+
+func stringList(name string, arg argument) ([]string, error) {
+	if arg.kind != argStrings {
+		return nil, errorf(arg.line, "%s expects a string list", name)
+	}
+	return arg.strs, nil
+}
+
+func (c *compiler) block(nodes []commandNode, topLevel bool) ([]command, error) {
+	var (
+		cmds       []command
+		requiresOk = topLevel
+		prevIf     *cmdIf
+	)
+	for _, node := range nodes {
+		if node.name == "require" {
+			if !requiresOk {
+				return nil, errorf(node.line, "require should be used before other commands")
+			}
+			if err := c.requireCmd(node); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requiresOk = false
+
+		switch node.name {
+		case "elsif", "else":
+			if prevIf == nil || prevIf.hasElse {
+				return nil, errorf(node.line, "%s without matching if", node.name)
+			}
+			if err := c.elseBranch(prevIf, node); err != nil {
+				return nil, err
+			}
+			if node.name == "else" {
+				prevIf = nil
+			}
+			continue
+		}
+		prevIf = nil
+
+		if node.block != nil && node.name != "if" {
+			return nil, errorf(node.line, "%s does not accept a block", node.name)
+		}
+		if node.tests != nil && node.name != "if" {
+			return nil, errorf(node.line, "%s does not accept tests", node.name)
+		}
+
+		cmd, err := c.command(node)
+		if err != nil {
+			return nil, err
+		}
+		if ifCmd, ok := cmd.(*cmdIf); ok {
+			prevIf = ifCmd
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (c *compiler) requireCmd(node commandNode) error {
+	if node.tests != nil || node.block != nil {
+		return errorf(node.line, "malformed require")
+	}
+	if err := expectPositional("require", node.line, node.args, argStrings); err != nil {
+		return err
+	}
+	for _, ext := range node.args[0].strs {
+		if !isSupported(ext) {
+			return errorf(node.line, "unsupported extension %q", ext)
+		}
+		c.requires[ext] = true
+	}
+	return nil
+}
+
+func (c *compiler) condition(node commandNode) (ifBranch, error) {
+	if len(node.args) != 0 || len(node.tests) != 1 {
+		return ifBranch{}, errorf(node.line, "%s expects a single test", node.name)
+	}
+	if node.block == nil {
+		return ifBranch{}, errorf(node.line, "%s requires a block", node.name)
+	}
+	t, err := c.test(node.tests[0])
+	if err != nil {
+		return ifBranch{}, err
+	}
+	block, err := c.block(node.block, false)
+	if err != nil {
+		return ifBranch{}, err
+	}
+	return ifBranch{test: t, block: block}, nil
+}
+
+func (c *compiler) elseBranch(ifCmd *cmdIf, node commandNode) error {
+	if node.name == "elsif" {
+		branch, err := c.condition(node)
+		if err != nil {
+			return err
+		}
+		ifCmd.branches = append(ifCmd.branches, branch)
+		return nil
+	}
+
+	if len(node.args) != 0 || node.tests != nil || node.block == nil {
+		return errorf(node.line, "malformed else")
+	}
+	block, err := c.block(node.block, false)
+	if err != nil {
+		return err
+	}
+	ifCmd.elseBlock = block
+	ifCmd.hasElse = true
+	return nil
+}
+
+func (c *compiler) flagsTag(name string, t taggedArgs) ([]string, bool, error) {
+	arg, ok := t.tags["flags"]
+	if !ok {
+		return nil, false, nil
+	}
+	flags, err := stringList(name, arg)
+	if err != nil {
+		return nil, false, err
+	}
+	return splitFlags(flags), true, nil
+}
+
+func (c *compiler) command(node commandNode) (command, error) {
+	switch node.name {
+	case "if":
+		branch, err := c.condition(node)
+		if err != nil {
+			return nil, err
+		}
+		return &cmdIf{branches: []ifBranch{branch}}, nil
+	case "stop":
+		if len(node.args) != 0 {
+			return nil, errorf(node.line, "stop does not accept arguments")
+		}
+		return cmdStop{}, nil
+	case "discard":
+		if len(node.args) != 0 {
+			return nil, errorf(node.line, "discard does not accept arguments")
+		}
+		return cmdDiscard{}, nil
+	case "keep":
+		spec := map[string]bool{}
+		if c.requires["imap4flags"] {
+			spec["flags"] = true
+		}
+		t, err := splitArgs("keep", node.line, node.args, spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectPositional("keep", node.line, t.pos); err != nil {
+			return nil, err
+		}
+		flags, hasFlags, err := c.flagsTag("keep", t)
+		if err != nil {
+			return nil, err
+		}
+		return cmdKeep{flags: flags, hasFlags: hasFlags}, nil
+	case "fileinto":
+		if err := c.require("fileinto", node.line); err != nil {
+			return nil, err
+		}
+		spec := map[string]bool{}
+		if c.requires["imap4flags"] {
+			spec["flags"] = true
+		}
+		t, err := splitArgs("fileinto", node.line, node.args, spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectPositional("fileinto", node.line, t.pos, argStrings); err != nil {
+			return nil, err
+		}
+		mailbox, err := singleString("fileinto", t.pos[0])
+		if err != nil {
+			return nil, err
+		}
+		if mailbox == "" {
+			return nil, errorf(node.line, "empty mailbox name")
+		}
+		flags, hasFlags, err := c.flagsTag("fileinto", t)
+		if err != nil {
+			return nil, err
+		}
+		return cmdFileInto{mailbox: mailbox, flags: flags, hasFlags: hasFlags}, nil
+	case "redirect":
+		if err := expectPositional("redirect", node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		addr, err := singleString("redirect", node.args[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, domain, err := address.Split(addr); err != nil || domain == "" {
+			return nil, errorf(node.line, "invalid redirect address %q", addr)
+		}
+		return cmdRedirect{address: addr}, nil
+	case "reject":
+		if err := c.require("reject", node.line); err != nil {
+			return nil, err
+		}
+		if err := expectPositional("reject", node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		reason, err := singleString("reject", node.args[0])
+		if err != nil {
+			return nil, err
+		}
+		return cmdReject{reason: reason}, nil
+	case "setflag", "addflag", "removeflag":
+		if err := c.require("imap4flags", node.line); err != nil {
+			return nil, err
+		}
+		if len(node.args) == 2 {
+			return nil, errorf(node.line, "%s with variable name requires \"variables\" extension, which is not supported", node.name)
+		}
+		if err := expectPositional(node.name, node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		return cmdFlags{op: node.name, flags: splitFlags(node.args[0].strs)}, nil
+	case "vacation":
+		return c.vacation(node)
+	default:
+		return nil, errorf(node.line, "unknown command %q", node.name)
+	}
+}
+
+func (c *compiler) vacation(node commandNode) (command, error) {
+	if err := c.require("vacation", node.line); err != nil {
+		return nil, err
+	}
+	t, err := splitArgs("vacation", node.line, node.args, map[string]bool{
+		"days":      true,
+		"subject":   true,
+		"from":      true,
+		"addresses": true,
+		"mime":      false,
+		"handle":    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.has("mime") {
+		return nil, errorf(node.line, "vacation :mime is not supported")
+	}
+	if err := expectPositional("vacation", node.line, t.pos, argStrings); err != nil {
+		return nil, err
+	}
+
+	v := Vacation{Days: DefaultVacationDays}
+	if v.Reason, err = singleString("vacation", t.pos[0]); err != nil {
+		return nil, err
+	}
+	if arg, ok := t.tags["days"]; ok {
+		if arg.kind != argNumber {
+			return nil, errorf(arg.line, ":days expects a number")
+		}
+		v.Days = int(arg.num)
+		if arg.num > MaxVacationDays {
+			v.Days = MaxVacationDays
+		}
+		if v.Days < 1 {
+			v.Days = 1
+		}
+	}
+	if arg, ok := t.tags["subject"]; ok {
+		if v.Subject, err = singleString(":subject", arg); err != nil {
+			return nil, err
+		}
+	}
+	if arg, ok := t.tags["from"]; ok {
+		if v.From, err = singleString(":from", arg); err != nil {
+			return nil, err
+		}
+	}
+	if arg, ok := t.tags["addresses"]; ok {
+		if v.Addresses, err = stringList(":addresses", arg); err != nil {
+			return nil, err
+		}
+	}
+	if arg, ok := t.tags["handle"]; ok {
+		if v.Handle, err = singleString(":handle", arg); err != nil {
+			return nil, err
+		}
+	}
+	return cmdVacation{v: v}, nil
+}
+
+func (c *compiler) matcher(name string, t taggedArgs) (matcher, error) {
+	m := matcher{comparator: "i;ascii-casemap", matchType: "is"}
+	if arg, ok := t.tags["comparator"]; ok {
+		cmp, err := singleString(":comparator", arg)
+		if err != nil {
+			return m, err
+		}
+		switch cmp {
+		case "i;ascii-casemap", "i;octet":
+		default:
+			return m, errorf(arg.line, "unsupported comparator %q", cmp)
+		}
+		m.comparator = cmp
+	}
+
+	found := false
+	for _, mt := range []string{"is", "contains", "matches"} {
+		if !t.has(mt) {
+			continue
+		}
+		if found {
+			return m, errorf(t.tags[mt].line, "multiple match types for %s", name)
+		}
+		found = true
+		m.matchType = mt
+	}
+	return m, nil
+}
+
+var matchSpec = map[string]bool{
+	"comparator": true,
+	"is":         false,
+	"contains":   false,
+	"matches":    false,
+}
+
+func addressSpec() map[string]bool {
+	spec := map[string]bool{
+		"all":       false,
+		"localpart": false,
+		"domain":    false,
+	}
+	for k, v := range matchSpec {
+		spec[k] = v
+	}
+	return spec
+}
+
+func addressPart(name string, t taggedArgs) (string, error) {
+	part := "all"
+	found := false
+	for _, p := range []string{"all", "localpart", "domain"} {
+		if !t.has(p) {
+			continue
+		}
+		if found {
+			return "", errorf(t.tags[p].line, "multiple address parts for %s", name)
+		}
+		found = true
+		part = p
+	}
+	return part, nil
+}
+
+func (c *compiler) tests(nodes []testNode) ([]test, error) {
+	res := make([]test, 0, len(nodes))
+	for _, node := range nodes {
+		t, err := c.test(node)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+func (c *compiler) test(node testNode) (test, error) {
+	switch node.name {
+	case "true", "false":
+		if len(node.args) != 0 || node.tests != nil {
+			return nil, errorf(node.line, "%s does not accept arguments", node.name)
+		}
+		return testBool(node.name == "true"), nil
+	case "not":
+		if len(node.args) != 0 || len(node.tests) != 1 {
+			return nil, errorf(node.line, "not expects a single test")
+		}
+		t, err := c.test(node.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return testNot{t}, nil
+	case "allof", "anyof":
+		if len(node.args) != 0 || len(node.tests) == 0 {
+			return nil, errorf(node.line, "%s expects a test list", node.name)
+		}
+		tests, err := c.tests(node.tests)
+		if err != nil {
+			return nil, err
+		}
+		return testList{all: node.name == "allof", tests: tests}, nil
+	}
+
+	if node.tests != nil {
+		return nil, errorf(node.line, "%s does not accept nested tests", node.name)
+	}
+
+	switch node.name {
+	case "exists":
+		if err := expectPositional("exists", node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		return testExists{headers: node.args[0].strs}, nil
+	case "size":
+		t, err := splitArgs("size", node.line, node.args, map[string]bool{"over": false, "under": false})
+		if err != nil {
+			return nil, err
+		}
+		if t.has("over") == t.has("under") {
+			return nil, errorf(node.line, "size expects either :over or :under")
+		}
+		if err := expectPositional("size", node.line, t.pos, argNumber); err != nil {
+			return nil, err
+		}
+		return testSize{over: t.has("over"), limit: t.pos[0].num}, nil
+	case "header":
+		t, err := splitArgs("header", node.line, node.args, matchSpec)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.matcher("header", t)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectPositional("header", node.line, t.pos, argStrings, argStrings); err != nil {
+			return nil, err
+		}
+		return testHeader{m: m, headers: t.pos[0].strs, keys: t.pos[1].strs}, nil
+	case "address", "envelope":
+		if node.name == "envelope" {
+			if err := c.require("envelope", node.line); err != nil {
+				return nil, err
+			}
+		}
+		t, err := splitArgs(node.name, node.line, node.args, addressSpec())
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.matcher(node.name, t)
+		if err != nil {
+			return nil, err
+		}
+		part, err := addressPart(node.name, t)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectPositional(node.name, node.line, t.pos, argStrings, argStrings); err != nil {
+			return nil, err
+		}
+		fields := t.pos[0].strs
+		if node.name == "envelope" {
+			for i, f := range fields {
+				f = strings.ToLower(f)
+				if f != "from" && f != "to" {
+					return nil, errorf(node.line, "unsupported envelope part %q", f)
+				}
+				fields[i] = f
+			}
+		}
+		return testAddress{m: m, part: part, fields: fields, keys: t.pos[1].strs, envelope: node.name == "envelope"}, nil
+	case "hasflag":
+		if err := c.require("imap4flags", node.line); err != nil {
+			return nil, err
+		}
+		t, err := splitArgs("hasflag", node.line, node.args, matchSpec)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.matcher("hasflag", t)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.pos) == 2 {
+			return nil, errorf(node.line, "hasflag with variable name requires \"variables\" extension, which is not supported")
+		}
+		if err := expectPositional("hasflag", node.line, t.pos, argStrings); err != nil {
+			return nil, err
+		}
+		return testHasFlag{m: m, keys: t.pos[0].strs}, nil
+	default:
+		return nil, errorf(node.line, "unknown test %q", node.name)
+	}
+}
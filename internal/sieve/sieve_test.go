@@ -0,0 +1,260 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testMsg(fields ...string) Message {
+	var h textproto.Header
+	for i := 0; i < len(fields); i += 2 {
+		h.Add(fields[i], fields[i+1])
+	}
+	return Message{
+		Header:   h,
+		Size:     1000,
+		MailFrom: "sender@example.org",
+		RcptTo:   "user@example.com",
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, src := range []string{
+		`fileinto "Junk";`,                            // missing require
+		`require "fileinto"; fileinto "Junk"`,         // missing semicolon
+		`keep; require "fileinto";`,                   // require after command
+		`require "foobar";`,                           // unsupported extension
+		`if true { keep; }  else { keep; } else {}`,   // duplicate else
+		`elsif true { keep; }`,                        // elsif without if
+		`if header :is "Subject" { keep; }`,           // missing key list
+		`if header :is :contains "a" "b" { keep; }`,   // multiple match types
+		`if size 100 { keep; }`,                       // missing :over/:under
+		`redirect "not an address";`,                  // invalid address
+		`require "vacation"; vacation :mime "text";`,  // :mime is not supported
+		`keep :flags "\\Seen";`,                       // missing imap4flags
+		`if true { keep; `,                            // unterminated block
+		`if "foo" { keep; }`,                          // not a test
+		`discard "foo";`,                              // unexpected argument
+		`/* unterminated comment`,                     // unterminated comment
+		`require "envelope"; if envelope "cc" "a" {}`, // unsupported envelope part
+	} {
+		t.Run(src, func(t *testing.T) {
+			_, err := Parse(src)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			var sieveErr *Error
+			if !errors.As(err, &sieveErr) {
+				t.Fatalf("unexpected error type: %T", err)
+			}
+		})
+	}
+}
+
+func TestParse_ErrorLine(t *testing.T) {
+	_, err := Parse("require \"fileinto\";\n\n# comment\nfoobar;\n")
+	var sieveErr *Error
+	if !errors.As(err, &sieveErr) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if sieveErr.Line != 4 {
+		t.Errorf("wrong line: %d", sieveErr.Line)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		msg    Message
+		want   []Action
+	}{
+		{
+			name:   "empty script",
+			script: ``,
+			msg:    testMsg("Subject", "Hello"),
+			want:   []Action{Keep{}},
+		},
+		{
+			name: "fileinto on header",
+			script: `require "fileinto";
+				if header :contains "subject" "[SPAM]" {
+					fileinto "Junk";
+				}`,
+			msg:  testMsg("Subject", "Buy now [spam]"),
+			want: []Action{FileInto{Mailbox: "Junk"}},
+		},
+		{
+			name: "no match",
+			script: `require "fileinto";
+				if header :contains "subject" "[SPAM]" { fileinto "Junk"; }`,
+			msg:  testMsg("Subject", "Hello"),
+			want: []Action{Keep{}},
+		},
+		{
+			name: "encoded header",
+			script: `require "fileinto";
+				if header :is "subject" "Привет" { fileinto "Greetings"; }`,
+			msg:  testMsg("Subject", "=?utf-8?b?0J/RgNC40LLQtdGC?="),
+			want: []Action{FileInto{Mailbox: "Greetings"}},
+		},
+		{
+			name: "address domain",
+			script: `require "fileinto";
+				if address :domain :is "from" "lists.example.org" { fileinto "Lists"; stop; }
+				fileinto "Other";`,
+			msg:  testMsg("From", "List <list@lists.example.org>"),
+			want: []Action{FileInto{Mailbox: "Lists"}},
+		},
+		{
+			name: "envelope localpart matches",
+			script: `require ["envelope", "fileinto"];
+				if envelope :localpart :matches "from" "send*" { fileinto "S"; }`,
+			msg:  testMsg(),
+			want: []Action{FileInto{Mailbox: "S"}},
+		},
+		{
+			name: "elsif chain",
+			script: `require "fileinto";
+				if header :is "X-Priority" "1" { fileinto "Urgent"; }
+				elsif exists "List-Id" { fileinto "Lists"; }
+				else { keep; }`,
+			msg:  testMsg("List-Id", "<x.example.org>"),
+			want: []Action{FileInto{Mailbox: "Lists"}},
+		},
+		{
+			name:   "size and allof",
+			script: `if allof (size :over 100, not exists "X-Trusted") { discard; }`,
+			msg:    testMsg(),
+			want:   []Action{Discard{}},
+		},
+		{
+			name: "flags",
+			script: `require ["imap4flags", "fileinto"];
+				addflag "\\Flagged";
+				addflag ["$Work", "\\Seen"];
+				removeflag "\\Seen";
+				if hasflag :contains "$work" { fileinto "Work"; }`,
+			msg:  testMsg(),
+			want: []Action{FileInto{Mailbox: "Work", Flags: []string{"\\Flagged", "$Work"}}},
+		},
+		{
+			name: "keep with explicit flags",
+			script: `require "imap4flags";
+				keep :flags "\\Seen";`,
+			msg:  testMsg(),
+			want: []Action{Keep{Flags: []string{"\\Seen"}}},
+		},
+		{
+			name:   "redirect and keep",
+			script: `redirect "other@example.net"; redirect "OTHER@example.net"; keep;`,
+			msg:    testMsg(),
+			want:   []Action{Redirect{Address: "other@example.net"}, Keep{}},
+		},
+		{
+			name: "reject",
+			script: `require "reject"; reject text:
+Go away.
+..
+.
+;`,
+			msg:  testMsg(),
+			want: []Action{Reject{Reason: "Go away.\r\n.\r\n"}},
+		},
+		{
+			name: "vacation",
+			script: `require "vacation";
+				vacation :days 200 :subject "Away" :addresses ["alias@example.com"] "I'm away";`,
+			msg: testMsg(),
+			want: []Action{
+				Vacation{Days: MaxVacationDays, Subject: "Away", Addresses: []string{"alias@example.com"}, Reason: "I'm away"},
+				Keep{},
+			},
+		},
+		{
+			name: "octet comparator",
+			script: `require ["fileinto", "comparator-i;octet"];
+				if header :comparator "i;octet" :is "subject" "hello" { fileinto "Lower"; }`,
+			msg:  testMsg("Subject", "HELLO"),
+			want: []Action{Keep{}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := Parse(c.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actions, err := s.Execute(c.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actions, c.want) {
+				t.Errorf("wrong actions:\n got  %#v\n want %#v", actions, c.want)
+			}
+		})
+	}
+}
+
+func TestExecute_Errors(t *testing.T) {
+	for _, script := range []string{
+		`require "reject"; reject "no"; keep;`,
+		`require "reject"; reject "no"; reject "again";`,
+		`redirect "a@example.org"; redirect "b@example.org"; redirect "c@example.org";
+		 redirect "d@example.org"; redirect "e@example.org";`,
+	} {
+		s, err := Parse(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Execute(testMsg()); err == nil {
+			t.Errorf("expected error for %q", script)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"?", "", false},
+		{"?x", "ax", true},
+		{"*@example.org", "user@example.org", true},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a?", "abc", false},
+	}
+	for _, c := range cases {
+		if got := wildcardMatch([]rune(c.pattern), []rune(c.value)); got != c.match {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", c.pattern, c.value, got, c.match)
+		}
+	}
+}
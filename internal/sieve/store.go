@@ -0,0 +1,245 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/sqldialect"
+)
+
+var (
+	ErrNoScript     = errors.New("sieve: no such script")
+	ErrScriptExists = errors.New("sieve: script already exists")
+	ErrActiveScript = errors.New("sieve: script is active")
+)
+
+// ScriptInfo describes a stored script.
+type ScriptInfo struct {
+	Name      string
+	Active    bool
+	UpdatedAt time.Time
+}
+
+// Store keeps per-account Sieve scripts in the SQL database shared with
+// storage.imapsql. At most one script of an account is active.
+type Store struct {
+	DB *sql.DB
+	// Driver is the name of the SQL driver used for DB, queries are adapted
+	// to it using sqldialect.Rebind.
+	Driver string
+}
+
+func (s *Store) rebind(query string) string {
+	return sqldialect.Rebind(s.Driver, query)
+}
+
+// Init creates the table used by the store if it doesn't exist.
+func (s *Store) Init() error {
+	_, err := s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS sieve_scripts (
+			username VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			content TEXT NOT NULL,
+			active INTEGER NOT NULL DEFAULT 0,
+			updated_at BIGINT NOT NULL,
+			PRIMARY KEY (username, name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("sieve: init: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) List(username string) ([]ScriptInfo, error) {
+	rows, err := s.DB.Query(s.rebind(`SELECT name, active, updated_at FROM sieve_scripts WHERE username = $1 ORDER BY name`), username)
+	if err != nil {
+		return nil, fmt.Errorf("sieve: list %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	res := []ScriptInfo{}
+	for rows.Next() {
+		var (
+			info      ScriptInfo
+			active    int
+			updatedAt int64
+		)
+		if err := rows.Scan(&info.Name, &active, &updatedAt); err != nil {
+			return nil, fmt.Errorf("sieve: list %s: %w", username, err)
+		}
+		info.Active = active != 0
+		info.UpdatedAt = time.Unix(updatedAt, 0)
+		res = append(res, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sieve: list %s: %w", username, err)
+	}
+	return res, nil
+}
+
+func (s *Store) Get(username, name string) (string, error) {
+	var content string
+	err := s.DB.QueryRow(s.rebind(`SELECT content FROM sieve_scripts WHERE username = $1 AND name = $2`),
+		username, name).Scan(&content)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoScript
+		}
+		return "", fmt.Errorf("sieve: get %s/%s: %w", username, name, err)
+	}
+	return content, nil
+}
+
+// Active returns the name and content of the active script. ErrNoScript is
+// returned if there is no active script.
+func (s *Store) Active(username string) (string, string, error) {
+	var name, content string
+	err := s.DB.QueryRow(s.rebind(`SELECT name, content FROM sieve_scripts WHERE username = $1 AND active = 1`),
+		username).Scan(&name, &content)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrNoScript
+		}
+		return "", "", fmt.Errorf("sieve: get active %s: %w", username, err)
+	}
+	return name, content, nil
+}
+
+// Put creates or replaces the script. Callers are expected to check the
+// script using Parse first.
+func (s *Store) Put(username, name, content string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("sieve: put %s/%s: %w", username, name, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(s.rebind(`UPDATE sieve_scripts SET content = $1, updated_at = $2 WHERE username = $3 AND name = $4`),
+		content, now, username, name)
+	if err != nil {
+		return fmt.Errorf("sieve: put %s/%s: %w", username, name, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		_, err = tx.Exec(s.rebind(`INSERT INTO sieve_scripts (username, name, content, active, updated_at) VALUES ($1, $2, $3, 0, $4)`),
+			username, name, content, now)
+		if err != nil {
+			return fmt.Errorf("sieve: put %s/%s: %w", username, name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetActive makes the script active, deactivating others. Empty name
+// deactivates all scripts.
+func (s *Store) SetActive(username, name string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("sieve: set active %s/%s: %w", username, name, err)
+	}
+	defer tx.Rollback()
+
+	if name != "" {
+		var exists bool
+		err := tx.QueryRow(s.rebind(`SELECT EXISTS(SELECT 1 FROM sieve_scripts WHERE username = $1 AND name = $2)`),
+			username, name).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("sieve: set active %s/%s: %w", username, name, err)
+		}
+		if !exists {
+			return ErrNoScript
+		}
+	}
+
+	if _, err := tx.Exec(s.rebind(`UPDATE sieve_scripts SET active = 0 WHERE username = $1`), username); err != nil {
+		return fmt.Errorf("sieve: set active %s/%s: %w", username, name, err)
+	}
+	if name != "" {
+		_, err := tx.Exec(s.rebind(`UPDATE sieve_scripts SET active = 1 WHERE username = $1 AND name = $2`), username, name)
+		if err != nil {
+			return fmt.Errorf("sieve: set active %s/%s: %w", username, name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the script. Active script cannot be removed (RFC 5804,
+// Section 2.10).
+func (s *Store) Delete(username, name string) error {
+	var active int
+	err := s.DB.QueryRow(s.rebind(`SELECT active FROM sieve_scripts WHERE username = $1 AND name = $2`),
+		username, name).Scan(&active)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoScript
+		}
+		return fmt.Errorf("sieve: delete %s/%s: %w", username, name, err)
+	}
+	if active != 0 {
+		return ErrActiveScript
+	}
+
+	if _, err := s.DB.Exec(s.rebind(`DELETE FROM sieve_scripts WHERE username = $1 AND name = $2`), username, name); err != nil {
+		return fmt.Errorf("sieve: delete %s/%s: %w", username, name, err)
+	}
+	return nil
+}
+
+func (s *Store) Rename(username, oldName, newName string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("sieve: rename %s/%s: %w", username, oldName, err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(s.rebind(`SELECT EXISTS(SELECT 1 FROM sieve_scripts WHERE username = $1 AND name = $2)`),
+		username, newName).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("sieve: rename %s/%s: %w", username, oldName, err)
+	}
+	if exists {
+		return ErrScriptExists
+	}
+
+	res, err := tx.Exec(s.rebind(`UPDATE sieve_scripts SET name = $1 WHERE username = $2 AND name = $3`), newName, username, oldName)
+	if err != nil {
+		return fmt.Errorf("sieve: rename %s/%s: %w", username, oldName, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoScript
+	}
+
+	return tx.Commit()
+}
+
+// DeleteAll removes all scripts of the account.
+func (s *Store) DeleteAll(username string) error {
+	if _, err := s.DB.Exec(s.rebind(`DELETE FROM sieve_scripts WHERE username = $1`), username); err != nil {
+		return fmt.Errorf("sieve: delete all %s: %w", username, err)
+	}
+	return nil
+}
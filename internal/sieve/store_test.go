@@ -0,0 +1,147 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(testutils.Dir(t), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := &Store{DB: db}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.Active("user"); !errors.Is(err, ErrNoScript) {
+		t.Fatalf("expected ErrNoScript, got %v", err)
+	}
+
+	if err := s.Put("user", "a", "keep;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("user", "b", "discard;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("user", "a", "stop;"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := s.Get("user", "a"); err != nil || content != "stop;" {
+		t.Fatalf("Get: %q, %v", content, err)
+	}
+
+	if err := s.SetActive("user", "missing"); !errors.Is(err, ErrNoScript) {
+		t.Fatalf("expected ErrNoScript, got %v", err)
+	}
+	if err := s.SetActive("user", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetActive("user", "b"); err != nil {
+		t.Fatal(err)
+	}
+	name, content, err := s.Active("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "b" || content != "discard;" {
+		t.Fatalf("wrong active script: %s %q", name, content)
+	}
+
+	list, err := s.List("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "a" || list[0].Active || list[1].Name != "b" || !list[1].Active {
+		t.Fatalf("wrong list: %+v", list)
+	}
+
+	if err := s.Delete("user", "b"); !errors.Is(err, ErrActiveScript) {
+		t.Fatalf("expected ErrActiveScript, got %v", err)
+	}
+	if err := s.Rename("user", "a", "b"); !errors.Is(err, ErrScriptExists) {
+		t.Fatalf("expected ErrScriptExists, got %v", err)
+	}
+	if err := s.Rename("user", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if name, _, _ := s.Active("user"); name != "c" {
+		t.Fatalf("active script was not renamed: %s", name)
+	}
+
+	if err := s.SetActive("user", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("user", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("user", "c"); !errors.Is(err, ErrNoScript) {
+		t.Fatalf("expected ErrNoScript, got %v", err)
+	}
+}
+
+func TestStore_DeleteAll(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(testutils.Dir(t), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := &Store{DB: db}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"user@example.org", "other@example.org"} {
+		if err := s.Put(user, "main", `redirect "attacker@example.net";`); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetActive(user, "main"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The account is deleted and then created again for a new owner.
+	if err := s.DeleteAll("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Active("user@example.org"); !errors.Is(err, ErrNoScript) {
+		t.Fatalf("re-created account has an active script: %v", err)
+	}
+	if list, err := s.List("user@example.org"); err != nil || len(list) != 0 {
+		t.Fatalf("re-created account has scripts: %+v, %v", list, err)
+	}
+
+	if name, _, err := s.Active("other@example.org"); err != nil || name != "main" {
+		t.Fatalf("scripts of other accounts were deleted: %s, %v", name, err)
+	}
+}
@@ -0,0 +1,36 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sqldialect adapts queries written for PostgreSQL to other SQL
+// drivers supported by storage.imapsql, it is used by modules that keep
+// their tables in the storage database.
+package sqldialect
+
+import "regexp"
+
+var pgPlaceholder = regexp.MustCompile(`\$[0-9]+`)
+
+// Rebind replaces $N placeholders with '?' for MySQL, so each $N must be
+// used exactly once and in order. Queries for other drivers are returned
+// unchanged.
+func Rebind(driver, query string) string {
+	if driver == "mysql" {
+		return pgPlaceholder.ReplaceAllString(query, "?")
+	}
+	return query
+}
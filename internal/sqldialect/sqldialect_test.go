@@ -0,0 +1,33 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sqldialect
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	const query = `SELECT a FROM b WHERE c = $1 AND d = $2`
+	if q := Rebind("mysql", query); q != `SELECT a FROM b WHERE c = ? AND d = ?` {
+		t.Errorf("unexpected query: %s", q)
+	}
+	for _, driver := range []string{"postgres", "sqlite3", ""} {
+		if q := Rebind(driver, query); q != query {
+			t.Errorf("%s: unexpected query: %s", driver, q)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package srs implements the Sender Rewriting Scheme used to preserve SPF
+// alignment of forwarded messages.
+//
+// Addresses are rewritten into the SRS0 form:
+//
+//	SRS0=HHHH=TT=orig-domain=orig-local@forwarder-domain
+//
+// where HHHH is the truncated HMAC of the remaining fields and TT is the
+// timestamp (days modulo 1024). Addresses that are already in SRS0 form are
+// rewritten into the SRS1 form that points at the first forwarder so bounces
+// do not traverse the whole forwarding chain:
+//
+//	SRS1=HHHH=first-forwarder==HHHH=TT=orig-domain=orig-local@forwarder-domain
+//
+// Hash and timestamp are encoded using base32 letters and digits only so the
+// result survives sub-addressing rewrites (e.g. "+" separators).
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const (
+	hashLen    = 4
+	timePrec   = 24 * time.Hour
+	timeSlots  = 1024 // 2 base32 characters
+	base32Alph = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+	// DefaultMaxAge is how long rewritten addresses are accepted for bounces.
+	DefaultMaxAge = 21 * 24 * time.Hour
+)
+
+var (
+	ErrNotSRS      = errors.New("srs: not an SRS address")
+	ErrMalformed   = errors.New("srs: malformed SRS address")
+	ErrInvalidHash = errors.New("srs: hash mismatch")
+	ErrExpired     = errors.New("srs: address expired")
+	ErrUnsupported = errors.New("srs: address cannot be rewritten")
+)
+
+// Rewriter rewrites envelope senders of forwarded messages and reverses
+// rewritten addresses found in recipients of bounces.
+type Rewriter struct {
+	// Domain is used as the domain part of rewritten addresses. Its SPF
+	// policy should authorize the forwarding server.
+	Domain string
+
+	// Secrets are HMAC keys. The first one is used to sign new addresses,
+	// all of them are accepted when reversing to allow key rotation.
+	Secrets [][]byte
+
+	// MaxAge limits the age of addresses accepted by Reverse. Zero value
+	// means DefaultMaxAge.
+	MaxAge time.Duration
+
+	now func() time.Time
+}
+
+// IsSRS reports whether the address local-part has the SRS0 or SRS1 prefix.
+func IsSRS(addr string) bool {
+	local, _, err := address.Split(addr)
+	if err != nil {
+		return false
+	}
+	return hasPrefixFold(local, "SRS0=") || hasPrefixFold(local, "SRS1=")
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func (r *Rewriter) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *Rewriter) hash(secret []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, p := range parts {
+		// Case is not guaranteed to be preserved by relays.
+		mac.Write([]byte(strings.ToLower(p)))
+		mac.Write([]byte{0})
+	}
+	return base32.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLen]
+}
+
+func (r *Rewriter) checkHash(hash string, parts ...string) error {
+	if len(hash) != hashLen {
+		return ErrMalformed
+	}
+	for _, secret := range r.Secrets {
+		want := r.hash(secret, parts...)
+		if subtle.ConstantTimeCompare([]byte(strings.ToUpper(hash)), []byte(want)) == 1 {
+			return nil
+		}
+	}
+	return ErrInvalidHash
+}
+
+func (r *Rewriter) timestamp() string {
+	slot := (r.timeNow().Unix() / int64(timePrec/time.Second)) % timeSlots
+	return string([]byte{base32Alph[slot>>5], base32Alph[slot&31]})
+}
+
+func (r *Rewriter) checkTimestamp(ts string) error {
+	if len(ts) != 2 {
+		return ErrMalformed
+	}
+	ts = strings.ToUpper(ts)
+	hi, lo := strings.IndexByte(base32Alph, ts[0]), strings.IndexByte(base32Alph, ts[1])
+	if hi == -1 || lo == -1 {
+		return ErrMalformed
+	}
+	then := int64(hi<<5 | lo)
+	now := (r.timeNow().Unix() / int64(timePrec/time.Second)) % timeSlots
+
+	age := (now - then + timeSlots) % timeSlots
+	maxAge := r.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	if time.Duration(age)*timePrec > maxAge {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Forward rewrites the envelope sender of a message forwarded by this
+// server. Null sender and addresses within Domain are returned unchanged.
+func (r *Rewriter) Forward(addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if len(r.Secrets) == 0 {
+		return "", errors.New("srs: no secrets configured")
+	}
+
+	local, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if domain == "" || strings.EqualFold(domain, r.Domain) {
+		return addr, nil
+	}
+	if strings.ContainsAny(local, "\" \\") {
+		return "", ErrUnsupported
+	}
+	secret := r.Secrets[0]
+
+	switch {
+	case hasPrefixFold(local, "SRS0="):
+		// We are not the first forwarder, point at the first one.
+		tail := local[4:] // "=HHHH=TT=domain=local"
+		return "SRS1=" + r.hash(secret, domain, tail) + "=" + domain + "=" + tail + "@" + r.Domain, nil
+	case hasPrefixFold(local, "SRS1="):
+		// Keep the first forwarder, only re-sign.
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", ErrMalformed
+		}
+		firstHop, tail := parts[1], parts[2]
+		return "SRS1=" + r.hash(secret, firstHop, tail) + "=" + firstHop + "=" + tail + "@" + r.Domain, nil
+	default:
+		ts := r.timestamp()
+		return "SRS0=" + r.hash(secret, ts, domain, local) + "=" + ts + "=" + domain + "=" + local + "@" + r.Domain, nil
+	}
+}
+
+// Reverse restores the address that was rewritten by Forward. SRS1
+// addresses are reversed into the SRS0 address of the first forwarder.
+func (r *Rewriter) Reverse(addr string) (string, error) {
+	local, _, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case hasPrefixFold(local, "SRS0="):
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", ErrMalformed
+		}
+		hash, ts, domain, origLocal := parts[0], parts[1], parts[2], parts[3]
+		if err := r.checkHash(hash, ts, domain, origLocal); err != nil {
+			return "", err
+		}
+		if err := r.checkTimestamp(ts); err != nil {
+			return "", err
+		}
+		return origLocal + "@" + domain, nil
+	case hasPrefixFold(local, "SRS1="):
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || !strings.HasPrefix(parts[2], "=") {
+			return "", ErrMalformed
+		}
+		hash, firstHop, tail := parts[0], parts[1], parts[2]
+		if err := r.checkHash(hash, firstHop, tail); err != nil {
+			return "", err
+		}
+		return "SRS0" + tail + "@" + firstHop, nil
+	default:
+		return "", ErrNotSRS
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRewriter(domain string, now time.Time) *Rewriter {
+	return &Rewriter{
+		Domain:  domain,
+		Secrets: [][]byte{[]byte("secret")},
+		now:     func() time.Time { return now },
+	}
+}
+
+func TestForwardReverse(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r := testRewriter("fwd.example", now)
+
+	rewritten, err := r.Forward("alice@sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=sender.example=alice@fwd.example") {
+		t.Fatal("unexpected rewritten address:", rewritten)
+	}
+	if !IsSRS(rewritten) {
+		t.Fatal("IsSRS = false for", rewritten)
+	}
+
+	orig, err := r.Reverse(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "alice@sender.example" {
+		t.Fatal("wrong reversed address:", orig)
+	}
+
+	// Case changes by relays should not break reversal.
+	orig, err = r.Reverse(strings.ToLower(rewritten))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "alice@sender.example" {
+		t.Fatal("wrong reversed address:", orig)
+	}
+}
+
+func TestForward_Unchanged(t *testing.T) {
+	r := testRewriter("fwd.example", time.Now())
+
+	for _, addr := range []string{"", "bob@fwd.example", "bob@FWD.example"} {
+		res, err := r.Forward(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != addr {
+			t.Errorf("Forward(%q) = %q, want unchanged", addr, res)
+		}
+	}
+}
+
+func TestForward_SRS1(t *testing.T) {
+	now := time.Now()
+	first := testRewriter("first.example", now)
+	second := &Rewriter{Domain: "second.example", Secrets: [][]byte{[]byte("other")}, now: first.now}
+	third := &Rewriter{Domain: "third.example", Secrets: [][]byte{[]byte("third")}, now: first.now}
+
+	srs0, err := first.Forward("alice@sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs1, err := second.Forward(srs0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.HasSuffix(srs1, "@second.example") {
+		t.Fatal("unexpected SRS1 address:", srs1)
+	}
+
+	// Further forwarders keep pointing at the first one.
+	srs1b, err := third.Forward(srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(srs1b, "=first.example==") {
+		t.Fatal("first forwarder is lost:", srs1b)
+	}
+
+	back, err := third.Reverse(srs1b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != srs0 {
+		t.Fatalf("SRS1 reversed into %s, want %s", back, srs0)
+	}
+	orig, err := first.Reverse(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "alice@sender.example" {
+		t.Fatal("wrong reversed address:", orig)
+	}
+}
+
+func TestReverse_Errors(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r := testRewriter("fwd.example", now)
+
+	rewritten, err := r.Forward("alice@sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reverse("alice@fwd.example"); !errors.Is(err, ErrNotSRS) {
+		t.Error("expected ErrNotSRS, got", err)
+	}
+	if _, err := r.Reverse("SRS0=xx@fwd.example"); !errors.Is(err, ErrMalformed) {
+		t.Error("expected ErrMalformed, got", err)
+	}
+
+	forged := strings.Replace(rewritten, "=alice@", "=mallory@", 1)
+	if _, err := r.Reverse(forged); !errors.Is(err, ErrInvalidHash) {
+		t.Error("expected ErrInvalidHash, got", err)
+	}
+
+	other := &Rewriter{Domain: "fwd.example", Secrets: [][]byte{[]byte("other")}, now: r.now}
+	if _, err := other.Reverse(rewritten); !errors.Is(err, ErrInvalidHash) {
+		t.Error("expected ErrInvalidHash for a different secret, got", err)
+	}
+
+	later := testRewriter("fwd.example", now.Add(DefaultMaxAge+48*time.Hour))
+	if _, err := later.Reverse(rewritten); !errors.Is(err, ErrExpired) {
+		t.Error("expected ErrExpired, got", err)
+	}
+}
+
+func TestReverse_SecretRotation(t *testing.T) {
+	now := time.Now()
+	old := testRewriter("fwd.example", now)
+	rewritten, err := old.Forward("alice@sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := &Rewriter{
+		Domain:  "fwd.example",
+		Secrets: [][]byte{[]byte("new"), []byte("secret")},
+		now:     old.now,
+	}
+	if _, err := rotated.Reverse(rewritten); err != nil {
+		t.Fatal("address signed with the old secret is not accepted:", err)
+	}
+}
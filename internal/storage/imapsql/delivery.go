@@ -20,6 +20,7 @@ package imapsql
 
 import (
 	"context"
+	"errors"
 	"runtime/trace"
 
 	"github.com/emersion/go-imap"
@@ -43,6 +44,10 @@ type delivery struct {
 	mailFrom string
 
 	addedRcpts map[string]addedRcpt
+
+	// filterCommits are side effects of IMAP filters, they are run after the
+	// message is committed.
+	filterCommits []func()
 }
 
 func (d *delivery) String() string {
@@ -104,6 +109,35 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 	return nil
 }
 
+// resetRcpts recreates the underlying delivery object with recipients that
+// are left in addedRcpts. go-imap-sql provides no way to remove an added
+// recipient.
+func (d *delivery) resetRcpts() error {
+	d.d = d.store.Back.NewDelivery()
+	for accountName := range d.addedRcpts {
+		userHeader := textproto.Header{}
+		userHeader.Add("Delivered-To", accountName)
+		if err := d.d.AddRcpt(accountName, userHeader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filter runs IMAP filters for the recipient. Side effects of filters that
+// support it are saved to run them on Commit.
+func (d *delivery) filter(accountName, rcptTo string, header textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	df, ok := d.store.filters.(module.DeferredIMAPFilter)
+	if !ok {
+		return d.store.filters.IMAPFilter(accountName, rcptTo, d.msgMeta, header, body)
+	}
+	folder, flags, commit, err := df.IMAPFilterDeferred(accountName, rcptTo, d.msgMeta, header, body)
+	if commit != nil {
+		d.filterCommits = append(d.filterCommits, commit)
+	}
+	return folder, flags, err
+}
+
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
@@ -115,14 +149,55 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 		}
 	}
 
+	// Target mailbox of each recipient, for per-mailbox caps.
+	targets := make(map[string]string, len(d.addedRcpts))
+
 	if !d.msgMeta.Quarantine && d.store.filters != nil {
+		type filterResult struct {
+			folder string
+			flags  []string
+		}
+		results := make(map[string]filterResult, len(d.addedRcpts))
+		discarded := false
 		for rcpt, rcptData := range d.addedRcpts {
-			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
+			folder, flags, err := d.filter(rcpt, rcptData.rcptTo, header, body)
+			if errors.Is(err, module.ErrDiscard) {
+				d.store.Log.Msg("message discarded by IMAP filter", "rcpt", rcpt, "msg_id", d.msgMeta.ID)
+				delete(d.addedRcpts, rcpt)
+				discarded = true
+				continue
+			}
 			if err != nil {
 				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
 				continue
 			}
-			d.d.UserMailbox(rcpt, folder, flags)
+			results[rcpt] = filterResult{folder: folder, flags: flags}
+		}
+
+		if discarded {
+			if err := d.resetRcpts(); err != nil {
+				return err
+			}
+			if len(d.addedRcpts) == 0 {
+				return nil
+			}
+		}
+		for rcpt, res := range results {
+			d.d.UserMailbox(rcpt, res.folder, res.flags)
+			targets[rcpt] = res.folder
+		}
+	}
+
+	for rcpt := range d.addedRcpts {
+		mbox := targets[rcpt]
+		if d.msgMeta.Quarantine {
+			mbox = d.store.junkMbox
+		}
+		if mbox == "" {
+			mbox = "INBOX"
+		}
+		if err := d.store.CheckMailboxQuota(rcpt, mbox, msgSize); err != nil {
+			return err
 		}
 	}
 
@@ -159,13 +234,26 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 func (d *delivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Abort").End()
 
+	d.filterCommits = nil
 	return d.d.Abort()
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	if err := d.d.Commit(); err != nil {
+		return err
+	}
+
+	for _, commit := range d.filterCommits {
+		commit()
+	}
+	d.filterCommits = nil
+
+	for rcpt := range d.addedRcpts {
+		d.store.CheckQuotaWarnings(rcpt)
+	}
+	return nil
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
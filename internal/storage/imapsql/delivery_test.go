@@ -0,0 +1,77 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type deferredFilter struct {
+	committed int
+}
+
+func (f *deferredFilter) IMAPFilter(accountName, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (string, []string, error) {
+	f.committed++
+	return "", nil, nil
+}
+
+func (f *deferredFilter) IMAPFilterDeferred(accountName, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (string, []string, func(), error) {
+	return "", nil, func() { f.committed++ }, nil
+}
+
+func TestDelivery_FilterCommit(t *testing.T) {
+	store := setupQuotaStorage(t)
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) { return s, nil }
+	filter := &deferredFilter{}
+	store.filters = filter
+
+	const username = "user@example.org"
+	if err := store.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserQuota(username, QuotaSettings{
+		Mailboxes: []MailboxQuota{{Mailbox: "INBOX", Messages: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.com", []string{username}); err != nil {
+		t.Fatal(err)
+	}
+	if filter.committed != 1 {
+		t.Fatalf("filter side effects run %d times after commit, want 1", filter.committed)
+	}
+
+	// Rejected by the INBOX cap after filters are run.
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.com", []string{username}); err == nil {
+		t.Fatal("delivery over INBOX cap succeeded")
+	}
+	if filter.committed != 1 {
+		t.Fatalf("filter side effects run for aborted delivery")
+	}
+}
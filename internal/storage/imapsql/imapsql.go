@@ -35,6 +35,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -44,9 +45,11 @@ import (
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/endpoint/eventsink"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
 
@@ -76,6 +79,14 @@ type Storage struct {
 
 	filters module.IMAPFilter
 
+	quotaWarnings *quotaWarnings
+	// quotaWebhookStop stops the sink created for quota_warning_webhook.
+	quotaWebhookStop func()
+	metricsStop      chan struct{}
+
+	retention     []RetentionRule
+	retentionStop chan struct{}
+
 	deliveryMap       module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
@@ -90,6 +101,12 @@ func (store *Storage) InstanceName() string {
 	return store.instName
 }
 
+// Driver returns the name of the SQL driver used for the database, modules
+// sharing the database use it to adapt their queries.
+func (store *Storage) Driver() string {
+	return store.driver
+}
+
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	store := &Storage{
 		instName: instName,
@@ -116,6 +133,15 @@ func (store *Storage) Init(cfg *config.Map) error {
 		authNormalize     string
 		deliveryNormalize string
 
+		hostname            string
+		quotaThresholds     []string
+		quotaWarningFrom    string
+		quotaWarningSubject string
+		quotaWarningBody    string
+		quotaWebhook        string
+
+		retentionInterval time.Duration
+
 		blobStore module.BlobStore
 	)
 
@@ -164,6 +190,16 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("quota_warning_thresholds", false, false, []string{"80", "95"}, &quotaThresholds)
+	cfg.String("quota_warning_from", false, false, "", &quotaWarningFrom)
+	cfg.String("quota_warning_subject", false, false, defaultQuotaWarningSubject, &quotaWarningSubject)
+	cfg.String("quota_warning_template", false, false, "", &quotaWarningBody)
+	cfg.String("quota_warning_webhook", false, false, "", &quotaWebhook)
+	cfg.Custom("retention", false, false, func() (interface{}, error) {
+		return []RetentionRule(nil), nil
+	}, parseRetentionBlock, &store.retention)
+	cfg.Duration("retention_interval", false, false, time.Hour, &retentionInterval)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -282,6 +318,32 @@ func (store *Storage) Init(cfg *config.Map) error {
 	store.driver = driver
 	store.dsn = dsn
 
+	if err := store.initSchema(); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+
+	store.quotaWarnings, err = newQuotaWarnings(quotaThresholds, quotaWarningFrom, hostname,
+		quotaWarningSubject, quotaWarningBody)
+	if err != nil {
+		return err
+	}
+	if quotaWebhook != "" {
+		// Shorthand for the webhook in the 'events' block that receives
+		// only quota.warning events.
+		store.quotaWebhookStop, err = eventsink.SubscribeWebhook(quotaWebhook, []string{events.QuotaWarning}, store.Log)
+		if err != nil {
+			return fmt.Errorf("imapsql: quota_warning_webhook: %w", err)
+		}
+	}
+
+	store.metricsStop = make(chan struct{})
+	go store.updateUsageMetrics(time.Minute, store.metricsStop)
+
+	if retentionInterval != 0 {
+		store.retentionStop = make(chan struct{})
+		go store.retentionJanitor(retentionInterval, store.retentionStop)
+	}
+
 	return nil
 }
 
@@ -379,7 +441,7 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT", "QUOTA"}
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -416,6 +478,16 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 }
 
 func (store *Storage) Close() error {
+	if store.metricsStop != nil {
+		close(store.metricsStop)
+	}
+	if store.retentionStop != nil {
+		close(store.retentionStop)
+	}
+	if store.quotaWebhookStop != nil {
+		store.quotaWebhookStop()
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
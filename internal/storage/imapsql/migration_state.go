@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+
+	"github.com/foxcpp/maddy/internal/imapmigrate"
+)
+
+// migrationStateMigrations are applied in order, the index+1 is the schema
+// version recorded in migration_schema.
+var migrationStateMigrations = []schemaMigration{
+	// 1: The last copied UID of each remote mailbox. source is "user@host"
+	// of the remote account.
+	{
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS migration_state (
+				username VARCHAR(255) NOT NULL,
+				source VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				uid_validity BIGINT NOT NULL,
+				last_uid BIGINT NOT NULL,
+				PRIMARY KEY (username, source, mailbox)
+			)`,
+		},
+		sqlite3: []string{
+			`CREATE TABLE IF NOT EXISTS migration_state (
+				username VARCHAR(255) NOT NULL,
+				source VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				uid_validity BIGINT NOT NULL,
+				last_uid BIGINT NOT NULL,
+				PRIMARY KEY (username, source, mailbox)
+			)`,
+		},
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS migration_state (
+				username VARCHAR(255) NOT NULL,
+				source VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				uid_validity BIGINT NOT NULL,
+				last_uid BIGINT NOT NULL,
+				PRIMARY KEY (username, source, mailbox)
+			)`,
+		},
+	},
+}
+
+// migrationState stores progress of IMAP migrations from the remote account
+// into the local one.
+type migrationState struct {
+	store    *Storage
+	username string
+	source   string
+}
+
+// MigrationState returns the migration progress of the account for the
+// source, usually "user@host" of the remote account.
+func (store *Storage) MigrationState(username, source string) imapmigrate.State {
+	return &migrationState{store: store, username: username, source: source}
+}
+
+// LastUID returns UIDVALIDITY and the last copied UID of the remote mailbox.
+// Zero values are returned if nothing was copied yet.
+func (ms *migrationState) LastUID(mailbox string) (uidValidity, uid uint32, err error) {
+	var validity, last int64
+	err = ms.store.Back.DB.QueryRow(ms.store.quotaSQL(`
+		SELECT uid_validity, last_uid FROM migration_state
+		WHERE username = $1 AND source = $2 AND mailbox = $3
+	`), ms.username, ms.source, mailbox).Scan(&validity, &last)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(validity), uint32(last), nil
+}
+
+// SetLastUID records the last copied UID of the remote mailbox.
+func (ms *migrationState) SetLastUID(mailbox string, uidValidity, uid uint32) error {
+	tx, err := ms.store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(ms.store.quotaSQL(`
+		DELETE FROM migration_state WHERE username = $1 AND source = $2 AND mailbox = $3
+	`), ms.username, ms.source, mailbox); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ms.store.quotaSQL(`
+		INSERT INTO migration_state (username, source, mailbox, uid_validity, last_uid)
+		VALUES ($1, $2, $3, $4, $5)
+	`), ms.username, ms.source, mailbox, int64(uidValidity), int64(uid)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteMigrationState removes progress of all migrations into the account.
+func (store *Storage) DeleteMigrationState(username string) error {
+	_, err := store.Back.DB.Exec(store.quotaSQL(`DELETE FROM migration_state WHERE username = $1`), username)
+	return err
+}
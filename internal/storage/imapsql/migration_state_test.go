@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"testing"
+)
+
+func TestMigrationState(t *testing.T) {
+	store := setupQuotaStorage(t)
+
+	check := func(state interface {
+		LastUID(string) (uint32, uint32, error)
+	}, mailbox string, validity, uid uint32) {
+		t.Helper()
+		v, u, err := state.LastUID(mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != validity || u != uid {
+			t.Errorf("%s: expected %d/%d, got %d/%d", mailbox, validity, uid, v, u)
+		}
+	}
+
+	state := store.MigrationState("user@example.org", "user@imap.example.net:993")
+	other := store.MigrationState("user@example.org", "other@imap.example.net:993")
+	check(state, "INBOX", 0, 0)
+
+	if err := state.SetLastUID("INBOX", 100, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetLastUID("INBOX", 100, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetLastUID("Sent", 200, 4000000000); err != nil {
+		t.Fatal(err)
+	}
+	check(state, "INBOX", 100, 7)
+	check(state, "Sent", 200, 4000000000)
+	check(other, "INBOX", 0, 0)
+
+	if err := store.DeleteMigrationState("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	check(state, "INBOX", 0, 0)
+}
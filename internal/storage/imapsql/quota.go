@@ -20,59 +20,268 @@ package imapsql
 
 import (
 	"database/sql"
+	"strings"
+	"time"
 
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
 )
 
-// CheckQuota verifies if the user has enough quota for a new message.
-// additionalBytes is the size of the incoming message (0 for pre-check).
-// Returns an SMTP error if quota is exceeded, nil otherwise.
-func (store *Storage) CheckQuota(username string, additionalBytes int64) error {
-	db := store.Back.DB
-
-	// Query current usage and effective quota
-	// Effective quota: user_quotas > domain_quotas > unlimited (0)
-	var usedBytes int64
-	var effectiveQuota int64
-
-	err := db.QueryRow(`
+// GetQuota returns the storage usage and the effective quota of the account.
+// Usage is read from quota_usage counters. Each limit is taken from
+// user_quotas, then domain_quotas, zero at either level means the limit is
+// inherited. Zero effective limit means unlimited.
+//
+// Nonexistent accounts have zero usage and no limits.
+func (store *Storage) GetQuota(username string) (module.Quota, error) {
+	var q module.Quota
+	domain := accountDomain(username)
+	err := store.Back.DB.QueryRow(store.quotaSQL(`
 		SELECT
-			COALESCE(SUM(m.bodylen), 0),
+			COALESCE(SUM(q.used_bytes), 0),
+			COALESCE(SUM(q.msg_count), 0),
+			COALESCE(
+				(SELECT NULLIF(quota_bytes, 0) FROM user_quotas WHERE username = $1),
+				(SELECT NULLIF(quota_bytes, 0) FROM domain_quotas WHERE domain = $2),
+				0
+			),
 			COALESCE(
-				(SELECT quota_bytes FROM user_quotas WHERE username = u.username),
-				(SELECT quota_bytes FROM domain_quotas
-				 WHERE domain = SUBSTRING(u.username FROM POSITION('@' IN u.username) + 1)),
+				(SELECT NULLIF(quota_messages, 0) FROM user_quotas WHERE username = $3),
+				(SELECT NULLIF(quota_messages, 0) FROM domain_quotas WHERE domain = $4),
 				0
 			)
 		FROM users u
 		LEFT JOIN mboxes mb ON mb.uid = u.id
-		LEFT JOIN msgs m ON m.mboxid = mb.id
-		WHERE u.username = $1
+		LEFT JOIN quota_usage q ON q.mboxid = mb.id
+		WHERE u.username = $5
 		GROUP BY u.id, u.username
-	`, username).Scan(&usedBytes, &effectiveQuota)
-
+	`), username, domain, username, domain, username).Scan(
+		&q.StorageUsed, &q.MessagesUsed, &q.StorageLimit, &q.MessagesLimit)
 	if err == sql.ErrNoRows {
-		// User doesn't exist yet, let other checks handle it
-		return nil
+		return module.Quota{}, nil
+	}
+	if err != nil {
+		return module.Quota{}, err
+	}
+	return q, nil
+}
+
+// MailboxUsage is the usage of a single mailbox as reported by
+// Storage.MailboxUsage.
+type MailboxUsage struct {
+	Name     string
+	Messages int64
+	Bytes    int64
+
+	// Effective caps of the mailbox, zero if not capped.
+	QuotaBytes    int64
+	QuotaMessages int64
+}
+
+// AccountUsage is the usage of a single account as reported by
+// Storage.DomainUsage.
+type AccountUsage struct {
+	Username  string
+	UsedBytes int64
+	// QuotaOverride is the per-account limit, if set.
+	QuotaOverride sql.NullInt64
+}
+
+// AccountExists reports whether the storage account exists.
+func (store *Storage) AccountExists(username string) (bool, error) {
+	var exists bool
+	err := store.Back.DB.QueryRow(store.quotaSQL(`SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)`), username).Scan(&exists)
+	return exists, err
+}
+
+// MailboxUsage returns usage and caps of each mailbox of the account,
+// sorted by name.
+func (store *Storage) MailboxUsage(username string) ([]MailboxUsage, error) {
+	caps, err := store.mailboxQuotas(username)
+	if err != nil {
+		return nil, err
+	}
+	var accountBytes int64
+	if len(caps) != 0 {
+		q, err := store.GetQuota(username)
+		if err != nil {
+			return nil, err
+		}
+		accountBytes = q.StorageLimit
 	}
+
+	rows, err := store.Back.DB.Query(store.quotaSQL(`
+		SELECT mb.name, COALESCE(q.msg_count, 0), COALESCE(q.used_bytes, 0)
+		FROM mboxes mb
+		LEFT JOIN quota_usage q ON q.mboxid = mb.id
+		WHERE mb.uid = (SELECT id FROM users WHERE username = $1)
+		ORDER BY mb.name
+	`), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []MailboxUsage
+	for rows.Next() {
+		var mu MailboxUsage
+		if err := rows.Scan(&mu.Name, &mu.Messages, &mu.Bytes); err != nil {
+			return nil, err
+		}
+		if mq, ok := caps[mu.Name]; ok {
+			mu.QuotaBytes, mu.QuotaMessages = mq.effective(accountBytes)
+		}
+		res = append(res, mu)
+	}
+	return res, rows.Err()
+}
+
+// DomainUsage returns usage of each account in the domain, sorted by
+// username.
+func (store *Storage) DomainUsage(domain string) ([]AccountUsage, error) {
+	rows, err := store.Back.DB.Query(store.quotaSQL(`
+		SELECT u.username, COALESCE(SUM(q.used_bytes), 0), uq.quota_bytes
+		FROM users u
+		LEFT JOIN mboxes mb ON mb.uid = u.id
+		LEFT JOIN quota_usage q ON q.mboxid = mb.id
+		LEFT JOIN user_quotas uq ON uq.username = u.username
+		WHERE u.username LIKE $1
+		GROUP BY u.id, u.username, uq.quota_bytes
+		ORDER BY u.username
+	`), "%@"+domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []AccountUsage
+	for rows.Next() {
+		var au AccountUsage
+		if err := rows.Scan(&au.Username, &au.UsedBytes, &au.QuotaOverride); err != nil {
+			return nil, err
+		}
+		res = append(res, au)
+	}
+	return res, rows.Err()
+}
+
+func accountDomain(username string) string {
+	_, domain, ok := strings.Cut(username, "@")
+	if !ok {
+		return ""
+	}
+	return domain
+}
+
+// CheckQuota verifies if the user has enough quota for a new message.
+// additionalBytes is the size of the incoming message (0 for pre-check).
+// Returns an SMTP error if quota is exceeded, nil otherwise.
+func (store *Storage) CheckQuota(username string, additionalBytes int64) error {
+	q, err := store.GetQuota(username)
 	if err != nil {
 		store.Log.Error("quota check failed", err, "username", username)
 		return err
 	}
 
 	// 0 means unlimited
-	if effectiveQuota == 0 {
-		return nil
+	if (q.StorageLimit != 0 && q.StorageUsed+additionalBytes > q.StorageLimit) ||
+		(q.MessagesLimit != 0 && q.MessagesUsed+1 > q.MessagesLimit) {
+		publishQuotaExceeded(username, "", q, additionalBytes)
+		return quotaExceeded("Mailbox quota exceeded")
 	}
 
-	if usedBytes+additionalBytes > effectiveQuota {
-		return &exterrors.SMTPError{
-			Code:         552,
-			EnhancedCode: exterrors.EnhancedCode{5, 2, 2},
-			Message:      "Mailbox quota exceeded",
-			TargetName:   "imapsql",
+	return nil
+}
+
+// publishQuotaExceeded publishes the quota.exceeded event for the rejected
+// message. mailbox is empty if the account quota is exceeded.
+func publishQuotaExceeded(username, mailbox string, q module.Quota, size int64) {
+	if !events.Enabled() {
+		return
+	}
+	data := map[string]interface{}{
+		"username":      username,
+		"size":          size,
+		"usedBytes":     q.StorageUsed,
+		"quotaBytes":    q.StorageLimit,
+		"messagesUsed":  q.MessagesUsed,
+		"messagesQuota": q.MessagesLimit,
+	}
+	if mailbox != "" {
+		data["mailbox"] = mailbox
+	}
+	events.Publish(events.QuotaExceeded, data)
+}
+
+func quotaExceeded(msg string) error {
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 2, 2},
+		Message:      msg,
+		TargetName:   "imapsql",
+	}
+}
+
+// domainUsageTotals returns storage used by accounts of each domain.
+func (store *Storage) domainUsageTotals() (map[string]int64, error) {
+	rows, err := store.Back.DB.Query(`
+		SELECT u.username, COALESCE(SUM(q.used_bytes), 0)
+		FROM users u
+		LEFT JOIN mboxes mb ON mb.uid = u.id
+		LEFT JOIN quota_usage q ON q.mboxid = mb.id
+		GROUP BY u.id, u.username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]int64{}
+	for rows.Next() {
+		var (
+			username string
+			used     int64
+		)
+		if err := rows.Scan(&username, &used); err != nil {
+			return nil, err
 		}
+		totals[accountDomain(username)] += used
 	}
+	return totals, rows.Err()
+}
 
-	return nil
+// updateUsageMetrics refreshes the per-domain usage gauge every interval
+// until stop is closed.
+func (store *Storage) updateUsageMetrics(interval time.Duration, stop <-chan struct{}) {
+	known := map[string]bool{}
+	update := func() {
+		totals, err := store.domainUsageTotals()
+		if err != nil {
+			store.Log.Error("failed to update domain usage metrics", err)
+			return
+		}
+		for domain := range known {
+			if _, ok := totals[domain]; !ok {
+				domainUsedBytes.DeleteLabelValues(store.instName, domain)
+				delete(known, domain)
+			}
+		}
+		for domain, used := range totals {
+			domainUsedBytes.WithLabelValues(store.instName, domain).Set(float64(used))
+			known[domain] = true
+		}
+	}
+
+	update()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			update()
+		case <-stop:
+			return
+		}
+	}
 }
@@ -0,0 +1,352 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	quotaScopeUser   = "user"
+	quotaScopeDomain = "domain"
+)
+
+// QuotaSettings are limits configured for an account or a domain. Zero
+// values mean the limit is not set at this level.
+type QuotaSettings struct {
+	Bytes     int64
+	Messages  int64
+	Mailboxes []MailboxQuota
+}
+
+// MailboxQuota is a cap on a single mailbox, in addition to the account
+// quota. Bytes takes precedence over Percent, which is relative to the
+// effective account byte quota.
+type MailboxQuota struct {
+	Mailbox  string
+	Bytes    int64
+	Percent  int64
+	Messages int64
+}
+
+// effective returns the byte and message caps of the mailbox.
+func (mq MailboxQuota) effective(accountBytes int64) (bytes, messages int64) {
+	bytes = mq.Bytes
+	if bytes == 0 && mq.Percent > 0 {
+		bytes = accountBytes * mq.Percent / 100
+	}
+	return bytes, mq.Messages
+}
+
+func (s QuotaSettings) validate() error {
+	if s.Bytes < 0 || s.Messages < 0 {
+		return fmt.Errorf("quota: negative limit")
+	}
+	seen := make(map[string]bool, len(s.Mailboxes))
+	for _, mq := range s.Mailboxes {
+		if mq.Mailbox == "" {
+			return fmt.Errorf("quota: empty mailbox name")
+		}
+		if seen[mq.Mailbox] {
+			return fmt.Errorf("quota: duplicate mailbox: %s", mq.Mailbox)
+		}
+		seen[mq.Mailbox] = true
+		if mq.Bytes < 0 || mq.Messages < 0 || mq.Percent < 0 || mq.Percent > 100 {
+			return fmt.Errorf("quota: invalid limit for mailbox %s", mq.Mailbox)
+		}
+	}
+	return nil
+}
+
+func (store *Storage) quotaSettings(table, keyColumn, scope, key string) (QuotaSettings, bool, error) {
+	var s QuotaSettings
+	err := store.Back.DB.QueryRow(store.quotaSQL(`SELECT quota_bytes, quota_messages FROM `+table+` WHERE `+keyColumn+` = $1`), key).
+		Scan(&s.Bytes, &s.Messages)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return s, false, err
+	}
+
+	rows, err := store.Back.DB.Query(store.quotaSQL(`
+		SELECT mailbox, quota_bytes, quota_percent, quota_messages
+		FROM mailbox_quotas
+		WHERE scope = $1 AND name = $2
+		ORDER BY mailbox
+	`), scope, key)
+	if err != nil {
+		return s, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mq MailboxQuota
+		if err := rows.Scan(&mq.Mailbox, &mq.Bytes, &mq.Percent, &mq.Messages); err != nil {
+			return s, false, err
+		}
+		s.Mailboxes = append(s.Mailboxes, mq)
+		exists = true
+	}
+	return s, exists, rows.Err()
+}
+
+func (store *Storage) setQuotaSettings(table, keyColumn, scope, key string, s QuotaSettings) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := store.setQuotaSettingsTx(tx, table, keyColumn, scope, key, s); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *Storage) setQuotaSettingsTx(tx *sql.Tx, table, keyColumn, scope, key string, s QuotaSettings) error {
+	if _, err := tx.Exec(store.quotaUpsertSQL(table, keyColumn), key, s.Bytes, s.Messages); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.quotaSQL(`DELETE FROM mailbox_quotas WHERE scope = $1 AND name = $2`), scope, key); err != nil {
+		return err
+	}
+	for _, mq := range s.Mailboxes {
+		if _, err := tx.Exec(store.quotaSQL(`
+			INSERT INTO mailbox_quotas (scope, name, mailbox, quota_bytes, quota_percent, quota_messages)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`), scope, key, mq.Mailbox, mq.Bytes, mq.Percent, mq.Messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *Storage) deleteQuotaSettings(table, keyColumn, scope, key string) error {
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := store.deleteQuotaSettingsTx(tx, table, keyColumn, scope, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *Storage) deleteQuotaSettingsTx(tx *sql.Tx, table, keyColumn, scope, key string) error {
+	if _, err := tx.Exec(store.quotaSQL(`DELETE FROM `+table+` WHERE `+keyColumn+` = $1`), key); err != nil {
+		return err
+	}
+	_, err := tx.Exec(store.quotaSQL(`DELETE FROM mailbox_quotas WHERE scope = $1 AND name = $2`), scope, key)
+	return err
+}
+
+// UserQuota returns limits set for the account. The second return value is
+// false if the account has no own limits.
+func (store *Storage) UserQuota(username string) (QuotaSettings, bool, error) {
+	return store.quotaSettings("user_quotas", "username", quotaScopeUser, username)
+}
+
+// SetUserQuota replaces limits of the account, overriding the domain ones.
+func (store *Storage) SetUserQuota(username string, s QuotaSettings) error {
+	return store.setQuotaSettings("user_quotas", "username", quotaScopeUser, username, s)
+}
+
+// DeleteUserQuota removes limits of the account.
+func (store *Storage) DeleteUserQuota(username string) error {
+	return store.deleteQuotaSettings("user_quotas", "username", quotaScopeUser, username)
+}
+
+// DomainQuota returns limits applied to accounts of the domain. The second
+// return value is false if the domain has no limits.
+func (store *Storage) DomainQuota(domain string) (QuotaSettings, bool, error) {
+	return store.quotaSettings("domain_quotas", "domain", quotaScopeDomain, domain)
+}
+
+// SetDomainQuota replaces limits applied to accounts of the domain.
+func (store *Storage) SetDomainQuota(domain string, s QuotaSettings) error {
+	return store.setQuotaSettings("domain_quotas", "domain", quotaScopeDomain, domain, s)
+}
+
+// DeleteDomainQuota removes limits of the domain.
+func (store *Storage) DeleteDomainQuota(domain string) error {
+	return store.deleteQuotaSettings("domain_quotas", "domain", quotaScopeDomain, domain)
+}
+
+// AddDomainSettings sets limits of the new domain (none if s is nil). If fn
+// is not nil, it is run in the same transaction before the commit, callers
+// use it to add their own rows (e.g. the domain registry entry) atomically
+// with the settings.
+func (store *Storage) AddDomainSettings(domain string, s *QuotaSettings, fn func(tx *sql.Tx) error) error {
+	if s != nil {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if fn != nil {
+		if err := fn(tx); err != nil {
+			return err
+		}
+	}
+	if s != nil {
+		if err := store.setQuotaSettingsTx(tx, "domain_quotas", "domain", quotaScopeDomain, domain, *s); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteUserSettings removes limits, retention rules and migration state of
+// the account in a single transaction, so a re-created account with the same
+// name does not inherit them.
+func (store *Storage) DeleteUserSettings(username string) error {
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := store.deleteUserSettingsTx(tx, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *Storage) deleteUserSettingsTx(tx *sql.Tx, username string) error {
+	if err := store.deleteQuotaSettingsTx(tx, "user_quotas", "username", quotaScopeUser, username); err != nil {
+		return err
+	}
+	if err := store.deleteRetentionRulesTx(tx, retentionScopeUser, username); err != nil {
+		return err
+	}
+	_, err := tx.Exec(store.quotaSQL(`DELETE FROM migration_state WHERE username = $1`), username)
+	return err
+}
+
+// DeleteDomainSettings removes limits and retention rules of the domain and
+// limits, retention rules and migration state of the listed accounts in a
+// single transaction. If fn is not nil, it is run in the same transaction
+// before the commit, callers use it to remove their own rows (e.g. the
+// domain registry entry) atomically with the settings.
+func (store *Storage) DeleteDomainSettings(domain string, usernames []string, fn func(tx *sql.Tx) error) error {
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, username := range usernames {
+		if err := store.deleteUserSettingsTx(tx, username); err != nil {
+			return err
+		}
+	}
+	if err := store.deleteQuotaSettingsTx(tx, "domain_quotas", "domain", quotaScopeDomain, domain); err != nil {
+		return err
+	}
+	if err := store.deleteRetentionRulesTx(tx, retentionScopeDomain, domain); err != nil {
+		return err
+	}
+	if fn != nil {
+		if err := fn(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// mailboxQuotas returns caps of each capped mailbox of the account. Caps
+// set for the account replace domain caps of the same mailbox.
+func (store *Storage) mailboxQuotas(username string) (map[string]MailboxQuota, error) {
+	domain, _, err := store.DomainQuota(accountDomain(username))
+	if err != nil {
+		return nil, err
+	}
+	user, _, err := store.UserQuota(username)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := make(map[string]MailboxQuota, len(domain.Mailboxes)+len(user.Mailboxes))
+	for _, mq := range domain.Mailboxes {
+		caps[mq.Mailbox] = mq
+	}
+	for _, mq := range user.Mailboxes {
+		caps[mq.Mailbox] = mq
+	}
+	return caps, nil
+}
+
+// GetMailboxQuota returns usage and caps of the mailbox. Zero limits mean
+// the mailbox is limited only by the account quota.
+func (store *Storage) GetMailboxQuota(username, mailbox string) (module.Quota, error) {
+	caps, err := store.mailboxQuotas(username)
+	if err != nil {
+		return module.Quota{}, err
+	}
+
+	var q module.Quota
+	if mq, ok := caps[mailbox]; ok {
+		account, err := store.GetQuota(username)
+		if err != nil {
+			return module.Quota{}, err
+		}
+		q.StorageLimit, q.MessagesLimit = mq.effective(account.StorageLimit)
+	}
+
+	err = store.Back.DB.QueryRow(store.quotaSQL(`
+		SELECT COALESCE(q.used_bytes, 0), COALESCE(q.msg_count, 0)
+		FROM mboxes mb
+		LEFT JOIN quota_usage q ON q.mboxid = mb.id
+		WHERE mb.uid = (SELECT id FROM users WHERE username = $1) AND mb.name = $2
+	`), username, mailbox).Scan(&q.StorageUsed, &q.MessagesUsed)
+	if err != nil && err != sql.ErrNoRows {
+		return module.Quota{}, err
+	}
+	return q, nil
+}
+
+// CheckMailboxQuota verifies if the mailbox cap allows a new message of the
+// specified size. Returns an SMTP error if the cap is exceeded.
+func (store *Storage) CheckMailboxQuota(username, mailbox string, additionalBytes int64) error {
+	q, err := store.GetMailboxQuota(username, mailbox)
+	if err != nil {
+		store.Log.Error("mailbox quota check failed", err, "username", username, "mailbox", mailbox)
+		return err
+	}
+
+	if (q.StorageLimit != 0 && q.StorageUsed+additionalBytes > q.StorageLimit) ||
+		(q.MessagesLimit != 0 && q.MessagesUsed+1 > q.MessagesLimit) {
+		publishQuotaExceeded(username, mailbox, q, additionalBytes)
+		return quotaExceeded("Mailbox folder quota exceeded")
+	}
+	return nil
+}
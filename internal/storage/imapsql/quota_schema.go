@@ -0,0 +1,297 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/sqldialect"
+)
+
+// quotaMigrations are applied in order, the index+1 is the schema version
+// recorded in quota_schema.
+var quotaMigrations = []schemaMigration{
+	// 1: Quota limits. Tables might already exist if they were created by
+	// older versions of the REST API.
+	{
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS domain_quotas (
+				id BIGSERIAL PRIMARY KEY,
+				domain VARCHAR(255) NOT NULL UNIQUE,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_quotas (
+				id BIGSERIAL PRIMARY KEY,
+				username VARCHAR(255) NOT NULL UNIQUE,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+		},
+		sqlite3: []string{
+			`CREATE TABLE IF NOT EXISTS domain_quotas (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				domain VARCHAR(255) NOT NULL UNIQUE,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_quotas (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username VARCHAR(255) NOT NULL UNIQUE,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+		},
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS domain_quotas (
+				id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				domain VARCHAR(255) NOT NULL UNIQUE,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_quotas (
+				id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				username VARCHAR(255) NOT NULL UNIQUE,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+		},
+	},
+
+	// 2: Per-mailbox usage counters maintained by triggers on msgs, so they
+	// are updated in the same transaction as the go-imap-sql change itself
+	// (delivery, APPEND, COPY, expunge). Counters of removed mailboxes and
+	// accounts are removed by ON DELETE CASCADE. The last statement fills
+	// the counters from existing messages.
+	{
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS quota_usage (
+				mboxid BIGINT PRIMARY KEY REFERENCES mboxes(id) ON DELETE CASCADE,
+				used_bytes BIGINT NOT NULL DEFAULT 0,
+				msg_count BIGINT NOT NULL DEFAULT 0
+			)`,
+			`CREATE OR REPLACE FUNCTION quota_usage_update() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP = 'INSERT' THEN
+					INSERT INTO quota_usage (mboxid, used_bytes, msg_count)
+					VALUES (NEW.mboxid, NEW.bodylen, 1)
+					ON CONFLICT (mboxid) DO UPDATE SET
+						used_bytes = quota_usage.used_bytes + EXCLUDED.used_bytes,
+						msg_count = quota_usage.msg_count + 1;
+					RETURN NEW;
+				END IF;
+				UPDATE quota_usage SET
+					used_bytes = used_bytes - OLD.bodylen,
+					msg_count = msg_count - 1
+				WHERE mboxid = OLD.mboxid;
+				RETURN OLD;
+			END
+			$$ LANGUAGE plpgsql`,
+			`DROP TRIGGER IF EXISTS quota_usage_msgs ON msgs`,
+			// Trigger creation locks msgs for writes until commit so the
+			// initial values are exact.
+			`CREATE TRIGGER quota_usage_msgs
+				AFTER INSERT OR DELETE ON msgs
+				FOR EACH ROW EXECUTE PROCEDURE quota_usage_update()`,
+			`DELETE FROM quota_usage`,
+			`INSERT INTO quota_usage (mboxid, used_bytes, msg_count)
+				SELECT mb.id, COALESCE(SUM(m.bodylen), 0), COUNT(m.msgid)
+				FROM mboxes mb
+				LEFT JOIN msgs m ON m.mboxid = mb.id
+				GROUP BY mb.id`,
+		},
+		sqlite3: []string{
+			`CREATE TABLE IF NOT EXISTS quota_usage (
+				mboxid BIGINT PRIMARY KEY REFERENCES mboxes(id) ON DELETE CASCADE,
+				used_bytes BIGINT NOT NULL DEFAULT 0,
+				msg_count BIGINT NOT NULL DEFAULT 0
+			)`,
+			`CREATE TRIGGER IF NOT EXISTS quota_usage_msgs_insert
+			AFTER INSERT ON msgs
+			BEGIN
+				INSERT INTO quota_usage (mboxid, used_bytes, msg_count)
+				VALUES (NEW.mboxid, NEW.bodylen, 1)
+				ON CONFLICT (mboxid) DO UPDATE SET
+					used_bytes = used_bytes + excluded.used_bytes,
+					msg_count = msg_count + 1;
+			END`,
+			`CREATE TRIGGER IF NOT EXISTS quota_usage_msgs_delete
+			AFTER DELETE ON msgs
+			BEGIN
+				UPDATE quota_usage SET
+					used_bytes = used_bytes - OLD.bodylen,
+					msg_count = msg_count - 1
+				WHERE mboxid = OLD.mboxid;
+			END`,
+			`DELETE FROM quota_usage`,
+			`INSERT INTO quota_usage (mboxid, used_bytes, msg_count)
+				SELECT mb.id, COALESCE(SUM(m.bodylen), 0), COUNT(m.msgid)
+				FROM mboxes mb
+				LEFT JOIN msgs m ON m.mboxid = mb.id
+				GROUP BY mb.id`,
+		},
+		// MySQL ignores inline REFERENCES, hence the table-level FOREIGN KEY.
+		// Cascaded deletes do not fire triggers there, which is fine since
+		// the counters are removed by the cascade too.
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS quota_usage (
+				mboxid BIGINT NOT NULL PRIMARY KEY,
+				used_bytes BIGINT NOT NULL DEFAULT 0,
+				msg_count BIGINT NOT NULL DEFAULT 0,
+				FOREIGN KEY (mboxid) REFERENCES mboxes(id) ON DELETE CASCADE
+			)`,
+			`DROP TRIGGER IF EXISTS quota_usage_msgs_insert`,
+			`CREATE TRIGGER quota_usage_msgs_insert
+				AFTER INSERT ON msgs FOR EACH ROW
+				INSERT INTO quota_usage (mboxid, used_bytes, msg_count)
+				VALUES (NEW.mboxId, NEW.bodyLen, 1)
+				ON DUPLICATE KEY UPDATE
+					used_bytes = used_bytes + VALUES(used_bytes),
+					msg_count = msg_count + 1`,
+			`DROP TRIGGER IF EXISTS quota_usage_msgs_delete`,
+			`CREATE TRIGGER quota_usage_msgs_delete
+				AFTER DELETE ON msgs FOR EACH ROW
+				UPDATE quota_usage SET
+					used_bytes = used_bytes - OLD.bodyLen,
+					msg_count = msg_count - 1
+				WHERE mboxid = OLD.mboxId`,
+			`DELETE FROM quota_usage`,
+			`INSERT INTO quota_usage (mboxid, used_bytes, msg_count)
+				SELECT mb.id, COALESCE(SUM(m.bodyLen), 0), COUNT(m.msgId)
+				FROM mboxes mb
+				LEFT JOIN msgs m ON m.mboxId = mb.id
+				GROUP BY mb.id`,
+		},
+	},
+
+	// 3: Usage thresholds already reported to the account.
+	{
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS quota_warnings (
+				username VARCHAR(255) NOT NULL,
+				threshold INTEGER NOT NULL,
+				sent_at BIGINT NOT NULL,
+				PRIMARY KEY (username, threshold)
+			)`,
+		},
+		sqlite3: []string{
+			`CREATE TABLE IF NOT EXISTS quota_warnings (
+				username VARCHAR(255) NOT NULL,
+				threshold INTEGER NOT NULL,
+				sent_at BIGINT NOT NULL,
+				PRIMARY KEY (username, threshold)
+			)`,
+		},
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS quota_warnings (
+				username VARCHAR(255) NOT NULL,
+				threshold INTEGER NOT NULL,
+				sent_at BIGINT NOT NULL,
+				PRIMARY KEY (username, threshold)
+			)`,
+		},
+	},
+
+	// 4: Message count limits and per-mailbox caps. scope is "user" or
+	// "domain", name is the account or the domain.
+	{
+		columns: []schemaColumn{
+			{table: "user_quotas", name: "quota_messages", definition: "BIGINT NOT NULL DEFAULT 0"},
+			{table: "domain_quotas", name: "quota_messages", definition: "BIGINT NOT NULL DEFAULT 0"},
+		},
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS mailbox_quotas (
+				scope VARCHAR(16) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				quota_percent INTEGER NOT NULL DEFAULT 0,
+				quota_messages BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (scope, name, mailbox)
+			)`,
+		},
+		sqlite3: []string{
+			`CREATE TABLE IF NOT EXISTS mailbox_quotas (
+				scope VARCHAR(16) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				quota_percent INTEGER NOT NULL DEFAULT 0,
+				quota_messages BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (scope, name, mailbox)
+			)`,
+		},
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS mailbox_quotas (
+				scope VARCHAR(16) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				quota_bytes BIGINT NOT NULL DEFAULT 0,
+				quota_percent INTEGER NOT NULL DEFAULT 0,
+				quota_messages BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (scope, name, mailbox)
+			)`,
+		},
+	},
+}
+
+// quotaSQL adapts a query written for PostgreSQL to the driver in use.
+//
+// Placeholders are replaced with '?' for MySQL, so each $N must be used
+// exactly once and in order.
+func (store *Storage) quotaSQL(query string) string {
+	switch store.driver {
+	case "mysql":
+		query = sqldialect.Rebind(store.driver, query)
+		if strings.Contains(query, "ON CONFLICT DO NOTHING") {
+			query = strings.Replace(query, "ON CONFLICT DO NOTHING", "", 1)
+			query = strings.Replace(query, "INSERT", "INSERT IGNORE", 1)
+		}
+	case "sqlite3", "sqlite":
+		// SQLite locks the whole database for writes.
+		query = strings.Replace(query, "FOR UPDATE", "", 1)
+	}
+	return query
+}
+
+// quotaUpsertSQL returns the statement that sets limits of the row with the
+// specified key, creating it if needed. Arguments are the key, quota_bytes
+// and quota_messages.
+func (store *Storage) quotaUpsertSQL(table, keyColumn string) string {
+	if store.driver == "mysql" {
+		return `INSERT INTO ` + table + ` (` + keyColumn + `, quota_bytes, quota_messages, updated_at)
+			VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+			ON DUPLICATE KEY UPDATE
+				quota_bytes = VALUES(quota_bytes),
+				quota_messages = VALUES(quota_messages),
+				updated_at = CURRENT_TIMESTAMP`
+	}
+	return `INSERT INTO ` + table + ` (` + keyColumn + `, quota_bytes, quota_messages, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (` + keyColumn + `) DO UPDATE SET
+			quota_bytes = EXCLUDED.quota_bytes,
+			quota_messages = EXCLUDED.quota_messages,
+			updated_at = CURRENT_TIMESTAMP`
+}
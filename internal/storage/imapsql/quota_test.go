@@ -0,0 +1,686 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/endpoint/eventsink"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const quotaTestMsg = "Subject: Test\r\n\r\nHello, world!\r\n"
+
+func setupQuotaStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	store, _ := setupQuotaStorageDir(t)
+	return store
+}
+
+// setupQuotaStorageDir is setupQuotaStorage that also returns the directory
+// with message blobs.
+func setupQuotaStorageDir(t *testing.T) (*Storage, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := imapsql.New("sqlite3", filepath.Join(dir, "imapsql.db"), &imapsql.FSStore{Root: filepath.Join(dir, "messages")}, imapsql.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &Storage{
+		Back:   db,
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+	}
+	if err := store.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+	return store, filepath.Join(dir, "messages")
+}
+
+func appendQuotaTestMsg(t *testing.T, store *Storage, username, mbox string) {
+	t.Helper()
+
+	u, err := store.Back.GetOrCreateUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMessage(mbox, nil, time.Now(), bytes.NewBufferString(quotaTestMsg), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkQuota(t *testing.T, store *Storage, username string, expected module.Quota) {
+	t.Helper()
+
+	q, err := store.GetQuota(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != expected {
+		t.Errorf("GetQuota(%s) = %+v, want %+v", username, q, expected)
+	}
+}
+
+func TestQuotaSchema_Idempotent(t *testing.T) {
+	store := setupQuotaStorage(t)
+	if err := store.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, migrations := range map[string][]schemaMigration{
+		"quota_schema":     quotaMigrations,
+		"retention_schema": retentionMigrations,
+		"migration_schema": migrationStateMigrations,
+	} {
+		var version, count int
+		if err := store.Back.DB.QueryRow(`SELECT MAX(version), COUNT(*) FROM `+table).Scan(&version, &count); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(migrations) || count != len(migrations) {
+			t.Errorf("%s: schema version %d (%d rows), want %d", table, version, count, len(migrations))
+		}
+	}
+}
+
+func TestQuotaSchema_Retry(t *testing.T) {
+	store := setupQuotaStorage(t)
+
+	// Columns added by version 4 are left in place as if the migration was
+	// interrupted after implicit DDL commits on MySQL.
+	if _, err := store.Back.DB.Exec(`DELETE FROM quota_schema WHERE version = 4`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	if err := store.Back.DB.QueryRow(`SELECT MAX(version) FROM quota_schema`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(quotaMigrations) {
+		t.Errorf("schema version %d, want %d", version, len(quotaMigrations))
+	}
+}
+
+func TestQuota_Usage(t *testing.T) {
+	store := setupQuotaStorage(t)
+	size := int64(len(quotaTestMsg))
+
+	checkQuota(t, store, "nonexistent@example.org", module.Quota{})
+
+	appendQuotaTestMsg(t, store, "user@example.org", "INBOX")
+	appendQuotaTestMsg(t, store, "user@example.org", "INBOX")
+	checkQuota(t, store, "user@example.org", module.Quota{
+		StorageUsed:  2 * size,
+		MessagesUsed: 2,
+	})
+
+	u, err := store.Back.GetOrCreateUser("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1")
+	if err := mbox.CopyMessages(false, seq, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, store, "user@example.org", module.Quota{
+		StorageUsed:  3 * size,
+		MessagesUsed: 3,
+	})
+
+	if err := mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, store, "user@example.org", module.Quota{
+		StorageUsed:  2 * size,
+		MessagesUsed: 2,
+	})
+
+	usage, err := store.MailboxUsage("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[0] != (MailboxUsage{Name: "Archive", Messages: 1, Bytes: size}) || usage[1] != (MailboxUsage{Name: "INBOX", Messages: 1, Bytes: size}) {
+		t.Errorf("unexpected mailbox usage: %+v", usage)
+	}
+
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, store, "user@example.org", module.Quota{
+		StorageUsed:  size,
+		MessagesUsed: 1,
+	})
+
+	// Break the counters and restore them.
+	if _, err := store.Back.DB.Exec(`UPDATE quota_usage SET used_bytes = 0, msg_count = 100`); err != nil {
+		t.Fatal(err)
+	}
+	q, err := store.RecomputeQuotaUsage("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != (module.Quota{StorageUsed: size, MessagesUsed: 1}) {
+		t.Errorf("RecomputeQuotaUsage = %+v", q)
+	}
+
+	if err := store.DeleteIMAPAcct("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := store.Back.DB.QueryRow(`SELECT COUNT(*) FROM quota_usage`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("%d quota_usage rows left after account removal", rows)
+	}
+}
+
+func TestQuota_Limits(t *testing.T) {
+	store := setupQuotaStorage(t)
+	size := int64(len(quotaTestMsg))
+
+	appendQuotaTestMsg(t, store, "a@example.org", "INBOX")
+	appendQuotaTestMsg(t, store, "b@example.org", "INBOX")
+	appendQuotaTestMsg(t, store, "c@example.com", "INBOX")
+
+	if err := store.SetDomainQuota("example.org", QuotaSettings{Bytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	// Second call updates the existing row.
+	if err := store.SetDomainQuota("example.org", QuotaSettings{Bytes: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserQuota("b@example.org", QuotaSettings{Bytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkQuota(t, store, "a@example.org", module.Quota{StorageUsed: size, StorageLimit: 2000, MessagesUsed: 1})
+	checkQuota(t, store, "b@example.org", module.Quota{StorageUsed: size, StorageLimit: 10, MessagesUsed: 1})
+	checkQuota(t, store, "c@example.com", module.Quota{StorageUsed: size, MessagesUsed: 1})
+
+	if err := store.CheckQuota("a@example.org", 100); err != nil {
+		t.Errorf("CheckQuota within limit: %v", err)
+	}
+	if err := store.CheckQuota("b@example.org", 100); err == nil {
+		t.Error("CheckQuota over limit succeeded")
+	}
+
+	user, ok, err := store.UserQuota("b@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || user.Bytes != 10 {
+		t.Errorf("UserQuota = %+v, %v", user, ok)
+	}
+	domain, ok, err := store.DomainQuota("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || domain.Bytes != 2000 {
+		t.Errorf("DomainQuota = %+v, %v", domain, ok)
+	}
+
+	usage, err := store.DomainUsage("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[0].Username != "a@example.org" || usage[0].QuotaOverride.Valid ||
+		usage[1].Username != "b@example.org" || usage[1].QuotaOverride.Int64 != 10 || usage[1].UsedBytes != size {
+		t.Errorf("unexpected domain usage: %+v", usage)
+	}
+
+	if err := store.DeleteUserQuota("b@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteDomainQuota("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, store, "b@example.org", module.Quota{StorageUsed: size, MessagesUsed: 1})
+}
+
+func TestDeleteDomainSettings(t *testing.T) {
+	store := setupQuotaStorage(t)
+	const username = "user@example.org"
+
+	if err := store.SetDomainQuota("example.org", QuotaSettings{Bytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserQuota(username, QuotaSettings{
+		Bytes:     2000,
+		Mailboxes: []MailboxQuota{{Mailbox: "Junk", Messages: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDomainRetention("example.org", []RetentionRule{{Mailbox: "Trash", MaxAge: time.Hour}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserRetention(username, []RetentionRule{{Mailbox: "Junk", MaxAge: time.Hour}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MigrationState(username, "user@imap.example.net").SetLastUID("INBOX", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(table string) int {
+		t.Helper()
+		var n int
+		if err := store.Back.DB.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tables := []string{"user_quotas", "domain_quotas", "mailbox_quotas", "retention_rules", "migration_state"}
+
+	// Everything is kept if the caller fails.
+	errFail := errors.New("fail")
+	if err := store.DeleteDomainSettings("example.org", []string{username}, func(tx *sql.Tx) error {
+		return errFail
+	}); !errors.Is(err, errFail) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+	for _, table := range tables {
+		if count(table) == 0 {
+			t.Errorf("%s: rows deleted despite the rollback", table)
+		}
+	}
+
+	if err := store.DeleteDomainSettings("example.org", []string{username}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if n := count(table); n != 0 {
+			t.Errorf("%s: %d rows left", table, n)
+		}
+	}
+}
+
+func TestDeleteUserSettings(t *testing.T) {
+	store := setupQuotaStorage(t)
+	const (
+		username = "user@example.org"
+		other    = "other@example.org"
+	)
+
+	for _, u := range []string{username, other} {
+		if err := store.SetUserQuota(u, QuotaSettings{
+			Bytes:     2000,
+			Mailboxes: []MailboxQuota{{Mailbox: "Junk", Messages: 1}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetUserRetention(u, []RetentionRule{{Mailbox: "Junk", MaxAge: time.Hour}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.MigrationState(u, "user@imap.example.net").SetLastUID("INBOX", 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetDomainQuota("example.org", QuotaSettings{Bytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteUserSettings(username); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(query string, args ...interface{}) int {
+		t.Helper()
+		var n int
+		if err := store.Back.DB.QueryRow(store.quotaSQL(query), args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, u := range []string{username, other} {
+		want := 1
+		if u == username {
+			want = 0
+		}
+		for _, query := range []string{
+			`SELECT COUNT(*) FROM user_quotas WHERE username = $1`,
+			`SELECT COUNT(*) FROM mailbox_quotas WHERE name = $1`,
+			`SELECT COUNT(*) FROM retention_rules WHERE name = $1`,
+			`SELECT COUNT(*) FROM migration_state WHERE username = $1`,
+		} {
+			if n := count(query, u); n != want {
+				t.Errorf("%s: %s: %d rows, want %d", u, query, n, want)
+			}
+		}
+	}
+	if _, exists, err := store.DomainQuota("example.org"); err != nil || !exists {
+		t.Fatal("domain quota should be kept:", exists, err)
+	}
+}
+
+func TestAddDomainSettings(t *testing.T) {
+	store := setupQuotaStorage(t)
+
+	// Nothing is stored if the caller fails.
+	errFail := errors.New("fail")
+	if err := store.AddDomainSettings("example.org", &QuotaSettings{Bytes: 1000}, func(tx *sql.Tx) error {
+		return errFail
+	}); !errors.Is(err, errFail) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+	if _, exists, err := store.DomainQuota("example.org"); err != nil || exists {
+		t.Fatalf("quota stored despite the rollback: %v, %v", exists, err)
+	}
+
+	if err := store.AddDomainSettings("example.org", &QuotaSettings{Bytes: 1000}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s, _, err := store.DomainQuota("example.org"); err != nil || s.Bytes != 1000 {
+		t.Fatalf("wrong quota: %+v, %v", s, err)
+	}
+
+	if err := store.AddDomainSettings("example.com", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := store.DomainQuota("example.com"); err != nil || exists {
+		t.Fatalf("quota stored for nil settings: %v, %v", exists, err)
+	}
+}
+
+func TestQuotaSQL(t *testing.T) {
+	mysql := &Storage{driver: "mysql"}
+	if q := mysql.quotaSQL(`SELECT a FROM b WHERE c = $1 AND d = $2`); q != `SELECT a FROM b WHERE c = ? AND d = ?` {
+		t.Errorf("unexpected query: %s", q)
+	}
+	if q := mysql.quotaSQL(`INSERT INTO a (b) VALUES ($1) ON CONFLICT DO NOTHING`); q != `INSERT IGNORE INTO a (b) VALUES (?) ` {
+		t.Errorf("unexpected query: %s", q)
+	}
+
+	pg := &Storage{driver: "postgres"}
+	if q := pg.quotaSQL(`SELECT a FROM b WHERE c = $1 FOR UPDATE`); q != `SELECT a FROM b WHERE c = $1 FOR UPDATE` {
+		t.Errorf("unexpected query: %s", q)
+	}
+}
+
+func TestQuotaWarning(t *testing.T) {
+	store := setupQuotaStorage(t)
+
+	received := make(chan events.Event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev events.Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	var err error
+	store.quotaWarnings, err = newQuotaWarnings([]string{"50%", "90"}, "", "mx.example.org",
+		defaultQuotaWarningSubject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, err := eventsink.SubscribeWebhook(srv.URL, []string{events.QuotaWarning}, store.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// Not sent to the webhook.
+	events.Publish(events.QuotaExceeded, nil)
+
+	const username = "user@example.org"
+	msg := "Subject: Test\r\n\r\n" + strings.Repeat("a", 2500) + "\r\n"
+	deliver := func() {
+		t.Helper()
+		u, err := store.Back.GetOrCreateUser(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.CreateMessage("INBOX", nil, time.Now(), bytes.NewBufferString(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+		store.CheckQuotaWarnings(username)
+	}
+	messages := func() int64 {
+		t.Helper()
+		q, err := store.GetQuota(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.MessagesUsed
+	}
+	expectEvent := func(threshold int) {
+		t.Helper()
+		select {
+		case ev := <-received:
+			if ev.Type != events.QuotaWarning || ev.Data["username"] != username ||
+				ev.Data["threshold"] != float64(threshold) || ev.Data["quotaBytes"] != float64(10000) {
+				t.Errorf("unexpected webhook event: %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no webhook event for threshold %d", threshold)
+		}
+	}
+
+	deliver()
+	if err := store.SetUserQuota(username, QuotaSettings{Bytes: 10000}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.CheckQuotaWarnings(username)
+	if n := messages(); n != 1 {
+		t.Fatalf("warning delivered below the threshold, %d messages", n)
+	}
+
+	deliver()
+	if n := messages(); n != 3 {
+		t.Fatalf("expected a warning after crossing 50%%, got %d messages", n)
+	}
+	expectEvent(50)
+
+	// Crossing the same threshold again is not reported.
+	store.CheckQuotaWarnings(username)
+	if n := messages(); n != 3 {
+		t.Fatalf("warning repeated, %d messages", n)
+	}
+
+	deliver()
+	deliver()
+	if n := messages(); n != 6 {
+		t.Fatalf("expected a warning after crossing 90%%, got %d messages", n)
+	}
+	expectEvent(90)
+
+	// Warning is delivered even if the account is over quota.
+	if err := store.CheckQuota(username, 0); err == nil {
+		t.Fatal("account is not over quota")
+	}
+
+	// Going below thresholds re-arms them, a single warning is sent for the
+	// highest one crossed.
+	if err := store.SetUserQuota(username, QuotaSettings{Bytes: 1000000}); err != nil {
+		t.Fatal(err)
+	}
+	store.CheckQuotaWarnings(username)
+	if err := store.SetUserQuota(username, QuotaSettings{Bytes: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	store.CheckQuotaWarnings(username)
+	if n := messages(); n != 7 {
+		t.Fatalf("expected a warning after re-crossing, got %d messages", n)
+	}
+	expectEvent(90)
+}
+
+func TestParseQuotaThresholds(t *testing.T) {
+	thresholds, err := parseQuotaThresholds([]string{"95", "80%", "95"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thresholds) != 2 || thresholds[0] != 80 || thresholds[1] != 95 {
+		t.Errorf("unexpected thresholds: %v", thresholds)
+	}
+
+	if thresholds, err := parseQuotaThresholds([]string{"off"}); err != nil || len(thresholds) != 0 {
+		t.Errorf("off: %v, %v", thresholds, err)
+	}
+	for _, bad := range []string{"0", "101", "abc"} {
+		if _, err := parseQuotaThresholds([]string{bad}); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		500:                "500 B",
+		2048:               "2.0 KiB",
+		10 * 1024 * 1024:   "10.0 MiB",
+		1536 * 1024 * 1024: "1.5 GiB",
+	} {
+		if s := formatBytes(n); s != expected {
+			t.Errorf("formatBytes(%d) = %s, want %s", n, s, expected)
+		}
+	}
+}
+
+func TestQuota_MessagesAndMailboxCaps(t *testing.T) {
+	store := setupQuotaStorage(t)
+	store.junkMbox = "Junk"
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) { return s, nil }
+	const username = "user@example.org"
+	if err := store.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetDomainQuota("example.org", QuotaSettings{
+		Bytes:     100000,
+		Messages:  3,
+		Mailboxes: []MailboxQuota{{Mailbox: "Junk", Percent: 10}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.com", []string{username}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Junk is capped at 10% of the account quota.
+	q, err := store.GetMailboxQuota(username, "Junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.StorageLimit != 10000 || q.MessagesLimit != 0 {
+		t.Errorf("unexpected Junk quota: %+v", q)
+	}
+	if err := store.CheckMailboxQuota(username, "Junk", 20000); err == nil {
+		t.Error("message over Junk cap accepted")
+	}
+	if err := store.CheckMailboxQuota(username, "INBOX", 20000); err != nil {
+		t.Errorf("uncapped INBOX: %v", err)
+	}
+
+	// Own mailbox caps replace domain ones, zero limits are inherited.
+	if err := store.SetUserQuota(username, QuotaSettings{
+		Mailboxes: []MailboxQuota{{Mailbox: "Junk", Messages: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	q, err = store.GetMailboxQuota(username, "Junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.StorageLimit != 0 || q.MessagesLimit != 1 {
+		t.Errorf("unexpected Junk quota with user override: %+v", q)
+	}
+	account, err := store.GetQuota(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.StorageLimit != 100000 || account.MessagesLimit != 3 || account.MessagesUsed != 1 {
+		t.Errorf("unexpected account quota: %+v", account)
+	}
+
+	quarantine := &module.MsgMetadata{ID: "test", Quarantine: true}
+	if _, err := testutils.DoTestDeliveryErrMeta(t, store, "sender@example.com", []string{username}, quarantine); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testutils.DoTestDeliveryErrMeta(t, store, "sender@example.com", []string{username}, quarantine); err == nil {
+		t.Error("delivery over Junk message cap succeeded")
+	}
+
+	usage, err := store.MailboxUsage(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mu := range usage {
+		if mu.Name == "Junk" && (mu.Messages != 1 || mu.QuotaMessages != 1 || mu.QuotaBytes != 0) {
+			t.Errorf("unexpected Junk usage: %+v", mu)
+		}
+		if mu.Name == "INBOX" && (mu.QuotaMessages != 0 || mu.QuotaBytes != 0) {
+			t.Errorf("unexpected INBOX usage: %+v", mu)
+		}
+	}
+
+	// Account message limit.
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.com", []string{username}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.com", []string{username}); err == nil {
+		t.Error("delivery over message quota succeeded")
+	}
+
+	if err := store.SetUserQuota(username, QuotaSettings{
+		Mailboxes: []MailboxQuota{{Mailbox: "Junk"}, {Mailbox: "Junk"}},
+	}); err == nil {
+		t.Error("duplicate mailbox caps accepted")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// The quota_usage table keeps per-mailbox usage counters so quota checks do
+// not have to scan msgs. It is created and maintained by the triggers
+// defined in quota_schema.go.
+
+// RecomputeQuotaUsage recalculates usage counters of the account from its
+// messages and returns the new values. Counters never drift during normal
+// operation, this is meant for recovery after manual database changes.
+func (store *Storage) RecomputeQuotaUsage(username string) (module.Quota, error) {
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var uid int64
+	err = tx.QueryRow(store.quotaSQL(`SELECT id FROM users WHERE username = $1`), username).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: no such account: %s", username)
+	}
+	if err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+
+	// Lock the counters first, concurrent deliveries then either finish
+	// before the recalculation and are included in it or wait and apply
+	// their change on top of it.
+	if _, err := tx.Exec(store.quotaSQL(`
+		INSERT INTO quota_usage (mboxid)
+		SELECT id FROM mboxes WHERE uid = $1
+		ON CONFLICT DO NOTHING
+	`), uid); err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+	if _, err := tx.Exec(store.quotaSQL(`
+		SELECT 1 FROM quota_usage
+		WHERE mboxid IN (SELECT id FROM mboxes WHERE uid = $1)
+		FOR UPDATE
+	`), uid); err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+
+	type usage struct{ mboxID, bytes, count int64 }
+	var sums []usage
+	rows, err := tx.Query(store.quotaSQL(`
+		SELECT mb.id, COALESCE(SUM(m.bodylen), 0), COUNT(m.msgid)
+		FROM mboxes mb
+		LEFT JOIN msgs m ON m.mboxid = mb.id
+		WHERE mb.uid = $1
+		GROUP BY mb.id
+	`), uid)
+	if err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+	for rows.Next() {
+		var u usage
+		if err := rows.Scan(&u.mboxID, &u.bytes, &u.count); err != nil {
+			rows.Close()
+			return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+		}
+		sums = append(sums, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+
+	for _, u := range sums {
+		if _, err := tx.Exec(store.quotaSQL(`
+			UPDATE quota_usage SET used_bytes = $1, msg_count = $2 WHERE mboxid = $3
+		`), u.bytes, u.count, u.mboxID); err != nil {
+			return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return module.Quota{}, fmt.Errorf("recompute quota usage: %w", err)
+	}
+
+	return store.GetQuota(username)
+}
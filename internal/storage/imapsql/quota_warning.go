@@ -0,0 +1,324 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	defaultQuotaWarningSubject = `Mailbox is {{.Percent}}% full`
+
+	defaultQuotaWarningBody = `Your mailbox {{.Username}} uses {{.Used}} of {{.Quota}} ({{.Percent}}%).
+
+Once the quota is exceeded, new messages addressed to you will be rejected.
+Please delete messages you no longer need and empty the Trash and Junk
+folders.
+`
+)
+
+// quotaWarnings delivers warnings to accounts that cross usage thresholds.
+type quotaWarnings struct {
+	// thresholds are percents of the quota in ascending order.
+	thresholds []int
+	from       string
+	msgIDHost  string
+	subject    *template.Template
+	body       *template.Template
+}
+
+// quotaWarningData is passed to the subject and body templates.
+type quotaWarningData struct {
+	Username  string
+	Threshold int
+	Percent   int64
+
+	UsedBytes     int64
+	QuotaBytes    int64
+	Used          string
+	Quota         string
+	MessagesUsed  int64
+	MessagesQuota int64
+}
+
+func parseQuotaThresholds(args []string) ([]int, error) {
+	if len(args) == 1 && args[0] == "off" {
+		return nil, nil
+	}
+
+	seen := make(map[int]bool, len(args))
+	thresholds := make([]int, 0, len(args))
+	for _, arg := range args {
+		val, err := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+		if err != nil || val < 1 || val > 100 {
+			return nil, fmt.Errorf("imapsql: invalid quota warning threshold: %s", arg)
+		}
+		if seen[val] {
+			continue
+		}
+		seen[val] = true
+		thresholds = append(thresholds, val)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+func newQuotaWarnings(thresholds []string, from, hostname, subject, bodyFile string) (*quotaWarnings, error) {
+	qw := &quotaWarnings{
+		from:      from,
+		msgIDHost: hostname,
+	}
+
+	var err error
+	qw.thresholds, err = parseQuotaThresholds(thresholds)
+	if err != nil {
+		return nil, err
+	}
+
+	if qw.msgIDHost == "" {
+		qw.msgIDHost = "localhost"
+	}
+	if qw.from == "" {
+		qw.from = "postmaster@" + qw.msgIDHost
+	}
+
+	qw.subject, err = template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: quota_warning_subject: %w", err)
+	}
+
+	body := defaultQuotaWarningBody
+	if bodyFile != "" {
+		blob, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: quota_warning_template: %w", err)
+		}
+		body = string(blob)
+	}
+	qw.body, err = template.New("body").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: quota_warning_template: %w", err)
+	}
+
+	return qw, nil
+}
+
+// formatBytes formats the size using binary units for the warning text.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// usagePercent returns the usage as percent of the quota, the largest of
+// the limited resources is used.
+func usagePercent(q module.Quota) int64 {
+	var percent int64
+	if q.StorageLimit > 0 {
+		percent = q.StorageUsed * 100 / q.StorageLimit
+	}
+	if q.MessagesLimit > 0 {
+		if p := q.MessagesUsed * 100 / q.MessagesLimit; p > percent {
+			percent = p
+		}
+	}
+	return percent
+}
+
+// CheckQuotaWarnings delivers the warning if the account has crossed a
+// threshold since the last check. Every threshold is reported once until
+// the usage goes back below it.
+//
+// Errors are only logged, the message that triggered the check is already
+// delivered at this point.
+func (store *Storage) CheckQuotaWarnings(username string) {
+	qw := store.quotaWarnings
+	if qw == nil || len(qw.thresholds) == 0 {
+		return
+	}
+
+	q, err := store.GetQuota(username)
+	if err != nil {
+		store.Log.Error("quota warning check failed", err, "username", username)
+		return
+	}
+	if q.StorageLimit == 0 && q.MessagesLimit == 0 {
+		return
+	}
+	percent := usagePercent(q)
+
+	rows, err := store.Back.DB.Query(store.quotaSQL(`SELECT threshold FROM quota_warnings WHERE username = $1`), username)
+	if err != nil {
+		store.Log.Error("quota warning check failed", err, "username", username)
+		return
+	}
+	warned := map[int]bool{}
+	for rows.Next() {
+		var threshold int
+		if err := rows.Scan(&threshold); err != nil {
+			rows.Close()
+			store.Log.Error("quota warning check failed", err, "username", username)
+			return
+		}
+		warned[threshold] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		store.Log.Error("quota warning check failed", err, "username", username)
+		return
+	}
+
+	crossed := 0
+	for _, threshold := range qw.thresholds {
+		if percent < int64(threshold) {
+			if warned[threshold] {
+				// Usage went down, report the threshold again next time.
+				if _, err := store.Back.DB.Exec(store.quotaSQL(`DELETE FROM quota_warnings WHERE username = $1 AND threshold = $2`),
+					username, threshold); err != nil {
+					store.Log.Error("quota warning check failed", err, "username", username)
+				}
+			}
+			continue
+		}
+		if warned[threshold] {
+			continue
+		}
+
+		// Concurrent deliveries could cross the threshold at the same
+		// time, only the one that inserts the row sends the warning.
+		res, err := store.Back.DB.Exec(store.quotaSQL(`
+			INSERT INTO quota_warnings (username, threshold, sent_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`), username, threshold, time.Now().Unix())
+		if err != nil {
+			store.Log.Error("quota warning check failed", err, "username", username)
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			crossed = threshold
+		}
+	}
+	if crossed == 0 {
+		return
+	}
+
+	data := quotaWarningData{
+		Username:      username,
+		Threshold:     crossed,
+		Percent:       percent,
+		UsedBytes:     q.StorageUsed,
+		QuotaBytes:    q.StorageLimit,
+		Used:          formatBytes(q.StorageUsed),
+		Quota:         formatBytes(q.StorageLimit),
+		MessagesUsed:  q.MessagesUsed,
+		MessagesQuota: q.MessagesLimit,
+	}
+	if err := store.deliverQuotaWarning(data); err != nil {
+		store.Log.Error("failed to deliver quota warning", err, "username", username, "threshold", crossed)
+		return
+	}
+	store.Log.Msg("quota warning", "username", username, "threshold", crossed,
+		"used", q.StorageUsed, "quota", q.StorageLimit)
+
+	events.Publish(events.QuotaWarning, map[string]interface{}{
+		"username":      username,
+		"threshold":     crossed,
+		"percent":       percent,
+		"usedBytes":     q.StorageUsed,
+		"quotaBytes":    q.StorageLimit,
+		"messagesUsed":  q.MessagesUsed,
+		"messagesQuota": q.MessagesLimit,
+	})
+}
+
+// deliverQuotaWarning puts the warning into INBOX of the account. The
+// message is added directly through go-imap-sql and so it is not subject
+// to the quota check.
+func (store *Storage) deliverQuotaWarning(data quotaWarningData) error {
+	qw := store.quotaWarnings
+
+	var subject, text bytes.Buffer
+	if err := qw.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := qw.body.Execute(&text, data); err != nil {
+		return err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	h := textproto.Header{}
+	h.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	h.Set("From", "<"+qw.from+">")
+	h.Set("To", "<"+data.Username+">")
+	h.Set("Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	h.Set("Message-Id", "<"+msgID+"@"+qw.msgIDHost+">")
+	h.Set("Auto-Submitted", "auto-generated")
+	h.Set("MIME-Version", "1.0")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	if _, err := w.Write(text.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	d := store.Back.NewDelivery()
+	if err := d.AddRcpt(data.Username, textproto.Header{}); err != nil {
+		return err
+	}
+	if err := d.Mailbox("INBOX"); err != nil {
+		d.Abort() //nolint:errcheck
+		return err
+	}
+	if err := d.BodyParsed(h, body.Len(), buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		d.Abort() //nolint:errcheck
+		return err
+	}
+	return d.Commit()
+}
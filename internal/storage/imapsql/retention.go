@@ -0,0 +1,464 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+const (
+	retentionScopeGlobal = "global"
+	retentionScopeDomain = "domain"
+	retentionScopeUser   = "user"
+
+	// retentionBatch is the maximum amount of messages expunged at once.
+	retentionBatch = 1000
+)
+
+// retentionMigrations are applied in order, the index+1 is the schema
+// version recorded in retention_schema.
+var retentionMigrations = []schemaMigration{
+	// 1: Retention rules applied by the janitor. scope is "global", "domain"
+	// or "user", name is empty for global rules. max_age is in seconds.
+	{
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS retention_rules (
+				scope VARCHAR(16) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				max_age BIGINT NOT NULL,
+				PRIMARY KEY (scope, name, mailbox)
+			)`,
+		},
+		sqlite3: []string{
+			`CREATE TABLE IF NOT EXISTS retention_rules (
+				scope VARCHAR(16) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				max_age BIGINT NOT NULL,
+				PRIMARY KEY (scope, name, mailbox)
+			)`,
+		},
+		mysql: []string{
+			`CREATE TABLE IF NOT EXISTS retention_rules (
+				scope VARCHAR(16) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				mailbox VARCHAR(255) NOT NULL,
+				max_age BIGINT NOT NULL,
+				PRIMARY KEY (scope, name, mailbox)
+			)`,
+		},
+	},
+}
+
+// RetentionRule expunges messages of the mailbox older than MaxAge. Zero
+// MaxAge keeps messages forever, this can be used to disable a rule
+// inherited from a wider scope.
+type RetentionRule struct {
+	Mailbox string
+	MaxAge  time.Duration
+}
+
+// EffectiveRetentionRule is a rule applied to an account. Source is the
+// level the rule comes from: "config", "global", "domain" or "user".
+type EffectiveRetentionRule struct {
+	RetentionRule
+	Source string
+}
+
+func validateRetention(rules []RetentionRule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if r.Mailbox == "" {
+			return fmt.Errorf("retention: empty mailbox name")
+		}
+		if seen[r.Mailbox] {
+			return fmt.Errorf("retention: duplicate mailbox: %s", r.Mailbox)
+		}
+		seen[r.Mailbox] = true
+		if r.MaxAge < 0 {
+			return fmt.Errorf("retention: negative max age for mailbox %s", r.Mailbox)
+		}
+	}
+	return nil
+}
+
+// parseRetentionAge parses the duration, in addition to units accepted by
+// time.ParseDuration, a number of days can be specified as "30d".
+func parseRetentionAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if dur < 0 {
+		return 0, errors.New("duration must not be negative")
+	}
+	return dur, nil
+}
+
+// parseRetentionBlock parses the retention directive block:
+//
+//	retention {
+//	    Junk 30d
+//	    Trash 30d
+//	}
+func parseRetentionBlock(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+
+	rules := make([]RetentionRule, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 || len(child.Children) != 0 {
+			return nil, config.NodeErr(child, "expected a mailbox name and a max age")
+		}
+		age, err := parseRetentionAge(child.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		rules = append(rules, RetentionRule{Mailbox: child.Name, MaxAge: age})
+	}
+	if err := validateRetention(rules); err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	return rules, nil
+}
+
+func (store *Storage) retentionRules(scope, name string) ([]RetentionRule, error) {
+	rows, err := store.Back.DB.Query(store.quotaSQL(`
+		SELECT mailbox, max_age
+		FROM retention_rules
+		WHERE scope = $1 AND name = $2
+		ORDER BY mailbox
+	`), scope, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []RetentionRule
+	for rows.Next() {
+		var (
+			r      RetentionRule
+			maxAge int64
+		)
+		if err := rows.Scan(&r.Mailbox, &maxAge); err != nil {
+			return nil, err
+		}
+		r.MaxAge = time.Duration(maxAge) * time.Second
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (store *Storage) setRetentionRules(scope, name string, rules []RetentionRule) error {
+	if err := validateRetention(rules); err != nil {
+		return err
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := store.deleteRetentionRulesTx(tx, scope, name); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if _, err := tx.Exec(store.quotaSQL(`
+			INSERT INTO retention_rules (scope, name, mailbox, max_age)
+			VALUES ($1, $2, $3, $4)
+		`), scope, name, r.Mailbox, int64(r.MaxAge/time.Second)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *Storage) deleteRetentionRulesTx(tx *sql.Tx, scope, name string) error {
+	_, err := tx.Exec(store.quotaSQL(`DELETE FROM retention_rules WHERE scope = $1 AND name = $2`), scope, name)
+	return err
+}
+
+// ConfigRetention returns rules set by the retention directive. They apply
+// to all accounts unless replaced by rules stored in the database.
+func (store *Storage) ConfigRetention() []RetentionRule {
+	return store.retention
+}
+
+// GlobalRetention returns rules applied to all accounts.
+func (store *Storage) GlobalRetention() ([]RetentionRule, error) {
+	return store.retentionRules(retentionScopeGlobal, "")
+}
+
+// SetGlobalRetention replaces rules applied to all accounts.
+func (store *Storage) SetGlobalRetention(rules []RetentionRule) error {
+	return store.setRetentionRules(retentionScopeGlobal, "", rules)
+}
+
+// DomainRetention returns rules applied to accounts of the domain.
+func (store *Storage) DomainRetention(domain string) ([]RetentionRule, error) {
+	return store.retentionRules(retentionScopeDomain, domain)
+}
+
+// SetDomainRetention replaces rules applied to accounts of the domain.
+func (store *Storage) SetDomainRetention(domain string, rules []RetentionRule) error {
+	return store.setRetentionRules(retentionScopeDomain, domain, rules)
+}
+
+// UserRetention returns rules set for the account.
+func (store *Storage) UserRetention(username string) ([]RetentionRule, error) {
+	return store.retentionRules(retentionScopeUser, username)
+}
+
+// SetUserRetention replaces rules set for the account.
+func (store *Storage) SetUserRetention(username string, rules []RetentionRule) error {
+	return store.setRetentionRules(retentionScopeUser, username, rules)
+}
+
+// mergeRetention combines rules of each level, rules of later levels
+// replace rules of the same mailbox. The result is sorted by mailbox.
+func mergeRetention(sources []string, levels ...[]RetentionRule) []EffectiveRetentionRule {
+	byMbox := map[string]EffectiveRetentionRule{}
+	for i, rules := range levels {
+		for _, r := range rules {
+			byMbox[r.Mailbox] = EffectiveRetentionRule{RetentionRule: r, Source: sources[i]}
+		}
+	}
+
+	res := make([]EffectiveRetentionRule, 0, len(byMbox))
+	for _, r := range byMbox {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Mailbox < res[j].Mailbox
+	})
+	return res
+}
+
+var retentionSources = []string{"config", retentionScopeGlobal, retentionScopeDomain, retentionScopeUser}
+
+// EffectiveRetention returns rules applied to the account. Rules set for
+// the account take precedence over domain rules, which take precedence
+// over global rules and then rules from the configuration.
+func (store *Storage) EffectiveRetention(username string) ([]EffectiveRetentionRule, error) {
+	global, err := store.GlobalRetention()
+	if err != nil {
+		return nil, err
+	}
+	domain, err := store.DomainRetention(accountDomain(username))
+	if err != nil {
+		return nil, err
+	}
+	user, err := store.UserRetention(username)
+	if err != nil {
+		return nil, err
+	}
+	return mergeRetention(retentionSources, store.retention, global, domain, user), nil
+}
+
+// allRetentionRules loads rules of all scopes, indexed by scope and name.
+func (store *Storage) allRetentionRules() (map[string]map[string][]RetentionRule, error) {
+	rows, err := store.Back.DB.Query(`SELECT scope, name, mailbox, max_age FROM retention_rules`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := map[string]map[string][]RetentionRule{}
+	for rows.Next() {
+		var (
+			scope, name string
+			r           RetentionRule
+			maxAge      int64
+		)
+		if err := rows.Scan(&scope, &name, &r.Mailbox, &maxAge); err != nil {
+			return nil, err
+		}
+		r.MaxAge = time.Duration(maxAge) * time.Second
+		if all[scope] == nil {
+			all[scope] = map[string][]RetentionRule{}
+		}
+		all[scope][name] = append(all[scope][name], r)
+	}
+	return all, rows.Err()
+}
+
+// applyRetention expunges messages of all accounts that are expired
+// according to the effective rules.
+func (store *Storage) applyRetention() error {
+	all, err := store.allRetentionRules()
+	if err != nil {
+		return err
+	}
+	if len(all) == 0 && len(store.retention) == 0 {
+		return nil
+	}
+
+	users, err := store.Back.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, username := range users {
+		rules := mergeRetention(retentionSources,
+			store.retention,
+			all[retentionScopeGlobal][""],
+			all[retentionScopeDomain][accountDomain(username)],
+			all[retentionScopeUser][username])
+		for _, r := range rules {
+			if r.MaxAge == 0 {
+				continue
+			}
+
+			msgs, bytes, err := store.expireMessages(username, r.Mailbox, now.Add(-r.MaxAge))
+			if err != nil {
+				store.Log.Error("retention failed", err, "username", username, "mailbox", r.Mailbox)
+				continue
+			}
+			if msgs == 0 {
+				continue
+			}
+			retentionExpunged.WithLabelValues(store.instName, r.Mailbox).Add(float64(msgs))
+			retentionReclaimed.WithLabelValues(store.instName, r.Mailbox).Add(float64(bytes))
+			store.Log.Msg("expired messages expunged", "username", username, "mailbox", r.Mailbox,
+				"messages", msgs, "bytes", bytes, "source", r.Source)
+		}
+	}
+	return nil
+}
+
+// expireMessages expunges messages of the mailbox received before cutoff.
+//
+// Messages are removed through go-imap-sql so external blobs are deleted
+// and connected sessions (including ones in other processes, via the
+// update pipe) are notified about the expunge.
+func (store *Storage) expireMessages(username, mailbox string, cutoff time.Time) (msgs, bytes int64, err error) {
+	var lastUID uint32
+	for {
+		var (
+			uids      imap.SeqSet
+			batch     int
+			batchSize int64
+		)
+		rows, err := store.Back.DB.Query(store.quotaSQL(`
+			SELECT m.msgId, m.bodyLen
+			FROM msgs m
+			JOIN mboxes mb ON mb.id = m.mboxId
+			JOIN users u ON u.id = mb.uid
+			WHERE u.username = $1 AND mb.name = $2 AND m.date < $3 AND m.msgId > $4
+			ORDER BY m.msgId
+			LIMIT `+strconv.Itoa(retentionBatch)), username, mailbox, cutoff.Unix(), lastUID)
+		if err != nil {
+			return msgs, bytes, err
+		}
+		for rows.Next() {
+			var (
+				uid  uint32
+				size int64
+			)
+			if err := rows.Scan(&uid, &size); err != nil {
+				rows.Close()
+				return msgs, bytes, err
+			}
+			uids.AddNum(uid)
+			lastUID = uid
+			batchSize += size
+			batch++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return msgs, bytes, err
+		}
+		if batch == 0 {
+			return msgs, bytes, nil
+		}
+
+		if err := store.delMessages(username, mailbox, &uids); err != nil {
+			return msgs, bytes, err
+		}
+		msgs += int64(batch)
+		bytes += batchSize
+
+		if batch < retentionBatch {
+			return msgs, bytes, nil
+		}
+	}
+}
+
+func (store *Storage) delMessages(username, mailbox string, uids *imap.SeqSet) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			store.Log.Error("logout failed", err, "username", username)
+		}
+	}()
+
+	_, mbox, err := u.GetMailbox(mailbox, false, nil)
+	if err != nil {
+		if errors.Is(err, backend.ErrNoSuchMailbox) {
+			return nil
+		}
+		return err
+	}
+	defer mbox.Close()
+
+	return mbox.(*imapsql.Mailbox).DelMessages(true, uids)
+}
+
+// retentionJanitor applies retention rules every interval until stop is
+// closed.
+func (store *Storage) retentionJanitor(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := store.applyRetention(); err != nil {
+				store.Log.Error("retention failed", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func appendRetentionTestMsg(t *testing.T, store *Storage, username, mbox string, date time.Time) {
+	t.Helper()
+
+	u, err := store.Back.GetOrCreateUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox != "INBOX" {
+		// Fails if the mailbox already exists, which is fine.
+		_ = u.CreateMailbox(mbox)
+	}
+	if err := u.CreateMessage(mbox, nil, date, bytes.NewBufferString(quotaTestMsg), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mailboxMessages(t *testing.T, store *Storage, username string) map[string]int64 {
+	t.Helper()
+
+	usage, err := store.MailboxUsage(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]int64{}
+	for _, mu := range usage {
+		res[mu.Name] = mu.Messages
+	}
+	return res
+}
+
+func TestRetention_Apply(t *testing.T) {
+	store, blobDir := setupQuotaStorageDir(t)
+	store.retention = []RetentionRule{{Mailbox: "Junk", MaxAge: 30 * 24 * time.Hour}}
+	if err := store.SetGlobalRetention([]RetentionRule{{Mailbox: "Trash", MaxAge: 7 * 24 * time.Hour}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserRetention("keep@example.org", []RetentionRule{{Mailbox: "Junk"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	for _, username := range []string{"user@example.org", "keep@example.org"} {
+		appendRetentionTestMsg(t, store, username, "INBOX", old)
+		appendRetentionTestMsg(t, store, username, "Junk", old)
+		appendRetentionTestMsg(t, store, username, "Junk", old)
+		appendRetentionTestMsg(t, store, username, "Junk", time.Now())
+		appendRetentionTestMsg(t, store, username, "Trash", old)
+	}
+
+	if err := store.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := mailboxMessages(t, store, "user@example.org"), map[string]int64{"INBOX": 1, "Junk": 1, "Trash": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("user@example.org: %v, want %v", got, want)
+	}
+	if got, want := mailboxMessages(t, store, "keep@example.org"), map[string]int64{"INBOX": 1, "Junk": 3, "Trash": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keep@example.org: %v, want %v", got, want)
+	}
+
+	blobs, err := os.ReadDir(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 6 {
+		t.Errorf("%d blobs left, want 6", len(blobs))
+	}
+
+	// Nothing else is expired.
+	if err := store.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if got := mailboxMessages(t, store, "user@example.org")["Junk"]; got != 1 {
+		t.Errorf("Junk has %d messages after second run, want 1", got)
+	}
+}
+
+func TestRetention_Effective(t *testing.T) {
+	store := setupQuotaStorage(t)
+	store.retention = []RetentionRule{
+		{Mailbox: "Junk", MaxAge: 30 * 24 * time.Hour},
+		{Mailbox: "Trash", MaxAge: 30 * 24 * time.Hour},
+	}
+	if err := store.SetGlobalRetention([]RetentionRule{{Mailbox: "Trash", MaxAge: 14 * 24 * time.Hour}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDomainRetention("example.org", []RetentionRule{
+		{Mailbox: "Junk", MaxAge: 7 * 24 * time.Hour},
+		{Mailbox: "Archive", MaxAge: 365 * 24 * time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserRetention("user@example.org", []RetentionRule{{Mailbox: "Archive"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := store.EffectiveRetention("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EffectiveRetentionRule{
+		{RetentionRule{Mailbox: "Archive"}, "user"},
+		{RetentionRule{Mailbox: "Junk", MaxAge: 7 * 24 * time.Hour}, "domain"},
+		{RetentionRule{Mailbox: "Trash", MaxAge: 14 * 24 * time.Hour}, "global"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("EffectiveRetention = %+v, want %+v", rules, want)
+	}
+
+	rules, err = store.EffectiveRetention("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []EffectiveRetentionRule{
+		{RetentionRule{Mailbox: "Junk", MaxAge: 30 * 24 * time.Hour}, "config"},
+		{RetentionRule{Mailbox: "Trash", MaxAge: 14 * 24 * time.Hour}, "global"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("EffectiveRetention = %+v, want %+v", rules, want)
+	}
+
+	// Replacing with an empty list removes the rules.
+	if err := store.SetDomainRetention("example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	domain, err := store.DomainRetention("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domain) != 0 {
+		t.Errorf("DomainRetention = %+v, want none", domain)
+	}
+
+	if err := store.SetUserRetention("user@example.org", []RetentionRule{{Mailbox: "Junk"}, {Mailbox: "Junk"}}); err == nil {
+		t.Error("duplicate mailbox accepted")
+	}
+}
+
+func TestParseRetentionAge(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want time.Duration
+		fail bool
+	}{
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "12h", want: 12 * time.Hour},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "-1d", fail: true},
+		{in: "-1h", fail: true},
+		{in: "d", fail: true},
+		{in: "30", fail: true},
+	} {
+		got, err := parseRetentionAge(c.in)
+		if c.fail {
+			if err == nil {
+				t.Errorf("parseRetentionAge(%q) = %v, want error", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRetentionAge(%q): %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseRetentionAge(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// schemaMigration is a single version of a schema set. Statements are
+// listed separately for each SQL dialect and must be idempotent since MySQL
+// commits DDL statements implicitly and a failed migration cannot be rolled
+// back there.
+type schemaMigration struct {
+	// columns are added before statements are executed.
+	columns []schemaColumn
+
+	postgres []string
+	sqlite3  []string
+	mysql    []string
+}
+
+// schemaColumn is a column added to an existing table. Only PostgreSQL
+// supports ADD COLUMN IF NOT EXISTS, for other dialects the column is looked
+// up first so the migration can be re-run.
+type schemaColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
+func (m schemaMigration) statements(dialect string) []string {
+	switch dialect {
+	case "postgres":
+		return m.postgres
+	case "sqlite3":
+		return m.sqlite3
+	case "mysql":
+		return m.mysql
+	}
+	return nil
+}
+
+// schemaDialect returns the SQL dialect used for schema migrations.
+func (store *Storage) schemaDialect() (string, error) {
+	switch store.driver {
+	case "postgres":
+		return "postgres", nil
+	case "sqlite3", "sqlite":
+		return "sqlite3", nil
+	case "mysql":
+		return "mysql", nil
+	}
+	return "", fmt.Errorf("unsupported driver: %s", store.driver)
+}
+
+func (store *Storage) addColumn(tx *sql.Tx, dialect string, col schemaColumn) error {
+	var query string
+	switch dialect {
+	case "postgres":
+		_, err := tx.Exec(`ALTER TABLE ` + col.table + ` ADD COLUMN IF NOT EXISTS ` + col.name + ` ` + col.definition)
+		return err
+	case "sqlite3":
+		query = `SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2`
+	case "mysql":
+		query = `SELECT COUNT(*) FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = $1 AND column_name = $2`
+	}
+
+	var exists int
+	if err := tx.QueryRow(store.quotaSQL(query), col.table, col.name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists != 0 {
+		return nil
+	}
+	_, err := tx.Exec(`ALTER TABLE ` + col.table + ` ADD COLUMN ` + col.name + ` ` + col.definition)
+	return err
+}
+
+// initSchema applies pending migrations of all tables maintained by the
+// module in addition to the go-imap-sql schema.
+func (store *Storage) initSchema() error {
+	if err := store.migrateSchema("quota", quotaMigrations); err != nil {
+		return err
+	}
+	if err := store.migrateSchema("retention", retentionMigrations); err != nil {
+		return err
+	}
+	return store.migrateSchema("migration", migrationStateMigrations)
+}
+
+// migrateSchema applies pending migrations of the set, the applied version
+// is recorded in the <name>_schema table. migrations are applied in order,
+// the index+1 is the schema version.
+func (store *Storage) migrateSchema(name string, migrations []schemaMigration) error {
+	dialect, err := store.schemaDialect()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	table := name + "_schema"
+	db := store.Back.DB
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + table + ` (
+			version INTEGER NOT NULL PRIMARY KEY,
+			applied_at BIGINT NOT NULL
+		)`); err != nil {
+		return fmt.Errorf("%s: create schema table: %w", name, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: migrate: %w", name, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ` + table).Scan(&version); err != nil {
+		return fmt.Errorf("%s: migrate: %w", name, err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%s: schema version %d is newer than supported %d", name, version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		for _, col := range migrations[i].columns {
+			if err := store.addColumn(tx, dialect, col); err != nil {
+				return fmt.Errorf("%s: migrate to version %d: %w", name, i+1, err)
+			}
+		}
+		for _, stmt := range migrations[i].statements(dialect) {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("%s: migrate to version %d: %w", name, i+1, err)
+			}
+		}
+		if _, err := tx.Exec(store.quotaSQL(`INSERT INTO `+table+` (version, applied_at) VALUES ($1, $2)`),
+			i+1, time.Now().Unix()); err != nil {
+			return fmt.Errorf("%s: migrate to version %d: %w", name, i+1, err)
+		}
+		store.Log.Msg("schema migrated", "schema", name, "version", i+1)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: migrate: %w", name, err)
+	}
+	return nil
+}
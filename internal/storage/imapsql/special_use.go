@@ -0,0 +1,57 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+// SetMailboxSpecialUse changes the SPECIAL-USE attribute (RFC 6154) of an
+// existing mailbox, empty attr removes it. go-imap-sql only allows setting
+// the attribute when the mailbox is created.
+func (store *Storage) SetMailboxSpecialUse(username, mailbox, attr string) error {
+	var specialUse sql.NullString
+	switch attr {
+	case "":
+	case imap.ArchiveAttr, imap.DraftsAttr, imap.JunkAttr, imap.SentAttr, imap.TrashAttr:
+		specialUse = sql.NullString{String: attr, Valid: true}
+	default:
+		return imapsql.ErrUnsupportedSpecialAttr
+	}
+
+	res, err := store.Back.DB.Exec(store.quotaSQL(`
+		UPDATE mboxes SET specialuse = $1
+		WHERE uid = (SELECT id FROM users WHERE username = $2) AND name = $3
+	`), specialUse, username, mailbox)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return backend.ErrNoSuchMailbox
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+func TestSetMailboxSpecialUse(t *testing.T) {
+	store := setupQuotaStorage(t)
+
+	u, err := store.Back.GetOrCreateUser("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	hasJunk := func() bool {
+		t.Helper()
+		mboxes, err := u.ListMailboxes(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range mboxes {
+			if info.Name != "Spam" {
+				continue
+			}
+			for _, attr := range info.Attributes {
+				if attr == imap.JunkAttr {
+					return true
+				}
+			}
+			return false
+		}
+		t.Fatal("mailbox not listed")
+		return false
+	}
+
+	if err := store.SetMailboxSpecialUse("user@example.org", "Spam", imap.JunkAttr); err != nil {
+		t.Fatal(err)
+	}
+	if !hasJunk() {
+		t.Errorf("%s is not set", imap.JunkAttr)
+	}
+
+	if err := store.SetMailboxSpecialUse("user@example.org", "Spam", ""); err != nil {
+		t.Fatal(err)
+	}
+	if hasJunk() {
+		t.Errorf("%s is not removed", imap.JunkAttr)
+	}
+
+	if err := store.SetMailboxSpecialUse("user@example.org", "Spam", imap.FlaggedAttr); !errors.Is(err, imapsql.ErrUnsupportedSpecialAttr) {
+		t.Errorf("unsupported attribute: got %v", err)
+	}
+	if err := store.SetMailboxSpecialUse("user@example.org", "Missing", imap.JunkAttr); !errors.Is(err, backend.ErrNoSuchMailbox) {
+		t.Errorf("missing mailbox: got %v", err)
+	}
+}
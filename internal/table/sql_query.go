@@ -41,6 +41,7 @@ type SQL struct {
 	list   *sql.Stmt
 	set    *sql.Stmt
 	del    *sql.Stmt
+	cas    *sql.Stmt
 }
 
 func NewSQL(modName, instName string, _, _ []string) (module.Module, error) {
@@ -69,6 +70,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 		listQuery   string
 		removeQuery string
 		setQuery    string
+		casQuery    string
 	)
 	cfg.StringList("init", false, false, nil, &initQueries)
 	cfg.String("driver", false, true, "", &driver)
@@ -81,6 +83,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 	cfg.String("list", false, false, "", &listQuery)
 	cfg.String("del", false, false, "", &removeQuery)
 	cfg.String("set", false, false, "", &setQuery)
+	cfg.String("cas", false, false, "", &casQuery)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -129,6 +132,12 @@ func (s *SQL) Init(cfg *config.Map) error {
 			return config.NodeErr(cfg.Block, "failed to prepare del query: %v", err)
 		}
 	}
+	if casQuery != "" {
+		s.cas, err = db.Prepare(casQuery)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "failed to prepare cas query: %v", err)
+		}
+	}
 
 	return nil
 }
@@ -222,6 +231,49 @@ func (s *SQL) RemoveKey(k string) error {
 	return nil
 }
 
+// SetKeyMulti replaces values of the key using 'del' and 'add' queries in a
+// single transaction.
+func (s *SQL) SetKeyMulti(k string, values []string) error {
+	if s.del == nil {
+		return fmt.Errorf("%s: table is not mutable (no 'del' query)", s.modName)
+	}
+	if s.add == nil {
+		return fmt.Errorf("%s: table is not mutable (no 'add' query)", s.modName)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, k, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if s.namedArgs {
+		_, err = tx.Stmt(s.del).Exec(sql.Named("key", k))
+	} else {
+		_, err = tx.Stmt(s.del).Exec(k)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, k, err)
+	}
+
+	add := tx.Stmt(s.add)
+	for _, v := range values {
+		if s.namedArgs {
+			_, err = add.Exec(sql.Named("key", k), sql.Named("value", v))
+		} else {
+			_, err = add.Exec(k, v)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: set %s: %w", s.modName, k, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, k, err)
+	}
+	return nil
+}
+
 func (s *SQL) SetKey(k, v string) error {
 	if s.set == nil {
 		return fmt.Errorf("%s: table is not mutable (no 'set' query)", s.modName)
@@ -246,6 +298,32 @@ func (s *SQL) SetKey(k, v string) error {
 	return nil
 }
 
+// CompareAndSetKey replaces the value of the key using the 'cas' query and
+// reports whether it affected any rows.
+func (s *SQL) CompareAndSetKey(k, old, v string) (bool, error) {
+	if s.cas == nil {
+		return false, fmt.Errorf("%s: table does not support conditional updates (no 'cas' query)", s.modName)
+	}
+
+	var (
+		res sql.Result
+		err error
+	)
+	if s.namedArgs {
+		res, err = s.cas.Exec(sql.Named("key", k), sql.Named("old", old), sql.Named("value", v))
+	} else {
+		res, err = s.cas.Exec(k, old, v)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: cas %s: %w", s.modName, k, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: cas %s: %w", s.modName, k, err)
+	}
+	return affected != 0, nil
+}
+
 func init() {
 	module.Register("table.sql_query", NewSQL)
 }
@@ -94,3 +94,96 @@ func TestSQL(t *testing.T) {
 		t.Error("Wrong result of LookupMulti:", vals)
 	}
 }
+
+func TestSQL_SetKeyMulti(t *testing.T) {
+	path := testutils.Dir(t)
+	mod, err := NewSQL("sql_table", "", nil, nil)
+	if err != nil {
+		t.Fatal("Module create failed:", err)
+	}
+	tbl := mod.(*SQL)
+	err = tbl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(path, "test.db")}},
+			{
+				Name: "init",
+				Args: []string{
+					"CREATE TABLE testTbl (key TEXT, value TEXT, PRIMARY KEY (key, value))",
+					"INSERT INTO testTbl VALUES ('user1', 'user1a')",
+				},
+			},
+			{Name: "lookup", Args: []string{"SELECT value FROM testTbl WHERE key = $1 ORDER BY value"}},
+			{Name: "add", Args: []string{"INSERT INTO testTbl VALUES ($1, $2)"}},
+			{Name: "del", Args: []string{"DELETE FROM testTbl WHERE key = $1"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+
+	check := func(want []string) {
+		t.Helper()
+		vals, err := tbl.LookupMulti(context.Background(), "user1")
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if !reflect.DeepEqual(vals, want) {
+			t.Errorf("Wrong result of LookupMulti: %v, want %v", vals, want)
+		}
+	}
+
+	if err := tbl.SetKeyMulti("user1", []string{"user1b", "user1c"}); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"user1b", "user1c"})
+
+	// Duplicate values fail the 'add' query, old values should be kept.
+	if err := tbl.SetKeyMulti("user1", []string{"user1d", "user1d"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	check([]string{"user1b", "user1c"})
+}
+
+func TestSQL_CompareAndSetKey(t *testing.T) {
+	path := testutils.Dir(t)
+	mod, err := NewSQLTable("sql_table", "", nil, nil)
+	if err != nil {
+		t.Fatal("Module create failed:", err)
+	}
+	tbl := mod.(*SQLTable)
+	err = tbl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(path, "test.db")}},
+			{Name: "table_name", Args: []string{"testTbl"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	if err := tbl.SetKey("user1", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(old, v string, swapped bool, want string) {
+		t.Helper()
+		ok, err := tbl.CompareAndSetKey("user1", old, v)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if ok != swapped {
+			t.Errorf("CompareAndSetKey(%s, %s) = %v, want %v", old, v, ok, swapped)
+		}
+		val, _, err := tbl.Lookup(context.Background(), "user1")
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if val != want {
+			t.Errorf("Wrong value: %s, want %s", val, want)
+		}
+	}
+
+	check("a", "b", true, "b")
+	check("a", "c", false, "b")
+}
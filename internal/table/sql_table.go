@@ -82,6 +82,7 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		listQuery   string
 		setQuery    string
 		delQuery    string
+		casQuery    string
 	)
 	if driver == "sqlite3" {
 		useNamedArgs = "yes"
@@ -90,6 +91,7 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		listQuery = fmt.Sprintf("SELECT %s from %s", keyColumn, tableName)
 		setQuery = fmt.Sprintf("UPDATE %s SET %s = :value WHERE %s = :key", tableName, valueColumn, keyColumn)
 		delQuery = fmt.Sprintf("DELETE FROM %s WHERE %s = :key", tableName, keyColumn)
+		casQuery = fmt.Sprintf("UPDATE %s SET %s = :value WHERE %s = :key AND %s = :old", tableName, valueColumn, keyColumn, valueColumn)
 	} else {
 		useNamedArgs = "no"
 		lookupQuery = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", valueColumn, tableName, keyColumn)
@@ -97,6 +99,7 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		listQuery = fmt.Sprintf("SELECT %s from %s", keyColumn, tableName)
 		setQuery = fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1", tableName, valueColumn, keyColumn)
 		delQuery = fmt.Sprintf("DELETE FROM %s WHERE %s = $1", tableName, keyColumn)
+		casQuery = fmt.Sprintf("UPDATE %s SET %s = $3 WHERE %s = $1 AND %s = $2", tableName, valueColumn, keyColumn, valueColumn)
 	}
 
 	return s.wrapped.Init(config.NewMap(cfg.Globals, config.Node{
@@ -133,6 +136,10 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 				Name: "del",
 				Args: []string{delQuery},
 			},
+			{
+				Name: "cas",
+				Args: []string{casQuery},
+			},
 			{
 				Name: "init",
 				Args: []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
@@ -168,6 +175,14 @@ func (s *SQLTable) SetKey(k, v string) error {
 	return s.wrapped.SetKey(k, v)
 }
 
+func (s *SQLTable) SetKeyMulti(k string, values []string) error {
+	return s.wrapped.SetKeyMulti(k, values)
+}
+
+func (s *SQLTable) CompareAndSetKey(k, old, v string) (bool, error) {
+	return s.wrapped.CompareAndSetKey(k, old, v)
+}
+
 func init() {
 	module.Register("table.sql_table", NewSQLTable)
 }
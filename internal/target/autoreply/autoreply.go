@@ -0,0 +1,252 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package autoreply implements target.autoreply, a delivery target that
+// answers messages with per-account vacation (out-of-office) replies.
+//
+// The target does not store messages, it is meant to be used in addition to
+// the local delivery target. Replies follow RFC 3834: they are sent with the
+// null envelope sender and Auto-Submitted: auto-replied, messages from
+// automated senders and mailing lists are not answered, and each sender gets
+// at most one reply per interval.
+package autoreply
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "target.autoreply"
+
+	// DefaultInterval is the minimal interval between replies to the same
+	// sender recommended by RFC 3834, Section 2.
+	DefaultInterval = 7 * 24 * time.Hour
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	store            *Store
+	reply            module.DeliveryTarget
+	autogenMsgDomain string
+	interval         time.Duration
+
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("target.autoreply: inline arguments are not used")
+	}
+
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		now:      time.Now,
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var (
+		storage  module.Storage
+		hostname string
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &storage)
+	cfg.String("hostname", true, true, "", &hostname)
+	cfg.String("autogenerated_msg_domain", true, true, "", &t.autogenMsgDomain)
+	cfg.Duration("interval", false, false, DefaultInterval, &t.interval)
+	cfg.Custom("reply", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		return msgpipeline.New(m.Globals, node.Children)
+	}, &t.reply)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	sqlStorage, ok := storage.(*imapsql.Storage)
+	if !ok {
+		return errors.New("target.autoreply: storage.imapsql is required")
+	}
+	t.store = &Store{DB: sqlStorage.Back.DB, Driver: sqlStorage.Driver()}
+	if err := t.store.Init(); err != nil {
+		return err
+	}
+	if err := t.store.Prune(t.now(), t.interval); err != nil {
+		t.log.Error("failed to prune replies log", err)
+	}
+
+	t.reply.(*msgpipeline.MsgPipeline).Hostname = hostname
+	t.reply.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "autoreply/pipeline", Debug: t.log.Debug}
+
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+type delivery struct {
+	t        *Target
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+	header   textproto.Header
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	d.header = header.Copy()
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+// Commit sends replies for recipients with active vacation settings.
+// Failures are logged and never affect delivery of the original message.
+func (d *delivery) Commit(ctx context.Context) error {
+	if reason := SkipReason(d.mailFrom, d.header); reason != "" {
+		d.log.DebugMsg("not replying", "reason", reason)
+		return nil
+	}
+
+	sender, err := address.ForLookup(d.mailFrom)
+	if err != nil {
+		return nil
+	}
+
+	now := d.t.now()
+	for _, rcpt := range d.rcpts {
+		user, err := address.ForLookup(rcpt)
+		if err != nil || user == sender {
+			continue
+		}
+
+		st, err := d.t.store.Get(user)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				d.log.Error("failed to get vacation settings", err, "rcpt", rcpt)
+			}
+			continue
+		}
+		if !st.Active(now) {
+			continue
+		}
+
+		if !AddressedTo(d.header, rcpt, d.msgMeta.OriginalRcpts[rcpt]) {
+			d.log.DebugMsg("not replying", "reason", "recipient is not listed in header", "rcpt", rcpt)
+			continue
+		}
+
+		send, err := d.t.store.MarkReplied(user, sender, now, d.t.interval)
+		if err != nil {
+			d.log.Error("failed to check replies log", err, "rcpt", rcpt)
+			continue
+		}
+		if !send {
+			d.log.DebugMsg("not replying", "reason", "already replied", "rcpt", rcpt)
+			continue
+		}
+
+		d.sendReply(ctx, rcpt, st, now)
+	}
+
+	return nil
+}
+
+func (d *delivery) sendReply(ctx context.Context, rcpt string, st Settings, now time.Time) {
+	replyID, err := module.GenerateMsgID()
+	if err != nil {
+		d.log.Error("rand.Rand error", err)
+		return
+	}
+
+	header, body := BuildReply(rcpt, d.mailFrom, replyID+"@"+d.t.autogenMsgDomain, st, d.header, now)
+
+	replyMeta := &module.MsgMetadata{
+		ID: replyID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8: d.msgMeta.SMTPOpts.UTF8,
+		},
+	}
+
+	// Null return-path, per RFC 3834, Section 3.3.
+	dl, err := d.t.reply.Start(ctx, replyMeta, "")
+	if err != nil {
+		d.log.Error("failed to enqueue reply", err, "rcpt", rcpt, "reply_id", replyID)
+		return
+	}
+	defer func() {
+		if err != nil {
+			d.log.Error("failed to enqueue reply", err, "rcpt", rcpt, "reply_id", replyID)
+			if err := dl.Abort(ctx); err != nil {
+				d.log.Error("failed to abort reply delivery", err, "reply_id", replyID)
+			}
+		}
+	}()
+
+	if err = dl.AddRcpt(ctx, d.mailFrom, smtp.RcptOptions{}); err != nil {
+		return
+	}
+	if err = dl.Body(ctx, header, buffer.MemoryBuffer{Slice: body}); err != nil {
+		return
+	}
+	if err = dl.Commit(ctx); err != nil {
+		return
+	}
+
+	d.log.Msg("sent vacation reply", "rcpt", rcpt, "reply_id", replyID)
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,205 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testTarget(t *testing.T) (*Target, *testutils.Target, *time.Time) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(testutils.Dir(t), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &Store{DB: db}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1000000000, 0)
+	reply := &testutils.Target{}
+	return &Target{
+		log:              testutils.Logger(t, modName),
+		store:            store,
+		reply:            reply,
+		autogenMsgDomain: "mx.example.com",
+		interval:         DefaultInterval,
+		now:              func() time.Time { return now },
+	}, reply, &now
+}
+
+func deliver(t *testing.T, tgt *Target, from string, to []string, hdr textproto.Header) {
+	t.Helper()
+	ctx := context.Background()
+
+	dl, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range to {
+		if err := dl.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dl.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dl.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoreply(t *testing.T) {
+	tgt, reply, now := testTarget(t)
+
+	err := tgt.store.Set("alice@example.com", Settings{
+		Enabled: true,
+		Subject: "Out of office",
+		Body:    "I am away.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := header("To", "alice@example.com, dave@example.com", "Message-Id", "<orig@example.org>")
+	deliver(t, tgt, "bob@example.org", []string{"alice@example.com", "dave@example.com"}, hdr)
+
+	if len(reply.Messages) != 1 {
+		t.Fatalf("expected 1 reply, got %d", len(reply.Messages))
+	}
+	msg := reply.Messages[0]
+	if msg.MailFrom != "" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "bob@example.org" {
+		t.Errorf("wrong reply envelope: from %q, to %v", msg.MailFrom, msg.RcptTo)
+	}
+	if msg.Header.Get("From") != "<alice@example.com>" || msg.Header.Get("Subject") != "Out of office" {
+		t.Errorf("wrong reply header: %v", msg.Header)
+	}
+	if msg.Header.Get("In-Reply-To") != "<orig@example.org>" {
+		t.Errorf("wrong In-Reply-To: %v", msg.Header.Get("In-Reply-To"))
+	}
+
+	// Same sender within the interval.
+	deliver(t, tgt, "bob@example.org", []string{"alice@example.com"}, hdr)
+	if len(reply.Messages) != 1 {
+		t.Fatal("duplicate reply sent within the interval")
+	}
+
+	// Other sender.
+	deliver(t, tgt, "carol@example.org", []string{"alice@example.com"}, hdr)
+	if len(reply.Messages) != 2 {
+		t.Fatal("no reply sent to other sender")
+	}
+
+	// Interval passed.
+	*now = now.Add(DefaultInterval)
+	deliver(t, tgt, "bob@example.org", []string{"alice@example.com"}, hdr)
+	if len(reply.Messages) != 3 {
+		t.Fatal("no reply sent after the interval")
+	}
+}
+
+func TestAutoreply_Skip(t *testing.T) {
+	tgt, reply, now := testTarget(t)
+
+	err := tgt.store.Set("alice@example.com", Settings{
+		Enabled: true,
+		Body:    "I am away.",
+		End:     now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := []string{"alice@example.com"}
+	deliver(t, tgt, "", to, header("To", "alice@example.com"))
+	deliver(t, tgt, "bob@example.org", to, header("To", "alice@example.com", "Auto-Submitted", "auto-replied"))
+	deliver(t, tgt, "bob@example.org", to, header("To", "alice@example.com", "List-Id", "<list.example.org>"))
+	deliver(t, tgt, "bob@example.org", to, header("To", "list@example.org"))
+	deliver(t, tgt, "alice@example.com", to, header("To", "alice@example.com"))
+	if len(reply.Messages) != 0 {
+		t.Fatalf("expected no replies, got %d", len(reply.Messages))
+	}
+
+	*now = now.Add(time.Hour)
+	deliver(t, tgt, "bob@example.org", to, header("To", "alice@example.com"))
+	if len(reply.Messages) != 0 {
+		t.Fatal("reply sent after the end date")
+	}
+}
+
+func TestStore(t *testing.T) {
+	tgt, _, now := testTarget(t)
+	s := tgt.store
+
+	if _, err := s.Get("alice@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+
+	st := Settings{Enabled: true, Subject: "Away", Body: "Text", Start: now.Add(-time.Hour), End: now.Add(time.Hour)}
+	if err := s.Set("alice@example.com", st); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != st.Subject || got.Body != st.Body || !got.Start.Equal(st.Start) || !got.End.Equal(st.End) || !got.Enabled {
+		t.Fatalf("wrong settings: %+v", got)
+	}
+
+	if ok, err := s.MarkReplied("alice@example.com", "bob@example.org", *now, time.Hour); err != nil || !ok {
+		t.Fatal("first reply should be sent", err)
+	}
+	if ok, err := s.MarkReplied("alice@example.com", "bob@example.org", *now, time.Hour); err != nil || ok {
+		t.Fatal("second reply should not be sent", err)
+	}
+
+	// Changing settings resets the log.
+	if err := s.Set("alice@example.com", st); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.MarkReplied("alice@example.com", "bob@example.org", *now, time.Hour); err != nil || !ok {
+		t.Fatal("reply should be sent after settings change", err)
+	}
+
+	if err := s.Delete("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("alice@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+}
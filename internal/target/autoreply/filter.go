@@ -0,0 +1,152 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"bytes"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// listHeaders indicate that the message was sent through a mailing list
+// (RFC 2369, RFC 2919).
+var listHeaders = []string{
+	"List-Id", "List-Help", "List-Subscribe", "List-Unsubscribe",
+	"List-Post", "List-Owner", "List-Archive",
+}
+
+// SkipReason returns the reason why the message should not be answered
+// automatically or an empty string if it can be answered.
+//
+// See RFC 3834, Section 2 for the list of conditions.
+func SkipReason(mailFrom string, header textproto.Header) string {
+	if mailFrom == "" {
+		return "null sender"
+	}
+
+	local, _, err := address.Split(mailFrom)
+	if err != nil {
+		return "malformed sender"
+	}
+	local = strings.ToLower(local)
+	switch {
+	case local == "mailer-daemon", local == "postmaster", local == "listserv", local == "majordomo",
+		strings.HasPrefix(local, "owner-"), strings.HasSuffix(local, "-request"),
+		strings.HasPrefix(local, "bounce"), strings.HasPrefix(local, "noreply"), strings.HasPrefix(local, "no-reply"):
+		return "automated sender"
+	}
+
+	if v := strings.TrimSpace(header.Get("Auto-Submitted")); v != "" && !strings.EqualFold(v, "no") {
+		return "auto-submitted message"
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "bulk message"
+	}
+
+	for _, field := range listHeaders {
+		if header.Has(field) {
+			return "mailing list message"
+		}
+	}
+
+	// Used by Microsoft Exchange to suppress out-of-office replies.
+	for _, v := range strings.Split(header.Get("X-Auto-Response-Suppress"), ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "oof", "all":
+			return "auto-response suppressed"
+		}
+	}
+
+	return ""
+}
+
+// AddressedTo reports whether any of the addresses is listed as a
+// recipient in the message header. Replies to messages that reach the
+// account only as a blind copy or via a mailing list should not be sent.
+func AddressedTo(header textproto.Header, addrs ...string) bool {
+	want := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if norm, err := address.ForLookup(addr); err == nil {
+			want[norm] = struct{}{}
+		}
+	}
+
+	h := mail.Header{Header: message.Header{Header: header}}
+	for _, field := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc"} {
+		list, err := h.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			norm, err := address.ForLookup(a.Address)
+			if err != nil {
+				continue
+			}
+			if _, ok := want[norm]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BuildReply generates the auto-reply message. from is the address of the
+// account, to is the envelope sender of the original message.
+func BuildReply(from, to, msgID string, st Settings, orig textproto.Header, now time.Time) (textproto.Header, []byte) {
+	origHdr := mail.Header{Header: message.Header{Header: orig}}
+
+	subject := st.Subject
+	if subject == "" {
+		origSubject, _ := origHdr.Subject()
+		subject = "Auto: " + origSubject
+	}
+
+	h := mail.Header{}
+	h.Set("Date", now.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	h.Set("From", "<"+from+">")
+	h.Set("To", "<"+to+">")
+	h.Set("Subject", mime.QEncoding.Encode("utf-8", subject))
+	h.Set("Message-Id", "<"+msgID+">")
+	if origID, err := origHdr.MessageID(); err == nil && origID != "" {
+		refs, _ := origHdr.MsgIDList("References")
+		h.SetMsgIDList("In-Reply-To", []string{origID})
+		h.SetMsgIDList("References", append(refs, origID))
+	}
+	h.Set("Auto-Submitted", "auto-replied")
+	h.Set("MIME-Version", "1.0")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	// Line breaks are converted to CRLF by the writer.
+	_, _ = w.Write([]byte(st.Body))
+	_ = w.Close()
+
+	return h.Header.Header, body.Bytes()
+}
@@ -0,0 +1,153 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func header(fields ...string) textproto.Header {
+	h := textproto.Header{}
+	for i := 0; i < len(fields); i += 2 {
+		h.Add(fields[i], fields[i+1])
+	}
+	return h
+}
+
+func TestSkipReason(t *testing.T) {
+	cases := []struct {
+		name     string
+		mailFrom string
+		header   textproto.Header
+		skip     bool
+	}{
+		{"plain", "bob@example.org", header("To", "alice@example.com"), false},
+		{"null sender", "", header(), true},
+		{"mailer-daemon", "MAILER-DAEMON@example.org", header(), true},
+		{"owner", "owner-list@example.org", header(), true},
+		{"request", "list-request@example.org", header(), true},
+		{"noreply", "noreply@example.org", header(), true},
+		{"auto-submitted no", "bob@example.org", header("Auto-Submitted", "no"), false},
+		{"auto-replied", "bob@example.org", header("Auto-Submitted", "auto-replied"), true},
+		{"auto-generated", "bob@example.org", header("Auto-Submitted", "auto-generated; owner-email=x@example.org"), true},
+		{"precedence bulk", "bob@example.org", header("Precedence", "bulk"), true},
+		{"precedence list", "bob@example.org", header("Precedence", "List"), true},
+		{"list-id", "bob@example.org", header("List-Id", "<list.example.org>"), true},
+		{"list-unsubscribe", "bob@example.org", header("List-Unsubscribe", "<mailto:x@example.org>"), true},
+		{"suppress oof", "bob@example.org", header("X-Auto-Response-Suppress", "DR, OOF"), true},
+		{"suppress other", "bob@example.org", header("X-Auto-Response-Suppress", "DR"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reason := SkipReason(c.mailFrom, c.header)
+			if (reason != "") != c.skip {
+				t.Fatalf("skip = %v (%q), want %v", reason != "", reason, c.skip)
+			}
+		})
+	}
+}
+
+func TestAddressedTo(t *testing.T) {
+	h := header(
+		"To", "Bob <bob@example.org>, \"Alice\" <Alice@Example.com>",
+		"Cc", "carol@example.org",
+	)
+	if !AddressedTo(h, "alice@example.com") {
+		t.Error("alice should be listed in To")
+	}
+	if !AddressedTo(h, "dave@example.org", "carol@example.org") {
+		t.Error("carol should be listed in Cc")
+	}
+	if AddressedTo(h, "dave@example.org") {
+		t.Error("dave is not listed")
+	}
+	if AddressedTo(header("To", "undisclosed-recipients:;"), "dave@example.org") {
+		t.Error("dave is not listed")
+	}
+}
+
+func TestSettingsActive(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	cases := []struct {
+		name   string
+		st     Settings
+		active bool
+	}{
+		{"disabled", Settings{}, false},
+		{"unlimited", Settings{Enabled: true}, true},
+		{"started", Settings{Enabled: true, Start: now.Add(-time.Hour)}, true},
+		{"not started", Settings{Enabled: true, Start: now.Add(time.Hour)}, false},
+		{"ended", Settings{Enabled: true, End: now}, false},
+		{"not ended", Settings{Enabled: true, Start: now.Add(-time.Hour), End: now.Add(time.Hour)}, true},
+	}
+	for _, c := range cases {
+		if c.st.Active(now) != c.active {
+			t.Errorf("%s: active = %v, want %v", c.name, !c.active, c.active)
+		}
+	}
+}
+
+func TestBuildReply(t *testing.T) {
+	orig := header(
+		"Subject", "Meeting",
+		"Message-Id", "<orig@example.org>",
+		"References", "<first@example.org>",
+	)
+	now := time.Unix(1000000, 0)
+	h, body := BuildReply("alice@example.com", "bob@example.org", "reply@example.com",
+		Settings{Enabled: true, Body: "I am away.\nBack on Monday."}, orig, now)
+
+	check := func(field, want string) {
+		t.Helper()
+		if got := h.Get(field); got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+	check("From", "<alice@example.com>")
+	check("To", "<bob@example.org>")
+	check("Subject", "Auto: Meeting")
+	check("Message-Id", "<reply@example.com>")
+	check("In-Reply-To", "<orig@example.org>")
+	check("References", "<first@example.org> <orig@example.org>")
+	check("Auto-Submitted", "auto-replied")
+
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(body))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "I am away.\r\nBack on Monday." {
+		t.Errorf("body = %q", decoded)
+	}
+
+	h, _ = BuildReply("alice@example.com", "bob@example.org", "reply@example.com",
+		Settings{Enabled: true, Subject: "Hors du bureau — absent", Body: "."}, header(), now)
+	if !strings.HasPrefix(h.Get("Subject"), "=?utf-8?q?") {
+		t.Errorf("non-ASCII subject is not encoded: %q", h.Get("Subject"))
+	}
+	if h.Has("In-Reply-To") {
+		t.Error("In-Reply-To should not be set without Message-Id")
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/sqldialect"
+)
+
+var ErrNotFound = errors.New("autoreply: no vacation settings")
+
+// Settings is the vacation configuration of an account.
+type Settings struct {
+	Enabled bool
+	Subject string
+	Body    string
+
+	// Start and End limit the period when replies are sent. Zero value
+	// means no limit.
+	Start time.Time
+	End   time.Time
+}
+
+// Active reports whether replies should be sent at the given time.
+func (s Settings) Active(now time.Time) bool {
+	if !s.Enabled {
+		return false
+	}
+	if !s.Start.IsZero() && now.Before(s.Start) {
+		return false
+	}
+	if !s.End.IsZero() && !now.Before(s.End) {
+		return false
+	}
+	return true
+}
+
+// Store keeps vacation settings and the log of sent replies in the SQL
+// database shared with storage.imapsql.
+type Store struct {
+	DB *sql.DB
+	// Driver is the name of the SQL driver used for DB, queries are adapted
+	// to it using sqldialect.Rebind.
+	Driver string
+}
+
+func (s *Store) rebind(query string) string {
+	return sqldialect.Rebind(s.Driver, query)
+}
+
+// Init creates the tables used by the store if they don't exist.
+func (s *Store) Init() error {
+	_, err := s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS vacation_settings (
+			username VARCHAR(255) NOT NULL PRIMARY KEY,
+			enabled INTEGER NOT NULL DEFAULT 0,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			start_at BIGINT NOT NULL DEFAULT 0,
+			end_at BIGINT NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("autoreply: init: %w", err)
+	}
+
+	_, err = s.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS vacation_replies (
+			username VARCHAR(255) NOT NULL,
+			sender VARCHAR(255) NOT NULL,
+			sent_at BIGINT NOT NULL,
+			PRIMARY KEY (username, sender)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("autoreply: init: %w", err)
+	}
+	return nil
+}
+
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
+
+// Get returns the vacation settings of the account. ErrNotFound is returned
+// if there are none.
+func (s *Store) Get(username string) (Settings, error) {
+	var (
+		st             Settings
+		enabled        int
+		start, endTime int64
+	)
+	err := s.DB.QueryRow(s.rebind(`SELECT enabled, subject, body, start_at, end_at FROM vacation_settings WHERE username = $1`),
+		username).Scan(&enabled, &st.Subject, &st.Body, &start, &endTime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Settings{}, ErrNotFound
+		}
+		return Settings{}, fmt.Errorf("autoreply: get %s: %w", username, err)
+	}
+	st.Enabled = enabled != 0
+	st.Start = fromUnix(start)
+	st.End = fromUnix(endTime)
+	return st, nil
+}
+
+// Set replaces the vacation settings of the account. The log of sent replies
+// is reset so senders get a reply for the new settings.
+func (s *Store) Set(username string, st Settings) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("autoreply: set %s: %w", username, err)
+	}
+	defer tx.Rollback()
+
+	enabled := 0
+	if st.Enabled {
+		enabled = 1
+	}
+
+	if _, err := tx.Exec(s.rebind(`DELETE FROM vacation_settings WHERE username = $1`), username); err != nil {
+		return fmt.Errorf("autoreply: set %s: %w", username, err)
+	}
+	if _, err := tx.Exec(s.rebind(`DELETE FROM vacation_replies WHERE username = $1`), username); err != nil {
+		return fmt.Errorf("autoreply: set %s: %w", username, err)
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO vacation_settings (username, enabled, subject, body, start_at, end_at) VALUES ($1, $2, $3, $4, $5, $6)`),
+		username, enabled, st.Subject, st.Body, toUnix(st.Start), toUnix(st.End))
+	if err != nil {
+		return fmt.Errorf("autoreply: set %s: %w", username, err)
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the vacation settings of the account.
+func (s *Store) Delete(username string) error {
+	res, err := s.DB.Exec(s.rebind(`DELETE FROM vacation_settings WHERE username = $1`), username)
+	if err != nil {
+		return fmt.Errorf("autoreply: delete %s: %w", username, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := s.DB.Exec(s.rebind(`DELETE FROM vacation_replies WHERE username = $1`), username); err != nil {
+		return fmt.Errorf("autoreply: delete %s: %w", username, err)
+	}
+	return nil
+}
+
+// MarkReplied records a reply to the sender unless one was already sent
+// within the window. It reports whether the reply should be sent.
+func (s *Store) MarkReplied(username, sender string, now time.Time, window time.Duration) (bool, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("autoreply: mark replied: %w", err)
+	}
+	defer tx.Rollback()
+
+	var sentAt int64
+	err = tx.QueryRow(s.rebind(`SELECT sent_at FROM vacation_replies WHERE username = $1 AND sender = $2`),
+		username, sender).Scan(&sentAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec(s.rebind(`INSERT INTO vacation_replies (username, sender, sent_at) VALUES ($1, $2, $3)`),
+			username, sender, now.Unix())
+	case err != nil:
+	case now.Sub(time.Unix(sentAt, 0)) < window:
+		return false, nil
+	default:
+		_, err = tx.Exec(s.rebind(`UPDATE vacation_replies SET sent_at = $1 WHERE username = $2 AND sender = $3`),
+			now.Unix(), username, sender)
+	}
+	if err != nil {
+		return false, fmt.Errorf("autoreply: mark replied: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("autoreply: mark replied: %w", err)
+	}
+	return true, nil
+}
+
+// Prune removes log entries older than the window.
+func (s *Store) Prune(now time.Time, window time.Duration) error {
+	_, err := s.DB.Exec(s.rebind(`DELETE FROM vacation_replies WHERE sent_at < $1`), now.Add(-window).Unix())
+	if err != nil {
+		return fmt.Errorf("autoreply: prune: %w", err)
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package target
 
 import (
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 )
@@ -32,3 +33,24 @@ func DeliveryLogger(l log.Logger, msgMeta *module.MsgMetadata) log.Logger {
 	l.Fields = fields
 	return l
 }
+
+// PublishEvent publishes the message.* event. The message ID, client
+// address and authenticated user are added to data.
+func PublishEvent(typ string, msgMeta *module.MsgMetadata, data map[string]interface{}) {
+	if !events.Enabled() {
+		return
+	}
+	if data == nil {
+		data = make(map[string]interface{}, 3)
+	}
+	data["msgId"] = msgMeta.ID
+	if msgMeta.Conn != nil {
+		if msgMeta.Conn.RemoteAddr != nil {
+			data["srcIp"] = msgMeta.Conn.RemoteAddr.String()
+		}
+		if msgMeta.Conn.AuthUser != "" {
+			data["authUser"] = msgMeta.Conn.AuthUser
+		}
+	}
+	events.Publish(typ, data)
+}
@@ -0,0 +1,337 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package forward implements target.forward, a delivery target that applies
+// per-account forwarding rules on top of local delivery.
+//
+// Messages for accounts without a rule are passed to the local target as is.
+// For accounts with a rule, the message is passed to the forwarding target
+// (normally target.queue with target.remote behind it) for each configured
+// destination, with the envelope sender rewritten using SRS. If the account
+// itself is listed as one of destinations, a copy is also delivered locally.
+//
+// Bounces sent to SRS addresses of srs_domain are reversed and routed back
+// to the original sender via the forwarding target.
+package forward
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/srs"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.forward"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	rules   module.Table
+	local   module.DeliveryTarget
+	forward module.DeliveryTarget
+	srs     srs.Rewriter
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("target.forward: inline arguments are not used")
+	}
+
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var secrets []string
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Custom("rules", false, true, nil, modconfig.TableDirective, &t.rules)
+	cfg.Custom("local_target", false, true, nil, modconfig.DeliveryDirective, &t.local)
+	cfg.Custom("forward_target", false, true, nil, modconfig.DeliveryDirective, &t.forward)
+	cfg.String("srs_domain", false, true, "", &t.srs.Domain)
+	cfg.StringList("srs_secrets", false, true, nil, &secrets)
+	cfg.Duration("srs_max_age", false, false, srs.DefaultMaxAge, &t.srs.MaxAge)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			return errors.New("target.forward: empty SRS secret")
+		}
+		t.srs.Secrets = append(t.srs.Secrets, []byte(secret))
+	}
+
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+// destinations returns forwarding destinations for the address. Empty
+// list means there is no forwarding rule.
+func (t *Target) destinations(ctx context.Context, rcptTo string) ([]string, error) {
+	normRcpt, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return nil, nil
+	}
+
+	if multi, ok := t.rules.(module.MultiTable); ok {
+		return multi.LookupMulti(ctx, normRcpt)
+	}
+	dest, ok, err := t.rules.Lookup(ctx, normRcpt)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{dest}, nil
+}
+
+func (t *Target) isSRSRcpt(rcptTo string) bool {
+	if !srs.IsSRS(rcptTo) {
+		return false
+	}
+	_, domain, err := address.Split(rcptTo)
+	return err == nil && strings.EqualFold(domain, t.srs.Domain)
+}
+
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	local     module.Delivery
+	forwarded module.Delivery
+	fwdMeta   *module.MsgMetadata
+	bounced   module.Delivery
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+	}, nil
+}
+
+func (d *delivery) localDelivery(ctx context.Context) (module.Delivery, error) {
+	if d.local == nil {
+		var err error
+		d.local, err = d.t.local.Start(ctx, d.msgMeta, d.mailFrom)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d.local, nil
+}
+
+func (d *delivery) forwardDelivery(ctx context.Context) (module.Delivery, error) {
+	if d.forwarded != nil {
+		return d.forwarded, nil
+	}
+
+	mailFrom, err := d.t.srs.Forward(d.mailFrom)
+	if err != nil {
+		d.log.Error("cannot rewrite sender, forwarding as is", err, "from", d.mailFrom)
+		mailFrom = d.mailFrom
+	}
+
+	// Queue uses message ID to name its files, so it should differ from the
+	// one used by other deliveries of the same message.
+	d.fwdMeta = d.msgMeta.DeepCopy()
+	d.fwdMeta.ID = d.msgMeta.ID + "-fwd"
+	d.fwdMeta.OriginalRcpts = map[string]string{}
+
+	d.forwarded, err = d.t.forward.Start(ctx, d.fwdMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return d.forwarded, nil
+}
+
+func (d *delivery) bounceDelivery(ctx context.Context) (module.Delivery, error) {
+	if d.bounced != nil {
+		return d.bounced, nil
+	}
+
+	meta := d.msgMeta.DeepCopy()
+	meta.ID = d.msgMeta.ID + "-srs"
+
+	var err error
+	d.bounced, err = d.t.forward.Start(ctx, meta, d.mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return d.bounced, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	if d.t.isSRSRcpt(rcptTo) {
+		orig, err := d.t.srs.Reverse(rcptTo)
+		if err != nil {
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+				Message:      "Invalid or expired SRS address",
+				TargetName:   modName,
+				Err:          err,
+			}
+		}
+		dl, err := d.bounceDelivery(ctx)
+		if err != nil {
+			return err
+		}
+		d.log.DebugMsg("reversed SRS address", "rcpt", rcptTo, "orig_rcpt", orig)
+		return dl.AddRcpt(ctx, orig, smtp.RcptOptions{})
+	}
+
+	dests, err := d.t.destinations(ctx, rcptTo)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during forwarding rules lookup",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	if len(dests) == 0 {
+		dl, err := d.localDelivery(ctx)
+		if err != nil {
+			return err
+		}
+		return dl.AddRcpt(ctx, rcptTo, opts)
+	}
+
+	normRcpt, _ := address.ForLookup(rcptTo)
+	origRcpt := rcptTo
+	if orig, ok := d.msgMeta.OriginalRcpts[rcptTo]; ok {
+		origRcpt = orig
+	}
+	for _, dest := range dests {
+		if normDest, err := address.ForLookup(dest); err == nil && normDest == normRcpt {
+			// Keep a copy.
+			dl, err := d.localDelivery(ctx)
+			if err != nil {
+				return err
+			}
+			if err := dl.AddRcpt(ctx, rcptTo, opts); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dl, err := d.forwardDelivery(ctx)
+		if err != nil {
+			return err
+		}
+		if err := dl.AddRcpt(ctx, dest, smtp.RcptOptions{}); err != nil {
+			return err
+		}
+		d.fwdMeta.OriginalRcpts[dest] = origRcpt
+		d.log.DebugMsg("forwarding", "rcpt", rcptTo, "dest", dest)
+	}
+
+	return nil
+}
+
+// deliveries returns started deliveries in the order used by Body and Abort.
+// Commit uses its own order.
+func (d *delivery) deliveries() []module.Delivery {
+	// Local delivery goes first, so the message is not copied for
+	// forwarding if the local copy is rejected (e.g. over quota).
+	var res []module.Delivery
+	for _, dl := range []module.Delivery{d.local, d.forwarded, d.bounced} {
+		if dl != nil {
+			res = append(res, dl)
+		}
+	}
+	return res
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	for _, dl := range d.deliveries() {
+		if err := dl.Body(ctx, header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	var lastErr error
+	for _, dl := range d.deliveries() {
+		if err := dl.Abort(ctx); err != nil {
+			d.log.Error("abort failed", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Commit commits reversed bounces first, then forwarded copies and then the
+// local one. If any of them fails, the rest are aborted, so a retry by the
+// sender doesn't create duplicates in the mailbox or forwarded copies.
+//
+// Bounces go first as they are a separate message: if they fail, nothing is
+// committed yet. Committed deliveries cannot be rolled back though, so if
+// forwarding fails after that, the retry sends the bounce again. This is
+// accepted, bounces are rare and a duplicate bounce is less harmful than a
+// duplicate forwarded copy.
+func (d *delivery) Commit(ctx context.Context) error {
+	var dls []module.Delivery
+	for _, dl := range []module.Delivery{d.bounced, d.forwarded, d.local} {
+		if dl != nil {
+			dls = append(dls, dl)
+		}
+	}
+	for i, dl := range dls {
+		if err := dl.Commit(ctx); err != nil {
+			for _, rest := range dls[i+1:] {
+				if err := rest.Abort(ctx); err != nil {
+					d.log.Error("abort failed", err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
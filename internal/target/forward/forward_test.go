@@ -0,0 +1,196 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package forward
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/srs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type rulesTable map[string][]string
+
+func (r rulesTable) Lookup(ctx context.Context, key string) (string, bool, error) {
+	vals, _ := r.LookupMulti(ctx, key)
+	if len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func (r rulesTable) LookupMulti(_ context.Context, key string) ([]string, error) {
+	return r[key], nil
+}
+
+func testTarget(t *testing.T, rules rulesTable) (*Target, *testutils.Target, *testutils.Target) {
+	local := &testutils.Target{}
+	remote := &testutils.Target{}
+	return &Target{
+		log:     testutils.Logger(t, modName),
+		rules:   rules,
+		local:   local,
+		forward: remote,
+		srs: srs.Rewriter{
+			Domain:  "example.org",
+			Secrets: [][]byte{[]byte("secret")},
+		},
+	}, local, remote
+}
+
+func TestForward_NoRule(t *testing.T) {
+	tgt, local, remote := testTarget(t, rulesTable{})
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.com", []string{"alice@example.org"})
+
+	if len(local.Messages) != 1 || len(remote.Messages) != 0 {
+		t.Fatalf("want 1 local and 0 forwarded messages, got %d and %d", len(local.Messages), len(remote.Messages))
+	}
+	testutils.CheckTestMessage(t, local, 0, "sender@example.com", []string{"alice@example.org"})
+}
+
+func TestForward_KeepCopy(t *testing.T) {
+	tgt, local, remote := testTarget(t, rulesTable{
+		"alice@example.org": {"alice@example.net", "alice@example.org"},
+	})
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.com", []string{"alice@example.org", "bob@example.org"})
+
+	if len(local.Messages) != 1 || len(remote.Messages) != 1 {
+		t.Fatalf("want 1 local and 1 forwarded messages, got %d and %d", len(local.Messages), len(remote.Messages))
+	}
+	testutils.CheckTestMessage(t, local, 0, "sender@example.com", []string{"alice@example.org", "bob@example.org"})
+
+	fwd := remote.Messages[0]
+	if !strings.HasPrefix(fwd.MailFrom, "SRS0=") || !strings.HasSuffix(fwd.MailFrom, "@example.org") {
+		t.Fatal("sender is not rewritten:", fwd.MailFrom)
+	}
+	if len(fwd.RcptTo) != 1 || fwd.RcptTo[0] != "alice@example.net" {
+		t.Fatal("wrong forwarded recipients:", fwd.RcptTo)
+	}
+	if fwd.MsgMeta.ID == local.Messages[0].MsgMeta.ID {
+		t.Fatal("forwarded copy reuses message ID of the local one")
+	}
+	if fwd.MsgMeta.OriginalRcpts["alice@example.net"] != "alice@example.org" {
+		t.Fatal("original recipient is not recorded:", fwd.MsgMeta.OriginalRcpts)
+	}
+}
+
+func TestForward_CommitFailed(t *testing.T) {
+	tgt, local, remote := testTarget(t, rulesTable{
+		"alice@example.org": {"alice@example.net", "alice@example.org"},
+	})
+	remote.CommitErr = errors.New("queue is full")
+
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.com", []string{"alice@example.org"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	// The sender will retry, so the local copy should not be kept.
+	if len(local.Messages) != 0 {
+		t.Fatalf("want 0 local messages, got %d", len(local.Messages))
+	}
+}
+
+// idFailTarget fails Commit of messages with the ID suffix.
+type idFailTarget struct {
+	*testutils.Target
+	suffix string
+}
+
+type idFailDelivery struct {
+	module.Delivery
+	fail bool
+}
+
+func (t idFailTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	dl, err := t.Target.Start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return &idFailDelivery{Delivery: dl, fail: strings.HasSuffix(msgMeta.ID, t.suffix)}, nil
+}
+
+func (d *idFailDelivery) Commit(ctx context.Context) error {
+	if d.fail {
+		return errors.New("queue is full")
+	}
+	return d.Delivery.Commit(ctx)
+}
+
+func TestForward_BounceCommitFailed(t *testing.T) {
+	tgt, local, remote := testTarget(t, rulesTable{
+		"alice@example.org": {"alice@example.net", "alice@example.org"},
+	})
+	tgt.forward = idFailTarget{Target: remote, suffix: "-srs"}
+
+	srsAddr, err := tgt.srs.Forward("sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.com", []string{"alice@example.org", srsAddr}); err == nil {
+		t.Fatal("expected an error")
+	}
+	// The sender will retry, so neither the forwarded nor the local copy
+	// should be kept.
+	if len(local.Messages) != 0 || len(remote.Messages) != 0 {
+		t.Fatalf("want 0 local and 0 forwarded messages, got %d and %d", len(local.Messages), len(remote.Messages))
+	}
+}
+
+func TestForward_NoCopy(t *testing.T) {
+	tgt, local, remote := testTarget(t, rulesTable{
+		"alice@example.org": {"alice@example.net"},
+	})
+
+	testutils.DoTestDelivery(t, tgt, "", []string{"alice@example.org"})
+
+	if len(local.Messages) != 0 || len(remote.Messages) != 1 {
+		t.Fatalf("want 0 local and 1 forwarded messages, got %d and %d", len(local.Messages), len(remote.Messages))
+	}
+	// Null sender is kept as is.
+	if remote.Messages[0].MailFrom != "" {
+		t.Fatal("null sender is rewritten:", remote.Messages[0].MailFrom)
+	}
+}
+
+func TestForward_BounceReversal(t *testing.T) {
+	tgt, local, remote := testTarget(t, rulesTable{})
+
+	srsAddr, err := tgt.srs.Forward("sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, tgt, "", []string{srsAddr})
+
+	if len(local.Messages) != 0 || len(remote.Messages) != 1 {
+		t.Fatalf("want 0 local and 1 forwarded messages, got %d and %d", len(local.Messages), len(remote.Messages))
+	}
+	testutils.CheckMsgID(t, &remote.Messages[0], "", []string{"sender@example.com"}, "")
+
+	forged := strings.Replace(srsAddr, "=sender@", "=mallory@", 1)
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "", []string{forged}); err == nil {
+		t.Fatal("forged SRS address is accepted")
+	}
+}
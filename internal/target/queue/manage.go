@@ -0,0 +1,459 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/events"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Management of queued messages.
+//
+// Every message known to the queue has a msgState. A message is either
+// scheduled on the time wheel, held, parked (waiting only for recipients in
+// suspended domains) or busy (being delivered or modified by a management
+// operation). Only one goroutine can own a busy message, the
+// owner is responsible for either removing the message state (forget) or
+// putting it back on the wheel (schedule, unclaim), on hold (hold) or
+// parking it (park).
+//
+// The time wheel provides no way to remove a slot, so each state change
+// increments the generation counter and dispatch ignores slots created
+// for earlier generations.
+
+var (
+	ErrNotFound = errors.New("queue: message not found")
+	ErrBusy     = errors.New("queue: message is being delivered, try again later")
+	ErrNotHeld  = errors.New("queue: message is not held")
+)
+
+const (
+	StateScheduled  = "scheduled"
+	StateDelivering = "delivering"
+	StateHeld       = "held"
+	StateSuspended  = "suspended"
+)
+
+type msgState struct {
+	gen     int
+	busy    bool
+	held    bool
+	parked  bool
+	nextTry time.Time
+}
+
+// MessageInfo describes a queued message.
+type MessageInfo struct {
+	ID    string
+	State string
+	From  string
+
+	// Recipients delivery is pending for.
+	To []string
+	// Last error for each recipient.
+	RcptErrs   map[string]*smtp.SMTPError
+	TriesCount map[string]int
+
+	Size         int64
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	// Zero for held, suspended and messages being delivered.
+	NextAttempt time.Time
+}
+
+// claimSlot marks the message as busy if the slot is not outdated.
+func (q *Queue) claimSlot(slot queueSlot) bool {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	st, ok := q.msgs[slot.ID]
+	if !ok || st.gen != slot.Gen || st.busy || st.held || st.parked {
+		return false
+	}
+	st.busy = true
+	return true
+}
+
+// deliveryDone removes the message state if the delivery attempt did not
+// reschedule the message. This is the case if the message was fully
+// processed or could not be read from disk.
+func (q *Queue) deliveryDone(id string) {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	if st, ok := q.msgs[id]; ok && st.busy {
+		delete(q.msgs, id)
+	}
+}
+
+// claim marks the message as busy so management operations do not
+// interfere with the delivery and each other.
+func (q *Queue) claim(id string) (held bool, err error) {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	st, ok := q.msgs[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if st.busy {
+		return false, ErrBusy
+	}
+	st.busy = true
+	return st.held, nil
+}
+
+// unclaim returns the claimed message to its previous state.
+func (q *Queue) unclaim(id string) {
+	q.msgsLock.Lock()
+	st := q.msgs[id]
+	st.busy = false
+	st.gen++
+	slot := queueSlot{ID: id, Gen: st.gen}
+	nextTry, waiting := st.nextTry, st.held || st.parked
+	q.msgsLock.Unlock()
+
+	if !waiting {
+		q.wheel.Add(nextTry, slot)
+	}
+}
+
+// schedule adds the message to the wheel, all previously scheduled slots
+// for it become outdated.
+func (q *Queue) schedule(t time.Time, slot queueSlot) {
+	q.msgsLock.Lock()
+	st, ok := q.msgs[slot.ID]
+	if !ok {
+		st = &msgState{}
+		q.msgs[slot.ID] = st
+	}
+	st.busy = false
+	st.held = false
+	st.parked = false
+	st.gen++
+	st.nextTry = t
+	slot.Gen = st.gen
+	q.msgsLock.Unlock()
+
+	// Should not be called with msgsLock held since Add blocks until the
+	// wheel goroutine picks up the update and it might be waiting for
+	// msgsLock in dispatch.
+	q.wheel.Add(t, slot)
+}
+
+func (q *Queue) hold(id string) {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	st, ok := q.msgs[id]
+	if !ok {
+		st = &msgState{}
+		q.msgs[id] = st
+	}
+	st.busy = false
+	st.held = true
+	st.parked = false
+	st.gen++
+	st.nextTry = time.Time{}
+}
+
+func (q *Queue) forget(id string) {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+	delete(q.msgs, id)
+}
+
+func (q *Queue) setHeld(id string, held bool) error {
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		return err
+	}
+	meta.Held = held
+	return q.updateMetadataOnDisk(meta)
+}
+
+// List returns all messages in the queue ordered by the arrival time.
+func (q *Queue) List() ([]MessageInfo, error) {
+	q.msgsLock.Lock()
+	ids := make([]string, 0, len(q.msgs))
+	for id := range q.msgs {
+		ids = append(ids, id)
+	}
+	q.msgsLock.Unlock()
+
+	res := make([]MessageInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := q.Message(id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				// Removed while we were reading other messages.
+				continue
+			}
+			return nil, err
+		}
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].FirstAttempt.Before(res[j].FirstAttempt)
+	})
+	return res, nil
+}
+
+// Message returns information about the queued message.
+func (q *Queue) Message(id string) (MessageInfo, error) {
+	q.msgsLock.Lock()
+	st, ok := q.msgs[id]
+	var info MessageInfo
+	if ok {
+		info = MessageInfo{ID: id, State: StateScheduled, NextAttempt: st.nextTry}
+		switch {
+		case st.busy:
+			info.State = StateDelivering
+			info.NextAttempt = time.Time{}
+		case st.held:
+			info.State = StateHeld
+		case st.parked:
+			info.State = StateSuspended
+		}
+	}
+	q.msgsLock.Unlock()
+	if !ok {
+		return MessageInfo{}, ErrNotFound
+	}
+
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return MessageInfo{}, ErrNotFound
+		}
+		return MessageInfo{}, err
+	}
+	info.From = meta.From
+	info.To = meta.To
+	info.RcptErrs = meta.RcptErrs
+	info.TriesCount = meta.TriesCount
+	info.FirstAttempt = meta.FirstAttempt
+	info.LastAttempt = meta.LastAttempt
+
+	for _, ext := range []string{".header", ".body"} {
+		if fi, err := os.Stat(filepath.Join(q.location, id+ext)); err == nil {
+			info.Size += fi.Size()
+		}
+	}
+
+	return info, nil
+}
+
+// Retry schedules an immediate delivery attempt for the message. Held
+// messages are released.
+func (q *Queue) Retry(id string) error {
+	held, err := q.claim(id)
+	if err != nil {
+		return err
+	}
+	if held {
+		if err := q.setHeld(id, false); err != nil {
+			q.unclaim(id)
+			return err
+		}
+	}
+
+	q.Log.Msg("delivery retry requested", "msg_id", id)
+	q.schedule(time.Now(), queueSlot{ID: id})
+	return nil
+}
+
+// Hold stops delivery attempts for the message until it is released.
+// The held state is preserved across restarts.
+func (q *Queue) Hold(id string) error {
+	held, err := q.claim(id)
+	if err != nil {
+		return err
+	}
+	if held {
+		q.unclaim(id)
+		return nil
+	}
+	if err := q.setHeld(id, true); err != nil {
+		q.unclaim(id)
+		return err
+	}
+
+	q.Log.Msg("message held", "msg_id", id)
+	q.hold(id)
+	return nil
+}
+
+// Release schedules an immediate delivery attempt for the held message.
+func (q *Queue) Release(id string) error {
+	held, err := q.claim(id)
+	if err != nil {
+		return err
+	}
+	if !held {
+		q.unclaim(id)
+		return ErrNotHeld
+	}
+	if err := q.setHeld(id, false); err != nil {
+		q.unclaim(id)
+		return err
+	}
+
+	q.Log.Msg("message released", "msg_id", id)
+	q.schedule(time.Now(), queueSlot{ID: id})
+	return nil
+}
+
+// Drop removes the message from the queue without notifying the sender.
+func (q *Queue) Drop(id string) error {
+	if _, err := q.claim(id); err != nil {
+		return err
+	}
+
+	q.Log.Msg("message dropped", "msg_id", id)
+	q.removeFromDisk(&module.MsgMetadata{ID: id})
+	q.forget(id)
+	return nil
+}
+
+// Bounce removes the message from the queue and sends a DSN for all
+// pending recipients.
+func (q *Queue) Bounce(id string) error {
+	if _, err := q.claim(id); err != nil {
+		return err
+	}
+
+	meta, header, _, err := q.openMessage(id)
+	if err != nil {
+		q.unclaim(id)
+		return err
+	}
+	if meta.RcptErrs == nil {
+		meta.RcptErrs = map[string]*smtp.SMTPError{}
+	}
+
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+	for _, rcpt := range meta.To {
+		meta.RcptErrs[rcpt] = &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+			Message:      "Message bounced by the administrator",
+		}
+		q.publishEvent(events.MessageBounced, meta, rcpt, errors.New("bounced by the administrator"))
+		dl.Msg("not delivered, bounced by the administrator", "rcpt", rcpt)
+	}
+	q.emitDSN(meta, header, meta.To)
+	q.removeFromDisk(meta.MsgMeta)
+	q.forget(id)
+	return nil
+}
+
+// Purge removes recipients matching the sender and domain from all messages
+// in the queue. Messages without any pending recipients left are dropped,
+// no DSNs are sent.
+//
+// Empty sender or domain matches anything. Messages that are being
+// delivered are skipped. The amount of changed messages is returned.
+func (q *Queue) Purge(sender, domain string) (int, error) {
+	if sender == "" && domain == "" {
+		return 0, errors.New("queue: sender or domain is required")
+	}
+
+	q.msgsLock.Lock()
+	ids := make([]string, 0, len(q.msgs))
+	for id := range q.msgs {
+		ids = append(ids, id)
+	}
+	q.msgsLock.Unlock()
+
+	purged := 0
+	for _, id := range ids {
+		if _, err := q.claim(id); err != nil {
+			if errors.Is(err, ErrBusy) {
+				q.Log.Msg("message is being delivered, not purged", "msg_id", id)
+			}
+			continue
+		}
+
+		changed, err := q.purgeMessage(id, sender, domain)
+		if err != nil {
+			q.unclaim(id)
+			return purged, err
+		}
+		if changed {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// purgeMessage removes matching recipients from the claimed message and
+// returns it to the previous state or drops it.
+func (q *Queue) purgeMessage(id, sender, domain string) (bool, error) {
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		return false, err
+	}
+	if sender != "" && !strings.EqualFold(meta.From, sender) {
+		q.unclaim(id)
+		return false, nil
+	}
+
+	newRcpts := make([]string, 0, len(meta.To))
+	for _, rcpt := range meta.To {
+		if domain != "" {
+			_, rcptDomain, err := address.Split(rcpt)
+			if err != nil || !strings.EqualFold(rcptDomain, domain) {
+				newRcpts = append(newRcpts, rcpt)
+				continue
+			}
+		}
+		delete(meta.TriesCount, rcpt)
+	}
+
+	if len(newRcpts) == len(meta.To) {
+		q.unclaim(id)
+		return false, nil
+	}
+	if len(newRcpts) == 0 {
+		q.Log.Msg("message purged", "msg_id", id)
+		q.removeFromDisk(meta.MsgMeta)
+		q.forget(id)
+		return true, nil
+	}
+
+	meta.To = newRcpts
+	if err := q.updateMetadataOnDisk(meta); err != nil {
+		return false, err
+	}
+	q.Log.Msg("recipients purged", "msg_id", id, "remaining_rcpts", newRcpts)
+	q.unclaim(id)
+	return true, nil
+}
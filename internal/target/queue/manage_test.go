@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// waitState waits for the message to reach the state.
+func waitState(t *testing.T, q *Queue, id, state string) MessageInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := q.Message(id)
+		if err == nil && info.State == state {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message %s did not reach state %s: %+v, %v", id, state, info, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// deferredTarget fails the first n deliveries with a temporary error.
+func deferredTarget(n int) *unreliableTarget {
+	dt := &unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	for i := 0; i < n; i++ {
+		dt.bodyFailures = append(dt.bodyFailures, exterrors.WithTemporary(errors.New("try later"), true))
+	}
+	return dt
+}
+
+func TestQueueManage_HoldRelease(t *testing.T) {
+	t.Parallel()
+
+	dt := deferredTarget(1)
+	dir := t.TempDir()
+	q := newTestQueueDir(t, dt, dir)
+	q.initialRetryTime = time.Hour
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	info := waitState(t, q, id, StateScheduled)
+	if info.From != "tester@example.com" || !reflect.DeepEqual(info.To, []string{"tester1@example.org"}) {
+		t.Errorf("wrong envelope: %+v", info)
+	}
+	if info.TriesCount["tester1@example.org"] != 1 || info.RcptErrs["tester1@example.org"].Code != 451 {
+		t.Errorf("wrong delivery status: %+v", info)
+	}
+	if time.Until(info.NextAttempt) < 50*time.Minute {
+		t.Errorf("wrong next attempt time: %v", info.NextAttempt)
+	}
+
+	if err := q.Release(id); !errors.Is(err, ErrNotHeld) {
+		t.Fatalf("expected ErrNotHeld, got %v", err)
+	}
+	if err := q.Hold(id); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, q, id, StateHeld)
+
+	// Held state should survive the restart.
+	cleanQueue(t, q)
+	q = newTestQueueDir(t, dt, dir)
+	defer cleanQueue(t, q)
+	waitState(t, q, id, StateHeld)
+	select {
+	case <-dt.committed:
+		t.Fatal("held message was delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := q.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueManage_Retry(t *testing.T) {
+	t.Parallel()
+
+	dt := deferredTarget(1)
+	q := newTestQueue(t, dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	if err := q.Retry("nonexistent"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	waitState(t, q, id, StateScheduled)
+
+	if err := q.Retry(id); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueManage_Bounce(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := deferredTarget(1)
+	q := newTestQueue(t, dt)
+	q.initialRetryTime = time.Hour
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	waitState(t, q, id, StateScheduled)
+
+	if err := q.Bounce(id); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if msg.MailFrom != "" || !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong DSN envelope: %v, %v", msg.MailFrom, msg.RcptTo)
+	}
+	if _, err := q.Message(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueManage_Purge(t *testing.T) {
+	t.Parallel()
+
+	dt := deferredTarget(2)
+	q := newTestQueue(t, dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	var idA, idB string
+	t.Run("a", func(t *testing.T) {
+		idA = testutils.DoTestDelivery(t, q, "a@example.com", []string{"x@example.org", "y@example.net"})
+		readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	})
+	t.Run("b", func(t *testing.T) {
+		idB = testutils.DoTestDelivery(t, q, "b@example.com", []string{"z@example.org"})
+		readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	})
+	waitState(t, q, idA, StateScheduled)
+	waitState(t, q, idB, StateScheduled)
+
+	if _, err := q.Purge("", ""); err == nil {
+		t.Fatal("expected error for empty filter")
+	}
+
+	purged, err := q.Purge("", "EXAMPLE.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Fatalf("expected 2 purged messages, got %d", purged)
+	}
+
+	list, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != idA || !reflect.DeepEqual(list[0].To, []string{"y@example.net"}) {
+		t.Fatalf("wrong queue contents after purge: %+v", list)
+	}
+	if list[0].State != StateScheduled || time.Until(list[0].NextAttempt) < 50*time.Minute {
+		t.Fatalf("purge should not change the schedule: %+v", list[0])
+	}
+
+	if purged, err := q.Purge("b@example.com", ""); err != nil || purged != 0 {
+		t.Fatalf("expected nothing to be purged, got %d, %v", purged, err)
+	}
+	if err := q.Drop(idA); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
@@ -0,0 +1,365 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// suspendedFile stores the list of domains delivery is suspended for.
+const suspendedFile = "suspended.json"
+
+var ErrInvalidDomain = errors.New("queue: invalid domain")
+
+// DomainPolicy describes the retry schedule used for recipients in the
+// domain.
+type DomainPolicy struct {
+	// Empty for the queue defaults.
+	Domain string
+
+	InitialRetryTime time.Duration
+	RetryTimeScale   float64
+	MaxTries         int
+	// Zero if there is no limit.
+	MaxLifetime time.Duration
+
+	Suspended bool
+}
+
+// nextTry returns the time of the next attempt after the tries count
+// attempts, the last one made at last.
+func (p DomainPolicy) nextTry(last time.Time, tries int) time.Time {
+	// Delay between retries grows exponentally, the formula is:
+	// initialRetryTime * retryTimeScale ^ (tries - 1)
+	scaleFactor := time.Duration(math.Pow(p.RetryTimeScale, float64(tries-1)))
+	return last.Add(p.InitialRetryTime * scaleFactor)
+}
+
+// giveUp reports whether no more attempts should be made after tries
+// attempts for the message queued at firstAttempt.
+func (p DomainPolicy) giveUp(tries int, firstAttempt time.Time) bool {
+	if tries >= p.MaxTries {
+		return true
+	}
+	return p.MaxLifetime != 0 && time.Since(firstAttempt) >= p.MaxLifetime
+}
+
+// parseDomainPolicy handles the 'domain' directive. Values not set in the
+// block are negative and inherited from the queue defaults by
+// resolvePolicies.
+func (q *Queue) parseDomainPolicy(m *config.Map, node config.Node) error {
+	if len(node.Args) == 0 {
+		return config.NodeErr(node, "at least one domain is required")
+	}
+
+	var p DomainPolicy
+	pm := config.NewMap(m.Globals, node)
+	pm.Duration("initial_retry", false, false, -1, &p.InitialRetryTime)
+	pm.Float("retry_scale", false, false, -1, &p.RetryTimeScale)
+	pm.Int("max_tries", false, false, -1, &p.MaxTries)
+	pm.Duration("max_lifetime", false, false, -1, &p.MaxLifetime)
+	if _, err := pm.Process(); err != nil {
+		return err
+	}
+	if p.RetryTimeScale != -1 && p.RetryTimeScale < 1 {
+		return config.NodeErr(node, "retry_scale should be at least 1")
+	}
+	if p.MaxTries != -1 && p.MaxTries < 1 {
+		return config.NodeErr(node, "max_tries should be at least 1")
+	}
+
+	if q.domainPolicies == nil {
+		q.domainPolicies = make(map[string]DomainPolicy)
+	}
+	for _, domain := range node.Args {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return config.NodeErr(node, "invalid domain: %s", domain)
+		}
+		if _, ok := q.domainPolicies[normDomain]; ok {
+			return config.NodeErr(node, "duplicate policy for %s", domain)
+		}
+		p.Domain = normDomain
+		q.domainPolicies[normDomain] = p
+	}
+	return nil
+}
+
+func (q *Queue) resolvePolicies() {
+	def := q.defaultPolicy()
+	for domain, p := range q.domainPolicies {
+		if p.InitialRetryTime < 0 {
+			p.InitialRetryTime = def.InitialRetryTime
+		}
+		if p.RetryTimeScale < 0 {
+			p.RetryTimeScale = def.RetryTimeScale
+		}
+		if p.MaxTries < 0 {
+			p.MaxTries = def.MaxTries
+		}
+		if p.MaxLifetime < 0 {
+			p.MaxLifetime = def.MaxLifetime
+		}
+		q.domainPolicies[domain] = p
+	}
+}
+
+func (q *Queue) defaultPolicy() DomainPolicy {
+	return DomainPolicy{
+		InitialRetryTime: q.initialRetryTime,
+		RetryTimeScale:   q.retryTimeScale,
+		MaxTries:         q.maxTries,
+		MaxLifetime:      q.maxLifetime,
+	}
+}
+
+func rcptDomain(rcpt string) string {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	return normDomain
+}
+
+// policyFor returns the policy used for the recipient.
+func (q *Queue) policyFor(rcpt string) DomainPolicy {
+	if p, ok := q.domainPolicies[rcptDomain(rcpt)]; ok {
+		return p
+	}
+	return q.defaultPolicy()
+}
+
+// nextTryTime returns the earliest time of the next attempt for
+// recipients.
+func (q *Queue) nextTryTime(meta *QueueMetadata, rcpts []string, last time.Time) time.Time {
+	var next time.Time
+	for _, rcpt := range rcpts {
+		t := q.policyFor(rcpt).nextTry(last, meta.TriesCount[rcpt])
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// DefaultPolicy returns the policy used for domains without overrides.
+func (q *Queue) DefaultPolicy() DomainPolicy {
+	return q.defaultPolicy()
+}
+
+// DomainPolicies returns policies for domains that have overrides or are
+// suspended, ordered by domain.
+func (q *Queue) DomainPolicies() []DomainPolicy {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	res := make([]DomainPolicy, 0, len(q.domainPolicies)+len(q.suspended))
+	for domain, p := range q.domainPolicies {
+		p.Suspended = q.suspended[domain]
+		res = append(res, p)
+	}
+	for domain := range q.suspended {
+		if _, ok := q.domainPolicies[domain]; !ok {
+			p := q.defaultPolicy()
+			p.Domain = domain
+			p.Suspended = true
+			res = append(res, p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Domain < res[j].Domain
+	})
+	return res
+}
+
+// splitSuspended splits recipients into those that can be attempted now and
+// those in suspended domains.
+func (q *Queue) splitSuspended(rcpts []string) (active, suspended []string) {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	if len(q.suspended) == 0 {
+		return rcpts, nil
+	}
+	for _, rcpt := range rcpts {
+		if q.suspended[rcptDomain(rcpt)] {
+			suspended = append(suspended, rcpt)
+		} else {
+			active = append(active, rcpt)
+		}
+	}
+	return active, suspended
+}
+
+// Suspend stops delivery attempts for recipients in the domain until it is
+// resumed. Messages are kept in the queue and tries count of suspended
+// recipients is not increased. The list of suspended domains is preserved
+// across restarts.
+func (q *Queue) Suspend(domain string) error {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil || normDomain == "" || strings.Contains(normDomain, "@") {
+		return ErrInvalidDomain
+	}
+
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	if q.suspended[normDomain] {
+		return nil
+	}
+	q.suspended[normDomain] = true
+	if err := q.saveSuspended(); err != nil {
+		delete(q.suspended, normDomain)
+		return err
+	}
+	q.Log.Msg("delivery suspended", "domain", normDomain)
+	return nil
+}
+
+// Resume restarts delivery attempts for the domain. Messages waiting only
+// for suspended domains are attempted immediately.
+func (q *Queue) Resume(domain string) error {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return ErrInvalidDomain
+	}
+
+	q.msgsLock.Lock()
+	if !q.suspended[normDomain] {
+		q.msgsLock.Unlock()
+		return nil
+	}
+	delete(q.suspended, normDomain)
+	if err := q.saveSuspended(); err != nil {
+		q.suspended[normDomain] = true
+		q.msgsLock.Unlock()
+		return err
+	}
+
+	// Messages with recipients in other suspended domains will be parked
+	// again on the next attempt.
+	now := time.Now()
+	var slots []queueSlot
+	for id, st := range q.msgs {
+		if !st.parked || st.busy {
+			continue
+		}
+		st.parked = false
+		st.gen++
+		st.nextTry = now
+		slots = append(slots, queueSlot{ID: id, Gen: st.gen})
+	}
+	q.msgsLock.Unlock()
+
+	q.Log.Msg("delivery resumed", "domain", normDomain, "messages", len(slots))
+	for _, slot := range slots {
+		q.wheel.Add(now, slot)
+	}
+	return nil
+}
+
+// park puts the message aside until one of the suspended domains is
+// resumed. If none of the recipients is in a suspended domain anymore, the
+// message is not parked and false is returned.
+func (q *Queue) park(id string, rcpts []string) bool {
+	q.msgsLock.Lock()
+	defer q.msgsLock.Unlock()
+
+	stillSuspended := false
+	for _, rcpt := range rcpts {
+		if q.suspended[rcptDomain(rcpt)] {
+			stillSuspended = true
+			break
+		}
+	}
+	if !stillSuspended {
+		return false
+	}
+
+	st := q.msgs[id]
+	st.busy = false
+	st.parked = true
+	st.gen++
+	st.nextTry = time.Time{}
+	return true
+}
+
+// saveSuspended writes the list of suspended domains to disk. msgsLock
+// should be held.
+func (q *Queue) saveSuspended() error {
+	path := filepath.Join(q.location, suspendedFile)
+	if len(q.suspended) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	domains := make([]string, 0, len(q.suspended))
+	for domain := range q.suspended {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	blob, err := json.Marshal(domains)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".new", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+func (q *Queue) loadSuspended() error {
+	q.suspended = make(map[string]bool)
+
+	blob, err := os.ReadFile(filepath.Join(q.location, suspendedFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var domains []string
+	if err := json.Unmarshal(blob, &domains); err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		q.suspended[domain] = true
+	}
+	if len(domains) != 0 {
+		q.Log.Printf("delivery is suspended for %v", domains)
+	}
+	return nil
+}
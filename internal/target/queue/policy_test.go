@@ -0,0 +1,192 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueue_ParseDomainPolicy(t *testing.T) {
+	q := &Queue{
+		initialRetryTime: 15 * time.Minute,
+		retryTimeScale:   1.25,
+		maxTries:         20,
+	}
+	m := config.NewMap(nil, config.Node{Children: []config.Node{
+		{
+			Name: "domain",
+			Args: []string{"Gmail.com", "googlemail.com"},
+			Children: []config.Node{
+				{Name: "initial_retry", Args: []string{"1m"}},
+				{Name: "retry_scale", Args: []string{"1.5"}},
+			},
+		},
+		{
+			Name: "domain",
+			Args: []string{"partner.example"},
+			Children: []config.Node{
+				{Name: "max_tries", Args: []string{"100"}},
+				{Name: "max_lifetime", Args: []string{"168h"}},
+			},
+		},
+	}})
+	m.Callback("domain", q.parseDomainPolicy)
+	if _, err := m.Process(); err != nil {
+		t.Fatal(err)
+	}
+	q.resolvePolicies()
+
+	expected := map[string]DomainPolicy{
+		"gmail.com":       {Domain: "gmail.com", InitialRetryTime: time.Minute, RetryTimeScale: 1.5, MaxTries: 20},
+		"googlemail.com":  {Domain: "googlemail.com", InitialRetryTime: time.Minute, RetryTimeScale: 1.5, MaxTries: 20},
+		"partner.example": {Domain: "partner.example", InitialRetryTime: 15 * time.Minute, RetryTimeScale: 1.25, MaxTries: 100, MaxLifetime: 168 * time.Hour},
+	}
+	if !reflect.DeepEqual(q.domainPolicies, expected) {
+		t.Errorf("wrong policies: %+v", q.domainPolicies)
+	}
+
+	if p := q.policyFor("foo@GMAIL.com"); p.InitialRetryTime != time.Minute {
+		t.Errorf("wrong policy for gmail.com: %+v", p)
+	}
+	if p := q.policyFor("foo@example.org"); !reflect.DeepEqual(p, q.DefaultPolicy()) {
+		t.Errorf("wrong default policy: %+v", p)
+	}
+
+	for _, children := range [][]config.Node{
+		{{Name: "domain"}},
+		{{Name: "domain", Args: []string{"example.org"}, Children: []config.Node{{Name: "retry_scale", Args: []string{"0.5"}}}}},
+		{{Name: "domain", Args: []string{"example.org"}}, {Name: "domain", Args: []string{"EXAMPLE.org"}}},
+	} {
+		q := &Queue{}
+		m := config.NewMap(nil, config.Node{Children: children})
+		m.Callback("domain", q.parseDomainPolicy)
+		if _, err := m.Process(); err == nil {
+			t.Errorf("expected error for %v", children)
+		}
+	}
+}
+
+func TestDomainPolicy_GiveUp(t *testing.T) {
+	p := DomainPolicy{MaxTries: 3, MaxLifetime: time.Hour}
+	if p.giveUp(2, time.Now().Add(-time.Minute)) {
+		t.Error("should not give up")
+	}
+	if !p.giveUp(3, time.Now()) {
+		t.Error("should give up after max_tries")
+	}
+	if !p.giveUp(1, time.Now().Add(-2*time.Hour)) {
+		t.Error("should give up after max_lifetime")
+	}
+}
+
+func TestQueueDelivery_DomainPolicy(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		bodyFailuresPartial: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+				"tester2@example.net": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.domainPolicies = map[string]DomainPolicy{
+		"example.net": {Domain: "example.net", RetryTimeScale: 1, MaxTries: 1},
+	}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.net"})
+
+	// First attempt fails for both recipients, example.net is not retried.
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	dsn := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(dsn.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong DSN recipients: %v", dsn.RcptTo)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDelivery_SuspendResume(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dir := t.TempDir()
+	q := newTestQueueDir(t, &dt, dir)
+
+	if err := q.Suspend("Example.NET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Suspend("foo@example.net"); err == nil {
+		t.Fatal("expected error for address")
+	}
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.net"})
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	info := waitState(t, q, id, StateSuspended)
+	if !reflect.DeepEqual(info.To, []string{"tester2@example.net"}) || info.TriesCount["tester2@example.net"] != 0 {
+		t.Fatalf("wrong message state: %+v", info)
+	}
+
+	// Suspension should survive the restart.
+	cleanQueue(t, q)
+	q = newTestQueueDir(t, &dt, dir)
+	defer cleanQueue(t, q)
+	waitState(t, q, id, StateSuspended)
+
+	policies := q.DomainPolicies()
+	if len(policies) != 1 || policies[0].Domain != "example.net" || !policies[0].Suspended {
+		t.Fatalf("wrong domain policies: %+v", policies)
+	}
+
+	if err := q.Resume("example.net"); err != nil {
+		t.Fatal(err)
+	}
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.net"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
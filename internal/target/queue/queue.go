@@ -63,7 +63,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -79,6 +78,7 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
@@ -133,6 +133,11 @@ type Queue struct {
 	initialRetryTime time.Duration
 	retryTimeScale   float64
 	maxTries         int
+	// Zero if there is no limit.
+	maxLifetime time.Duration
+
+	// Overrides of the values above for recipient domains, see policy.go.
+	domainPolicies map[string]DomainPolicy
 
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
@@ -153,6 +158,12 @@ type Queue struct {
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
 	deliverySemaphore chan struct{}
+
+	// State of all messages in the queue, see manage.go.
+	msgsLock sync.Mutex
+	msgs     map[string]*msgState
+	// Domains delivery is suspended for, protected by msgsLock.
+	suspended map[string]bool
 }
 
 type QueueMetadata struct {
@@ -176,11 +187,18 @@ type QueueMetadata struct {
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Held messages are not delivered until released by the administrator.
+	Held bool
 }
 
 type queueSlot struct {
 	ID string
 
+	// Slots scheduled before the last state change of the message are
+	// outdated and ignored by dispatch.
+	Gen int
+
 	// If nil - Hdr and Body are invalid, all values should be read from
 	// disk.
 	Meta *QueueMetadata
@@ -211,6 +229,10 @@ func (q *Queue) Init(cfg *config.Map) error {
 	var maxParallelism int
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
+	cfg.Duration("initial_retry", false, false, 15*time.Minute, &q.initialRetryTime)
+	cfg.Float("retry_scale", false, false, 1.25, &q.retryTimeScale)
+	cfg.Duration("max_lifetime", false, false, 0, &q.maxLifetime)
+	cfg.Callback("domain", q.parseDomainPolicy)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
 	cfg.String("location", false, false, q.location, &q.location)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
@@ -222,6 +244,10 @@ func (q *Queue) Init(cfg *config.Map) error {
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if q.retryTimeScale < 1 {
+		return errors.New("queue: retry_scale should be at least 1")
+	}
+	q.resolvePolicies()
 
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
@@ -249,7 +275,11 @@ func (q *Queue) Init(cfg *config.Map) error {
 func (q *Queue) start(maxParallelism int) error {
 	q.wheel = NewTimeWheel(q.dispatch)
 	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.msgs = make(map[string]*msgState)
 
+	if err := q.loadSuspended(); err != nil {
+		return err
+	}
 	if err := q.readDiskQueue(); err != nil {
 		return err
 	}
@@ -284,6 +314,11 @@ func (q *Queue) discardBroken(id string) {
 func (q *Queue) dispatch(value TimeSlot) {
 	slot := value.Value.(queueSlot)
 
+	if !q.claimSlot(slot) {
+		q.Log.Debugln("skipping outdated schedule for", slot.ID)
+		return
+	}
+
 	q.Log.Debugln("starting delivery for", slot.ID)
 
 	q.deliveryWg.Add(1)
@@ -304,6 +339,7 @@ func (q *Queue) dispatch(value TimeSlot) {
 				q.discardBroken(slot.ID)
 			}
 		}()
+		defer q.deliveryDone(slot.ID)
 
 		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
 		var (
@@ -374,26 +410,29 @@ func toSMTPErr(err error) *smtp.SMTPError {
 func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 
-	partialErr := q.deliver(meta, header, body)
-	dl.Debugf("errors: %v", partialErr.Errs)
-
-	// While iterating the list of recipients we also pick the smallest tries count
-	// and use it to calculate the delay for the next attempt.
-	smallestTriesCount := 999999
-
 	if meta.TriesCount == nil {
 		meta.TriesCount = make(map[string]int)
 	}
 
+	// Recipients in suspended domains are not attempted and their tries
+	// count is not increased.
+	rcpts, suspendedRcpts := q.splitSuspended(meta.To)
+	partialErr := partialError{Errs: map[string]error{}}
+	if len(rcpts) != 0 {
+		partialErr = q.deliver(meta, rcpts, header, body)
+		dl.Debugf("errors: %v", partialErr.Errs)
+	}
+
 	// Check attempted recipients and corresponding errors.
 	// Split list into two parts: recipients that should be retried (newRcpts)
 	// and recipients DSN will be generated for.
-	newRcpts := make([]string, 0, len(partialErr.Errs))
+	newRcpts := make([]string, 0, len(partialErr.Errs)+len(suspendedRcpts))
 	failedRcpts := make([]string, 0, len(partialErr.Errs))
-	for _, rcpt := range meta.To {
+	for _, rcpt := range rcpts {
 		rcptErr, ok := partialErr.Errs[rcpt]
 		if !ok {
 			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			q.publishEvent(events.MessageDelivered, meta, rcpt, nil)
 			continue
 		}
 
@@ -402,7 +441,8 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
-		if !temporary || meta.TriesCount[rcpt]+1 >= q.maxTries {
+		if !temporary || q.policyFor(rcpt).giveUp(meta.TriesCount[rcpt]+1, meta.FirstAttempt) {
+			q.publishEvent(events.MessageBounced, meta, rcpt, rcptErr)
 			delete(meta.TriesCount, rcpt)
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
 			failedRcpts = append(failedRcpts, rcpt)
@@ -410,13 +450,9 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		}
 
 		// Temporary error, increase tries counter and requeue.
+		q.publishEvent(events.MessageDeferred, meta, rcpt, rcptErr)
 		meta.TriesCount[rcpt]++
 		newRcpts = append(newRcpts, rcpt)
-
-		// See smallestTriesCount comment.
-		if count := meta.TriesCount[rcpt]; count < smallestTriesCount {
-			smallestTriesCount = count
-		}
 	}
 
 	// Generate DSN for recipients that failed permanently this time.
@@ -424,30 +460,39 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		q.emitDSN(meta, header, failedRcpts)
 	}
 	// No recipients to try, either all failed or all succeeded.
-	if len(newRcpts) == 0 {
+	if len(newRcpts) == 0 && len(suspendedRcpts) == 0 {
 		q.removeFromDisk(meta.MsgMeta)
 		return
 	}
 
-	meta.To = newRcpts
-	meta.LastAttempt = time.Now()
+	// The next attempt time is determined by the policy of retried
+	// recipients, suspended ones wait for the domain to be resumed.
+	nextTryTime := q.nextTryTime(meta, newRcpts, time.Now())
+
+	meta.To = append(newRcpts, suspendedRcpts...)
+	if len(rcpts) != 0 {
+		meta.LastAttempt = time.Now()
+	}
 
 	if err := q.updateMetadataOnDisk(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
-	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	if len(newRcpts) == 0 {
+		if q.park(meta.MsgMeta.ID, suspendedRcpts) {
+			dl.Msg("waiting for delivery to be resumed", "rcpts", suspendedRcpts)
+			return
+		}
+		// Resumed in the meantime.
+		nextTryTime = time.Now()
+	}
+
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
 
-	q.wheel.Add(nextTryTime, queueSlot{
+	q.schedule(nextTryTime, queueSlot{
 		ID: meta.MsgMeta.ID,
 
 		// Do not keep (meta-)data in memory to reduce usage.  At this point,
@@ -458,7 +503,27 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	})
 }
 
-func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) partialError {
+// publishEvent publishes the result of the delivery attempt for the
+// recipient. It should be called before TriesCount is updated.
+func (q *Queue) publishEvent(typ string, meta *QueueMetadata, rcpt string, rcptErr error) {
+	if !events.Enabled() {
+		return
+	}
+	data := map[string]interface{}{
+		"queue":   q.name,
+		"from":    meta.From,
+		"rcpt":    rcpt,
+		"attempt": meta.TriesCount[rcpt] + 1,
+	}
+	if rcptErr != nil {
+		smtpErr := meta.RcptErrs[rcpt]
+		data["smtpCode"] = smtpErr.Code
+		data["reason"] = smtpErr.Message
+	}
+	target.PublishEvent(typ, meta.MsgMeta, data)
+}
+
+func (q *Queue) deliver(meta *QueueMetadata, rcpts []string, header textproto.Header, body buffer.Buffer) partialError {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 	perr := partialError{
 		Errs:       map[string]error{},
@@ -477,7 +542,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	mailTask.End()
 	if err != nil {
 		dl.Debugf("target.Start failed: %v", err)
-		for _, rcpt := range meta.To {
+		for _, rcpt := range rcpts {
 			perr.Errs[rcpt] = err
 		}
 		return perr
@@ -485,7 +550,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	dl.Debugf("target.Start OK")
 
 	var acceptedRcpts []string
-	for _, rcpt := range meta.To {
+	for _, rcpt := range rcpts {
 		rcptCtx, rcptTask := trace.NewTask(msgCtx, "RCPT TO")
 		if err := delivery.AddRcpt(rcptCtx, rcpt, smtp.RcptOptions{} /* TODO: DSN support */); err != nil {
 			dl.Debugf("delivery.AddRcpt %s failed: %v", rcpt, err)
@@ -594,7 +659,7 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
+	qd.q.schedule(time.Time{}, queueSlot{
 		ID:   qd.meta.MsgMeta.ID,
 		Meta: qd.meta,
 		Hdr:  &qd.header,
@@ -685,22 +750,20 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
+		if meta.Held {
+			q.Log.Debugf("message is held (msg ID = %s)", id)
+			q.hold(id)
+			loadedCount++
+			continue
 		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
 
+		nextTryTime := q.nextTryTime(meta, meta.To, meta.LastAttempt)
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
 
 		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
-		q.wheel.Add(nextTryTime, queueSlot{
+		q.schedule(nextTryTime, queueSlot{
 			ID: id,
 		})
 		loadedCount++
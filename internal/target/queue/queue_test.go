@@ -24,6 +24,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -35,6 +36,7 @@ import (
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
@@ -360,6 +362,61 @@ func TestQueueDelivery_TemporaryFail_Partial(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+type eventSink struct {
+	msgID string
+	ch    chan events.Event
+}
+
+func (s eventSink) Handle(ev events.Event) {
+	if ev.Data["msgId"] == s.msgID {
+		s.ch <- ev
+	}
+}
+
+func TestQueueDelivery_Events(t *testing.T) {
+	t.Parallel()
+
+	IDRaw := sha1.Sum([]byte(t.Name()))
+	sink := eventSink{msgID: hex.EncodeToString(IDRaw[:]), ch: make(chan events.Event, 10)}
+	defer events.Subscribe(sink)()
+
+	dt := unreliableTarget{
+		bodyFailuresPartial: []map[string]error{
+			{
+				"tester2@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+				"tester3@example.org": exterrors.WithTemporary(errors.New("no such user"), false),
+			},
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org", "tester3@example.org"})
+
+	got := map[string]string{}
+	for i := 0; i < 4; i++ {
+		select {
+		case ev := <-sink.ch:
+			rcpt, _ := ev.Data["rcpt"].(string)
+			got[ev.Type+" "+rcpt] = fmt.Sprint(ev.Data["attempt"])
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d events received: %v", i, got)
+		}
+	}
+
+	expected := map[string]string{
+		events.MessageDelivered + " tester1@example.org": "1",
+		events.MessageDeferred + " tester2@example.org":  "1",
+		events.MessageBounced + " tester3@example.org":   "1",
+		events.MessageDelivered + " tester2@example.org": "2",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong events: %v", got)
+	}
+}
+
 func TestQueueDelivery_MultipleAttempts(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,52 @@
+package maddy
+
+import (
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/auth/throttle"
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+// listLockouts handles GET /v1/auth/lockouts
+func listLockouts(c echo.Context) error {
+	list := throttle.Default.Lockouts()
+
+	results := make([]model.AuthLockout, 0, len(list))
+	for _, l := range list {
+		results = append(results, model.AuthLockout{
+			Kind:        l.Kind,
+			Key:         l.Key,
+			Failures:    l.Failures,
+			LockedUntil: l.Until,
+		})
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// unlockAuth handles POST /v1/auth/unlock
+func unlockAuth(c echo.Context) error {
+	r := model.AuthUnlockRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	unlocked := false
+	if r.Username != "" {
+		unlocked = throttle.Default.UnlockUser(r.Username)
+	}
+	if r.IP != "" {
+		ok, err := throttle.Default.UnlockIP(r.IP)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		unlocked = unlocked || ok
+	}
+	if !unlocked {
+		return echo.NewHTTPError(http.StatusNotFound, "no failed attempts recorded")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,268 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+// listMailboxes handles GET /v1/users/:id/mailboxes
+func listMailboxes(c echo.Context) error {
+	username := c.Param("id")
+
+	u, err := imapAccount(username)
+	if err != nil {
+		return err
+	}
+	defer u.Logout() //nolint:errcheck
+
+	all, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	subscribed, err := u.ListMailboxes(true)
+	if err != nil {
+		return err
+	}
+	isSubscribed := make(map[string]bool, len(subscribed))
+	for _, info := range subscribed {
+		isSubscribed[info.Name] = true
+	}
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+	usage, err := storage.MailboxUsage(username)
+	if err != nil {
+		return err
+	}
+	usedBytes := make(map[string]int64, len(usage))
+	for _, mu := range usage {
+		usedBytes[mu.Name] = mu.Bytes
+	}
+
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusUidNext, imap.StatusUidValidity}
+	results := []model.Mailbox{}
+	for _, info := range all {
+		status, err := u.Status(info.Name, items)
+		if err != nil {
+			if errors.Is(err, backend.ErrNoSuchMailbox) {
+				// Deleted concurrently.
+				continue
+			}
+			return err
+		}
+
+		results = append(results, model.Mailbox{
+			Name:        info.Name,
+			SpecialUse:  specialUseAttr(info.Attributes),
+			Subscribed:  isSubscribed[info.Name],
+			Messages:    status.Messages,
+			Unseen:      status.Unseen,
+			UsedBytes:   usedBytes[info.Name],
+			UidNext:     status.UidNext,
+			UidValidity: status.UidValidity,
+		})
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// createMailbox handles POST /v1/users/:id/mailboxes/:mailbox
+func createMailbox(c echo.Context) error {
+	name, err := mailboxParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req model.CreateMailboxRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	attr, err := parseSpecialUse(req.SpecialUse)
+	if err != nil {
+		return err
+	}
+
+	u, err := imapAccount(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	defer u.Logout() //nolint:errcheck
+
+	if attr == "" {
+		err = u.CreateMailbox(name)
+	} else {
+		suu, ok := u.(SpecialUseUser)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "storage backend does not support SPECIAL-USE")
+		}
+		err = suu.CreateMailboxSpecial(name, attr)
+	}
+	if err != nil {
+		return mailboxError(err)
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// updateMailbox handles PATCH /v1/users/:id/mailboxes/:mailbox
+func updateMailbox(c echo.Context) error {
+	username := c.Param("id")
+	name, err := mailboxParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req model.UpdateMailboxRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var attr string
+	if req.SpecialUse != nil {
+		if attr, err = parseSpecialUse(*req.SpecialUse); err != nil {
+			return err
+		}
+	}
+
+	u, err := imapAccount(username)
+	if err != nil {
+		return err
+	}
+	defer u.Logout() //nolint:errcheck
+
+	if _, err := u.Status(name, []imap.StatusItem{imap.StatusMessages}); err != nil {
+		return mailboxError(err)
+	}
+
+	if req.Name != nil && *req.Name != name {
+		if _, err := u.Status(*req.Name, []imap.StatusItem{imap.StatusMessages}); err == nil {
+			return mailboxError(backend.ErrMailboxAlreadyExists)
+		}
+		if err := u.RenameMailbox(name, *req.Name); err != nil {
+			return mailboxError(err)
+		}
+		name = *req.Name
+	}
+
+	if req.SpecialUse != nil {
+		storage, err := sqlStorage()
+		if err != nil {
+			return err
+		}
+		if err := storage.SetMailboxSpecialUse(username, name, attr); err != nil {
+			return mailboxError(err)
+		}
+	}
+
+	if req.Subscribed != nil {
+		if err := u.SetSubscribed(name, *req.Subscribed); err != nil {
+			return mailboxError(err)
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteMailbox handles DELETE /v1/users/:id/mailboxes/:mailbox
+func deleteMailbox(c echo.Context) error {
+	name, err := mailboxParam(c)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(name, "INBOX") {
+		return echo.NewHTTPError(http.StatusBadRequest, "INBOX can't be deleted")
+	}
+
+	u, err := imapAccount(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	defer u.Logout() //nolint:errcheck
+
+	if err := u.DeleteMailbox(name); err != nil {
+		return mailboxError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// imapAccount returns the storage account of the user. 404 is returned if
+// the user has no mailboxes.
+func imapAccount(username string) (backend.User, error) {
+	storage, err := sqlStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := storage.AccountExists(username)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "user has no mailboxes")
+	}
+
+	return imapDb.GetIMAPAcct(username)
+}
+
+// mailboxParam returns the mailbox name from the path. Echo leaves
+// parameters escaped if the path contains encoded characters such as "%2F".
+func mailboxParam(c echo.Context) (string, error) {
+	name := c.Param("mailbox")
+	if c.Request().URL.RawPath == "" {
+		return name, nil
+	}
+
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "malformed mailbox name")
+	}
+	return name, nil
+}
+
+// mailboxError converts storage errors to HTTP errors
+func mailboxError(err error) error {
+	switch {
+	case errors.Is(err, backend.ErrNoSuchMailbox):
+		return echo.NewHTTPError(http.StatusNotFound, "no such mailbox")
+	case errors.Is(err, backend.ErrMailboxAlreadyExists):
+		return echo.NewHTTPError(http.StatusConflict, "mailbox already exists")
+	}
+	return err
+}
+
+var specialUseAttrs = []string{imap.ArchiveAttr, imap.DraftsAttr, imap.JunkAttr, imap.SentAttr, imap.TrashAttr}
+
+// parseSpecialUse accepts a SPECIAL-USE attribute with or without the
+// leading backslash, in any case
+func parseSpecialUse(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, attr := range specialUseAttrs {
+		if strings.EqualFold(strings.TrimPrefix(s, `\`), attr[1:]) {
+			return attr, nil
+		}
+	}
+	return "", echo.NewHTTPError(http.StatusBadRequest, "unsupported special-use attribute: "+s)
+}
+
+func specialUseAttr(attrs []string) string {
+	for _, attr := range attrs {
+		for _, special := range specialUseAttrs {
+			if attr == special {
+				return attr
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,355 @@
+package maddy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/rest/model"
+)
+
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 500
+)
+
+var messageItems = []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, imap.FetchInternalDate, imap.FetchEnvelope}
+
+// listMessages handles GET /v1/users/:id/mailboxes/:mailbox/messages
+//
+// Messages are returned from newest to oldest, ?limit= sets the page size
+// and ?before= returns messages with UIDs lower than the specified one.
+func listMessages(c echo.Context) error {
+	limit, err := uintQueryParam(c, "limit", defaultMessagesLimit)
+	if err != nil {
+		return err
+	}
+	if limit == 0 || limit > maxMessagesLimit {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxMessagesLimit))
+	}
+	before, err := uintQueryParam(c, "before", 0)
+	if err != nil {
+		return err
+	}
+
+	mbox, err := openMailbox(c, true)
+	if err != nil {
+		return err
+	}
+	defer mbox.close()
+
+	criteria := imap.NewSearchCriteria()
+	if before != 0 {
+		if before == 1 {
+			return c.JSON(http.StatusOK, model.MessageList{Total: mbox.status.Messages, Messages: []model.Message{}})
+		}
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(1, before-1)
+	}
+	uids, err := mbox.SearchMessages(true, criteria)
+	if err != nil {
+		return err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+
+	response := model.MessageList{Total: mbox.status.Messages, Messages: []model.Message{}}
+	if len(uids) > int(limit) {
+		uids = uids[:limit]
+		response.NextBefore = uids[len(uids)-1]
+	}
+	if len(uids) == 0 {
+		return c.JSON(http.StatusOK, response)
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	msgs, err := fetchMessages(mbox, seq, messageItems)
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		if msg, ok := msgs[uid]; ok {
+			response.Messages = append(response.Messages, messageToModel(msg))
+		}
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// getMessage handles GET /v1/users/:id/mailboxes/:mailbox/messages/:uid
+func getMessage(c echo.Context) error {
+	uid, err := uidParam(c)
+	if err != nil {
+		return err
+	}
+
+	mbox, err := openMailbox(c, true)
+	if err != nil {
+		return err
+	}
+	defer mbox.close()
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	msgs, err := fetchMessages(mbox, seq, messageItems)
+	if err != nil {
+		return err
+	}
+	msg, ok := msgs[uid]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no such message")
+	}
+
+	return c.JSON(http.StatusOK, messageToModel(msg))
+}
+
+// getMessageRaw handles GET /v1/users/:id/mailboxes/:mailbox/messages/:uid/raw
+//
+// The message is returned as stored (RFC 5322), the \Seen flag is not set.
+func getMessageRaw(c echo.Context) error {
+	uid, err := uidParam(c)
+	if err != nil {
+		return err
+	}
+
+	mbox, err := openMailbox(c, true)
+	if err != nil {
+		return err
+	}
+	defer mbox.close()
+
+	section, err := imap.ParseBodySectionName("BODY.PEEK[]")
+	if err != nil {
+		return err
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	msgs, err := fetchMessages(mbox, seq, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return err
+	}
+	msg, ok := msgs[uid]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no such message")
+	}
+	var body imap.Literal
+	for _, literal := range msg.Body {
+		body = literal
+	}
+	if body == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such message")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%d.eml"`, uid))
+	return c.Stream(http.StatusOK, "message/rfc822", body)
+}
+
+// updateMessageFlags handles POST /v1/users/:id/mailboxes/:mailbox/messages/flags
+func updateMessageFlags(c echo.Context) error {
+	var req model.UpdateFlagsRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	var op imap.FlagsOp
+	switch req.Op {
+	case "add":
+		op = imap.AddFlags
+	case "remove":
+		op = imap.RemoveFlags
+	case "set":
+		op = imap.SetFlags
+	}
+	for _, flag := range req.Flags {
+		if flag == imap.RecentFlag {
+			return echo.NewHTTPError(http.StatusBadRequest, "\\Recent flag can't be changed")
+		}
+	}
+	if req.Flags == nil {
+		req.Flags = []string{}
+	}
+
+	mbox, err := openMailbox(c, false)
+	if err != nil {
+		return err
+	}
+	defer mbox.close()
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(req.UIDs...)
+	if err := mbox.UpdateMessagesFlags(true, seq, op, true, req.Flags); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// copyMessages handles POST /v1/users/:id/mailboxes/:mailbox/messages/copy
+func copyMessages(c echo.Context) error {
+	return transferMessages(c, false)
+}
+
+// moveMessages handles POST /v1/users/:id/mailboxes/:mailbox/messages/move
+func moveMessages(c echo.Context) error {
+	return transferMessages(c, true)
+}
+
+func transferMessages(c echo.Context, move bool) error {
+	var req model.CopyMessagesRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	mbox, err := openMailbox(c, false)
+	if err != nil {
+		return err
+	}
+	defer mbox.close()
+
+	if _, err := mbox.user.Status(req.Destination, []imap.StatusItem{imap.StatusMessages}); err != nil {
+		if errors.Is(err, backend.ErrNoSuchMailbox) {
+			return echo.NewHTTPError(http.StatusNotFound, "no such destination mailbox")
+		}
+		return err
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(req.UIDs...)
+	if move {
+		moveMbox, ok := mbox.Mailbox.(backend.MoveMailbox)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "storage backend does not support MOVE")
+		}
+		err = moveMbox.MoveMessages(true, seq, req.Destination)
+	} else {
+		err = mbox.CopyMessages(true, seq, req.Destination)
+	}
+	if err != nil {
+		return mailboxError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// openedMailbox is a mailbox opened by openMailbox along with its account
+type openedMailbox struct {
+	backend.Mailbox
+	user   backend.User
+	status *imap.MailboxStatus
+}
+
+func (m *openedMailbox) close() {
+	m.Mailbox.Close()
+	m.user.Logout() //nolint:errcheck
+}
+
+// openMailbox opens the mailbox from the path, it must be closed by the
+// caller.
+func openMailbox(c echo.Context, readOnly bool) (*openedMailbox, error) {
+	name, err := mailboxParam(c)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := imapAccount(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := u.Status(name, []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		u.Logout() //nolint:errcheck
+		return nil, mailboxError(err)
+	}
+	_, mbox, err := u.GetMailbox(name, readOnly, nil)
+	if err != nil {
+		u.Logout() //nolint:errcheck
+		return nil, mailboxError(err)
+	}
+
+	return &openedMailbox{Mailbox: mbox, user: u, status: status}, nil
+}
+
+// fetchMessages returns messages from the UID set indexed by UID
+func fetchMessages(mbox backend.Mailbox, seq *imap.SeqSet, items []imap.FetchItem) (map[uint32]*imap.Message, error) {
+	ch := make(chan *imap.Message, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mbox.ListMessages(true, seq, items, ch)
+	}()
+
+	msgs := map[uint32]*imap.Message{}
+	for msg := range ch {
+		msgs[msg.Uid] = msg
+	}
+	return msgs, <-errCh
+}
+
+func messageToModel(msg *imap.Message) model.Message {
+	m := model.Message{
+		UID:          msg.Uid,
+		Flags:        msg.Flags,
+		Size:         msg.Size,
+		InternalDate: msg.InternalDate,
+		From:         []model.Address{},
+		To:           []model.Address{},
+	}
+	if m.Flags == nil {
+		m.Flags = []string{}
+	}
+	if env := msg.Envelope; env != nil {
+		if !env.Date.IsZero() {
+			date := env.Date
+			m.Date = &date
+		}
+		m.Subject = env.Subject
+		m.From = addressesToModel(env.From)
+		m.To = addressesToModel(env.To)
+		m.Cc = addressesToModel(env.Cc)
+		m.MessageID = env.MessageId
+		m.InReplyTo = env.InReplyTo
+	}
+	return m
+}
+
+func addressesToModel(addrs []*imap.Address) []model.Address {
+	res := []model.Address{}
+	for _, addr := range addrs {
+		if addr.HostName == "" {
+			// Group syntax delimiter.
+			continue
+		}
+		res = append(res, model.Address{
+			Name:    addr.PersonalName,
+			Address: addr.Address(),
+		})
+	}
+	return res
+}
+
+func uidParam(c echo.Context) (uint32, error) {
+	uid, err := strconv.ParseUint(c.Param("uid"), 10, 32)
+	if err != nil || uid == 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid message UID")
+	}
+	return uint32(uid), nil
+}
+
+func uintQueryParam(c echo.Context, name string, defaultVal uint32) (uint32, error) {
+	s := c.QueryParam(name)
+	if s == "" {
+		return defaultVal, nil
+	}
+	val, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid "+name)
+	}
+	return uint32(val), nil
+}
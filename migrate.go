@@ -0,0 +1,101 @@
+package maddy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/imapmigrate"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
+)
+
+// startMigration handles POST /v1/users/:id/migrations
+//
+// Credentials of the remote account are only kept in memory while the
+// migration runs. Re-running the migration copies only messages added
+// since the previous run.
+func startMigration(c echo.Context) error {
+	r := model.MigrationRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	if r.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "host is required")
+	}
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	port := r.Port
+	if port == 0 {
+		port = 993
+		if r.TLS == imapmigrate.TLSStartTLS || r.TLS == imapmigrate.TLSNone {
+			port = 143
+		}
+	}
+	opts := imapmigrate.Options{
+		Addr:               net.JoinHostPort(r.Host, strconv.Itoa(port)),
+		TLS:                r.TLS,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+		Username:           r.Username,
+		Password:           r.Password,
+		OAuth2Token:        r.OAuth2Token,
+		// The server should not be usable to probe its own services.
+		// Private networks are allowed only for unrestricted principals,
+		// domain-restricted ones manage hosted domains only.
+		CheckAddr: imapmigrate.CheckPublicAddr(api_auth.Principal(c).Unrestricted()),
+	}
+
+	username := c.Param("id")
+	u, err := imapAccount(username)
+	if err != nil {
+		return err
+	}
+
+	job, err := newAccountJob(jobMigration, username, "")
+	if err != nil {
+		u.Logout()
+		return err
+	}
+	job.mu.Lock()
+	job.info.Source = opts.Source()
+	job.mu.Unlock()
+
+	go job.run(u, func() error {
+		cl, err := imapmigrate.Dial(opts)
+		if err != nil {
+			return err
+		}
+		defer cl.Logout() //nolint:errcheck
+
+		// Imported messages are subject to the same limits as IMAP APPEND.
+		checked := imapmigrate.WithCheck(u, func(mailbox string, size int64) error {
+			if err := storage.CheckQuota(u.Username(), size); err != nil {
+				return err
+			}
+			return storage.CheckMailboxQuota(u.Username(), mailbox, size)
+		})
+		defer storage.CheckQuotaWarnings(u.Username())
+
+		return imapmigrate.Migrate(cl, checked, storage.MigrationState(username, opts.Source()), func(p imapmigrate.Progress) {
+			job.setProgress(p.Mailbox, p.MessagesDone, p.MessagesTotal)
+		})
+	})
+
+	return c.JSON(http.StatusAccepted, job.snapshot())
+}
+
+// getMigration handles GET /v1/users/:id/migrations/:job
+func getMigration(c echo.Context) error {
+	job, err := findAccountJob(c, jobMigration)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, job.snapshot())
+}
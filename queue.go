@@ -0,0 +1,261 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+var errQueuesMissing = echo.NewHTTPError(http.StatusNotFound, "no outbound queues are configured")
+
+// listQueue handles GET /v1/queue
+//
+// Supported filters: queue (instance name), state, sender and domain (of
+// any pending recipient).
+func listQueue(c echo.Context) error {
+	queues, err := selectQueues(c)
+	if err != nil {
+		return err
+	}
+
+	var (
+		state  = c.QueryParam("state")
+		sender = c.QueryParam("sender")
+		domain = c.QueryParam("domain")
+	)
+
+	results := []model.QueuedMessage{}
+	for _, q := range queues {
+		list, err := q.List()
+		if err != nil {
+			return err
+		}
+		for _, info := range list {
+			if state != "" && info.State != state {
+				continue
+			}
+			if sender != "" && !strings.EqualFold(info.From, sender) {
+				continue
+			}
+			if domain != "" && !hasRcptDomain(info.To, domain) {
+				continue
+			}
+			results = append(results, queuedMessageToModel(q, info))
+		}
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// getQueuedMessage handles GET /v1/queue/:id
+func getQueuedMessage(c echo.Context) error {
+	q, info, err := findQueuedMessage(c.Param("id"))
+	if err != nil {
+		return queueError(err)
+	}
+
+	return c.JSON(http.StatusOK, queuedMessageToModel(q, info))
+}
+
+// retryQueuedMessage handles POST /v1/queue/:id/retry
+func retryQueuedMessage(c echo.Context) error {
+	return queueAction(c, (*queue.Queue).Retry)
+}
+
+// holdQueuedMessage handles POST /v1/queue/:id/hold
+func holdQueuedMessage(c echo.Context) error {
+	return queueAction(c, (*queue.Queue).Hold)
+}
+
+// releaseQueuedMessage handles POST /v1/queue/:id/release
+func releaseQueuedMessage(c echo.Context) error {
+	return queueAction(c, (*queue.Queue).Release)
+}
+
+// bounceQueuedMessage handles POST /v1/queue/:id/bounce
+func bounceQueuedMessage(c echo.Context) error {
+	return queueAction(c, (*queue.Queue).Bounce)
+}
+
+// dropQueuedMessage handles DELETE /v1/queue/:id
+func dropQueuedMessage(c echo.Context) error {
+	return queueAction(c, (*queue.Queue).Drop)
+}
+
+// purgeQueue handles POST /v1/queue/purge
+func purgeQueue(c echo.Context) error {
+	if len(outboundQueues) == 0 {
+		return errQueuesMissing
+	}
+
+	r := model.QueuePurgeRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	total := 0
+	for _, q := range outboundQueues {
+		purged, err := q.Purge(r.Sender, r.Domain)
+		total += purged
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, model.QueuePurgeResponse{Purged: total})
+}
+
+// listQueueDomains handles GET /v1/queue/domains
+func listQueueDomains(c echo.Context) error {
+	queues, err := selectQueues(c)
+	if err != nil {
+		return err
+	}
+
+	results := make([]model.QueuePolicies, 0, len(queues))
+	for _, q := range queues {
+		p := model.QueuePolicies{
+			Queue:    q.InstanceName(),
+			Defaults: domainPolicyToModel(q.DefaultPolicy()),
+			Domains:  []model.QueueDomainPolicy{},
+		}
+		for _, dp := range q.DomainPolicies() {
+			p.Domains = append(p.Domains, domainPolicyToModel(dp))
+		}
+		results = append(results, p)
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// suspendQueueDomain handles POST /v1/queue/domains/:domain/suspend
+func suspendQueueDomain(c echo.Context) error {
+	return queueDomainAction(c, (*queue.Queue).Suspend)
+}
+
+// resumeQueueDomain handles POST /v1/queue/domains/:domain/resume
+func resumeQueueDomain(c echo.Context) error {
+	return queueDomainAction(c, (*queue.Queue).Resume)
+}
+
+func queueDomainAction(c echo.Context, action func(q *queue.Queue, domain string) error) error {
+	queues, err := selectQueues(c)
+	if err != nil {
+		return err
+	}
+	for _, q := range queues {
+		if err := action(q, c.Param("domain")); err != nil {
+			return queueError(err)
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// selectQueues returns the queue specified using the queue query parameter
+// or all queues.
+func selectQueues(c echo.Context) ([]*queue.Queue, error) {
+	if len(outboundQueues) == 0 {
+		return nil, errQueuesMissing
+	}
+	name := c.QueryParam("queue")
+	if name == "" {
+		return outboundQueues, nil
+	}
+	for _, q := range outboundQueues {
+		if q.InstanceName() == name {
+			return []*queue.Queue{q}, nil
+		}
+	}
+	return nil, echo.NewHTTPError(http.StatusNotFound, "unknown queue: "+name)
+}
+
+func queueAction(c echo.Context, action func(q *queue.Queue, id string) error) error {
+	id := c.Param("id")
+	q, _, err := findQueuedMessage(id)
+	if err != nil {
+		return queueError(err)
+	}
+	if err := action(q, id); err != nil {
+		return queueError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func findQueuedMessage(id string) (*queue.Queue, queue.MessageInfo, error) {
+	if len(outboundQueues) == 0 {
+		return nil, queue.MessageInfo{}, errQueuesMissing
+	}
+	for _, q := range outboundQueues {
+		info, err := q.Message(id)
+		if err == nil {
+			return q, info, nil
+		}
+		if !errors.Is(err, queue.ErrNotFound) {
+			return nil, queue.MessageInfo{}, err
+		}
+	}
+	return nil, queue.MessageInfo{}, queue.ErrNotFound
+}
+
+func queueError(err error) error {
+	switch {
+	case errors.Is(err, queue.ErrNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, queue.ErrBusy), errors.Is(err, queue.ErrNotHeld):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, queue.ErrInvalidDomain):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return err
+}
+
+func hasRcptDomain(rcpts []string, domain string) bool {
+	for _, rcpt := range rcpts {
+		if _, rcptDomain, err := address.Split(rcpt); err == nil && strings.EqualFold(rcptDomain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func queuedMessageToModel(q *queue.Queue, info queue.MessageInfo) model.QueuedMessage {
+	m := model.QueuedMessage{
+		ID:           info.ID,
+		Queue:        q.InstanceName(),
+		State:        info.State,
+		From:         info.From,
+		Recipients:   make([]model.QueuedRecipient, 0, len(info.To)),
+		Size:         info.Size,
+		FirstAttempt: info.FirstAttempt,
+		LastAttempt:  info.LastAttempt,
+	}
+	if !info.NextAttempt.IsZero() {
+		m.NextAttempt = &info.NextAttempt
+	}
+	for _, rcpt := range info.To {
+		r := model.QueuedRecipient{Address: rcpt, Tries: info.TriesCount[rcpt]}
+		if rcptErr := info.RcptErrs[rcpt]; rcptErr != nil {
+			r.LastError = rcptErr.Error()
+		}
+		m.Recipients = append(m.Recipients, r)
+	}
+	return m
+}
+
+func domainPolicyToModel(p queue.DomainPolicy) model.QueueDomainPolicy {
+	return model.QueueDomainPolicy{
+		Domain:              p.Domain,
+		InitialRetrySeconds: int64(p.InitialRetryTime / time.Second),
+		RetryScale:          p.RetryTimeScale,
+		MaxTries:            p.MaxTries,
+		MaxLifetimeSeconds:  int64(p.MaxLifetime / time.Second),
+		Suspended:           p.Suspended,
+	}
+}
@@ -1,7 +1,6 @@
 package maddy
 
 import (
-	"database/sql"
 	"net/http"
 	"strings"
 
@@ -14,48 +13,31 @@ import (
 func getUserQuota(c echo.Context) error {
 	username := c.Param("id")
 
-	storage, ok := imapDb.(*imapsql.Storage)
-	if !ok {
-		return echo.NewHTTPError(http.StatusInternalServerError, "storage backend not accessible")
-	}
-	db := storage.Back.DB
-
-	// Get mailbox breakdown
-	mailboxQuery := `
-		SELECT mb.name, COUNT(m.msgid), COALESCE(SUM(m.bodylen), 0)
-		FROM mboxes mb
-		LEFT JOIN msgs m ON m.mboxid = mb.id
-		WHERE mb.uid = (SELECT id FROM users WHERE username = $1)
-		GROUP BY mb.id, mb.name
-		ORDER BY mb.name
-	`
-
-	rows, err := db.Query(mailboxQuery, username)
+	storage, err := sqlStorage()
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	var mailboxes []model.MailboxUsage
-	var totalUsed int64
 
-	for rows.Next() {
-		var mu model.MailboxUsage
-		if err := rows.Scan(&mu.Name, &mu.MessageCount, &mu.UsedBytes); err != nil {
-			return err
-		}
-		totalUsed += mu.UsedBytes
-		mailboxes = append(mailboxes, mu)
+	// Get mailbox breakdown from usage counters
+	usage, err := storage.MailboxUsage(username)
+	if err != nil {
+		return err
 	}
 
-	if err := rows.Err(); err != nil {
-		return err
+	var mailboxes []model.MailboxUsage
+	for _, mu := range usage {
+		mailboxes = append(mailboxes, model.MailboxUsage{
+			Name:          mu.Name,
+			MessageCount:  mu.Messages,
+			UsedBytes:     mu.Bytes,
+			QuotaBytes:    mu.QuotaBytes,
+			QuotaMessages: mu.QuotaMessages,
+		})
 	}
 
 	// If no mailboxes found, check if user exists
 	if len(mailboxes) == 0 {
-		var exists bool
-		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists)
+		exists, err := storage.AccountExists(username)
 		if err != nil {
 			return err
 		}
@@ -64,41 +46,32 @@ func getUserQuota(c echo.Context) error {
 		}
 	}
 
-	// Get quota info (user override or domain quota)
-	domain := extractDomain(username)
-	var userQuota, domainQuota sql.NullInt64
-
-	err = db.QueryRow("SELECT quota_bytes FROM user_quotas WHERE username = $1", username).Scan(&userQuota)
-	if err != nil && err != sql.ErrNoRows {
+	q, err := storage.GetQuota(username)
+	if err != nil {
 		return err
 	}
 
-	err = db.QueryRow("SELECT quota_bytes FROM domain_quotas WHERE domain = $1", domain).Scan(&domainQuota)
-	if err != nil && err != sql.ErrNoRows {
+	// Determine the source of the byte quota
+	userQuota, _, err := storage.UserQuota(username)
+	if err != nil {
 		return err
 	}
-
-	// Determine effective quota and source
-	var quotaBytes int64
-	var quotaSource string
-
-	if userQuota.Valid && userQuota.Int64 > 0 {
-		quotaBytes = userQuota.Int64
+	quotaSource := "none"
+	if userQuota.Bytes > 0 {
 		quotaSource = "user"
-	} else if domainQuota.Valid && domainQuota.Int64 > 0 {
-		quotaBytes = domainQuota.Int64
+	} else if q.StorageLimit > 0 {
 		quotaSource = "domain"
-	} else {
-		quotaBytes = 0
-		quotaSource = "none"
 	}
 
 	response := model.UserQuotaResponse{
-		Username:    username,
-		UsedBytes:   totalUsed,
-		QuotaBytes:  quotaBytes,
-		QuotaSource: quotaSource,
-		Mailboxes:   mailboxes,
+		Username:      username,
+		UsedBytes:     q.StorageUsed,
+		QuotaBytes:    q.StorageLimit,
+		MessageCount:  q.MessagesUsed,
+		QuotaMessages: q.MessagesLimit,
+		QuotaSource:   quotaSource,
+		Mailboxes:     mailboxes,
+		MailboxQuotas: mailboxQuotasToModel(userQuota.Mailboxes),
 	}
 
 	return c.JSON(http.StatusOK, response)
@@ -113,15 +86,13 @@ func setUserQuota(c echo.Context) error {
 		return err
 	}
 
-	storage, ok := imapDb.(*imapsql.Storage)
-	if !ok {
-		return echo.NewHTTPError(http.StatusInternalServerError, "storage backend not accessible")
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
 	}
-	db := storage.Back.DB
 
 	// Check if user exists
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists)
+	exists, err := storage.AccountExists(username)
 	if err != nil {
 		return err
 	}
@@ -129,18 +100,14 @@ func setUserQuota(c echo.Context) error {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	// Upsert user quota override
-	_, err = db.Exec(`
-		INSERT INTO user_quotas (username, quota_bytes, updated_at)
-		VALUES ($1, $2, CURRENT_TIMESTAMP)
-		ON CONFLICT (username) DO UPDATE SET
-			quota_bytes = EXCLUDED.quota_bytes,
-			updated_at = CURRENT_TIMESTAMP
-	`, username, req.QuotaBytes)
-
+	// Replace user quota overrides
+	settings, err := quotaSettingsFromRequest(req)
 	if err != nil {
 		return err
 	}
+	if err := storage.SetUserQuota(username, settings); err != nil {
+		return err
+	}
 
 	return c.NoContent(http.StatusOK)
 }
@@ -149,71 +116,48 @@ func setUserQuota(c echo.Context) error {
 func getDomainQuota(c echo.Context) error {
 	domain := c.Param("domain")
 
-	storage, ok := imapDb.(*imapsql.Storage)
-	if !ok {
-		return echo.NewHTTPError(http.StatusInternalServerError, "storage backend not accessible")
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
 	}
-	db := storage.Back.DB
 
 	// Get domain quota setting
-	var quotaBytes int64
-	err := db.QueryRow("SELECT quota_bytes FROM domain_quotas WHERE domain = $1", domain).Scan(&quotaBytes)
-	if err != nil && err != sql.ErrNoRows {
+	quota, _, err := storage.DomainQuota(domain)
+	if err != nil {
 		return err
 	}
 
-	// Get per-user breakdown
-	userQuery := `
-		SELECT u.username, COALESCE(SUM(m.bodylen), 0), uq.quota_bytes
-		FROM users u
-		LEFT JOIN mboxes mb ON mb.uid = u.id
-		LEFT JOIN msgs m ON m.mboxid = mb.id
-		LEFT JOIN user_quotas uq ON uq.username = u.username
-		WHERE u.username LIKE '%@' || $1
-		GROUP BY u.id, u.username, uq.quota_bytes
-		ORDER BY u.username
-	`
-
-	rows, err := db.Query(userQuery, domain)
+	// Get per-user breakdown from usage counters
+	usage, err := storage.DomainUsage(domain)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
 	var users []model.UserUsage
 	var totalUsed int64
 
-	for rows.Next() {
-		var username string
-		var usedBytes int64
-		var quotaOverride sql.NullInt64
-
-		if err := rows.Scan(&username, &usedBytes, &quotaOverride); err != nil {
-			return err
-		}
-
+	for _, au := range usage {
 		user := model.UserUsage{
-			Username:  username,
-			UsedBytes: usedBytes,
+			Username:  au.Username,
+			UsedBytes: au.UsedBytes,
 		}
-		if quotaOverride.Valid && quotaOverride.Int64 > 0 {
-			user.QuotaOverride = &quotaOverride.Int64
+		if au.QuotaOverride.Valid && au.QuotaOverride.Int64 > 0 {
+			override := au.QuotaOverride.Int64
+			user.QuotaOverride = &override
 		}
 
-		totalUsed += usedBytes
+		totalUsed += au.UsedBytes
 		users = append(users, user)
 	}
 
-	if err := rows.Err(); err != nil {
-		return err
-	}
-
 	response := model.DomainQuotaResponse{
-		Domain:     domain,
-		UsedBytes:  totalUsed,
-		QuotaBytes: quotaBytes,
-		UserCount:  int64(len(users)),
-		Users:      users,
+		Domain:        domain,
+		UsedBytes:     totalUsed,
+		QuotaBytes:    quota.Bytes,
+		QuotaMessages: quota.Messages,
+		UserCount:     int64(len(users)),
+		Users:         users,
+		MailboxQuotas: mailboxQuotasToModel(quota.Mailboxes),
 	}
 
 	return c.JSON(http.StatusOK, response)
@@ -228,28 +172,58 @@ func setDomainQuota(c echo.Context) error {
 		return err
 	}
 
-	storage, ok := imapDb.(*imapsql.Storage)
-	if !ok {
-		return echo.NewHTTPError(http.StatusInternalServerError, "storage backend not accessible")
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
 	}
-	db := storage.Back.DB
-
-	// Upsert domain quota
-	_, err := db.Exec(`
-		INSERT INTO domain_quotas (domain, quota_bytes, updated_at)
-		VALUES ($1, $2, CURRENT_TIMESTAMP)
-		ON CONFLICT (domain) DO UPDATE SET
-			quota_bytes = EXCLUDED.quota_bytes,
-			updated_at = CURRENT_TIMESTAMP
-	`, domain, req.QuotaBytes)
 
+	settings, err := quotaSettingsFromRequest(req)
 	if err != nil {
 		return err
 	}
+	if err := storage.SetDomainQuota(domain, settings); err != nil {
+		return err
+	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+// quotaSettingsFromRequest converts the request to storage limits
+func quotaSettingsFromRequest(req model.SetQuotaRequest) (imapsql.QuotaSettings, error) {
+	settings := imapsql.QuotaSettings{
+		Bytes:    req.QuotaBytes,
+		Messages: req.QuotaMessages,
+	}
+	seen := make(map[string]bool, len(req.Mailboxes))
+	for _, mq := range req.Mailboxes {
+		if seen[mq.Mailbox] {
+			return settings, echo.NewHTTPError(http.StatusBadRequest, "duplicate mailbox: "+mq.Mailbox)
+		}
+		seen[mq.Mailbox] = true
+		settings.Mailboxes = append(settings.Mailboxes, imapsql.MailboxQuota{
+			Mailbox:  mq.Mailbox,
+			Bytes:    mq.QuotaBytes,
+			Percent:  mq.QuotaPercent,
+			Messages: mq.QuotaMessages,
+		})
+	}
+	return settings, nil
+}
+
+// mailboxQuotasToModel converts storage mailbox caps to DTOs
+func mailboxQuotasToModel(caps []imapsql.MailboxQuota) []model.MailboxQuota {
+	var res []model.MailboxQuota
+	for _, mq := range caps {
+		res = append(res, model.MailboxQuota{
+			Mailbox:       mq.Mailbox,
+			QuotaBytes:    mq.Bytes,
+			QuotaPercent:  mq.Percent,
+			QuotaMessages: mq.Messages,
+		})
+	}
+	return res
+}
+
 // extractDomain extracts the domain part from an email address
 func extractDomain(email string) string {
 	parts := strings.Split(email, "@")
@@ -0,0 +1,196 @@
+package maddy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	echo "github.com/labstack/echo/v4"
+)
+
+const retentionDay = 24 * time.Hour
+
+// getGlobalRetention handles GET /v1/retention
+func getGlobalRetention(c echo.Context) error {
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	rules, err := storage.GlobalRetention()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, model.RetentionResponse{
+		Rules:    retentionToModel(rules),
+		Defaults: retentionToModel(storage.ConfigRetention()),
+	})
+}
+
+// setGlobalRetention handles PUT /v1/retention
+func setGlobalRetention(c echo.Context) error {
+	var req model.SetRetentionRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	rules, err := retentionFromRequest(req)
+	if err != nil {
+		return err
+	}
+	if err := storage.SetGlobalRetention(rules); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// getDomainRetention handles GET /v1/domains/:domain/retention
+func getDomainRetention(c echo.Context) error {
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	rules, err := storage.DomainRetention(c.Param("domain"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, model.RetentionResponse{
+		Rules: retentionToModel(rules),
+	})
+}
+
+// setDomainRetention handles PUT /v1/domains/:domain/retention
+func setDomainRetention(c echo.Context) error {
+	var req model.SetRetentionRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	rules, err := retentionFromRequest(req)
+	if err != nil {
+		return err
+	}
+	if err := storage.SetDomainRetention(c.Param("domain"), rules); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// getUserRetention handles GET /v1/users/:id/retention
+func getUserRetention(c echo.Context) error {
+	username := c.Param("id")
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	exists, err := storage.AccountExists(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	rules, err := storage.UserRetention(username)
+	if err != nil {
+		return err
+	}
+	effective, err := storage.EffectiveRetention(username)
+	if err != nil {
+		return err
+	}
+
+	response := model.RetentionResponse{
+		Rules: retentionToModel(rules),
+	}
+	for _, r := range effective {
+		response.Effective = append(response.Effective, model.EffectiveRetentionRule{
+			Mailbox:    r.Mailbox,
+			MaxAgeDays: int64(r.MaxAge / retentionDay),
+			Source:     r.Source,
+		})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// setUserRetention handles PUT /v1/users/:id/retention
+func setUserRetention(c echo.Context) error {
+	username := c.Param("id")
+
+	var req model.SetRetentionRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	exists, err := storage.AccountExists(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	rules, err := retentionFromRequest(req)
+	if err != nil {
+		return err
+	}
+	if err := storage.SetUserRetention(username, rules); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// retentionFromRequest converts the request to storage rules
+func retentionFromRequest(req model.SetRetentionRequest) ([]imapsql.RetentionRule, error) {
+	var rules []imapsql.RetentionRule
+	seen := make(map[string]bool, len(req.Rules))
+	for _, r := range req.Rules {
+		if seen[r.Mailbox] {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "duplicate mailbox: "+r.Mailbox)
+		}
+		seen[r.Mailbox] = true
+		rules = append(rules, imapsql.RetentionRule{
+			Mailbox: r.Mailbox,
+			MaxAge:  time.Duration(r.MaxAgeDays) * retentionDay,
+		})
+	}
+	return rules, nil
+}
+
+// retentionToModel converts storage rules to DTOs, ages are rounded down to
+// whole days
+func retentionToModel(rules []imapsql.RetentionRule) []model.RetentionRule {
+	res := []model.RetentionRule{}
+	for _, r := range rules {
+		res = append(res, model.RetentionRule{
+			Mailbox:    r.Mailbox,
+			MaxAgeDays: int64(r.MaxAge / retentionDay),
+		})
+	}
+	return res
+}
@@ -0,0 +1,34 @@
+package maddy
+
+import (
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+// initSieveStore opens the Sieve scripts store in the storage database. The
+// same table is used by imap.filter.sieve and the managesieve endpoint.
+func initSieveStore() error {
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	store := &sieve.Store{DB: storage.Back.DB, Driver: storage.Driver()}
+	if err := store.Init(); err != nil {
+		return err
+	}
+	sieveStore = store
+	return nil
+}
+
+// sieveDelete removes all Sieve scripts of the user so a re-created
+// account does not run the scripts of the previous owner.
+func sieveDelete(username string) error {
+	// Scripts are stored under the account name normalized the same way as
+	// by the default storage_map_normalize of imapsql and managesieve.
+	key, err := authz.NormalizeAuto(username)
+	if err != nil {
+		return err
+	}
+	return sieveStore.DeleteAll(key)
+}
@@ -0,0 +1,247 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/auth/throttle"
+	"github.com/foxcpp/maddy/internal/rest/admin"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
+)
+
+// requireSelf allows the request only if it is made by the admin from the
+// path using the password. TOTP secrets and recovery codes are not
+// available to other admins and to API tokens.
+func requireSelf(c echo.Context) error {
+	p := api_auth.Principal(c)
+	if p.TokenID != "" || p.Admin != c.Param("name") {
+		return echo.NewHTTPError(http.StatusForbidden, "only the admin can manage their second factor, using password authentication")
+	}
+	return nil
+}
+
+// getAdminTOTP handles GET /v1/admins/:name/totp
+func getAdminTOTP(c echo.Context) error {
+	status, err := adminStore.GetTOTPStatus(c.Param("name"))
+	if err != nil {
+		return adminTOTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, model.TOTPStatus{
+		Enabled:       status.Enabled,
+		Pending:       status.Pending,
+		RecoveryCodes: &status.RecoveryCodes,
+	})
+}
+
+// enrollAdminTOTP handles POST /v1/admins/:name/totp
+func enrollAdminTOTP(c echo.Context) error {
+	if err := requireSelf(c); err != nil {
+		return err
+	}
+
+	secret, uri, err := adminStore.EnrollTOTP(c.Param("name"))
+	if err != nil {
+		return adminTOTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, model.TOTPEnrollment{Secret: secret, URI: uri})
+}
+
+// confirmAdminTOTP handles POST /v1/admins/:name/totp/confirm
+//
+// Recovery codes are returned only in this response.
+func confirmAdminTOTP(c echo.Context) error {
+	if err := requireSelf(c); err != nil {
+		return err
+	}
+
+	r := model.TOTPCodeDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	codes, err := adminStore.ConfirmTOTP(c.Param("name"), r.Code)
+	if err != nil {
+		return adminTOTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, model.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// regenerateRecoveryCodes handles POST /v1/admins/:name/totp/recovery-codes
+func regenerateRecoveryCodes(c echo.Context) error {
+	if err := requireSelf(c); err != nil {
+		return err
+	}
+
+	codes, err := adminStore.RegenerateRecoveryCodes(c.Param("name"))
+	if err != nil {
+		return adminTOTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, model.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// disableAdminTOTP handles DELETE /v1/admins/:name/totp
+//
+// Any unrestricted admin with admins:write scope can disable the second
+// factor, e.g. for an admin that lost both the device and recovery codes.
+func disableAdminTOTP(c echo.Context) error {
+	if err := adminStore.DisableTOTP(c.Param("name")); err != nil {
+		return adminTOTPError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func adminTOTPError(err error) error {
+	switch {
+	case errors.Is(err, admin.ErrUnknownAdmin), errors.Is(err, admin.ErrTOTPDisabled):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, admin.ErrTOTPEnabled), errors.Is(err, admin.ErrTOTPNotEnrolled):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, admin.ErrInvalidOTP):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return err
+}
+
+var errTOTPMissing = echo.NewHTTPError(http.StatusNotFound, "TOTP is not configured")
+
+// totpDB returns the credentials store if it supports TOTP.
+func totpDB() (*pass_table.Auth, error) {
+	db, ok := userDb.(*pass_table.Auth)
+	if !ok || !db.TOTPConfigured() {
+		return nil, errTOTPMissing
+	}
+	return db, nil
+}
+
+// getUserTOTP handles GET /v1/users/:id/totp
+func getUserTOTP(c echo.Context) error {
+	db, err := totpDB()
+	if err != nil {
+		return err
+	}
+
+	status, err := db.GetTOTPStatus(c.Param("id"))
+	if err != nil {
+		return userTOTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, model.TOTPStatus{
+		Enabled: status.Enabled,
+		Pending: status.Pending,
+	})
+}
+
+// enrollUserTOTP handles POST /v1/users/:id/totp
+func enrollUserTOTP(c echo.Context) error {
+	db, err := totpDB()
+	if err != nil {
+		return err
+	}
+
+	secret, uri, err := db.EnrollTOTP(c.Param("id"))
+	if err != nil {
+		return userTOTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, model.TOTPEnrollment{Secret: secret, URI: uri})
+}
+
+// confirmUserTOTP handles POST /v1/users/:id/totp/confirm
+func confirmUserTOTP(c echo.Context) error {
+	db, err := totpDB()
+	if err != nil {
+		return err
+	}
+
+	r := model.TOTPCodeDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	if err := db.ConfirmTOTP(c.Param("id"), r.Code); err != nil {
+		return userTOTPError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// disableUserTOTP handles DELETE /v1/users/:id/totp
+func disableUserTOTP(c echo.Context) error {
+	db, err := totpDB()
+	if err != nil {
+		return err
+	}
+
+	if err := db.DisableTOTP(c.Param("id")); err != nil {
+		return userTOTPError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// createUserSession handles POST /v1/users/:id/totp/session
+//
+// It is meant for a self-service portal that asks the user for the
+// password and the code and gives back a temporary app password for the
+// mail client. Failures are counted by throttle.Default for the user.
+func createUserSession(c echo.Context) error {
+	db, err := totpDB()
+	if err != nil {
+		return err
+	}
+	if !db.AppPasswordsEnabled() {
+		return errAppPasswordsMissing
+	}
+
+	r := model.CreateSessionDto{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+
+	username := c.Param("id")
+	if err := throttle.Default.Check(username, nil); err != nil {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed authentication attempts")
+	}
+
+	ttl := time.Duration(r.TTLSeconds) * time.Second
+	if ttl > pass_table.MaxSessionTTL {
+		return echo.NewHTTPError(http.StatusBadRequest, "session lifetime is too long")
+	}
+
+	ap, pass, err := db.CreateSessionPassword(username, r.Password, r.Code, r.Protocols, ttl)
+	if err != nil {
+		if errors.Is(err, pass_table.ErrTOTPDisabled) {
+			return userTOTPError(err)
+		}
+		throttle.Default.Failed(username, nil)
+		c.Logger().Debugf("session password for %s rejected: %v", username, err)
+		return echo.NewHTTPError(http.StatusForbidden, "invalid credentials")
+	}
+	throttle.Default.Succeeded(username)
+
+	m := appPasswordToModel(ap)
+	m.Password = pass
+	return c.JSON(http.StatusCreated, m)
+}
+
+func userTOTPError(err error) error {
+	switch {
+	case errors.Is(err, pass_table.ErrUnknownUser), errors.Is(err, pass_table.ErrTOTPDisabled):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, pass_table.ErrTOTPEnabled), errors.Is(err, pass_table.ErrTOTPNotEnrolled):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, pass_table.ErrInvalidOTP):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return err
+}
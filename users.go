@@ -1,14 +1,19 @@
 package maddy
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/foxcpp/maddy/framework/events"
 	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/rest/util/middleware/api_auth"
 	echo "github.com/labstack/echo/v4"
 
 	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/target/autoreply"
 )
 
 func createUser(c echo.Context) error {
@@ -18,9 +23,14 @@ func createUser(c echo.Context) error {
 		return err
 	}
 
+	if err := api_auth.CheckDomain(c, r.Username); err != nil {
+		return err
+	}
+
 	if err := userCreate(r.Username, r.Password, r.CreateMailboxes); err != nil {
 		return err
 	}
+	publishUserEvent(events.UserCreated, r.Username, api_auth.Principal(c).Admin)
 
 	return c.NoContent(http.StatusCreated)
 }
@@ -31,9 +41,13 @@ func listUsers(c echo.Context) error {
 		return err
 	}
 
+	p := api_auth.Principal(c)
 	results := []string{}
 	domain := c.QueryParam("domain")
 	if domain != "" {
+		if err := api_auth.CheckDomain(c, domain); err != nil {
+			return err
+		}
 		for _, user := range list {
 			if strings.HasSuffix(user, fmt.Sprintf("@%s", domain)) {
 				results = append(results, user)
@@ -42,6 +56,15 @@ func listUsers(c echo.Context) error {
 		return c.JSON(http.StatusOK, results)
 	}
 
+	if !p.Unrestricted() {
+		for _, user := range list {
+			if p.HasDomain(extractDomain(user)) {
+				results = append(results, user)
+			}
+		}
+		return c.JSON(http.StatusOK, results)
+	}
+
 	return c.JSON(http.StatusOK, list)
 }
 
@@ -65,6 +88,7 @@ func deleteUser(c echo.Context) error {
 	if err := userDelete(c.Param("id"), deleteMailbox); err != nil {
 		return err
 	}
+	publishUserEvent(events.UserDeleted, c.Param("id"), api_auth.Principal(c).Admin)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -79,10 +103,20 @@ func updateUserPassword(c echo.Context) error {
 	if err := userDb.SetUserPassword(c.Param("id"), r.Password); err != nil {
 		return err
 	}
+	publishUserEvent(events.UserPasswordChanged, c.Param("id"), api_auth.Principal(c).Admin)
 
 	return c.NoContent(http.StatusOK)
 }
 
+// publishUserEvent publishes the user.* event, admin is the API admin that
+// made the change.
+func publishUserEvent(typ, username, admin string) {
+	events.Publish(typ, map[string]interface{}{
+		"username": username,
+		"admin":    admin,
+	})
+}
+
 func userCreate(username, password string, createMailboxes bool) (err error) {
 	beHash, ok := userDb.(*pass_table.Auth)
 	if !ok {
@@ -95,19 +129,6 @@ func userCreate(username, password string, createMailboxes bool) (err error) {
 	}
 	domain := userParts[1]
 
-	users, err := userDb.ListUsers()
-	if err != nil {
-		return err
-	}
-
-	found := false
-	for _, user := range users {
-		if strings.HasSuffix(user, domain) {
-			found = true
-			break
-		}
-	}
-
 	err = beHash.CreateUserHash(username, password, pass_table.HashBcrypt, pass_table.HashOpts{
 		BcryptCost: 10,
 	})
@@ -115,10 +136,9 @@ func userCreate(username, password string, createMailboxes bool) (err error) {
 		return err
 	}
 
-	if !found && dkimModule != nil {
-		if err = dkimModule.AddKey(domain); err != nil {
-			return err
-		}
+	// Domains of new users are registered implicitly.
+	if err = domainEnsure(domain); err != nil {
+		return err
 	}
 
 	if createMailboxes {
@@ -157,5 +177,38 @@ func userDelete(username string, deleteMailbox bool) (err error) {
 		}
 	}
 
+	// Quota overrides, retention rules and migration state are keyed by
+	// username, a re-created account should not inherit them.
+	if storage, ok := imapDb.(*imapsql.Storage); ok {
+		err = storage.DeleteUserSettings(username)
+		if err != nil {
+			return
+		}
+	}
+
+	if forwardTable != nil {
+		err = forwardingDelete(username)
+		if errors.Is(err, errForwardingNotFound) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if vacationStore != nil {
+		err = vacationDelete(username)
+		if errors.Is(err, autoreply.ErrNotFound) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if sieveStore != nil {
+		err = sieveDelete(username)
+	}
+
 	return
 }
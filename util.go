@@ -1,14 +1,20 @@
 package maddy
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/foxcpp/maddy/internal/sqldialect"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/target/queue"
 	"github.com/foxcpp/maddy/internal/updatepipe"
+	echo "github.com/labstack/echo/v4"
 )
 
 type (
@@ -114,3 +120,59 @@ func openDKIM(mods []ModInfo) (*dkim.Modifier, error) {
 	}
 	return nil, fmt.Errorf("Error: DKIM modifier not found.")
 }
+
+// openQueues returns all target.queue instances defined as top-level
+// configuration blocks.
+func openQueues(mods []ModInfo) []*queue.Queue {
+	var queues []*queue.Queue
+	for _, mod := range mods {
+		if q, ok := mod.Instance.(*queue.Queue); ok {
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+// openMutableTable returns the table defined by the configuration block
+// with the given name. It is expected to be shared with the message pipeline,
+// e.g. local_aliases used by replace_rcpt.
+func openMutableTable(moduleName string) (module.MutableTable, error) {
+	tableModule, err := module.GetInstance(moduleName)
+	if err != nil {
+		return nil, err
+	}
+	tbl, ok := tableModule.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s is not a mutable table", moduleName)
+	}
+
+	return tbl, nil
+}
+
+// sqlStorage returns the storage.imapsql module.
+func sqlStorage() (*imapsql.Storage, error) {
+	storage, ok := imapDb.(*imapsql.Storage)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "storage backend not accessible")
+	}
+	return storage, nil
+}
+
+// storageDB returns the database used by the storage.imapsql module.
+func storageDB() (*sql.DB, error) {
+	storage, err := sqlStorage()
+	if err != nil {
+		return nil, err
+	}
+	return storage.Back.DB, nil
+}
+
+// storageSQL adapts a query written for PostgreSQL to the driver of the
+// storage.imapsql database.
+func storageSQL(query string) string {
+	storage, err := sqlStorage()
+	if err != nil {
+		return query
+	}
+	return sqldialect.Rebind(storage.Driver(), query)
+}
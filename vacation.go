@@ -0,0 +1,148 @@
+package maddy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/rest/model"
+	"github.com/foxcpp/maddy/internal/target/autoreply"
+)
+
+var errVacationMissing = echo.NewHTTPError(http.StatusNotFound, "vacation auto-replies are not configured")
+
+// getVacation handles GET /v1/users/:id/vacation
+func getVacation(c echo.Context) error {
+	if vacationStore == nil {
+		return errVacationMissing
+	}
+
+	v, err := vacationGet(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, autoreply.ErrNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, v)
+}
+
+// setVacation handles PUT /v1/users/:id/vacation
+func setVacation(c echo.Context) error {
+	if vacationStore == nil {
+		return errVacationMissing
+	}
+
+	r := model.Vacation{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if r.StartDate != nil && r.EndDate != nil && !r.EndDate.After(*r.StartDate) {
+		return echo.NewHTTPError(http.StatusBadRequest, "endDate should be after startDate")
+	}
+
+	exists, err := userExists(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	if err := vacationSet(c.Param("id"), r); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteVacation handles DELETE /v1/users/:id/vacation
+func deleteVacation(c echo.Context) error {
+	if vacationStore == nil {
+		return errVacationMissing
+	}
+
+	if err := vacationDelete(c.Param("id")); err != nil {
+		if errors.Is(err, autoreply.ErrNotFound) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// initVacationStore opens the vacation settings store in the storage
+// database. The same tables are used by target.autoreply.
+func initVacationStore() error {
+	storage, err := sqlStorage()
+	if err != nil {
+		return err
+	}
+
+	store := &autoreply.Store{DB: storage.Back.DB, Driver: storage.Driver()}
+	if err := store.Init(); err != nil {
+		return err
+	}
+	vacationStore = store
+	return nil
+}
+
+func vacationGet(username string) (model.Vacation, error) {
+	key, err := address.ForLookup(username)
+	if err != nil {
+		return model.Vacation{}, autoreply.ErrNotFound
+	}
+
+	st, err := vacationStore.Get(key)
+	if err != nil {
+		return model.Vacation{}, err
+	}
+
+	v := model.Vacation{
+		Enabled: st.Enabled,
+		Subject: st.Subject,
+		Body:    st.Body,
+	}
+	if !st.Start.IsZero() {
+		start := st.Start.UTC()
+		v.StartDate = &start
+	}
+	if !st.End.IsZero() {
+		end := st.End.UTC()
+		v.EndDate = &end
+	}
+	return v, nil
+}
+
+func vacationSet(username string, v model.Vacation) error {
+	key, err := address.ForLookup(username)
+	if err != nil {
+		return err
+	}
+
+	st := autoreply.Settings{
+		Enabled: v.Enabled,
+		Subject: v.Subject,
+		Body:    v.Body,
+	}
+	if v.StartDate != nil {
+		st.Start = v.StartDate.Truncate(time.Second)
+	}
+	if v.EndDate != nil {
+		st.End = v.EndDate.Truncate(time.Second)
+	}
+	return vacationStore.Set(key, st)
+}
+
+func vacationDelete(username string) error {
+	key, err := address.ForLookup(username)
+	if err != nil {
+		return autoreply.ErrNotFound
+	}
+	return vacationStore.Delete(key)
+}